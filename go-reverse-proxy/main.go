@@ -1,16 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"reverse-proxy/proxy"
 )
 
 func main() {
 	// Parse command-line arguments
 	mode := flag.String("mode", "", "Mode to run in: 'server' or 'client'")
-	configFile := flag.String("config", "config.json", "Path to configuration file")
+	configFile := flag.String("config", "config.json", "Path to configuration file, - for standard input, or an http(s) URL")
+	validate := flag.Bool("validate", false, "Validate the configuration and connectivity, then exit")
 	flag.Parse()
 
 	// Validate mode
@@ -21,54 +27,119 @@ func main() {
 	}
 
 	// Load configuration
-	config := DefaultConfig()
-	if err := loadConfig(*configFile, config); err != nil {
+	config := proxy.DefaultConfig()
+	if err := proxy.LoadConfig(*configFile, config); err != nil {
 		fmt.Printf("Error loading configuration: %v\n", err)
+		if errors.Is(err, proxy.ErrConfigNotFound) {
+			fmt.Println("Use -config to give the path to the configuration file")
+		}
 		os.Exit(1)
 	}
 
+	// Check the configuration without serving traffic
+	if *validate {
+		if !printValidation(*mode, proxy.ValidateRuntime(config, *mode)) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Create logger
-	logger, err := NewLogger(config.Logging.Level, config.Logging.File)
+	logger, err := proxy.NewLogger(config.Logging.Level, config.Logging.File)
 	if err != nil {
 		fmt.Printf("Error creating logger: %v\n", err)
 		os.Exit(1)
 	}
 	defer logger.Close()
+	logger.SetMaxEntryBytes(config.Logging.MaxEntryBytes)
+	logger.SetRedactHeaders(config.Logging.RedactHeaders)
+	if err := logger.SetFormat(config.Logging.Format); err != nil {
+		fmt.Printf("Error creating logger: %v\n", err)
+		os.Exit(1)
+	}
+	if err := logger.SetRotation(config.Logging.RotationInterval, config.Logging.MaxAgeDays); err != nil {
+		fmt.Printf("Error creating logger: %v\n", err)
+		os.Exit(1)
+	}
+	if syslogConfig := config.Logging.Syslog; syslogConfig.Enabled {
+		if err := logger.SetSyslog(syslogConfig.Network, syslogConfig.Address, syslogConfig.Facility, syslogConfig.Tag); err != nil {
+			fmt.Printf("Error connecting to syslog: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Set up distributed tracing
+	if err := proxy.SetupTracing(config); err != nil {
+		fmt.Printf("Error setting up tracing: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Shut down on SIGINT or SIGTERM and reload settings on SIGHUP
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
 	// Run in appropriate mode
 	if *mode == "server" {
-		server := NewProxyServer(config, logger)
-		if err := server.Start(); err != nil {
+		server := proxy.NewProxyServer(config, logger)
+		go func() {
+			for range hangup {
+				server.ReloadCerts()
+				if err := proxy.ReloadConfig(*configFile, config, logger); err != nil {
+					logger.Error("config", "Failed to reload configuration", map[string]interface{}{
+						"error": err.Error(),
+					})
+					continue
+				}
+				server.ReloadRateLimits()
+			}
+		}()
+
+		if err := server.Run(ctx); err != nil {
 			fmt.Printf("Error starting server: %v\n", err)
 			os.Exit(1)
 		}
-
-		// Keep the main goroutine alive
-		select {}
 	} else {
-		client := NewProxyClient(config, logger)
-		if err := client.Connect(); err != nil {
-			fmt.Printf("Error connecting client: %v\n", err)
+		client, err := proxy.NewProxyClient(config, logger)
+		if err != nil {
+			fmt.Printf("Error creating client: %v\n", err)
 			os.Exit(1)
 		}
+		go func() {
+			for range hangup {
+				if err := proxy.ReloadConfig(*configFile, config, logger); err != nil {
+					logger.Error("config", "Failed to reload configuration", map[string]interface{}{
+						"error": err.Error(),
+					})
+					continue
+				}
+				client.ReloadRewriteRules()
+			}
+		}()
 
-		// Keep the main goroutine alive
-		select {}
+		if err := client.Run(ctx); err != nil {
+			fmt.Printf("Error connecting client: %v\n", err)
+			os.Exit(1)
+		}
 	}
 }
 
-// loadConfig loads configuration from a JSON file
-func loadConfig(path string, config *Config) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return fmt.Errorf("failed to open config file: %v", err)
+// printValidation prints the outcome of each -validate check and a summary, and
+// reports whether every check passed
+func printValidation(mode string, checks []proxy.ValidationCheck) bool {
+	for _, c := range checks {
+		if c.Err != nil {
+			fmt.Printf("FAIL  %s: %v\n", c.Name, c.Err)
+		} else {
+			fmt.Printf("OK    %s\n", c.Name)
+		}
 	}
-	defer file.Close()
-
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(config); err != nil {
-		return fmt.Errorf("failed to decode config file: %v", err)
+	passed := proxy.ValidationPassed(checks)
+	if passed {
+		fmt.Printf("Configuration valid for %s mode (%d checks passed)\n", mode, len(checks))
+	} else {
+		fmt.Printf("Configuration invalid for %s mode\n", mode)
 	}
-
-	return nil
+	return passed
 }
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// responseRecorder wraps an http.ResponseWriter to capture the status code and body size
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// newResponseRecorder creates a new responseRecorder around w
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+// WriteHeader records the first final status code written
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 && code >= 200 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the number of body bytes written
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes flushes through so streamed responses keep working
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logAccess writes one access log entry for a completed request. pending is nil
+// if the request was never forwarded to a client.
+func (s *ProxyServer) logAccess(r *http.Request, recorder *responseRecorder, start time.Time, clientID string, requestID string, pending *PendingRequest) {
+	status := recorder.status
+	if status == 0 {
+		// Nothing was written, so net/http will send an empty 200
+		status = http.StatusOK
+	}
+
+	entry := map[string]interface{}{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      status,
+		"bytes":       recorder.bytes,
+		"latency_ms":  time.Since(start).Milliseconds(),
+		"client_id":   clientID,
+		"request_id":  requestID,
+		"remote_addr": r.RemoteAddr,
+	}
+
+	// The rest of the latency was spent in the tunnel and on the server
+	if pending != nil {
+		pending.mu.Lock()
+		if pending.upstreamMs >= 0 {
+			entry["upstream_ms"] = pending.upstreamMs
+		}
+		entry["request_bytes"] = pending.requestBytes
+		entry["upstream_bytes"] = pending.responseBytes
+		pending.mu.Unlock()
+	}
+
+	s.logger.Info("access", "Request completed", entry)
+}
+
+// logUpstreamAccess writes one proxy-access entry for a request the client sent
+// upstream, if client.proxy.accessLog is set. resp is nil if no response came
+// back, and duration runs until the response headers arrived. Every attempt is
+// logged, so a retried request has several entries with the same requestId.
+func (c *ProxyClient) logUpstreamAccess(requestID interface{}, req *http.Request, resp *http.Response, err error, duration time.Duration) {
+	if !c.config.live().upstreamAccessLog {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"requestId":  requestID,
+		"method":     req.Method,
+		"url":        req.URL.String(),
+		"headers":    req.Header,
+		"durationMs": duration.Milliseconds(),
+	}
+	if resp != nil {
+		entry["status"] = resp.StatusCode
+		entry["proto"] = resp.Proto
+		entry["responseHeaders"] = resp.Header
+	}
+	if err != nil {
+		entry["error"] = err.Error()
+	}
+
+	c.logger.Info("proxy-access", "Upstream request", entry)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// logEntries returns the JSON log entries in category written so far
+func (p *testProxy) logEntries(t *testing.T, category string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(p.logs(t), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["category"] == category {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// accessEntry waits for the access log entry of the request to path and returns it
+func (p *testProxy) accessEntry(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	var found map[string]interface{}
+	waitFor(t, "access log entry for "+path, func() bool {
+		for _, entry := range p.logEntries(t, "access") {
+			if entry["path"] == path {
+				found = entry
+				return true
+			}
+		}
+		return false
+	})
+	return found
+}
+
+func TestAccessLog(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}), func(c *Config) { c.Logging.AccessLog = true })
+
+	req, err := http.NewRequest(http.MethodPut, p.url+"/items/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.do(t, req)
+
+	entry := p.accessEntry(t, "/items/1")
+	if entry["method"] != http.MethodPut || entry["status"] != float64(http.StatusCreated) || entry["bytes"] != float64(5) {
+		t.Errorf("entry = %v, want PUT with status 201 and 5 bytes", entry)
+	}
+	if _, ok := entry["latency_ms"].(float64); !ok {
+		t.Errorf("entry %v has no latency", entry)
+	}
+	for _, field := range []string{"client_id", "request_id"} {
+		if id, _ := entry[field].(string); id == "" {
+			t.Errorf("entry %v has no %s", entry, field)
+		}
+	}
+}
+
+func TestAccessLogRecordsTimeout(t *testing.T) {
+	// The client never answers
+	p := startTestServer(t, func(c *Config) {
+		c.Logging.AccessLog = true
+		c.Server.RequestTimeout = 100
+	})
+	p.connectFakeClient(t)
+
+	p.get(t, "/slow")
+	if entry := p.accessEntry(t, "/slow"); entry["status"] != float64(http.StatusGatewayTimeout) {
+		t.Errorf("entry = %v, want status 504", entry)
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+
+	p.get(t, "/")
+	if entries := p.logEntries(t, "access"); len(entries) != 0 {
+		t.Errorf("logged %d access entries with the access log off", len(entries))
+	}
+}
+
+func TestUpstreamAccessLog(t *testing.T) {
+	// The upstream fails twice, so the request is sent three times
+	var attempts atomic.Int32
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}), func(c *Config) {
+		c.Client.Proxy.AccessLog = true
+		c.Client.Proxy.Retry.MaxAttempts = 3
+		c.Client.Proxy.Retry.BackoffMs = 10
+	})
+
+	req, err := http.NewRequest(http.MethodGet, p.url+"/items?page=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Trace", "abc")
+	if resp, _ := p.do(t, req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var entries []map[string]interface{}
+	waitFor(t, "an entry for each attempt", func() bool {
+		entries = p.logEntries(t, "proxy-access")
+		return len(entries) == 3
+	})
+	for i, wantStatus := range []int{503, 503, 200} {
+		entry := entries[i]
+		if entry["status"] != float64(wantStatus) || entry["method"] != http.MethodGet {
+			t.Errorf("attempt %d: entry = %v, want GET with status %d", i+1, entry, wantStatus)
+		}
+		if url, _ := entry["url"].(string); !strings.HasSuffix(url, "/items?page=2") {
+			t.Errorf("attempt %d: url = %q, want the upstream URL", i+1, url)
+		}
+		if headers, _ := entry["headers"].(map[string]interface{}); headers == nil || headers["X-Trace"] == nil {
+			t.Errorf("attempt %d: headers = %v, want the request's headers", i+1, entry["headers"])
+		}
+		if _, ok := entry["durationMs"].(float64); !ok {
+			t.Errorf("attempt %d: entry %v has no duration", i+1, entry)
+		}
+		if entry["requestId"] != entries[0]["requestId"] || entry["requestId"] == "" {
+			t.Errorf("attempt %d: requestId = %v, want every attempt under the same ID", i+1, entry["requestId"])
+		}
+	}
+}
+
+func TestUpstreamAccessLogRecordsError(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Client.Proxy.AccessLog = true
+		c.Client.Proxy.DefaultTarget = "http://127.0.0.1:1"
+	})
+
+	p.get(t, "/")
+	var entries []map[string]interface{}
+	waitFor(t, "the failed attempt to be logged", func() bool {
+		entries = p.logEntries(t, "proxy-access")
+		return len(entries) > 0
+	})
+	if errorText, _ := entries[0]["error"].(string); !strings.Contains(errorText, "connection refused") {
+		t.Errorf("entry = %v, want the connection error", entries[0])
+	}
+	if _, ok := entries[0]["status"]; ok {
+		t.Errorf("entry = %v has a status with no response", entries[0])
+	}
+}
+
+func TestUpstreamAccessLogDisabled(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+
+	p.get(t, "/")
+	if entries := p.logEntries(t, "proxy-access"); len(entries) != 0 {
+		t.Errorf("logged %d upstream entries with the upstream access log off", len(entries))
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import "sync/atomic"
+
+// Directions of frame traffic on a client connection, as seen by the server
+const (
+	directionReceived = "received"
+	directionSent     = "sent"
+)
+
+// byteCounts totals the bytes that flowed through one client connection
+type byteCounts struct {
+	// requestBody and responseBody count the bodies of proxied requests and of the
+	// upstream responses to them, before any response compression
+	requestBody  atomic.Int64
+	responseBody atomic.Int64
+
+	// framesReceived and framesSent count every frame on the connection,
+	// headers included
+	framesReceived atomic.Int64
+	framesSent     atomic.Int64
+}
+
+// registerByteMetrics declares the per-client byte counters
+func (s *ProxyServer) registerByteMetrics() {
+	s.metrics.counter("proxy_client_request_bytes_total", "Request body bytes forwarded to each client.")
+	s.metrics.counter("proxy_client_response_bytes_total", "Response body bytes received from each client.")
+	s.metrics.counter("proxy_client_frame_bytes_total", "Bytes of frames exchanged with each client, by direction.")
+}
+
+// countRequestBytes records the body of a request forwarded to a client
+func (s *ProxyServer) countRequestBytes(pending *PendingRequest, client *ClientInfo, n int) {
+	pending.mu.Lock()
+	pending.requestBytes += int64(n)
+	pending.mu.Unlock()
+	client.bytes.requestBody.Add(int64(n))
+	s.metrics.add("proxy_client_request_bytes_total", float64(n), "client", pending.clientID)
+}
+
+// countResponseBytes records response body bytes received for a request; the
+// caller must hold pending.mu
+func (s *ProxyServer) countResponseBytes(pending *PendingRequest, n int) {
+	pending.responseBytes += int64(n)
+	if pending.client != nil {
+		pending.client.bytes.responseBody.Add(int64(n))
+	}
+	s.metrics.add("proxy_client_response_bytes_total", float64(n), "client", pending.clientID)
+}
+
+// countFrameBytes records frame traffic on a client connection. Metrics are only
+// kept for registered clients, so short-lived anonymous IDs don't add series.
+func (s *ProxyServer) countFrameBytes(info *ClientInfo, direction string, n int) {
+	if direction == directionSent {
+		info.bytes.framesSent.Add(int64(n))
+	} else {
+		info.bytes.framesReceived.Add(int64(n))
+	}
+
+	s.clientsMutex.RLock()
+	clientID, registered := info.id, info.registered
+	s.clientsMutex.RUnlock()
+	if registered {
+		s.metrics.add("proxy_client_frame_bytes_total", float64(n), "client", clientID, "direction", direction)
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestByteAccounting(t *testing.T) {
+	small := strings.Repeat("r", 5000)
+	large := strings.Repeat("s", 300000)
+	p := startAdminProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/large" {
+			w.Write([]byte(large))
+			return
+		}
+		w.Write([]byte(small))
+	}), func(c *Config) {
+		c.Client.ID = "billing"
+		c.Server.Metrics.Path = "/metrics"
+		c.Server.StreamingThresholdBytes = 64 * 1024
+	})
+
+	for range 3 {
+		req, err := http.NewRequest(http.MethodPost, p.url+"/upload", bytes.NewReader(bytes.Repeat([]byte("q"), 1234)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.do(t, req)
+	}
+	// Large enough to be streamed back in chunks
+	p.get(t, "/large")
+	p.waitForLog(t, "Streaming response to client")
+
+	const wantRequest, wantResponse = 3 * 1234, 3*5000 + 300000
+	p.server.clientsMutex.RLock()
+	info := p.server.clients["billing"]
+	p.server.clientsMutex.RUnlock()
+	waitFor(t, "response bytes to be counted", func() bool { return info.bytes.responseBody.Load() == wantResponse })
+	if got := info.bytes.requestBody.Load(); got != wantRequest {
+		t.Errorf("request body bytes = %d, want %d", got, wantRequest)
+	}
+	// Frames carry the bodies plus their headers
+	if got := info.bytes.framesSent.Load(); got <= wantRequest {
+		t.Errorf("frame bytes sent = %d, want more than the %d body bytes", got, wantRequest)
+	}
+	if got := info.bytes.framesReceived.Load(); got <= wantResponse {
+		t.Errorf("frame bytes received = %d, want more than the %d body bytes", got, wantResponse)
+	}
+
+	_, body := p.admin(t, http.MethodGet, "clients", "")
+	clients, _ := body["clients"].([]interface{})
+	if len(clients) != 1 {
+		t.Fatalf("listed %v, want one client", body)
+	}
+	counts, _ := clients[0].(map[string]interface{})["bytes"].(map[string]interface{})
+	if counts["requestBody"] != float64(wantRequest) || counts["responseBody"] != float64(wantResponse) {
+		t.Errorf("admin byte counts = %v, want %d request and %d response bytes", counts, wantRequest, wantResponse)
+	}
+
+	_, metrics := p.get(t, "/metrics")
+	for _, want := range []string{
+		`proxy_client_request_bytes_total{client="billing"} 3702`,
+		`proxy_client_response_bytes_total{client="billing"} 315000`,
+		`proxy_client_frame_bytes_total{client="billing",direction="received"}`,
+		`proxy_client_frame_bytes_total{client="billing",direction="sent"}`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %s:\n%s", want, metrics)
+		}
+	}
+}
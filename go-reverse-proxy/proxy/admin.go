@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminPathPrefix is the path under which admin endpoints are served
+const adminPathPrefix = "/admin/"
+
+// registerAdminRoutes adds the admin endpoints to mux. They are only served when
+// enabled and an admin token is configured.
+func (s *ProxyServer) registerAdminRoutes(mux *http.ServeMux) {
+	if !s.config.Server.Admin.Enabled {
+		return
+	}
+	if s.config.Server.Admin.Token == "" {
+		s.logger.Warn("admin", "Admin endpoints enabled without a token; not serving them", nil)
+		return
+	}
+	mux.HandleFunc(adminPathPrefix+"loglevel", s.requireAdmin(s.handleLogLevel))
+	mux.HandleFunc(adminPathPrefix+"clients", s.requireAdmin(s.handleListClients))
+	mux.HandleFunc(adminPathPrefix+"clients/{id}/drain", s.requireAdmin(s.handleDrainClient))
+}
+
+// requireAdmin wraps an admin handler so it only runs for callers presenting the admin token
+func (s *ProxyServer) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.hasAdminToken(r) {
+			s.logger.Warn("admin", "Unauthorized admin request", map[string]interface{}{
+				"path":          r.URL.Path,
+				"remoteAddress": r.RemoteAddr,
+			})
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "unauthorized",
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// hasAdminToken reports whether the caller presents the admin token as a bearer
+// token. No caller does if no token is configured.
+func (s *ProxyServer) hasAdminToken(r *http.Request) bool {
+	if s.config.Server.Admin.Token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Server.Admin.Token)) == 1
+}
+
+// handleLogLevel reports the current log level, or changes it on POST
+func (s *ProxyServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error": "invalid request body: " + err.Error(),
+			})
+			return
+		}
+
+		previous := s.logger.Level()
+		if err := s.logger.SetLevel(request.Level); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		s.logger.Warn("admin", "Log level changed", map[string]interface{}{
+			"from":          previous,
+			"to":            request.Level,
+			"remoteAddress": r.RemoteAddr,
+		})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"level": s.logger.Level(),
+	})
+}
+
+// handleListClients reports every connected client
+func (s *ProxyServer) handleListClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+
+	// Oldest connections first
+	clientIDs := make([]string, 0, len(s.clients))
+	for clientID := range s.clients {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Slice(clientIDs, func(i, j int) bool {
+		return s.clients[clientIDs[i]].connectedAt.Before(s.clients[clientIDs[j]].connectedAt)
+	})
+
+	clients := make([]map[string]interface{}, 0, len(clientIDs))
+	for _, clientID := range clientIDs {
+		info := s.clients[clientID]
+		clients = append(clients, map[string]interface{}{
+			"id":             clientID,
+			"remoteAddress":  info.conn.RemoteAddr().String(),
+			"tags":           info.tags,
+			"weight":         info.weight,
+			"inFlight":       info.inFlight.Load(),
+			"maxConcurrency": info.maxConcurrency.Load(),
+			"healthy":        info.healthy,
+			"draining":       info.draining,
+			"ageSeconds":     int64(time.Since(info.connectedAt).Seconds()),
+			"bytes": map[string]interface{}{
+				"requestBody":    info.bytes.requestBody.Load(),
+				"responseBody":   info.bytes.responseBody.Load(),
+				"framesReceived": info.bytes.framesReceived.Load(),
+				"framesSent":     info.bytes.framesSent.Load(),
+			},
+			"buffered": bufferedStats(info.messageBuffer),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"clients": clients,
+	})
+}
+
+// handleDrainClient stops routing new requests to a client while letting its
+// in-flight requests finish
+func (s *ProxyServer) handleDrainClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{
+			"error": "method not allowed",
+		})
+		return
+	}
+
+	clientID := r.PathValue("id")
+
+	s.clientsMutex.Lock()
+	info, exists := s.clients[clientID]
+	if exists {
+		info.draining = true
+	}
+	s.clientsMutex.Unlock()
+
+	if !exists {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "unknown client",
+		})
+		return
+	}
+
+	s.logger.Warn("admin", "Client draining", map[string]interface{}{
+		"clientId":      clientID,
+		"inFlight":      info.inFlight.Load(),
+		"remoteAddress": r.RemoteAddr,
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"clientId": clientID,
+		"draining": true,
+		"inFlight": info.inFlight.Load(),
+	})
+}
+
+// writeJSON writes body as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+// bufferedStats describes the partly received frame held for a client, which
+// helps diagnose a connection stuck partway through a frame
+func bufferedStats(mb *MessageBuffer) map[string]interface{} {
+	stats := map[string]interface{}{
+		"bytes": mb.BufferedBytes(),
+	}
+	if length, ok := mb.PendingFrameLength(); ok {
+		stats["pendingFrameLength"] = length
+	}
+	return stats
+}
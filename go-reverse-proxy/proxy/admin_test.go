@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminToken is the admin token of the servers started by the admin tests
+const adminToken = "admin-token"
+
+// startAdminProxy starts a proxy with the admin endpoints enabled, letting configure
+// adjust the configuration first
+func startAdminProxy(t *testing.T, backend http.Handler, configure func(*Config)) *testProxy {
+	t.Helper()
+	return startTestProxy(t, backend, func(c *Config) {
+		c.Server.Admin.Enabled = true
+		c.Server.Admin.Token = adminToken
+		if configure != nil {
+			configure(c)
+		}
+	})
+}
+
+// startAdminServer starts a server with the admin endpoints enabled and a client
+// for each id. Requests for /hold wait for release; each upstream reports its
+// client's id on arrivals and answers with it.
+func startAdminServer(t *testing.T, release <-chan struct{}, ids ...string) (*testProxy, <-chan string) {
+	t.Helper()
+	p := startTestServer(t, func(c *Config) {
+		c.Server.Admin.Enabled = true
+		c.Server.Admin.Token = adminToken
+	})
+	arrivals := make(chan string, 1024)
+	for _, id := range ids {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrivals <- id
+			if r.URL.Path == "/hold" {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}
+			w.Write([]byte(id))
+		}))
+		t.Cleanup(upstream.Close)
+
+		config := newTestConfig(t)
+		config.Client.ID = id
+		config.Client.Proxy.DefaultTarget = upstream.URL
+		p.connectClient(t, config)
+	}
+	waitFor(t, "every client to register", func() bool { return p.server.registeredClients() == len(ids) })
+	return p, arrivals
+}
+
+// admin sends an admin request with the admin token and decodes the JSON response
+func (p *testProxy) admin(t *testing.T, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, p.url+adminPathPrefix+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, data := p.do(t, req)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil {
+		t.Fatalf("invalid admin response %q: %v", data, err)
+	}
+	return resp.StatusCode, decoded
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	p := startAdminProxy(t, http.NotFoundHandler(), func(c *Config) { c.Logging.Level = "info" })
+
+	p.get(t, "/before")
+	if strings.Contains(p.logs(t), "Relative URL converted to absolute") {
+		t.Fatal("debug entry logged at info level")
+	}
+
+	if status, body := p.admin(t, http.MethodPost, "loglevel", `{"level":"debug"}`); status != http.StatusOK || body["level"] != "debug" {
+		t.Fatalf("got %d %v, want 200 with the debug level", status, body)
+	}
+	p.waitForLog(t, "Log level changed")
+	p.get(t, "/after")
+	p.waitForLog(t, "Relative URL converted to absolute")
+
+	if status, body := p.admin(t, http.MethodGet, "loglevel", ""); status != http.StatusOK || body["level"] != "debug" {
+		t.Errorf("got %d %v, want the debug level reported", status, body)
+	}
+}
+
+func TestAdminLogLevelRejectsUnknownLevel(t *testing.T) {
+	p := startAdminProxy(t, http.NotFoundHandler(), func(c *Config) { c.Logging.Level = "info" })
+
+	for _, body := range []string{`{"level":"verbose"}`, `not json`} {
+		if status, _ := p.admin(t, http.MethodPost, "loglevel", body); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, status)
+		}
+	}
+	if level := p.logger.Level(); level != InfoLevel {
+		t.Errorf("level = %q after rejected changes, want info", level)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	p := startAdminProxy(t, http.NotFoundHandler(), nil)
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		req, err := http.NewRequest(http.MethodPost, p.url+adminPathPrefix+"loglevel", strings.NewReader(`{"level":"error"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if resp, _ := p.do(t, req); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want 401", authorization, resp.StatusCode)
+		}
+	}
+	if level := p.logger.Level(); level != DebugLevel {
+		t.Errorf("level = %q after unauthorized requests, want it unchanged", level)
+	}
+}
+
+func TestAdminDrainClient(t *testing.T) {
+	release := make(chan struct{})
+	p, arrivals := startAdminServer(t, release, "a", "b")
+
+	held := make(chan string, 1)
+	go func() {
+		_, body := p.get(t, "/hold")
+		held <- body
+	}()
+	draining := <-arrivals
+	other := map[string]string{"a": "b", "b": "a"}[draining]
+
+	status, body := p.admin(t, http.MethodPost, "clients/"+draining+"/drain", "")
+	if status != http.StatusOK || body["draining"] != true || body["inFlight"] != float64(1) {
+		t.Fatalf("got %d %v, want 200 draining with 1 request in flight", status, body)
+	}
+
+	// New requests avoid the draining client while its request finishes
+	for i := 0; i < 20; i++ {
+		if _, served := p.get(t, "/"); served != other {
+			t.Fatalf("request %d served by %q, want %q", i, served, other)
+		}
+	}
+	close(release)
+	if body := <-held; body != draining {
+		t.Errorf("held request answered by %q, want the draining %q", body, draining)
+	}
+}
+
+func TestAdminDrainClientErrors(t *testing.T) {
+	p, _ := startAdminServer(t, nil, "a")
+
+	if status, _ := p.admin(t, http.MethodPost, "clients/unknown/drain", ""); status != http.StatusNotFound {
+		t.Errorf("unknown client: status = %d, want 404", status)
+	}
+	if status, _ := p.admin(t, http.MethodGet, "clients/a/drain", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d, want 405", status)
+	}
+	if _, served := p.get(t, "/"); served != "a" {
+		t.Errorf("request served by %q, want the client that was not drained", served)
+	}
+}
+
+func TestAdminListClients(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	p, arrivals := startAdminServer(t, release, "a")
+	p.getAsync(t, "/hold")
+	<-arrivals
+
+	config := newTestConfig(t)
+	config.Client.ID = "b"
+	config.Client.Tags = []string{"blue", "large"}
+	config.Client.Weight = 3
+	p.connectClient(t, config)
+	waitFor(t, "the second client to register", func() bool { return p.server.registeredClients() == 2 })
+	p.admin(t, http.MethodPost, "clients/b/drain", "")
+
+	status, body := p.admin(t, http.MethodGet, "clients", "")
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	clients, _ := body["clients"].([]interface{})
+	if len(clients) != 2 {
+		t.Fatalf("listed %v, want both clients", body)
+	}
+
+	// Oldest connection first
+	for i, want := range []map[string]interface{}{
+		{"id": "a", "tags": "[]", "weight": float64(1), "inFlight": float64(1), "draining": false},
+		{"id": "b", "tags": "[blue large]", "weight": float64(3), "inFlight": float64(0), "draining": true},
+	} {
+		client := clients[i].(map[string]interface{})
+		for key, value := range want {
+			got := client[key]
+			if key == "tags" {
+				got = fmt.Sprint(got)
+			}
+			if got != value {
+				t.Errorf("client %d %s = %v, want %v", i, key, got, value)
+			}
+		}
+		if client["remoteAddress"] != "memory" || client["ageSeconds"] != float64(0) {
+			t.Errorf("client %d remoteAddress = %v, ageSeconds = %v; want memory and 0", i, client["remoteAddress"], client["ageSeconds"])
+		}
+	}
+
+	if status, _ := p.admin(t, http.MethodPost, "clients", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status = %d, want 405", status)
+	}
+}
+
+func TestAdminEndpointsAreOptIn(t *testing.T) {
+	for name, configure := range map[string]func(*Config){
+		"disabled":      nil,
+		"without token": func(c *Config) { c.Server.Admin.Enabled = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("upstream " + r.URL.Path))
+			}), configure)
+
+			if resp, body := p.get(t, "/admin/clients"); resp.StatusCode != http.StatusOK || body != "upstream /admin/clients" {
+				t.Errorf("got %d %q, want the request forwarded upstream", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestEveryClientDrainingAnswersNoClients(t *testing.T) {
+	p, _ := startAdminServer(t, nil, "a")
+	p.admin(t, http.MethodPost, "clients/a/drain", "")
+
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d with every client draining, want 503", resp.StatusCode)
+	}
+}
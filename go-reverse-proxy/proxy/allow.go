@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// allowList restricts the methods and paths the server proxies. An empty list of
+// either allows everything.
+type allowList struct {
+	methods map[string]bool
+	paths   []*regexp.Regexp
+}
+
+// compileAllowList compiles the configured allowlist, skipping invalid path patterns
+func compileAllowList(config *Config, logger *Logger) allowList {
+	var allow allowList
+	if len(config.Server.Allow.Methods) > 0 {
+		allow.methods = make(map[string]bool)
+		for _, method := range config.Server.Allow.Methods {
+			allow.methods[strings.ToUpper(method)] = true
+		}
+	}
+	for _, path := range config.Server.Allow.Paths {
+		pattern, err := regexp.Compile(path)
+		if err != nil {
+			logger.Error("server", "Invalid allowed path pattern", map[string]interface{}{
+				"pattern": path,
+				"error":   err.Error(),
+			})
+			continue
+		}
+		allow.paths = append(allow.paths, pattern)
+	}
+	return allow
+}
+
+// allowsMethod reports whether requests with the method may be proxied
+func (a allowList) allowsMethod(method string) bool {
+	return a.methods == nil || a.methods[method]
+}
+
+// allowsPath reports whether requests for the path may be proxied
+func (a allowList) allowsPath(path string) bool {
+	if len(a.paths) == 0 {
+		return true
+	}
+	for _, pattern := range a.paths {
+		if pattern.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeader lists the allowed methods for the Allow header of a 405 response
+func (a allowList) allowHeader() string {
+	methods := make([]string, 0, len(a.methods))
+	for method := range a.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// checkAllowed rejects requests outside the allowlist, answering 405 for a method
+// that isn't allowed and 403 for a path that isn't. It reports whether the request
+// may be proxied.
+func (s *ProxyServer) checkAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if !s.allow.allowsMethod(r.Method) {
+		s.logger.Warn("request", "Request method not allowed", map[string]interface{}{
+			"method": r.Method,
+			"url":    r.URL.String(),
+		})
+		w.Header().Set("Allow", s.allow.allowHeader())
+		s.writeError(w, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "Method Not Allowed", "")
+		return false
+	}
+	if !s.allow.allowsPath(r.URL.Path) {
+		s.logger.Warn("request", "Request path not allowed", map[string]interface{}{
+			"method": r.Method,
+			"url":    r.URL.String(),
+		})
+		s.writeError(w, http.StatusForbidden, errorCodeForbidden, "Forbidden", "")
+		return false
+	}
+	return true
+}
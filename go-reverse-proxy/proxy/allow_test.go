@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAllowList(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}), func(c *Config) {
+		c.Server.Allow.Methods = []string{"get", "POST"}
+		c.Server.Allow.Paths = []string{"^/api/"}
+	})
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+		wantLog      string
+	}{
+		{http.MethodGet, "/api/users", http.StatusOK, ""},
+		{http.MethodPost, "/api/users", http.StatusOK, ""},
+		{http.MethodDelete, "/api/users", http.StatusMethodNotAllowed, "Request method not allowed"},
+		{http.MethodGet, "/internal", http.StatusForbidden, "Request path not allowed"},
+	} {
+		req, err := http.NewRequest(tc.method, p.url+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, body := p.do(t, req)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, resp.StatusCode, tc.want)
+		}
+		if tc.want == http.StatusOK && body != "upstream" {
+			t.Errorf("%s %s: body = %q, want it proxied", tc.method, tc.path, body)
+		}
+		if tc.want == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != "GET, POST" {
+			t.Errorf("Allow = %q, want GET, POST", resp.Header.Get("Allow"))
+		}
+		if tc.wantLog != "" {
+			p.waitForLog(t, tc.wantLog)
+		}
+	}
+}
+
+func TestAllowListSkipsInvalidPattern(t *testing.T) {
+	config := newTestConfig(t)
+	config.Server.Allow.Paths = []string{"(", "^/api/"}
+	allow := compileAllowList(config, newTestLogger(t, config))
+
+	if len(allow.paths) != 1 || !allow.allowsPath("/api/users") || allow.allowsPath("/other") {
+		t.Errorf("compiled paths %v, want only the valid pattern", allow.paths)
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import "sync"
+
+// defaultReadBufferSize is used when no read buffer size is configured
+const defaultReadBufferSize = 4096
+
+// bufferPool hands out fixed-size read buffers so connections don't each allocate their own
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool creates a bufferPool of buffers with the given size
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultReadBufferSize
+	}
+
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buffer := make([]byte, size)
+		return &buffer
+	}
+	return p
+}
+
+// Get returns a buffer from the pool
+func (p *bufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool
+func (p *bufferPool) Put(buffer *[]byte) {
+	p.pool.Put(buffer)
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// bufferSink keeps benchmarked buffers from being optimized away
+var bufferSink []byte
+
+func BenchmarkReadBuffer(b *testing.B) {
+	b.Run("pooled", func(b *testing.B) {
+		pool := newBufferPool(32 * 1024)
+		b.ReportAllocs()
+		for b.Loop() {
+			buffer := pool.Get()
+			pool.Put(buffer)
+		}
+	})
+	b.Run("allocated", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			bufferSink = make([]byte, 32*1024)
+		}
+	})
+}
+
+func BenchmarkProxyLargeResponse(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 4<<20)
+	for _, size := range []int{defaultReadBufferSize, 32 * 1024} {
+		b.Run(fmt.Sprintf("readBuffer=%d", size), func(b *testing.B) {
+			p := startTestProxy(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(body)
+			}), func(c *Config) {
+				c.Logging.Level = "error"
+				c.Server.Socket.ReadBufferSize = size
+				c.Client.ReadBufferSize = size
+			})
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if resp, got := p.get(b, "/"); resp.StatusCode != http.StatusOK || len(got) != len(body) {
+					b.Fatalf("status = %d, body of %d bytes; want 200 with %d bytes", resp.StatusCode, len(got), len(body))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedResponse is a buffered upstream response kept for later GET requests
+type cachedResponse struct {
+	key        string
+	statusCode int
+	headers    http.Header
+	body       []byte
+	storedAt   time.Time
+	expires    time.Time
+}
+
+// responseCache is an in-memory LRU cache of GET responses. Entries expire when
+// the freshness lifetime the upstream gave them runs out.
+type responseCache struct {
+	mu           sync.Mutex
+	maxEntries   int
+	maxBodyBytes int
+	entries      map[string]*list.Element
+
+	// order holds the entries with the most recently used at the front
+	order *list.List
+}
+
+// newResponseCache creates a cache holding up to maxEntries responses whose
+// bodies are at most maxBodyBytes
+func newResponseCache(maxEntries, maxBodyBytes int) *responseCache {
+	return &responseCache{
+		maxEntries:   maxEntries,
+		maxBodyBytes: maxBodyBytes,
+		entries:      make(map[string]*list.Element),
+		order:        list.New(),
+	}
+}
+
+// get returns the fresh entry for key, or nil if there is none
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+	entry := element.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry
+}
+
+// put stores an entry, evicting the least recently used ones beyond maxEntries.
+// Bodies over maxBodyBytes are not stored.
+func (c *responseCache) put(entry *cachedResponse) {
+	if len(entry.body) > c.maxBodyBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[entry.key]; exists {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
+
+// len returns the number of entries held, fresh or not
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// cacheKey identifies the response to a request by method, host and URL
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.Host + r.URL.RequestURI()
+}
+
+// isCacheableRequest reports whether a response to r may be stored. Requests with
+// credentials are never cached, as their responses may be specific to the caller.
+// Range requests go to a client, which answers with the partial content asked for.
+func isCacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	return !hasCacheDirective(r.Header, "no-store")
+}
+
+// responseFreshness returns how long a response may be served from the cache, or
+// false if it must not be cached. Only responses with an explicit lifetime from
+// s-maxage, max-age or Expires are cached. Responses that set cookies or vary by
+// request header are not, since the cache key doesn't capture the differences.
+func responseFreshness(statusCode int, headers http.Header, now time.Time) (time.Duration, bool) {
+	switch statusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusNotFound, http.StatusGone:
+	default:
+		return 0, false
+	}
+	if headers.Get("Set-Cookie") != "" || headers.Get("Vary") != "" {
+		return 0, false
+	}
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if hasCacheDirective(headers, directive) {
+			return 0, false
+		}
+	}
+
+	if age, ok := cacheDirectiveSeconds(headers, "s-maxage"); ok {
+		return age, age > 0
+	}
+	if age, ok := cacheDirectiveSeconds(headers, "max-age"); ok {
+		return age, age > 0
+	}
+	if value := headers.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0, false
+		}
+		// Measure against the upstream's clock when it sent one
+		if date, err := http.ParseTime(headers.Get("Date")); err == nil {
+			now = date
+		}
+		lifetime := expires.Sub(now)
+		return lifetime, lifetime > 0
+	}
+	return 0, false
+}
+
+// cacheDirectives returns the lower-cased Cache-Control directives in h
+func cacheDirectives(h http.Header) []string {
+	var directives []string
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directives = append(directives, strings.ToLower(strings.TrimSpace(directive)))
+		}
+	}
+	return directives
+}
+
+// hasCacheDirective reports whether h's Cache-Control includes a directive
+func hasCacheDirective(h http.Header, name string) bool {
+	for _, directive := range cacheDirectives(h) {
+		if directive == name || strings.HasPrefix(directive, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheDirectiveSeconds returns the value of a delta-seconds Cache-Control directive
+func cacheDirectiveSeconds(h http.Header, name string) (time.Duration, bool) {
+	for _, directive := range cacheDirectives(h) {
+		value, found := strings.CutPrefix(directive, name+"=")
+		if !found {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// messageHeader converts the headers of a response message to an http.Header
+func messageHeader(headers map[string]interface{}) http.Header {
+	header := make(http.Header)
+	for key, value := range headers {
+		switch v := value.(type) {
+		case string:
+			header.Add(key, v)
+		case []interface{}:
+			for _, val := range v {
+				header.Add(key, fmt.Sprint(val))
+			}
+		default:
+			header.Add(key, fmt.Sprint(v))
+		}
+	}
+	return header
+}
+
+// storeResponse caches a buffered response to a cacheable request, if the
+// upstream allows it
+func (s *ProxyServer) storeResponse(r *http.Request, response map[string]interface{}, body []byte) {
+	if s.cache == nil || !isCacheableRequest(r) || response["trailers"] != nil {
+		return
+	}
+	statusCodeValue, ok := response["statusCode"].(float64)
+	if !ok {
+		return
+	}
+	statusCode := int(statusCodeValue)
+	headers, _ := response["headers"].(map[string]interface{})
+	header := messageHeader(headers)
+	now := time.Now()
+	lifetime, ok := responseFreshness(statusCode, header, now)
+	if !ok {
+		return
+	}
+
+	s.cache.put(&cachedResponse{
+		key:        cacheKey(r),
+		statusCode: statusCode,
+		headers:    header,
+		body:       body,
+		storedAt:   now,
+		expires:    now.Add(lifetime),
+	})
+}
+
+// serveFromCache writes the cached response to a request, if there is a fresh one.
+// Callers sending Cache-Control: no-cache always go to a client.
+func (s *ProxyServer) serveFromCache(w http.ResponseWriter, r *http.Request) bool {
+	if s.cache == nil || !isCacheableRequest(r) || hasCacheDirective(r.Header, "no-cache") {
+		return false
+	}
+	entry := s.cache.get(cacheKey(r))
+	if entry == nil {
+		s.metrics.add("proxy_cache_misses_total", 1)
+		return false
+	}
+	s.metrics.add("proxy_cache_hits_total", 1)
+
+	// Rebuild the response message so hits take the same path as client responses
+	headers := make(map[string]interface{}, len(entry.headers)+2)
+	for key, values := range entry.headers {
+		items := make([]interface{}, len(values))
+		for i, value := range values {
+			items[i] = value
+		}
+		headers[key] = items
+	}
+	headers["Age"] = strconv.Itoa(int(time.Since(entry.storedAt).Seconds()))
+	headers["X-Cache"] = "HIT"
+	response := map[string]interface{}{
+		"statusCode": float64(entry.statusCode),
+		"headers":    headers,
+	}
+
+	body := s.compressResponse(r, response, entry.body)
+	s.writeResponseHead(w, r, response)
+	w.Write(body)
+	return true
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCacheTestProxy starts a proxy with the cache enabled in front of a backend
+// that numbers its responses, returning the proxy and the number of upstream calls
+func startCacheTestProxy(t *testing.T) (*testProxy, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch r.URL.Path {
+		case "/cached":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("response " + strconv.FormatInt(n, 10)))
+	}), func(c *Config) { c.Server.Cache.Enabled = true })
+	return p, &calls
+}
+
+func TestCacheHitWithoutClient(t *testing.T) {
+	p, calls := startCacheTestProxy(t)
+
+	if resp, body := p.get(t, "/cached"); resp.Header.Get("X-Cache") != "" || body != "response 1" {
+		t.Fatalf("first request got %q with X-Cache %q, want it from the upstream", body, resp.Header.Get("X-Cache"))
+	}
+
+	// With no client left, only the cache can answer
+	p.client.Close()
+	waitFor(t, "client to disconnect", func() bool { return p.server.registeredClients() == 0 })
+
+	resp, body := p.get(t, "/cached")
+	if resp.StatusCode != http.StatusOK || body != "response 1" {
+		t.Fatalf("got %d %q, want the cached response", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Age") == "" {
+		t.Errorf("X-Cache = %q, Age = %q; want a HIT with an Age", resp.Header.Get("X-Cache"), resp.Header.Get("Age"))
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstream called %d times, want once", calls.Load())
+	}
+}
+
+func TestCacheMiss(t *testing.T) {
+	p, calls := startCacheTestProxy(t)
+
+	for _, path := range []string{"/no-store", "/no-store", "/plain", "/plain"} {
+		if resp, _ := p.get(t, path); resp.Header.Get("X-Cache") != "" {
+			t.Errorf("%s: X-Cache = %q, want the response from the upstream", path, resp.Header.Get("X-Cache"))
+		}
+	}
+
+	// A caller's no-cache skips a fresh entry
+	p.get(t, "/cached")
+	req, err := http.NewRequest(http.MethodGet, p.url+"/cached", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+	if _, body := p.do(t, req); body != "response 6" {
+		t.Errorf("no-cache request got %q, want a fresh response", body)
+	}
+	if calls.Load() != 6 {
+		t.Errorf("upstream called %d times, want 6", calls.Load())
+	}
+	if entries := p.server.cache.len(); entries != 1 {
+		t.Errorf("cache holds %d entries, want only /cached", entries)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	p, calls := startCacheTestProxy(t)
+
+	p.get(t, "/cached")
+	if _, body := p.get(t, "/cached"); body != "response 1" {
+		t.Fatalf("got %q, want the cached response", body)
+	}
+
+	// Age the entry past its max-age
+	p.server.cache.mu.Lock()
+	for _, element := range p.server.cache.entries {
+		element.Value.(*cachedResponse).expires = time.Now().Add(-time.Second)
+	}
+	p.server.cache.mu.Unlock()
+
+	resp, body := p.get(t, "/cached")
+	if resp.Header.Get("X-Cache") != "" || body != "response 2" {
+		t.Errorf("got %q with X-Cache %q, want a fresh response once expired", body, resp.Header.Get("X-Cache"))
+	}
+	if calls.Load() != 2 {
+		t.Errorf("upstream called %d times, want twice", calls.Load())
+	}
+}
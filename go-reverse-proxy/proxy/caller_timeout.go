@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// callerTimeoutHeader lets a caller set the timeout for its own request
+const callerTimeoutHeader = "X-Proxy-Timeout-Ms"
+
+// callerTimeout returns the timeout a caller asked for with X-Proxy-Timeout-Ms,
+// clamped to server.maxRequestTimeout, or 0 if it asked for none or caller
+// timeouts are disabled. A value that isn't a positive number of milliseconds is
+// answered with 400 and ok is false.
+func (s *ProxyServer) callerTimeout(w http.ResponseWriter, r *http.Request) (timeout time.Duration, ok bool) {
+	maxTimeout := s.config.live().maxRequestTimeout
+	value := r.Header.Get(callerTimeoutHeader)
+	if maxTimeout <= 0 || value == "" {
+		return 0, true
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		s.logger.Warn("request", "Invalid caller timeout", map[string]interface{}{
+			"url":     r.URL.String(),
+			"timeout": value,
+		})
+		s.writeError(w, http.StatusBadRequest, errorCodeInvalidTimeout, "Invalid "+callerTimeoutHeader+" header", "")
+		return 0, false
+	}
+	return time.Duration(min(ms, int64(maxTimeout))) * time.Millisecond, true
+}
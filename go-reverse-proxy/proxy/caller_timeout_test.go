@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCallerTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		header      string
+		wantTimeout time.Duration
+	}{
+		{"shorter than the default", "100", 100 * time.Millisecond},
+		{"clamped to the maximum", "60000", 300 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestServer(t, func(c *Config) {
+				c.Server.RequestTimeout = 5000
+				c.Server.MaxRequestTimeout = 300
+			})
+			f := p.connectFakeClient(t)
+
+			req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set(callerTimeoutHeader, tc.header)
+			start := time.Now()
+			resp, _ := p.do(t, req)
+			elapsed := time.Since(start)
+			if resp.StatusCode != http.StatusGatewayTimeout {
+				t.Errorf("status = %d, want 504", resp.StatusCode)
+			}
+			if elapsed < tc.wantTimeout || elapsed > tc.wantTimeout+time.Second {
+				t.Errorf("timed out after %v, want %v", elapsed, tc.wantTimeout)
+			}
+
+			// The client is given the same deadline
+			request := f.receive(t, "request")
+			if ms, _ := request["timeoutMs"].(float64); ms <= 0 || ms > float64(tc.wantTimeout.Milliseconds()) {
+				t.Errorf("timeoutMs = %v, want at most %d", request["timeoutMs"], tc.wantTimeout.Milliseconds())
+			}
+		})
+	}
+}
+
+func TestCallerTimeoutInvalid(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.MaxRequestTimeout = 300 })
+	p.connectFakeClient(t)
+
+	for _, value := range []string{"soon", "0", "-5"} {
+		req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(callerTimeoutHeader, value)
+		if resp, _ := p.do(t, req); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %q: status = %d, want 400", callerTimeoutHeader, value, resp.StatusCode)
+		}
+	}
+}
+
+func TestCallerTimeoutIgnoredWithoutMaximum(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.RequestTimeout = 300 })
+	p.connectFakeClient(t)
+
+	req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(callerTimeoutHeader, "50")
+	start := time.Now()
+	p.do(t, req)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("timed out after %v, want the 300ms server timeout with caller timeouts off", elapsed)
+	}
+}
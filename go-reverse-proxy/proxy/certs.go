@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certificateReloader serves a certificate and key loaded from disk, and can swap
+// them for new ones without restarting the listener. Connections that are already
+// established keep the certificate they were handshaken with.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+
+	// mu guards modTime, the newest modification time of the files when last loaded
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// newCertificateReloader loads the certificate and key from disk
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTLSLoad, err)
+	}
+	return reloader, nil
+}
+
+// reload loads the certificate and key again; the current pair is kept if loading fails
+func (r *certificateReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime := r.filesModTime()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.modTime = modTime
+	return nil
+}
+
+// changed reports whether either file was modified since it was last loaded
+func (r *certificateReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.filesModTime().Equal(r.modTime)
+}
+
+// filesModTime returns the newest modification time of the certificate and key files
+func (r *certificateReloader) filesModTime() time.Time {
+	var newest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// addCertificates registers a listener's certificate for reloading
+func (s *ProxyServer) addCertificates(listener string, reloader *certificateReloader) {
+	s.certsMutex.Lock()
+	s.certs[listener] = reloader
+	s.certsMutex.Unlock()
+}
+
+// ReloadCerts loads every listener's certificate and key from disk again. New
+// connections use the new certificates; a listener whose files fail to load keeps
+// serving its current certificate.
+func (s *ProxyServer) ReloadCerts() error {
+	s.certsMutex.Lock()
+	defer s.certsMutex.Unlock()
+
+	var firstErr error
+	for listener, reloader := range s.certs {
+		if err := reloader.reload(); err != nil {
+			s.logger.Error("server", "Failed to reload SSL certificates", map[string]interface{}{
+				"error":    err.Error(),
+				"listener": listener,
+			})
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.logger.Info("server", "Reloaded SSL certificates", map[string]interface{}{
+			"listener": listener,
+			"cert":     reloader.certFile,
+		})
+	}
+	return firstErr
+}
+
+// watchCertificates reloads certificates whenever their files change on disk,
+// until the server stops
+func (s *ProxyServer) watchCertificates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.certsMutex.Lock()
+		changed := false
+		for _, reloader := range s.certs {
+			if reloader.changed() {
+				changed = true
+			}
+		}
+		s.certsMutex.Unlock()
+
+		if changed {
+			s.ReloadCerts()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// replaceCertificate overwrites the socket listener's certificate and key files with
+// a new certificate from ca and returns it
+func replaceCertificate(t *testing.T, p *testProxy, ca *testCA) *x509.Certificate {
+	t.Helper()
+	cert := ca.issue(t, "127.0.0.1")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssl := p.config.Server.Socket.SSL
+	for file, block := range map[string]*pem.Block{
+		ssl.Cert: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		ssl.Key:  {Type: "PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+// servedSerial returns the serial number of the certificate a new connection to the
+// socket listener is handshaken with
+func servedSerial(t *testing.T, p *testProxy, ca *testCA) *big.Int {
+	t.Helper()
+	state, err := dialSocketTLS(p, ca, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.PeerCertificates[0].SerialNumber
+}
+
+// clientIDs returns the ids of the connected clients
+func (p *testProxy) clientIDs() []string {
+	p.server.clientsMutex.RLock()
+	defer p.server.clientsMutex.RUnlock()
+	var ids []string
+	for id := range p.server.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestReloadCerts(t *testing.T) {
+	ca := newTestCA(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+	p := startSocketServer(t, func(c *Config) {
+		socketTLS(t, ca)(c)
+		c.Server.CertReloadInterval = 0
+		c.Client.Proxy.DefaultTarget = backend.URL
+	})
+	p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+	connected := p.clientIDs()
+	old := servedSerial(t, p, ca)
+
+	replacement := replaceCertificate(t, p, ca)
+	if got := servedSerial(t, p, ca); got.Cmp(old) != 0 {
+		t.Fatalf("served serial %v before reloading, want the original %v", got, old)
+	}
+	if err := p.server.ReloadCerts(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(t, p, ca); got.Cmp(replacement.SerialNumber) != 0 {
+		t.Errorf("served serial %v after reloading, want the new %v", got, replacement.SerialNumber)
+	}
+
+	// The client's connection made with the old certificate is untouched
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d through the existing client, want 200", resp.StatusCode)
+	}
+	if ids := p.clientIDs(); len(ids) != 1 || ids[0] != connected[0] {
+		t.Errorf("clients %v after reloading, want the original connection %v", ids, connected)
+	}
+}
+
+func TestReloadCertsKeepsCurrentOnFailure(t *testing.T) {
+	ca := newTestCA(t)
+	p := startSocketServer(t, func(c *Config) {
+		socketTLS(t, ca)(c)
+		c.Server.CertReloadInterval = 0
+	})
+	old := servedSerial(t, p, ca)
+
+	if err := os.WriteFile(p.config.Server.Socket.SSL.Key, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.server.ReloadCerts(); err == nil {
+		t.Fatal("reloading an invalid key succeeded")
+	}
+	p.waitForLog(t, "Failed to reload SSL certificates")
+	if got := servedSerial(t, p, ca); got.Cmp(old) != 0 {
+		t.Errorf("served serial %v after a failed reload, want the original %v", got, old)
+	}
+}
+
+func TestCertificatesReloadWhenFilesChange(t *testing.T) {
+	ca := newTestCA(t)
+	p := startSocketServer(t, func(c *Config) {
+		socketTLS(t, ca)(c)
+		c.Server.CertReloadInterval = 10
+	})
+
+	replacement := replaceCertificate(t, p, ca)
+	waitFor(t, "the new certificate to be served", func() bool {
+		return servedSerial(t, p, ca).Cmp(replacement.SerialNumber) == 0
+	})
+}
+
+func TestCertificateLoadError(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newCertificateReloader(missing, missing); !errors.Is(err, ErrTLSLoad) {
+		t.Errorf("err = %v, want ErrTLSLoad", err)
+	}
+}
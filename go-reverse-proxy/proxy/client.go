@@ -0,0 +1,1217 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// streamChunkSize is the maximum body size carried by a single response-chunk message
+const streamChunkSize = 32 * 1024
+
+// ProxyClient handles the client-side of the reverse proxy
+type ProxyClient struct {
+	config        *Config
+	logger        *Logger
+	codec         Codec
+	messageBuffer *MessageBuffer
+	readBuffers   *bufferPool
+	httpClient    *http.Client
+	grpcClient    *http.Client
+	rewriteRules  []rewriteRule
+	headerRules   []headerRule
+	rewriteMutex  sync.RWMutex
+	tunnels       map[string]*tunnelStream
+	tunnelsMutex  sync.Mutex
+
+	// cancels holds the cancel functions of gRPC requests in progress, guarded by tunnelsMutex
+	cancels map[string]context.CancelFunc
+
+	// conn is the current connection to the server, nil until Connect first
+	// succeeds. Reconnecting replaces it while handlers may be writing to it.
+	conn      net.Conn
+	connMutex sync.Mutex
+
+	// transport, if set, replaces dialing the configured server
+	transport Transport
+
+	// closed is set by Close, after which the client no longer reconnects
+	closed atomic.Bool
+
+	// protocol is the protocol version agreed with the server at registration
+	protocol atomic.Int64
+
+	// reconnectAfter is the delay in milliseconds the server asked for before
+	// reconnecting when it shut down; 0 means use the configured delay
+	reconnectAfter atomic.Int64
+
+	// Backend health tracking. healthGeneration numbers the health reports, so the
+	// server can ignore one that it happens to handle after a newer one.
+	healthMutex         sync.Mutex
+	consecutiveFailures int
+	unhealthy           bool
+	healthGeneration    int64
+}
+
+// NewProxyClient creates a new ProxyClient instance. It fails with ErrTLSLoad if
+// the upstream TLS settings can't be loaded, rather than on the first Connect.
+func NewProxyClient(config *Config, logger *Logger) (*ProxyClient, error) {
+	client := &ProxyClient{
+		config:        config,
+		logger:        logger,
+		messageBuffer: NewMessageBuffer(),
+		readBuffers:   newBufferPool(config.Client.ReadBufferSize),
+		rewriteRules:  compileRewriteRules(config, logger),
+		headerRules:   compileHeaderRules(config.Client.Proxy.HeaderRules, logger, "proxy"),
+		tunnels:       make(map[string]*tunnelStream),
+		cancels:       make(map[string]context.CancelFunc),
+	}
+
+	// Share one HTTP client, kept across reconnects, so connections to the target are reused
+	httpClient, err := client.newUpstreamClient()
+	if err != nil {
+		return nil, err
+	}
+	client.httpClient = httpClient
+	client.grpcClient = newGRPCClient(httpClient)
+
+	client.messageBuffer.SetMaxFrameSize(config.Transport.MaxFrameBytes)
+	client.messageBuffer.SetOnDataCallback(client.handleMessage)
+	return client, nil
+}
+
+// serverAddress returns the network and address of the server's socket listener
+func serverAddress(config *Config) (string, string) {
+	if config.Client.Server.Network == "unix" {
+		return "unix", config.Client.Server.Path
+	}
+	return "tcp", net.JoinHostPort(config.Client.Server.Host, strconv.Itoa(config.Client.Server.Port))
+}
+
+// SetTransport makes the client connect through transport instead of dialing the
+// configured server address. It must be called before Connect.
+func (c *ProxyClient) SetTransport(transport Transport) {
+	c.transport = transport
+}
+
+// Connect establishes a connection to the server
+func (c *ProxyClient) Connect() error {
+	codec, err := newCodec(c.config.Transport.Codec)
+	if err != nil {
+		return err
+	}
+	c.codec = codec
+
+	network, addr := serverAddress(c.config)
+
+	// Dial into a local, so a failed attempt leaves the last connection in place
+	var conn net.Conn
+	if c.transport != nil {
+		network, addr = memoryAddr{}.Network(), memoryAddr{}.String()
+		conn, err = c.transport.Dial()
+	} else if c.config.Client.Server.SSL.Enabled {
+		// Load CA certificate
+		var caCert []byte
+		caCert, err = os.ReadFile(c.config.Client.Server.SSL.CA)
+		if err != nil {
+			return fmt.Errorf("%w: failed to read CA certificate: %w", ErrTLSLoad, err)
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("%w: no certificates found in %s", ErrTLSLoad, c.config.Client.Server.SSL.CA)
+		}
+
+		tlsConfig := &tls.Config{
+			RootCAs:            caCertPool,
+			InsecureSkipVerify: !c.config.Client.Server.SSL.RejectUnauthorized,
+		}
+		sslConfig := c.config.Client.Server.SSL
+		if err := applyTLSPolicy(tlsConfig, sslConfig.MinVersion, sslConfig.CipherSuites); err != nil {
+			return fmt.Errorf("%w: invalid TLS settings: %w", ErrTLSLoad, err)
+		}
+
+		// Present a client certificate when the server requires one
+		if c.config.Client.Server.SSL.Cert != "" && c.config.Client.Server.SSL.Key != "" {
+			cert, err := tls.LoadX509KeyPair(c.config.Client.Server.SSL.Cert, c.config.Client.Server.SSL.Key)
+			if err != nil {
+				return fmt.Errorf("%w: failed to load client certificate: %w", ErrTLSLoad, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		// A unix socket path says nothing about the server's name
+		if network == "unix" {
+			tlsConfig.ServerName = c.config.Client.Server.Host
+		}
+
+		conn, err = tls.Dial(network, addr, tlsConfig)
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDial, err)
+	}
+	c.connMutex.Lock()
+	c.conn = conn
+	c.connMutex.Unlock()
+
+	c.logger.Info("socket", "Connected to server", map[string]interface{}{
+		"network": network,
+		"address": addr,
+	})
+
+	// Frames stay uncompressed until the server accepts our registration, but the
+	// server may compress its reply to it and everything after if we offer to
+	c.messageBuffer.SetCompression(false, 0)
+	c.messageBuffer.SetDecompression(c.config.Client.Compression.Enabled, c.config.Transport.MaxInflatedBytes)
+	c.register()
+
+	// A new connection starts out healthy on the server; correct it if needed
+	c.healthMutex.Lock()
+	unhealthy := c.unhealthy
+	generation := c.healthGeneration
+	c.healthMutex.Unlock()
+	if unhealthy {
+		c.sendHealth(false, generation)
+	}
+
+	go c.readLoop(conn)
+	return nil
+}
+
+// connection returns the current connection to the server, or nil if the client
+// has never connected
+func (c *ProxyClient) connection() net.Conn {
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	return c.conn
+}
+
+// readLoop continuously reads data from the server over conn
+func (c *ProxyClient) readLoop(conn net.Conn) {
+	bufferPtr := c.readBuffers.Get()
+	buffer := *bufferPtr
+
+	frames := &frameClock{timeout: time.Duration(c.config.Client.Server.ReadTimeout) * time.Millisecond}
+	for {
+		conn.SetReadDeadline(frames.deadline())
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if isTimeout(err) {
+				c.logger.Warn("socket", "Timed out reading frame from server", map[string]interface{}{
+					"readTimeout": c.config.Client.Server.ReadTimeout,
+				})
+				conn.Close()
+			} else if err != io.EOF && !c.closed.Load() {
+				c.logger.Error("socket", "Error reading from server", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+
+			c.readBuffers.Put(bufferPtr)
+			c.closeTunnels()
+
+			// Finish handling requests that already arrived before replacing the connection
+			drainTimeout := time.Duration(c.config.Client.Server.DrainTimeout) * time.Millisecond
+			if !c.messageBuffer.Drain(drainTimeout) {
+				c.logger.Warn("socket", "Timed out draining server messages", nil)
+			}
+			if c.closed.Load() {
+				c.logger.Info("socket", "Disconnected from server", nil)
+				return
+			}
+			c.reconnect()
+			return
+		}
+
+		buffered := c.messageBuffer.BufferedBytes()
+		if err := c.messageBuffer.Consume(buffer[:n]); err != nil {
+			c.logger.Error("socket", "Dropped invalid frames from server", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+		frames.update(buffered, n, c.messageBuffer.BufferedBytes())
+	}
+}
+
+// Run connects to the server and serves requests until ctx is done, then closes
+// the connection. It returns an error only if the first connection attempt fails.
+func (c *ProxyClient) Run(ctx context.Context) error {
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	c.Close()
+	return nil
+}
+
+// Close closes the connection to the server and stops the client reconnecting.
+// Requests already received are left to finish. It returns ErrNotConnected if the
+// client never connected.
+func (c *ProxyClient) Close() error {
+	c.closed.Store(true)
+	conn := c.connection()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.Close()
+}
+
+// reconnect attempts to reconnect to the server. The first attempt waits as long
+// as the server asked for if it shut down, then the configured delay applies.
+func (c *ProxyClient) reconnect() {
+	for {
+		delay := time.Duration(c.config.Reconnection.Delay) * time.Millisecond
+		if after := c.reconnectAfter.Swap(0); after > 0 {
+			delay = time.Duration(after) * time.Millisecond
+		}
+		c.logger.Warn("socket", "Connection lost, attempting to reconnect", map[string]interface{}{
+			"delayMs": delay.Milliseconds(),
+		})
+		time.Sleep(delay)
+		if c.closed.Load() {
+			return
+		}
+
+		if err := c.Connect(); err == nil {
+			c.logger.Info("socket", "Reconnected to server", nil)
+			return
+		}
+	}
+}
+
+// handleShutdown records how long the server asked clients to wait before
+// reconnecting; the server closes the connection after sending it
+func (c *ProxyClient) handleShutdown(message map[string]interface{}) {
+	reconnectAfter, _ := message["reconnectAfterMs"].(float64)
+	c.logger.Info("socket", "Server is shutting down", map[string]interface{}{
+		"reconnectAfterMs": reconnectAfter,
+	})
+	if reconnectAfter > 0 {
+		c.reconnectAfter.Store(int64(reconnectAfter))
+	}
+}
+
+// send encodes a message and writes it to the server
+func (c *ProxyClient) send(message map[string]interface{}) error {
+	data, err := c.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(c.messageBuffer.Produce(data))
+}
+
+// writeFrame writes a frame to the server within the write timeout
+func (c *ProxyClient) writeFrame(frame []byte) error {
+	conn := c.connection()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return writeFrame(conn, frame, time.Duration(c.config.Client.Server.WriteTimeout)*time.Millisecond)
+}
+
+// register announces the client's capabilities to the server
+func (c *ProxyClient) register() {
+	err := c.send(map[string]interface{}{
+		"type":               "register",
+		"protocolVersion":    protocolVersion,
+		"minProtocolVersion": minProtocolVersion,
+		"id":                 c.config.Client.ID,
+		"compression":        c.config.Client.Compression.Enabled,
+		"weight":             c.config.Client.Weight,
+		"maxConcurrency":     c.config.Client.MaxConcurrency,
+		"tags":               c.config.Client.Tags,
+	})
+	if err != nil {
+		c.logger.Error("socket", "Failed to register with server", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// handleRegistered applies the settings the server agreed to during registration
+func (c *ProxyClient) handleRegistered(message map[string]interface{}) {
+	// The server refuses registrations it can't accept and closes the connection
+	if errMessage, _ := message["error"].(string); errMessage != "" {
+		c.logger.Error("socket", "Server rejected registration", map[string]interface{}{
+			"error": errMessage,
+		})
+		return
+	}
+
+	// A server that picked a version this client can't speak gets disconnected
+	version, err := negotiateProtocol(message)
+	if err != nil {
+		c.logger.Error("socket", "Server protocol version is not supported", map[string]interface{}{
+			"error": err.Error(),
+		})
+		if conn := c.connection(); conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	c.protocol.Store(int64(version))
+
+	compression, _ := message["compression"].(bool)
+	c.messageBuffer.SetCompression(compression, c.config.Client.Compression.Threshold)
+	c.messageBuffer.SetDecompression(compression, c.config.Transport.MaxInflatedBytes)
+
+	c.logger.Info("socket", "Registered with server", map[string]interface{}{
+		"compression":     compression,
+		"protocolVersion": version,
+	})
+}
+
+// encodeBody encodes a body for a message to the server
+func (c *ProxyClient) encodeBody(body []byte) interface{} {
+	return encodeBody(c.codec, int(c.protocol.Load()), body)
+}
+
+// sendHealth notifies the server of the backend's health as of the given generation
+func (c *ProxyClient) sendHealth(healthy bool, generation int64) {
+	err := c.send(map[string]interface{}{
+		"type":       "health",
+		"healthy":    healthy,
+		"generation": generation,
+	})
+	if err != nil {
+		c.logger.Error("socket", "Failed to send health update", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// recordUpstreamResult tracks consecutive upstream failures and reports health transitions
+func (c *ProxyClient) recordUpstreamResult(failed bool) {
+	c.healthMutex.Lock()
+	transition := false
+	if failed {
+		c.consecutiveFailures++
+		threshold := c.config.Client.Health.FailureThreshold
+		if !c.unhealthy && threshold > 0 && c.consecutiveFailures >= threshold {
+			c.unhealthy = true
+			transition = true
+		}
+	} else {
+		c.consecutiveFailures = 0
+		if c.unhealthy {
+			c.unhealthy = false
+			transition = true
+		}
+	}
+	healthy := !c.unhealthy
+	if transition {
+		c.healthGeneration++
+	}
+	generation := c.healthGeneration
+	c.healthMutex.Unlock()
+
+	if !transition {
+		return
+	}
+
+	if healthy {
+		c.logger.Info("proxy", "Backend recovered", nil)
+	} else {
+		c.logger.Warn("proxy", "Backend marked unhealthy after consecutive failures", map[string]interface{}{
+			"failures": c.config.Client.Health.FailureThreshold,
+		})
+		// The server stops routing to us, so probe the backend to detect recovery
+		go c.probeBackend()
+	}
+	c.sendHealth(healthy, generation)
+}
+
+// probeBackend periodically checks the targets while the backend is unhealthy
+func (c *ProxyClient) probeBackend() {
+	interval := time.Duration(c.config.Client.Health.ProbeInterval) * time.Millisecond
+	for {
+		time.Sleep(interval)
+
+		c.healthMutex.Lock()
+		unhealthy := c.unhealthy
+		c.healthMutex.Unlock()
+		if !unhealthy {
+			return
+		}
+
+		for _, target := range c.targets() {
+			if c.probe(target, interval) {
+				c.recordUpstreamResult(false)
+				return
+			}
+		}
+	}
+}
+
+// probe sends a GET request to target and reports whether any response came back.
+// A probe gives up after timeout, so a target that accepts connections but never
+// answers can't hold up the probes of the others or the next round.
+func (c *ProxyClient) probe(target string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = c.httpClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			return true
+		}
+	}
+	c.logger.Debug("proxy", "Backend probe failed", map[string]interface{}{
+		"target": target,
+		"error":  err.Error(),
+	})
+	return false
+}
+
+// newUpstreamClient creates an HTTP client for requests to the target server. It
+// fails if the upstream TLS settings are invalid or the CA can't be loaded.
+func (c *ProxyClient) newUpstreamClient() (*http.Client, error) {
+	transportConfig := c.config.Client.Proxy.Transport
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(transportConfig.DialTimeout) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// A custom CA is always verified against, even with rejectUnauthorized off
+	sslConfig := c.config.Client.Proxy.SSL
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !sslConfig.RejectUnauthorized && sslConfig.CA == "",
+		ServerName:         sslConfig.ServerName,
+	}
+	if err := applyTLSPolicy(tlsConfig, sslConfig.MinVersion, sslConfig.CipherSuites); err != nil {
+		return nil, fmt.Errorf("%w: invalid upstream TLS settings: %w", ErrTLSLoad, err)
+	}
+
+	// Verify upstream certificates against a custom CA instead of the system roots
+	if sslConfig.CA != "" {
+		caCert, err := os.ReadFile(sslConfig.CA)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to read upstream CA certificate: %w", ErrTLSLoad, err)
+		}
+
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("%w: no certificates found in %s", ErrTLSLoad, sslConfig.CA)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: time.Duration(transportConfig.ResponseHeaderTimeout) * time.Millisecond,
+			MaxIdleConnsPerHost:   transportConfig.MaxIdleConnsPerHost,
+			IdleConnTimeout:       time.Duration(transportConfig.IdleConnTimeout) * time.Millisecond,
+			TLSClientConfig:       tlsConfig,
+		},
+	}, nil
+}
+
+// handleMessage processes messages from the server
+func (c *ProxyClient) handleMessage(data []byte) {
+	message, err := c.codec.Decode(data)
+	if err != nil {
+		c.logger.Error("message", "Failed to decode message", map[string]interface{}{
+			"error": err.Error(),
+			"codec": c.config.Transport.Codec,
+		})
+		return
+	}
+
+	switch message["type"] {
+	case "registered":
+		c.handleRegistered(message)
+	case "shutdown":
+		c.handleShutdown(message)
+	case "connect":
+		c.handleConnect(message)
+	case "tunnel-data", "tunnel-close", "tunnel-ack":
+		c.handleTunnelMessage(message)
+	case "request-cancel":
+		c.handleRequestCancel(message)
+	default:
+		c.handleRequest(message)
+	}
+}
+
+// handleRequest forwards a request from the server to the target and relays the response
+func (c *ProxyClient) handleRequest(request map[string]interface{}) {
+	// Drop messages that cannot be forwarded rather than crashing on them
+	if err := normalizeRequest(request, c.codec); err != nil {
+		c.logger.Error("proxy", "Malformed request", map[string]interface{}{
+			"error":     err.Error(),
+			"requestId": request["requestId"],
+		})
+		if _, ok := request["requestId"].(string); ok {
+			c.sendUpstreamError(request, "malformed_request", err.Error())
+		}
+		return
+	}
+
+	// gRPC requests stream in both directions and take a path of their own
+	if grpc, _ := request["grpc"].(bool); grpc {
+		c.handleGRPCRequest(request)
+		return
+	}
+
+	// Track the server's deadline locally so clock skew between hosts doesn't matter
+	var deadline time.Time
+	if timeoutMs, ok := request["timeoutMs"].(float64); ok {
+		deadline = time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	}
+
+	// Cancel the upstream call once the server has given up waiting for it
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// Continue the server's trace around the upstream call
+	ctx = extractTraceContext(ctx, request)
+	ctx, span := tracer().Start(ctx, "proxy.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", fmt.Sprint(request["method"]))))
+	defer span.End()
+
+	// Resolve the request URL against each configured target
+	targetURLs, err := c.upstreamURLs(request)
+	if err != nil {
+		c.sendUpstreamError(request, "invalid_url", err.Error())
+		return
+	}
+
+	body := request["body"].([]byte)
+
+	attempts := max(c.config.Client.Proxy.AttemptsPerTarget, 1)
+	retryConfig := c.config.live().retry
+	method := request["method"].(string)
+	retryable := isIdempotentMethod(method) || retryConfig.AllowNonIdempotent
+
+	// Send request, failing over to the next target while targets are unreachable,
+	// and retrying the whole pass on transient failures
+	var resp *http.Response
+	var targetURL string
+	var lastErr error
+	upstreamStart := time.Now()
+	for try := 1; ; try++ {
+		resp, lastErr = nil, nil
+	failover:
+		for _, targetURL = range targetURLs {
+			for attempt := 1; attempt <= attempts; attempt++ {
+				// Stop once the server has given up on the request
+				if !deadline.IsZero() && time.Until(deadline) <= 0 {
+					c.logger.Warn("proxy", "Request deadline passed before forwarding", map[string]interface{}{
+						"requestId": request["requestId"],
+					})
+					return
+				}
+
+				httpReq, err := c.newUpstreamRequest(ctx, request, targetURL, bytes.NewReader(body))
+				if err != nil {
+					c.logger.Error("proxy", "Failed to create HTTP request", map[string]interface{}{
+						"error":     err.Error(),
+						"requestId": request["requestId"],
+					})
+					c.sendUpstreamError(request, "malformed_request", err.Error())
+					return
+				}
+
+				c.logger.Debug("proxy", "Forwarding request", map[string]interface{}{
+					"requestId": request["requestId"],
+					"url":       targetURL,
+					"attempt":   attempt,
+					"try":       try,
+					"headers":   httpReq.Header,
+				})
+
+				attemptStart := time.Now()
+				resp, err = c.httpClient.Do(httpReq)
+				c.logUpstreamAccess(request["requestId"], httpReq, resp, err, time.Since(attemptStart))
+				if err == nil {
+					break failover
+				}
+				lastErr = err
+
+				c.logger.Warn("proxy", "Upstream attempt failed", map[string]interface{}{
+					"requestId": request["requestId"],
+					"url":       targetURL,
+					"attempt":   attempt,
+					"try":       try,
+					"error":     err.Error(),
+				})
+
+				// Only connection failures are safe to fail over: the request never reached the target
+				if !isDialError(err) {
+					break failover
+				}
+			}
+		}
+
+		if !retryable || try >= retryConfig.MaxAttempts {
+			break
+		}
+
+		var reason string
+		if resp != nil {
+			if !slices.Contains(retryConfig.RetryOnStatuses, resp.StatusCode) {
+				break
+			}
+			reason = resp.Status
+		} else {
+			if !isTransientError(lastErr) {
+				break
+			}
+			reason = lastErr.Error()
+		}
+
+		// Back off exponentially, but never past the request deadline
+		backoff := time.Duration(retryConfig.BackoffMs) * time.Millisecond << (try - 1)
+		if !deadline.IsZero() && time.Until(deadline) <= backoff {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		c.logger.Info("proxy", "Retrying request", map[string]interface{}{
+			"requestId": request["requestId"],
+			"method":    method,
+			"try":       try,
+			"reason":    reason,
+			"backoffMs": backoff.Milliseconds(),
+		})
+		time.Sleep(backoff)
+	}
+	c.recordUpstreamResult(resp == nil)
+	span.SetAttributes(attribute.String("url.full", targetURL))
+	if resp == nil {
+		errorClass := classifyUpstreamError(lastErr)
+		span.RecordError(lastErr)
+		span.SetStatus(codes.Error, errorClass)
+		c.logger.Error("proxy", "Failed to send request", map[string]interface{}{
+			"error": lastErr.Error(),
+			"class": errorClass,
+			"url":   targetURL,
+		})
+
+		// Send error response back to server
+		c.sendUpstreamError(request, errorClass, lastErr.Error())
+		return
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	// Refuse responses whose headers would bloat the message to the server
+	proxyConfig := c.config.Client.Proxy
+	if !headersWithinLimits(resp.Header, proxyConfig.MaxResponseHeaderCount, proxyConfig.MaxResponseHeaderBytes) {
+		count, size := headerSize(resp.Header)
+		c.logger.Warn("proxy", "Upstream response headers too large", map[string]interface{}{
+			"url":         targetURL,
+			"headerCount": count,
+			"headerBytes": size,
+		})
+		c.sendUpstreamError(request, "response_headers_too_large",
+			fmt.Sprintf("response has %d headers totalling %d bytes", count, size))
+		return
+	}
+
+	// Refuse or cap oversized upstream bodies
+	maxBodyBytes := c.config.Client.Proxy.MaxResponseBodyBytes
+	if maxBodyBytes > 0 {
+		if resp.ContentLength > maxBodyBytes {
+			c.logger.Warn("proxy", "Upstream response body too large", map[string]interface{}{
+				"url":           targetURL,
+				"contentLength": resp.ContentLength,
+				"limit":         maxBodyBytes,
+			})
+			c.sendUpstreamError(request, "response_too_large",
+				fmt.Sprintf("response body of %d bytes exceeds limit of %d bytes", resp.ContentLength, maxBodyBytes))
+			return
+		}
+		resp.Body = http.MaxBytesReader(nil, resp.Body, maxBodyBytes)
+	}
+
+	// Small responses are buffered; anything above the threshold is streamed
+	var threshold int64
+	if v, ok := request["streamingThreshold"].(float64); ok {
+		threshold = int64(v)
+	}
+
+	// Responses of the content types the server lists are streamed whatever their size
+	alwaysStream := streamsContentType(request["streamContentTypes"], resp.Header.Get("Content-Type"))
+
+	// Read response body
+	body, stream, err := readResponseBody(resp, threshold, alwaysStream)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.logger.Warn("proxy", "Upstream response body too large", map[string]interface{}{
+				"url":   targetURL,
+				"limit": maxBodyBytes,
+			})
+			c.sendUpstreamError(request, "response_too_large",
+				fmt.Sprintf("response body exceeds limit of %d bytes", maxBodyBytes))
+			return
+		}
+
+		c.logger.Error("proxy", "Failed to read response body", map[string]interface{}{
+			"error": err.Error(),
+		})
+		c.sendUpstreamError(request, "read_error", err.Error())
+		return
+	}
+
+	// Time spent on the upstream, including retries, so the server can tell it apart from tunnel time
+	upstreamDuration := time.Since(upstreamStart)
+
+	if stream {
+		c.streamResponse(request, resp, body, upstreamDuration)
+		return
+	}
+
+	// Create response message
+	response := map[string]interface{}{
+		"type":               "response",
+		"clientId":           request["clientId"],
+		"requestId":          request["requestId"],
+		"statusCode":         resp.StatusCode,
+		"headers":            headerMap(resp.Header),
+		"body":               c.encodeBody(body),
+		"upstreamDurationMs": upstreamDuration.Milliseconds(),
+	}
+
+	// Trailers are only available once the body has been read
+	if len(resp.Trailer) > 0 {
+		response["trailers"] = headerMap(resp.Trailer)
+	}
+
+	// Send response back to server
+	data, err := c.codec.Encode(response)
+	if err != nil {
+		c.logger.Error("proxy", "Failed to encode response", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// The server drops messages over the frame limit, so a response too large for
+	// one is streamed instead
+	if maxFrame := c.config.Transport.MaxFrameBytes; maxFrame > 0 && len(data) > maxFrame {
+		c.logger.Debug("proxy", "Streaming response too large for one message", map[string]interface{}{
+			"requestId":    request["requestId"],
+			"messageBytes": len(data),
+			"limit":        maxFrame,
+		})
+		c.streamResponse(request, resp, body, upstreamDuration)
+		return
+	}
+
+	err = c.writeFrame(c.messageBuffer.Produce(data))
+	if err != nil {
+		c.logger.Error("proxy", "Failed to send response to server", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// targets returns the ordered list of upstream base URLs
+func (c *ProxyClient) targets() []string {
+	if len(c.config.Client.Proxy.Targets) > 0 {
+		return c.config.Client.Proxy.Targets
+	}
+	return []string{c.config.Client.Proxy.DefaultTarget}
+}
+
+// normalizeRequest checks the fields of a request message that are used without
+// further checks, filling in an empty header map when it is absent. The encoded
+// body is replaced with its bytes.
+func normalizeRequest(request map[string]interface{}, codec Codec) error {
+	for _, field := range []string{"method", "url"} {
+		if value, _ := request[field].(string); value == "" {
+			return fmt.Errorf("missing %s", field)
+		}
+	}
+
+	body, err := codec.DecodeBody(request["body"])
+	if err != nil {
+		return fmt.Errorf("invalid body: %w", err)
+	}
+	request["body"] = body
+
+	switch request["headers"].(type) {
+	case nil:
+		request["headers"] = map[string]interface{}{}
+	case map[string]interface{}:
+	default:
+		return errors.New("headers is not an object")
+	}
+	return nil
+}
+
+// hostTarget returns the upstream base URL configured for the request's host, if any.
+// An exact match (including any port) takes precedence over a match on the hostname alone.
+func (c *ProxyClient) hostTarget(request map[string]interface{}) (string, bool) {
+	host, _ := request["host"].(string)
+	if host == "" {
+		return "", false
+	}
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	var fallback string
+	for pattern, target := range c.config.Client.Proxy.HostTargets {
+		if strings.EqualFold(pattern, host) {
+			return target, true
+		}
+		if strings.EqualFold(pattern, hostname) {
+			fallback = target
+		}
+	}
+	return fallback, fallback != ""
+}
+
+// upstreamURLs resolves the request URL against each target, in failover order.
+// Absolute URLs are used as they are. It fails if a URL cannot be parsed.
+func (c *ProxyClient) upstreamURLs(request map[string]interface{}) ([]string, error) {
+	requestURL := request["url"].(string)
+
+	var bases []string
+	if strings.HasPrefix(requestURL, "http://") || strings.HasPrefix(requestURL, "https://") {
+		bases = []string{""}
+	} else if target, ok := c.hostTarget(request); ok {
+		bases = []string{target}
+	} else {
+		bases = c.targets()
+	}
+
+	targetURLs := make([]string, 0, len(bases))
+	for _, base := range bases {
+		targetURL := base + requestURL
+		if base != "" {
+			c.logger.Debug("proxy", "Relative URL converted to absolute", map[string]interface{}{
+				"relative": requestURL,
+				"absolute": targetURL,
+			})
+		}
+
+		// Apply URL rewriting rules
+		targetURL = c.applyRewriteRules(targetURL)
+
+		// Parse the target URL
+		if _, err := url.Parse(targetURL); err != nil {
+			c.logger.Error("proxy", "Failed to parse URL", map[string]interface{}{
+				"error": err.Error(),
+				"url":   targetURL,
+			})
+			return nil, err
+		}
+		targetURLs = append(targetURLs, targetURL)
+	}
+	return targetURLs, nil
+}
+
+// newUpstreamRequest builds the HTTP request for one attempt against targetURL,
+// bounded by the deadline of ctx
+func (c *ProxyClient) newUpstreamRequest(ctx context.Context, request map[string]interface{}, targetURL string, body io.Reader) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(
+		ctx,
+		request["method"].(string),
+		targetURL,
+		body,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set headers
+	headers := request["headers"].(map[string]interface{})
+	for key, value := range headers {
+		switch v := value.(type) {
+		case string:
+			httpReq.Header.Set(key, v)
+		case []interface{}:
+			// If it's a slice, join all values with comma
+			strValues := make([]string, len(v))
+			for i, val := range v {
+				strValues[i] = fmt.Sprint(val)
+			}
+			httpReq.Header.Set(key, strings.Join(strValues, ", "))
+		default:
+			// For any other type, convert to string
+			httpReq.Header.Set(key, fmt.Sprint(v))
+		}
+	}
+
+	// Remove host header to avoid conflicts
+	// httpReq.Header.Del("Host")
+
+	// Describe the caller's TLS connection when the server forwarded it
+	if info, ok := request["tls"].(map[string]interface{}); ok {
+		setTLSInfoHeaders(httpReq.Header, info)
+	}
+
+	// Identify the caller's connection when the server forwarded it
+	setConnectionInfoHeaders(httpReq.Header, request)
+
+	// Hop-by-hop headers belong to the caller's connection, not this one
+	removeHopByHopHeaders(httpReq.Header)
+
+	// Apply the configured header rules
+	applyHeaderRules(httpReq.Header, c.headerRules, messageVars(request))
+
+	// Propagate the trace to the target
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+
+	// Pass the remaining timeout budget on to the target
+	if header := c.config.live().timeoutHeader; header != "" {
+		if deadline, ok := ctx.Deadline(); ok {
+			httpReq.Header.Set(header, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+		}
+	}
+
+	return httpReq, nil
+}
+
+// isIdempotentMethod reports whether repeating a request with method has the same effect as sending it once
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// isTransientError reports whether err is a connection failure that may succeed on retry
+func isTransientError(err error) bool {
+	return isDialError(err) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isDialError reports whether err happened while connecting to the target,
+// before any of the request was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// readResponseBody reads the upstream body if it fits within threshold bytes.
+// When the body is larger (or threshold is positive and the length is unknown and
+// exceeds it), stream is true and body holds only the bytes consumed so far.
+// With alwaysStream nothing is read and stream is true.
+func readResponseBody(resp *http.Response, threshold int64, alwaysStream bool) (body []byte, stream bool, err error) {
+	if alwaysStream {
+		return nil, true, nil
+	}
+	if threshold <= 0 || (resp.ContentLength >= 0 && resp.ContentLength <= threshold) {
+		body, err = io.ReadAll(resp.Body)
+		return body, false, err
+	}
+
+	if resp.ContentLength > threshold {
+		return nil, true, nil
+	}
+
+	// Unknown length: buffer up to the threshold before deciding
+	body, err = io.ReadAll(io.LimitReader(resp.Body, threshold+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return body, int64(len(body)) > threshold, nil
+}
+
+// streamsContentType reports whether contentType matches one of the patterns in
+// a request's streamContentTypes list. A pattern is a media type such as
+// "application/octet-stream", or a type with a wildcard subtype such as "video/*".
+func streamsContentType(patterns interface{}, contentType string) bool {
+	list, _ := patterns.([]interface{})
+	if len(list) == 0 || contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, p := range list {
+		pattern, _ := p.(string)
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// streamResponse relays an upstream response to the server as a response-start message,
+// a series of response-chunk messages and a final response-end message
+func (c *ProxyClient) streamResponse(request map[string]interface{}, resp *http.Response, prefix []byte, upstreamDuration time.Duration) {
+	seq := 0
+	send := func(message map[string]interface{}) error {
+		message["clientId"] = request["clientId"]
+		message["requestId"] = request["requestId"]
+		message["seq"] = seq
+		seq++
+		return c.send(message)
+	}
+	sendChunk := func(chunk []byte) error {
+		return send(map[string]interface{}{
+			"type": "response-chunk",
+			"body": c.encodeBody(chunk),
+		})
+	}
+
+	start := map[string]interface{}{
+		"type":               "response-start",
+		"statusCode":         resp.StatusCode,
+		"headers":            headerMap(resp.Header),
+		"upstreamDurationMs": upstreamDuration.Milliseconds(),
+	}
+	// Announce the trailer names now; their values follow in response-end
+	if len(resp.Trailer) > 0 {
+		start["trailers"] = headerMap(resp.Trailer)
+	}
+	err := send(start)
+
+	for len(prefix) > 0 && err == nil {
+		n := min(len(prefix), streamChunkSize)
+		err = sendChunk(prefix[:n])
+		prefix = prefix[n:]
+	}
+
+	// upstreamError describes why the body could not be read to the end
+	var upstreamError map[string]interface{}
+	buffer := make([]byte, streamChunkSize)
+	for err == nil {
+		n, readErr := resp.Body.Read(buffer)
+		if n > 0 {
+			err = sendChunk(buffer[:n])
+		}
+		if readErr != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(readErr, &maxBytesErr) {
+				c.logger.Warn("proxy", "Upstream response truncated at size limit", map[string]interface{}{
+					"limit":     maxBytesErr.Limit,
+					"requestId": request["requestId"],
+				})
+				upstreamError = map[string]interface{}{"class": "response_too_large", "message": readErr.Error()}
+			} else if readErr != io.EOF {
+				c.logger.Error("proxy", "Failed to read response body", map[string]interface{}{
+					"error":     readErr.Error(),
+					"requestId": request["requestId"],
+				})
+				upstreamError = map[string]interface{}{"class": "read_error", "message": readErr.Error()}
+			}
+			break
+		}
+	}
+
+	// A body that couldn't be read to the end is reported instead of its trailers,
+	// so the server breaks the response off rather than ending it cleanly
+	if err == nil {
+		end := map[string]interface{}{"type": "response-end"}
+		if upstreamError != nil {
+			end["upstreamError"] = upstreamError
+		} else if len(resp.Trailer) > 0 {
+			end["trailers"] = headerMap(resp.Trailer)
+		}
+		err = send(end)
+	}
+	if err != nil {
+		c.logger.Error("proxy", "Failed to send response to server", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.logger.Debug("proxy", "Streamed response to server", map[string]interface{}{
+		"requestId": request["requestId"],
+		"messages":  seq,
+	})
+}
+
+// sendUpstreamError tells the server that the target could not be reached or
+// its response could not be relayed; the server renders the error body
+func (c *ProxyClient) sendUpstreamError(request map[string]interface{}, class string, message string) {
+	errorResponse := map[string]interface{}{
+		"type":       "response",
+		"clientId":   request["clientId"],
+		"requestId":  request["requestId"],
+		"statusCode": http.StatusBadGateway,
+		"headers":    map[string]string{},
+		"upstreamError": map[string]interface{}{
+			"class":   class,
+			"message": message,
+		},
+	}
+
+	if err := c.send(errorResponse); err != nil {
+		c.logger.Error("proxy", "Failed to send response to server", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// classifyUpstreamError reports why a request to the target server failed
+func classifyUpstreamError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// headerMap converts response headers into the form sent in response messages
+func headerMap(header http.Header) map[string]interface{} {
+	headers := make(map[string]interface{})
+	for key, values := range header {
+		// Store all values for the header
+		headers[key] = values
+	}
+	return headers
+}
@@ -0,0 +1,652 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startTLSBackend starts an HTTPS server presenting cert
+func startTLSBackend(t *testing.T, cert tls.Certificate, handler http.Handler) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewUnstartedServer(handler)
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestUpstreamCustomCA(t *testing.T) {
+	ca := newTestCA(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("secure")) })
+	trusted := startTLSBackend(t, ca.issue(t, "127.0.0.1"), ok)
+	untrusted := startTLSBackend(t, newTestCA(t).issue(t, "127.0.0.1"), ok)
+
+	for _, tc := range []struct {
+		name               string
+		target             string
+		rejectUnauthorized bool
+		wantStatus         int
+	}{
+		{"signed by CA", trusted.URL, true, http.StatusOK},
+		{"signed by another CA", untrusted.URL, true, http.StatusBadGateway},
+
+		// A configured CA is verified against even when verification is turned off
+		{"another CA without rejectUnauthorized", untrusted.URL, false, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+				c.Client.Proxy.DefaultTarget = tc.target
+				c.Client.Proxy.SSL.CA = ca.certFile
+				c.Client.Proxy.SSL.RejectUnauthorized = tc.rejectUnauthorized
+			})
+			resp, _ := p.get(t, "/")
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUpstreamServerNameOverride(t *testing.T) {
+	ca := newTestCA(t)
+	backend := startTLSBackend(t, ca.issue(t, "upstream.internal"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Client.Proxy.DefaultTarget = backend.URL
+		c.Client.Proxy.SSL.CA = ca.certFile
+		c.Client.Proxy.SSL.ServerName = "upstream.internal"
+	})
+	resp, body := p.get(t, "/")
+	if resp.StatusCode != http.StatusOK || body != "upstream.internal" {
+		t.Errorf("got %d %q, want 200 with the overridden server name", resp.StatusCode, body)
+	}
+}
+
+func TestNewProxyClientFailsOnInvalidUpstreamTLS(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+		want      string
+	}{
+		{"missing CA", func(c *Config) { c.Client.Proxy.SSL.CA = filepath.Join(t.TempDir(), "missing.crt") }, "failed to read upstream CA"},
+		{"CA without certificates", func(c *Config) { c.Client.Proxy.SSL.CA = notPEM }, "no certificates found"},
+		{"unknown minimum version", func(c *Config) { c.Client.Proxy.SSL.MinVersion = "0.9" }, "invalid upstream TLS settings"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			tc.configure(config)
+			_, err := NewProxyClient(config, newTestLogger(t, config))
+			if !errors.Is(err, ErrTLSLoad) || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("NewProxyClient = %v, want ErrTLSLoad mentioning %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+		want      error
+	}{
+		{"nothing listening", func(c *Config) {}, ErrDial},
+		{"missing server CA", func(c *Config) {
+			c.Client.Server.SSL.Enabled = true
+			c.Client.Server.SSL.CA = filepath.Join(t.TempDir(), "missing.crt")
+		}, ErrTLSLoad},
+		{"server CA without certificates", func(c *Config) {
+			c.Client.Server.SSL.Enabled = true
+			c.Client.Server.SSL.CA = notPEM
+		}, ErrTLSLoad},
+		{"unknown server minimum version", func(c *Config) {
+			c.Client.Server.SSL.Enabled = true
+			c.Client.Server.SSL.MinVersion = "0.9"
+		}, ErrTLSLoad},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			config.Client.Server.Host = "127.0.0.1"
+			config.Client.Server.Port = freeTestPort(t)
+			tc.configure(config)
+
+			client, err := NewProxyClient(config, newTestLogger(t, config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.Connect()
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Connect = %v, want %v", err, tc.want)
+			}
+			var opErr *net.OpError
+			if tc.want == ErrDial && !errors.As(err, &opErr) {
+				t.Errorf("Connect = %v, want it to wrap a *net.OpError", err)
+			}
+		})
+	}
+}
+
+func TestCloseBeforeConnect(t *testing.T) {
+	config := newTestConfig(t)
+	client, err := NewProxyClient(config, newTestLogger(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Close = %v, want ErrNotConnected", err)
+	}
+}
+
+func TestCloseAfterFailedConnect(t *testing.T) {
+	ca := newTestCA(t)
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{"plain", func(c *Config) {}},
+		{"TLS", func(c *Config) {
+			c.Client.Server.SSL.Enabled = true
+			c.Client.Server.SSL.CA = ca.certFile
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			config.Client.Server.Host = "127.0.0.1"
+			config.Client.Server.Port = freeTestPort(t)
+			tc.configure(config)
+			client, err := NewProxyClient(config, newTestLogger(t, config))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := client.Connect(); !errors.Is(err, ErrDial) {
+				t.Fatalf("Connect = %v, want ErrDial", err)
+			}
+			if err := client.send(map[string]interface{}{"type": "health"}); !errors.Is(err, ErrNotConnected) {
+				t.Errorf("send = %v, want ErrNotConnected", err)
+			}
+			if err := client.Close(); !errors.Is(err, ErrNotConnected) {
+				t.Errorf("Close = %v, want ErrNotConnected", err)
+			}
+		})
+	}
+}
+
+// startHangingBackend starts an HTTP server that never answers
+func startHangingBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestBackendProbeTimeout(t *testing.T) {
+	hanging := startHangingBackend(t)
+	config := newTestConfig(t)
+	client, err := NewProxyClient(config, newTestLogger(t, config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if client.probe(hanging.URL, 100*time.Millisecond) {
+		t.Error("probe of a target that never answers succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probe took %v, want it to give up after 100ms", elapsed)
+	}
+}
+
+func TestBackendProbeRecovers(t *testing.T) {
+	hanging := startHangingBackend(t)
+	healthy := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(healthy.Close)
+
+	// The first target never answers, which must not stop the second being probed
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Client.Proxy.Targets = []string{hanging.URL, healthy.URL}
+		c.Client.Health.ProbeInterval = 50
+	})
+	p.client.healthMutex.Lock()
+	p.client.unhealthy = true
+	p.client.healthMutex.Unlock()
+
+	go p.client.probeBackend()
+	p.waitForLog(t, "Client reported backend healthy")
+	if !strings.Contains(p.logs(t), "Backend probe failed") {
+		t.Error("the probe of the hanging target was not logged as failed")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		method       string
+		maxAttempts  int
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{"off by default", http.MethodGet, 0, http.StatusServiceUnavailable, 1},
+		{"idempotent request", http.MethodGet, 3, http.StatusOK, 3},
+		{"non-idempotent request", http.MethodPost, 3, http.StatusServiceUnavailable, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The upstream fails twice before it succeeds
+			var attempts atomic.Int32
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) <= 2 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}), func(c *Config) {
+				if tc.maxAttempts > 0 {
+					c.Client.Proxy.Retry.MaxAttempts = tc.maxAttempts
+				}
+				c.Client.Proxy.Retry.BackoffMs = 1
+			})
+
+			req, err := http.NewRequest(tc.method, p.url+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, _ := p.do(t, req)
+			if resp.StatusCode != tc.wantStatus || attempts.Load() != tc.wantAttempts {
+				t.Errorf("got %d after %d attempts, want %d after %d", resp.StatusCode, attempts.Load(), tc.wantStatus, tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestUpstreamResponseHeaderTimeout(t *testing.T) {
+	hanging := startHangingBackend(t)
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Client.Proxy.DefaultTarget = hanging.URL
+		c.Client.Proxy.Transport.ResponseHeaderTimeout = 100
+	})
+
+	start := time.Now()
+	resp, body := p.get(t, "/")
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, `"class":"timeout"`) {
+		t.Errorf("got %d %s, want 502 with class timeout", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v, want it to give up after 100ms", elapsed)
+	}
+}
+
+func BenchmarkUpstreamClient(b *testing.B) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	b.Cleanup(backend.Close)
+
+	config := newTestConfig(b)
+	client, err := NewProxyClient(config, newTestLogger(b, config))
+	if err != nil {
+		b.Fatal(err)
+	}
+	get := func(b *testing.B, httpClient *http.Client) {
+		resp, err := httpClient.Get(backend.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// A shared client keeps connections alive between requests, where a client
+	// per request dials the upstream every time
+	b.Run("shared", func(b *testing.B) {
+		httpClient, err := client.newUpstreamClient()
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns.Store(0)
+		for b.Loop() {
+			get(b, httpClient)
+		}
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	})
+	b.Run("per request", func(b *testing.B) {
+		conns.Store(0)
+		for b.Loop() {
+			httpClient, err := client.newUpstreamClient()
+			if err != nil {
+				b.Fatal(err)
+			}
+			get(b, httpClient)
+			httpClient.CloseIdleConnections()
+		}
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	})
+}
+
+func TestFailover(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("second target"))
+	}), func(c *Config) {
+		c.Client.Proxy.Targets = []string{"http://127.0.0.1:1", c.Client.Proxy.DefaultTarget}
+		c.Client.Proxy.AttemptsPerTarget = 2
+	})
+
+	resp, body := p.get(t, "/")
+	if resp.StatusCode != http.StatusOK || body != "second target" {
+		t.Errorf("got %d %q, want 200 from the second target", resp.StatusCode, body)
+	}
+	if n := strings.Count(p.logs(t), "Upstream attempt failed"); n != 2 {
+		t.Errorf("logged %d failed attempts, want 2 against the first target", n)
+	}
+}
+
+// forwardRequest hands the test client a request message as if the server had
+// forwarded it, and returns the response the server wrote for it
+func forwardRequest(t *testing.T, p *testProxy, request map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var clientID string
+	p.server.clientsMutex.RLock()
+	for id := range p.server.clients {
+		clientID = id
+	}
+	p.server.clientsMutex.RUnlock()
+
+	recorder := httptest.NewRecorder()
+	pending := newPendingRequest(httptest.NewRequest(http.MethodGet, "/", nil), recorder, clientID)
+	requestID, _, err := p.server.addPendingRequest(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request["type"] = "request"
+	request["clientId"] = clientID
+	request["requestId"] = requestID
+	data, err := p.client.codec.Encode(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.client.handleMessage(data)
+
+	select {
+	case <-pending.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client never answered the request")
+	}
+	return recorder
+}
+
+func TestHostTargets(t *testing.T) {
+	backend := func(name string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default"))
+	}), func(c *Config) {
+		c.Client.Proxy.HostTargets = map[string]string{
+			"api.example.com":      backend("api"),
+			"web.example.com":      backend("web"),
+			"web.example.com:8443": backend("web-8443"),
+		}
+	})
+
+	for host, want := range map[string]string{
+		"api.example.com":      "api",
+		"API.Example.com":      "api",
+		"web.example.com:8080": "web",
+		"web.example.com:8443": "web-8443",
+		"other.example.com":    "default",
+	} {
+		req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		if _, got := p.do(t, req); got != want {
+			t.Errorf("host %s served by %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestUpstreamRequestNotBuilt(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+	for _, tc := range []struct {
+		name      string
+		method    string
+		url       string
+		wantClass string
+	}{
+		{"invalid URL", http.MethodGet, "/%zz", "invalid_url"},
+		{"invalid method", "NOT VALID", "/", "malformed_request"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := forwardRequest(t, p, map[string]interface{}{"method": tc.method, "url": tc.url})
+			if body := recorder.Body.String(); recorder.Code != http.StatusBadGateway || !strings.Contains(body, `"class":"`+tc.wantClass+`"`) {
+				t.Errorf("got %d %s, want 502 with class %s", recorder.Code, body, tc.wantClass)
+			}
+		})
+	}
+}
+
+func TestRequestWithoutBody(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + strconv.Itoa(len(body))))
+	}), nil)
+
+	for name, request := range map[string]map[string]interface{}{
+		"absent body and headers": {"method": http.MethodGet, "url": "/"},
+		"null body and headers":   {"method": http.MethodGet, "url": "/", "body": nil, "headers": nil},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := forwardRequest(t, p, request)
+			if recorder.Code != http.StatusOK || recorder.Body.String() != "GET 0" {
+				t.Errorf("got %d %q, want 200 GET 0", recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestMalformedRequest(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served"))
+	}), nil)
+
+	for name, request := range map[string]map[string]interface{}{
+		"missing method":     {"url": "/"},
+		"missing URL":        {"method": http.MethodGet},
+		"non-string method":  {"method": 1, "url": "/"},
+		"non-string body":    {"method": http.MethodPost, "url": "/", "body": 42},
+		"non-object headers": {"method": http.MethodGet, "url": "/", "headers": "Accept: */*"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder := forwardRequest(t, p, request)
+			if body := recorder.Body.String(); recorder.Code != http.StatusBadGateway || !strings.Contains(body, `"class":"malformed_request"`) {
+				t.Errorf("got %d %s, want 502 with class malformed_request", recorder.Code, body)
+			}
+		})
+	}
+
+	// A malformed message without a request ID is only logged
+	data, err := p.client.codec.Encode(map[string]interface{}{"type": "request", "url": "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.client.handleMessage(data)
+	p.waitForLog(t, "Malformed request")
+
+	// The client keeps serving requests
+	if resp, body := p.get(t, "/"); resp.StatusCode != http.StatusOK || body != "served" {
+		t.Errorf("got %d %q after malformed requests, want 200 served", resp.StatusCode, body)
+	}
+}
+
+func TestResponseBodyLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configure  func(*Config)
+		bodyBytes  int
+		wantStatus int
+	}{
+		{"under the limit", func(c *Config) { c.Client.Proxy.MaxResponseBodyBytes = 1000 }, 1000, http.StatusOK},
+		{"over the limit", func(c *Config) { c.Client.Proxy.MaxResponseBodyBytes = 1000 }, 1001, http.StatusBadGateway},
+		{"too large for one message", func(c *Config) { c.Transport.MaxFrameBytes = 64 * 1024 }, 256 * 1024, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := strings.Repeat("x", tc.bodyBytes)
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}), tc.configure)
+
+			resp, got := p.get(t, "/")
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK && got != body {
+				t.Errorf("got %d bytes, want %d", len(got), len(body))
+			}
+			if tc.wantStatus != http.StatusOK && !strings.Contains(got, `"class":"response_too_large"`) {
+				t.Errorf("body = %q, want class response_too_large", got)
+			}
+		})
+	}
+}
+
+func TestClassifyUpstreamError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "backend.invalid", IsNotFound: true}, "dns"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection_refused"},
+		{context.DeadlineExceeded, "timeout"},
+		{errors.New("something else"), "unknown"},
+	} {
+		if got := classifyUpstreamError(tc.err); got != tc.want {
+			t.Errorf("classifyUpstreamError(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestUpstreamErrorResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		target    string
+		wantClass string
+	}{
+		{"connection refused", "http://127.0.0.1:1", "connection_refused"},
+		{"unknown host", "http://backend.invalid", "dns"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+				c.Client.Proxy.DefaultTarget = tc.target
+			})
+
+			resp, body := p.get(t, "/")
+			var report struct {
+				Error string `json:"error"`
+				Class string `json:"class"`
+			}
+			if err := json.Unmarshal([]byte(body), &report); err != nil {
+				t.Fatalf("invalid error body %q: %v", body, err)
+			}
+			if resp.StatusCode != http.StatusBadGateway || report.Error != errorCodeUpstream || report.Class != tc.wantClass {
+				t.Errorf("got %d %s, want 502 with class %s", resp.StatusCode, body, tc.wantClass)
+			}
+		})
+	}
+}
+
+func TestUpstreamCanceledAtDeadline(t *testing.T) {
+	canceled := make(chan time.Time, 1)
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- time.Now()
+		case <-time.After(10 * time.Second):
+		}
+	}), func(c *Config) { c.Server.RequestTimeout = 200 })
+
+	// Either the server's timeout or the client's canceled call answers the caller
+	start := time.Now()
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusGatewayTimeout && resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 504 or 502", resp.StatusCode)
+	}
+	select {
+	case at := <-canceled:
+		if elapsed := at.Sub(start); elapsed > time.Second {
+			t.Errorf("upstream call canceled after %v, want soon after the 200ms deadline", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream call was not canceled at the deadline")
+	}
+}
+
+func TestTimeoutBudgetHeader(t *testing.T) {
+	// The upstream fails twice, so the budget is sent with three attempts
+	var budgets []int
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget, err := strconv.Atoi(r.Header.Get("X-Request-Timeout-Ms"))
+		if err != nil {
+			t.Errorf("invalid budget header %q", r.Header.Get("X-Request-Timeout-Ms"))
+		}
+		budgets = append(budgets, budget)
+		if len(budgets) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}), func(c *Config) {
+		c.Server.RequestTimeout = 5000
+		c.Client.Proxy.Retry.MaxAttempts = 3
+		c.Client.Proxy.Retry.BackoffMs = 20
+	})
+
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if len(budgets) != 3 || budgets[0] > 5000 || budgets[0] <= budgets[1] || budgets[1] <= budgets[2] || budgets[2] <= 0 {
+		t.Errorf("budgets = %v, want three decreasing values within 5000ms", budgets)
+	}
+}
+
+func TestTimeoutBudgetHeaderDisabled(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Request-Timeout-Ms")))
+	}), func(c *Config) { c.Client.Proxy.TimeoutHeader = "" })
+
+	if _, body := p.get(t, "/"); body != "" {
+		t.Errorf("upstream received a budget of %q with the header disabled", body)
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes the messages exchanged between the server and its clients. Both
+// ends of a connection must use the same codec.
+type Codec interface {
+	Encode(message map[string]interface{}) ([]byte, error)
+	Decode(data []byte) (map[string]interface{}, error)
+
+	// EncodeBody returns the value a request, response or tunnel body is sent as
+	// in a message, and DecodeBody turns it back into bytes. A missing body
+	// decodes as empty.
+	EncodeBody(body []byte) interface{}
+	DecodeBody(value interface{}) ([]byte, error)
+}
+
+// codecs are the available message codecs by their transport.codec name
+var codecs = map[string]Codec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// newCodec returns the codec with the given name
+func newCodec(name string) (Codec, error) {
+	codec, exists := codecs[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown transport codec %q", name)
+	}
+	return codec, nil
+}
+
+// jsonCodec encodes messages as JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(message map[string]interface{}) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Decode(data []byte) (map[string]interface{}, error) {
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// EncodeBody base64-encodes the body, as JSON has no type for raw bytes
+func (jsonCodec) EncodeBody(body []byte) interface{} {
+	return base64.StdEncoding.EncodeToString(body)
+}
+
+func (jsonCodec) DecodeBody(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{}, nil
+	case string:
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return nil, errors.New("body is not a string")
+}
+
+// msgpackCodec encodes messages as MessagePack, which is smaller and faster to
+// encode and decode than JSON
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(message map[string]interface{}) ([]byte, error) {
+	return msgpack.Marshal(message)
+}
+
+// Decode returns numbers as float64, as the JSON codec does, so message handlers
+// work the same whichever codec is in use
+func (msgpackCodec) Decode(data []byte) (map[string]interface{}, error) {
+	var message map[string]interface{}
+	if err := msgpack.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	for key, value := range message {
+		message[key] = normalizeNumbers(value)
+	}
+	return message, nil
+}
+
+// EncodeBody sends the body as MessagePack binary, avoiding the size and CPU cost
+// of base64
+func (msgpackCodec) EncodeBody(body []byte) interface{} {
+	return body
+}
+
+// DecodeBody accepts binary or, from version 1 peers, base64
+func (msgpackCodec) DecodeBody(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{}, nil
+	case []byte:
+		return v, nil
+	case string:
+		// Peers speaking protocol version 1 base64-encode bodies
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return nil, errors.New("body is not binary")
+}
+
+// normalizeNumbers converts every number in a decoded value to float64
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMessage returns a response message using each type a message field can have
+func testMessage() map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "response",
+		"requestId":  "req-1",
+		"statusCode": float64(200),
+		"seq":        float64(1 << 40),
+		"final":      true,
+		"headers": map[string]interface{}{
+			"Content-Type": []interface{}{"text/plain"},
+			"Set-Cookie":   []interface{}{"a=1", "b=2"},
+		},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Encode(testMessage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := codec.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := testMessage(); !reflect.DeepEqual(message, want) {
+				t.Errorf("decoded %#v, want %#v", message, want)
+			}
+		})
+	}
+}
+
+func TestCodecThroughProxy(t *testing.T) {
+	for name := range codecs {
+		t.Run(name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello from " + r.URL.Path))
+			}), func(c *Config) { c.Transport.Codec = name })
+
+			resp, body := p.get(t, "/codec")
+			if resp.StatusCode != http.StatusOK || body != "hello from /codec" {
+				t.Errorf("got %d %q, want 200 hello from /codec", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestCodecMismatch(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Transport.Codec = "msgpack" })
+	config := newTestConfig(t)
+	config.Transport.Codec = "json"
+	p.connectClient(t, config)
+
+	p.waitForLog(t, "Failed to decode message")
+	if p.server.registeredClients() != 0 {
+		t.Error("a client using another codec registered")
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	message := testMessage()
+	message["body"] = strings.Repeat("x", 1024)
+	for name, codec := range codecs {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				data, err := codec.Encode(message)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// binaryBody returns a body containing every byte value, which is not valid UTF-8
+func binaryBody() []byte {
+	body := make([]byte, 0, 4*256)
+	for i := 0; i < 4; i++ {
+		for b := 0; b < 256; b++ {
+			body = append(body, byte(b))
+		}
+	}
+	return body
+}
+
+func TestCodecBodyRoundTrip(t *testing.T) {
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			for _, body := range [][]byte{{}, binaryBody()} {
+				data, err := codec.Encode(map[string]interface{}{"type": "response", "body": codec.EncodeBody(body)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				message, err := codec.Decode(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := codec.DecodeBody(message["body"])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, body) {
+					t.Errorf("decoded %d bytes, want the %d byte body", len(got), len(body))
+				}
+			}
+		})
+	}
+}
+
+func TestBinaryBodyThroughProxy(t *testing.T) {
+	body := binaryBody()
+	for name := range codecs {
+		t.Run(name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received, _ := io.ReadAll(r.Body)
+				if !bytes.Equal(received, body) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write(received)
+			}), func(c *Config) { c.Transport.Codec = name })
+
+			req, err := http.NewRequest(http.MethodPost, p.url+"/", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, got := p.do(t, req)
+			if resp.StatusCode != http.StatusOK || got != string(body) {
+				t.Errorf("got %d with %d bytes, want 200 echoing the %d byte body", resp.StatusCode, len(got), len(body))
+			}
+		})
+	}
+}
+
+func BenchmarkCodecBody(b *testing.B) {
+	body := bytes.Repeat(binaryBody(), 64)
+	for name, codec := range codecs {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for b.Loop() {
+				data, err := codec.Encode(map[string]interface{}{"type": "response", "body": codec.EncodeBody(body)})
+				if err != nil {
+					b.Fatal(err)
+				}
+				message, err := codec.Decode(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.DecodeBody(message["body"]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(mustEncode(b, codec, body)))/float64(len(body)), "wire/body")
+		})
+	}
+}
+
+// mustEncode encodes a message carrying body
+func mustEncode(b *testing.B, codec Codec, body []byte) []byte {
+	b.Helper()
+	data, err := codec.Encode(map[string]interface{}{"body": codec.EncodeBody(body)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errNoCapacity is returned when every client that could serve a request stayed
+// at its concurrency limit for as long as the request could wait
+var errNoCapacity = errors.New("no client capacity available")
+
+// capacitySignal wakes requests waiting for a client slot whenever one may have
+// become available
+type capacitySignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel closed at the next notify
+func (c *capacitySignal) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		c.ch = make(chan struct{})
+	}
+	return c.ch
+}
+
+// notify wakes every current waiter
+func (c *capacitySignal) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil {
+		close(c.ch)
+		c.ch = nil
+	}
+}
+
+// hasCapacity reports whether the client is below the concurrency limit it
+// advertised; 0 means it has none
+func (info *ClientInfo) hasCapacity() bool {
+	limit := info.maxConcurrency.Load()
+	return limit == 0 || info.inFlight.Load() < limit
+}
+
+// reserve claims one of the client's request slots, reporting false if it is
+// already at its concurrency limit
+func (info *ClientInfo) reserve() bool {
+	for {
+		inFlight := info.inFlight.Load()
+		if limit := info.maxConcurrency.Load(); limit > 0 && inFlight >= limit {
+			return false
+		}
+		if info.inFlight.CompareAndSwap(inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+// acquireClient selects a client for the request and reserves one of its slots.
+// If every client that could serve the request is at its concurrency limit, it
+// waits for one to free up, for at most the request timeout. It returns a nil
+// client, and errNoCapacity if the wait timed out, when none can be had.
+func (s *ProxyServer) acquireClient(r *http.Request, rt *route) (string, *ClientInfo, error) {
+	timeout := time.NewTimer(s.requestTimeout(rt))
+	defer timeout.Stop()
+
+	for {
+		// Taken before selecting so a slot freed in between isn't missed
+		freed := s.capacityFreed.wait()
+
+		clientID, client := s.selectClient(r, rt)
+		if client != nil {
+			if client.reserve() {
+				return clientID, client, nil
+			}
+			// Another request took the last slot first
+			continue
+		}
+		if !s.clientsSaturated(rt) {
+			return "", nil, nil
+		}
+
+		select {
+		case <-freed:
+		case <-timeout.C:
+			return "", nil, errNoCapacity
+		case <-r.Context().Done():
+			return "", nil, r.Context().Err()
+		}
+	}
+}
+
+// releaseClient frees the slot a request held on its client
+func (s *ProxyServer) releaseClient(client *ClientInfo) {
+	client.inFlight.Add(-1)
+	s.capacityFreed.notify()
+}
+
+// clientsSaturated reports whether a client could serve requests on the route
+// but for its concurrency limit
+func (s *ProxyServer) clientsSaturated(rt *route) bool {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	for _, info := range s.clients {
+		if info.registered && info.healthy && !info.draining && rt.accepts(info) && !info.hasCapacity() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,616 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config holds all configuration settings
+type Config struct {
+	Server struct {
+		HTTP struct {
+			Host string `json:"host"`
+			Port int    `json:"port"`
+			SSL  struct {
+				Enabled           bool     `json:"enabled"`
+				Key               string   `json:"key"`
+				Cert              string   `json:"cert"`
+				MinVersion        string   `json:"minVersion"`
+				CipherSuites      []string `json:"cipherSuites"`
+				ForwardInfo       bool     `json:"forwardInfo"`
+				RequestClientCert bool     `json:"requestClientCert"`
+			} `json:"ssl"`
+			Listeners []struct {
+				Host            string `json:"host"`
+				Port            int    `json:"port"`
+				TLS             bool   `json:"tls"`
+				RedirectToHTTPS bool   `json:"redirectToHttps"`
+			} `json:"listeners"`
+			Timeouts struct {
+				ReadHeader int `json:"readHeader"`
+				Read       int `json:"read"`
+				Write      int `json:"write"`
+				Idle       int `json:"idle"`
+			} `json:"timeouts"`
+			H2C bool `json:"h2c"`
+		} `json:"http"`
+		Socket struct {
+			Network string `json:"network"`
+			Host    string `json:"host"`
+			Port    int    `json:"port"`
+			Path    string `json:"path"`
+			SSL     struct {
+				Enabled           bool     `json:"enabled"`
+				Key               string   `json:"key"`
+				Cert              string   `json:"cert"`
+				ClientCA          string   `json:"clientCa"`
+				RequireClientCert bool     `json:"requireClientCert"`
+				MinVersion        string   `json:"minVersion"`
+				CipherSuites      []string `json:"cipherSuites"`
+			} `json:"ssl"`
+			DrainTimeout           int    `json:"drainTimeout"`
+			ReadBufferSize         int    `json:"readBufferSize"`
+			MaxConnsPerIP          int    `json:"maxConnsPerIp"`
+			IdleTimeout            int    `json:"idleTimeout"`
+			ReadTimeout            int    `json:"readTimeout"`
+			WriteTimeout           int    `json:"writeTimeout"`
+			ReusePort              bool   `json:"reusePort"`
+			OutboundQueueSize      int    `json:"outboundQueueSize"`
+			OutboundOverflowPolicy string `json:"outboundOverflowPolicy"`
+		} `json:"socket"`
+		StreamingThresholdBytes     int64    `json:"streamingThresholdBytes"`
+		StreamContentTypes          []string `json:"streamContentTypes"`
+		CertReloadInterval          int      `json:"certReloadInterval"`
+		MaxRequestBodyBytes         int64    `json:"maxRequestBodyBytes"`
+		MinBodyReadRate             int64    `json:"minBodyReadRate"`
+		MaxHeaderCount              int      `json:"maxHeaderCount"`
+		MaxHeaderBytes              int      `json:"maxHeaderBytes"`
+		MaxURLLength                int      `json:"maxUrlLength"`
+		AllowConnect                bool     `json:"allowConnect"`
+		ConnectAllowedHosts         []string `json:"connectAllowedHosts"`
+		AllowClientPinning          bool     `json:"allowClientPinning"`
+		ForwardConnectionInfo       bool     `json:"forwardConnectionInfo"`
+		RequestTimeout              int      `json:"requestTimeout"`
+		MaxRequestTimeout           int      `json:"maxRequestTimeout"`
+		PendingRequestWarnThreshold int      `json:"pendingRequestWarnThreshold"`
+		MaxPendingRequests          int      `json:"maxPendingRequests"`
+		PendingOverflowPolicy       string   `json:"pendingOverflowPolicy"`
+		MaxConcurrentRequests       int      `json:"maxConcurrentRequests"`
+		ExpectContinue              string   `json:"expectContinue"`
+		Compression                 struct {
+			Enabled   bool `json:"enabled"`
+			Threshold int  `json:"threshold"`
+		} `json:"compression"`
+		ResponseCompression struct {
+			Enabled  bool `json:"enabled"`
+			MinBytes int  `json:"minBytes"`
+		} `json:"responseCompression"`
+		PerClientRateLimit struct {
+			RequestsPerSecond float64 `json:"requestsPerSecond"`
+			Burst             int     `json:"burst"`
+			MaxWait           int     `json:"maxWait"`
+		} `json:"perClientRateLimit"`
+		ResponseHeaderRules []struct {
+			Action string `json:"action"`
+			Name   string `json:"name"`
+			Value  string `json:"value"`
+		} `json:"responseHeaderRules"`
+		Cache struct {
+			Enabled      bool `json:"enabled"`
+			MaxEntries   int  `json:"maxEntries"`
+			MaxBodyBytes int  `json:"maxBodyBytes"`
+		} `json:"cache"`
+		Health struct {
+			Path string `json:"path"`
+		} `json:"health"`
+		Ping struct {
+			Path string `json:"path"`
+		} `json:"ping"`
+		Metrics struct {
+			Path string `json:"path"`
+		} `json:"metrics"`
+		Shutdown struct {
+			Timeout        int `json:"timeout"`
+			ReconnectAfter int `json:"reconnectAfter"`
+		} `json:"shutdown"`
+		Routes []struct {
+			Host        string   `json:"host"`
+			PathPrefix  string   `json:"pathPrefix"`
+			StripPrefix bool     `json:"stripPrefix"`
+			ClientTags  []string `json:"clientTags"`
+			Timeout     int      `json:"timeout"`
+		} `json:"routes"`
+		Routing struct {
+			RequireRoute   bool `json:"requireRoute"`
+			NoRouteStatus  int  `json:"noRouteStatus"`
+			NoClientStatus int  `json:"noClientStatus"`
+		} `json:"routing"`
+		NoClientsResponse struct {
+			Status      int    `json:"status"`
+			ContentType string `json:"contentType"`
+			Body        string `json:"body"`
+			BodyFile    string `json:"bodyFile"`
+		} `json:"noClientsResponse"`
+		Allow struct {
+			Methods []string `json:"methods"`
+			Paths   []string `json:"paths"`
+		} `json:"allow"`
+		StickySession struct {
+			CookieName string `json:"cookieName"`
+			TTL        int    `json:"ttl"`
+		} `json:"stickySession"`
+		LoadBalancing struct {
+			Strategy string `json:"strategy"`
+		} `json:"loadBalancing"`
+		Startup struct {
+			ReadyPath     string `json:"readyPath"`
+			RequireClient bool   `json:"requireClient"`
+			Timeout       int    `json:"timeout"`
+		} `json:"startup"`
+		WaitForClients struct {
+			Count   int    `json:"count"`
+			Timeout int    `json:"timeout"`
+			Mode    string `json:"mode"`
+		} `json:"waitForClients"`
+		Admin struct {
+			Enabled bool   `json:"enabled"`
+			Token   string `json:"token"`
+		} `json:"admin"`
+		ErrorFormat  string `json:"errorFormat"`
+		ErrorDetails struct {
+			TrustedCIDRs []string `json:"trustedCidrs"`
+			Header       string   `json:"header"`
+			Token        string   `json:"token"`
+		} `json:"errorDetails"`
+	} `json:"server"`
+	Client struct {
+		Server struct {
+			Network string `json:"network"`
+			Host    string `json:"host"`
+			Port    int    `json:"port"`
+			Path    string `json:"path"`
+			SSL     struct {
+				Enabled            bool     `json:"enabled"`
+				CA                 string   `json:"ca"`
+				RejectUnauthorized bool     `json:"rejectUnauthorized"`
+				Cert               string   `json:"cert"`
+				Key                string   `json:"key"`
+				MinVersion         string   `json:"minVersion"`
+				CipherSuites       []string `json:"cipherSuites"`
+			} `json:"ssl"`
+			DrainTimeout int `json:"drainTimeout"`
+			ReadTimeout  int `json:"readTimeout"`
+			WriteTimeout int `json:"writeTimeout"`
+		} `json:"server"`
+		Proxy struct {
+			DefaultTarget       string            `json:"defaultTarget"`
+			Targets             []string          `json:"targets"`
+			HostTargets         map[string]string `json:"hostTargets"`
+			AttemptsPerTarget   int               `json:"attemptsPerTarget"`
+			ConnectAllowedHosts []string          `json:"connectAllowedHosts"`
+			Retry               struct {
+				MaxAttempts        int   `json:"maxAttempts"`
+				RetryOnStatuses    []int `json:"retryOnStatuses"`
+				BackoffMs          int   `json:"backoffMs"`
+				AllowNonIdempotent bool  `json:"allowNonIdempotent"`
+			} `json:"retry"`
+			MaxResponseBodyBytes   int64  `json:"maxResponseBodyBytes"`
+			MaxResponseHeaderCount int    `json:"maxResponseHeaderCount"`
+			MaxResponseHeaderBytes int    `json:"maxResponseHeaderBytes"`
+			TimeoutHeader          string `json:"timeoutHeader"`
+			AccessLog              bool   `json:"accessLog"`
+			Transport              struct {
+				DialTimeout           int `json:"dialTimeout"`
+				ResponseHeaderTimeout int `json:"responseHeaderTimeout"`
+				MaxIdleConnsPerHost   int `json:"maxIdleConnsPerHost"`
+				IdleConnTimeout       int `json:"idleConnTimeout"`
+			} `json:"transport"`
+			SSL struct {
+				RejectUnauthorized bool     `json:"rejectUnauthorized"`
+				ServerName         string   `json:"serverName"`
+				CA                 string   `json:"ca"`
+				MinVersion         string   `json:"minVersion"`
+				CipherSuites       []string `json:"cipherSuites"`
+			} `json:"ssl"`
+			RewriteRules []struct {
+				Pattern     string `json:"pattern"`
+				Replacement string `json:"replacement"`
+				Target      string `json:"target"`
+			} `json:"rewriteRules"`
+			HeaderRules []struct {
+				Action string `json:"action"`
+				Name   string `json:"name"`
+				Value  string `json:"value"`
+			} `json:"headerRules"`
+		} `json:"proxy"`
+		ReadBufferSize int      `json:"readBufferSize"`
+		Weight         int      `json:"weight"`
+		MaxConcurrency int      `json:"maxConcurrency"`
+		ID             string   `json:"id"`
+		Tags           []string `json:"tags"`
+		Compression    struct {
+			Enabled   bool `json:"enabled"`
+			Threshold int  `json:"threshold"`
+		} `json:"compression"`
+		Health struct {
+			FailureThreshold int `json:"failureThreshold"`
+			ProbeInterval    int `json:"probeInterval"`
+		} `json:"health"`
+	} `json:"client"`
+	Reconnection struct {
+		Delay int `json:"delay"`
+	} `json:"reconnection"`
+	Tracing struct {
+		Enabled     bool    `json:"enabled"`
+		Endpoint    string  `json:"endpoint"`
+		ServiceName string  `json:"serviceName"`
+		SampleRatio float64 `json:"sampleRatio"`
+	} `json:"tracing"`
+	Transport struct {
+		Codec            string `json:"codec"`
+		MaxFrameBytes    int    `json:"maxFrameBytes"`
+		MaxInflatedBytes int    `json:"maxInflatedBytes"`
+	} `json:"transport"`
+	Logging struct {
+		Level            string   `json:"level"`
+		Format           string   `json:"format"`
+		File             string   `json:"file"`
+		MaxEntryBytes    int      `json:"maxEntryBytes"`
+		AccessLog        bool     `json:"accessLog"`
+		DeadLetter       bool     `json:"deadLetter"`
+		RedactHeaders    []string `json:"redactHeaders"`
+		RotationInterval string   `json:"rotationInterval"`
+		MaxAgeDays       int      `json:"maxAgeDays"`
+		Syslog           struct {
+			Enabled  bool   `json:"enabled"`
+			Network  string `json:"network"`
+			Address  string `json:"address"`
+			Facility string `json:"facility"`
+			Tag      string `json:"tag"`
+		} `json:"syslog"`
+	} `json:"logging"`
+
+	// reloadMutex guards the reloadable settings while ReloadConfig changes them.
+	// Code serving requests reads them through live rather than directly.
+	reloadMutex sync.RWMutex
+}
+
+// DefaultConfig returns the default configuration
+func DefaultConfig() *Config {
+	config := &Config{}
+
+	// Server HTTP settings
+	config.Server.HTTP.Host = "0.0.0.0"
+	config.Server.HTTP.Port = 8080
+	config.Server.HTTP.SSL.Enabled = false
+	config.Server.HTTP.SSL.Key = "server.key"
+	config.Server.HTTP.SSL.Cert = "server.crt"
+	config.Server.HTTP.SSL.MinVersion = "1.2"
+
+	// Forward the caller's TLS details to upstreams as X-SSL-* headers
+	config.Server.HTTP.SSL.ForwardInfo = false
+	config.Server.HTTP.SSL.RequestClientCert = false
+
+	// Limits on HTTP connections, in milliseconds (0 means no limit): reading the
+	// request headers, reading the whole request, writing the response, and waiting
+	// for the next request on a keep-alive connection. Reads and writes are left
+	// unlimited so large uploads and streamed responses aren't cut off.
+	config.Server.HTTP.Timeouts.ReadHeader = 10000
+	config.Server.HTTP.Timeouts.Read = 0
+	config.Server.HTTP.Timeouts.Write = 0
+	config.Server.HTTP.Timeouts.Idle = 120000
+
+	// Accept HTTP/2 without TLS (h2c) on plain listeners, for gRPC callers that
+	// don't use TLS. TLS listeners negotiate HTTP/2 regardless.
+	config.Server.HTTP.H2C = false
+
+	// Server Socket settings ("tcp" uses host and port, "unix" uses path)
+	config.Server.Socket.Network = "tcp"
+	config.Server.Socket.Host = "0.0.0.0"
+	config.Server.Socket.Port = 8081
+	config.Server.Socket.Path = ""
+	config.Server.Socket.SSL.Enabled = false
+	config.Server.Socket.SSL.Key = "server.key"
+	config.Server.Socket.SSL.Cert = "server.crt"
+	config.Server.Socket.SSL.ClientCA = "ca.crt"
+	config.Server.Socket.SSL.RequireClientCert = false
+	config.Server.Socket.SSL.MinVersion = "1.2"
+
+	// How often certificate files are checked for changes, in milliseconds (0 disables)
+	config.Server.CertReloadInterval = 60000
+	config.Server.Socket.DrainTimeout = 5000
+	config.Server.Socket.ReadBufferSize = 32 * 1024
+
+	// Socket connections allowed from one remote IP (0 means unlimited)
+	config.Server.Socket.MaxConnsPerIP = 0
+
+	// Close client connections with no traffic for this long, in milliseconds (0 disables)
+	config.Server.Socket.IdleTimeout = 0
+
+	// How long a frame may take to arrive once it has started, and a write of one
+	// may take, in milliseconds (0 means no limit); the connection is closed after
+	config.Server.Socket.ReadTimeout = 60000
+	config.Server.Socket.WriteTimeout = 60000
+
+	// Let several server processes share the HTTP and socket ports via SO_REUSEPORT
+	config.Server.Socket.ReusePort = false
+
+	// Frames that may wait to be written to each client, and what happens to new
+	// requests for a client whose queue is full: "block" waits for room, "reject"
+	// answers 503
+	config.Server.Socket.OutboundQueueSize = 256
+	config.Server.Socket.OutboundOverflowPolicy = "block"
+
+	// Responses larger than this are streamed rather than buffered (0 disables streaming)
+	config.Server.StreamingThresholdBytes = 1024 * 1024
+
+	// Responses of these content types are always streamed, however small, such as
+	// "video/*" or "application/octet-stream"
+	config.Server.StreamContentTypes = []string{}
+
+	// Time to wait for a client response, in milliseconds
+	config.Server.RequestTimeout = 30000
+
+	// Longest timeout a caller may ask for with X-Proxy-Timeout-Ms, in milliseconds
+	// (0 ignores the header)
+	config.Server.MaxRequestTimeout = 0
+
+	// Log a warning when this many requests are waiting for clients (0 disables it)
+	config.Server.PendingRequestWarnThreshold = 1000
+
+	// Cap on requests waiting for clients (0 means unlimited) and what happens to a
+	// new request at the cap: "reject" it with 503, or "evict-oldest" with 504
+	config.Server.MaxPendingRequests = 0
+	config.Server.PendingOverflowPolicy = "reject"
+
+	// Requests beyond this many in flight get 503 (0 means unlimited)
+	config.Server.MaxConcurrentRequests = 0
+
+	// How to answer Expect: 100-continue: "continue" once the request is accepted,
+	// or "reject" with 417
+	config.Server.ExpectContinue = "continue"
+
+	// Requests per second dispatched to any one client (0 disables), the burst it may
+	// take at once, and how long a request waits for its turn before 503, in milliseconds
+	config.Server.PerClientRateLimit.RequestsPerSecond = 0
+	config.Server.PerClientRateLimit.Burst = 10
+	config.Server.PerClientRateLimit.MaxWait = 1000
+
+	// Tunnel compression, used only when the client also enables it
+	config.Server.Compression.Enabled = false
+	config.Server.Compression.Threshold = 1024
+
+	// Gzip buffered responses for callers that accept it
+	config.Server.ResponseCompression.Enabled = false
+	config.Server.ResponseCompression.MinBytes = 1024
+
+	// In-memory cache of GET responses that the upstream marks as cacheable
+	config.Server.Cache.Enabled = false
+	config.Server.Cache.MaxEntries = 1000
+	config.Server.Cache.MaxBodyBytes = 1024 * 1024
+
+	// Health endpoint served by the proxy itself, such as "/healthz". It hides any
+	// upstream path of the same name, so it is off unless a path is set.
+	config.Server.Health.Path = ""
+
+	// Liveness endpoint that answers "pong" whether or not any client is connected
+	// (empty disables it)
+	config.Server.Ping.Path = "/__ping"
+
+	// Metrics endpoint in the Prometheus text format, such as "/metrics". It is
+	// unauthenticated and hides any upstream path of the same name, so it is off
+	// unless a path is set.
+	config.Server.Metrics.Path = ""
+
+	// On SIGINT or SIGTERM, how long in-flight requests get to finish and how long
+	// clients are asked to wait before reconnecting, in milliseconds
+	config.Server.Shutdown.Timeout = 10000
+	config.Server.Shutdown.ReconnectAfter = 5000
+
+	// Session affinity (an empty cookie name disables it)
+	config.Server.StickySession.CookieName = ""
+	config.Server.StickySession.TTL = 3600000
+
+	// Client selection: "first" healthy client, "least-connections" or "weighted-round-robin"
+	config.Server.LoadBalancing.Strategy = "first"
+
+	// Statuses returned when a request matches no route (only rejected when
+	// requireRoute is set) and when no client can serve it
+	config.Server.Routing.RequireRoute = false
+	config.Server.Routing.NoRouteStatus = 404
+	config.Server.Routing.NoClientStatus = 503
+
+	// Startup checks gating the readiness endpoint, such as "/readyz". It hides any
+	// upstream path of the same name, so it is off unless a path is set.
+	config.Server.Startup.ReadyPath = ""
+	config.Server.Startup.RequireClient = false
+	config.Server.Startup.Timeout = 60000
+
+	// Clients that must register before proxied requests are served (0 disables
+	// the wait), the longest wait in milliseconds, and whether requests meanwhile
+	// are held ("hold") or answered with 503 and Retry-After ("reject")
+	config.Server.WaitForClients.Count = 0
+	config.Server.WaitForClients.Timeout = 30000
+	config.Server.WaitForClients.Mode = "hold"
+
+	// Errors the proxy writes itself are plain "text", or a "json" envelope with a
+	// code and the request ID
+	config.Server.ErrorFormat = "text"
+
+	// Detailed error messages are only shown to trusted callers
+	config.Server.ErrorDetails.Header = "X-Proxy-Debug-Token"
+
+	// Admin endpoints are served only when enabled and a token is set
+	config.Server.Admin.Enabled = false
+	config.Server.Admin.Token = ""
+
+	// Body size limits (0 means unlimited)
+	config.Server.MaxRequestBodyBytes = 0
+
+	// Request bodies arriving slower than this many bytes per second, after the
+	// first second, get 408 (0 disables the check)
+	config.Server.MinBodyReadRate = 0
+
+	// CONNECT tunnels through clients are refused unless allowed, and then only to
+	// these destinations: "host:port", where the host may be "*" or "*.example.com"
+	// and the port may be "*"
+	config.Server.AllowConnect = false
+	config.Server.ConnectAllowedHosts = []string{"*:443"}
+
+	// Let callers with the admin token send a request to a given client with the
+	// X-Proxy-Client header, bypassing the load balancer
+	config.Server.AllowClientPinning = false
+
+	// Pass the caller's source port and connection ID on to upstreams
+	config.Server.ForwardConnectionInfo = false
+
+	// Header limits; requests beyond them get 431. They are off (0) unless set,
+	// such as to 200 values and 64 KiB, so existing traffic is never refused.
+	config.Server.MaxHeaderCount = 0
+	config.Server.MaxHeaderBytes = 0
+
+	// Longest request target, path and query included, before requests get 414. It
+	// is off (0) unless set, such as to 8 KiB, so existing traffic is never refused.
+	config.Server.MaxURLLength = 0
+
+	// Client Server settings
+	config.Client.Server.Network = "tcp"
+	config.Client.Server.Host = "localhost"
+	config.Client.Server.Port = 8081
+	config.Client.Server.Path = ""
+	config.Client.Server.SSL.Enabled = false
+	config.Client.Server.SSL.CA = "ca.crt"
+	config.Client.Server.SSL.RejectUnauthorized = true
+	config.Client.Server.SSL.MinVersion = "1.2"
+	config.Client.Server.DrainTimeout = 5000
+	config.Client.Server.ReadTimeout = 60000
+	config.Client.Server.WriteTimeout = 60000
+
+	// Client Proxy settings
+	config.Client.Proxy.DefaultTarget = "http://localhost:8080"
+	config.Client.Proxy.AttemptsPerTarget = 1
+
+	// Destinations this client opens CONNECT tunnels to, in the same form as
+	// server.connectAllowedHosts; the server's list is checked first
+	config.Client.Proxy.ConnectAllowedHosts = []string{"*:443"}
+
+	// Retries of transient upstream failures; only idempotent methods unless allowed.
+	// A single attempt means no retries, so they are off unless maxAttempts is raised.
+	config.Client.Proxy.Retry.MaxAttempts = 1
+	config.Client.Proxy.Retry.RetryOnStatuses = []int{502, 503}
+	config.Client.Proxy.Retry.BackoffMs = 100
+	config.Client.Proxy.Retry.AllowNonIdempotent = false
+	config.Client.Proxy.SSL.RejectUnauthorized = true
+	config.Client.Proxy.SSL.MinVersion = "1.2"
+	config.Client.Proxy.MaxResponseBodyBytes = 0
+
+	// Limits on upstream response headers, answered with 502 when exceeded; off (0)
+	// unless set, like the server's request header limits
+	config.Client.Proxy.MaxResponseHeaderCount = 0
+	config.Client.Proxy.MaxResponseHeaderBytes = 0
+
+	config.Client.Proxy.TimeoutHeader = "X-Request-Timeout-Ms"
+
+	// Log every upstream request with its status and duration (off by default)
+	config.Client.Proxy.AccessLog = false
+
+	// Upstream transport settings (durations in milliseconds, 0 means no limit)
+	config.Client.Proxy.Transport.DialTimeout = 10000
+	config.Client.Proxy.Transport.ResponseHeaderTimeout = 30000
+	config.Client.Proxy.Transport.MaxIdleConnsPerHost = 32
+	config.Client.Proxy.Transport.IdleConnTimeout = 90000
+
+	// Size of the buffer used to read from the server connection
+	config.Client.ReadBufferSize = 32 * 1024
+
+	// Share of traffic this client asks for under weighted-round-robin
+	config.Client.Weight = 1
+
+	// Most requests this client asks the server to send it at once (0 means unlimited)
+	config.Client.MaxConcurrency = 0
+
+	// Stable ID the server knows this client by; empty lets the server assign one per connection
+	config.Client.ID = ""
+
+	// Labels reported to the server, matched against route clientTags and shown in its client list
+	config.Client.Tags = []string{}
+
+	// Client tunnel compression
+	config.Client.Compression.Enabled = false
+	config.Client.Compression.Threshold = 1024
+
+	// Client health settings
+	config.Client.Health.FailureThreshold = 3
+	config.Client.Health.ProbeInterval = 5000
+
+	// Reconnection settings
+	config.Reconnection.Delay = 5000
+
+	// Tracing settings (spans are exported over OTLP/HTTP when enabled)
+	config.Tracing.Enabled = false
+	config.Tracing.Endpoint = "http://localhost:4318"
+	config.Tracing.ServiceName = "reverse-proxy"
+	config.Tracing.SampleRatio = 1
+
+	// Encoding of messages between server and clients ("json" or "msgpack"); both ends must match
+	config.Transport.Codec = "json"
+
+	// Largest message either end accepts, as sent and once decompressed (0 means no
+	// limit). Request bodies are sent in one message, so this also caps their size.
+	config.Transport.MaxFrameBytes = 64 * 1024 * 1024
+	config.Transport.MaxInflatedBytes = 64 * 1024 * 1024
+
+	// Logging settings
+	config.Logging.Level = "info"
+	config.Logging.File = "proxy.log"
+	config.Logging.Format = FormatJSON
+	config.Logging.MaxEntryBytes = 0
+	config.Logging.AccessLog = false
+
+	// Log every request that could not be delivered to any client
+	config.Logging.DeadLetter = false
+
+	// Start a new log file every day or hour ("none", "daily" or "hourly"), and
+	// delete rotated files older than this many days (0 keeps them all)
+	config.Logging.RotationInterval = RotationNone
+	config.Logging.MaxAgeDays = 0
+
+	// Header values that are never written to the log
+	config.Logging.RedactHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+	// Also send entries to syslog; an empty network means the local daemon
+	config.Logging.Syslog.Enabled = false
+	config.Logging.Syslog.Network = ""
+	config.Logging.Syslog.Address = ""
+	config.Logging.Syslog.Facility = "local0"
+	config.Logging.Syslog.Tag = "reverse-proxy"
+
+	return config
+}
+
+// LoadConfig loads configuration from a JSON or YAML file, chosen by extension.
+// YAML is converted to JSON first so both formats share the struct's json tags.
+// A path of "-" reads JSON from standard input, and an http:// or https:// URL
+// is fetched, its format chosen by the response's Content-Type.
+func LoadConfig(path string, config *Config) error {
+	data, isYAML, err := readConfigSource(path)
+	if err != nil {
+		return err
+	}
+
+	if isYAML {
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigDecode, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("%w: %w", ErrConfigDecode, err)
+	}
+
+	return checkListenerForms(data)
+}
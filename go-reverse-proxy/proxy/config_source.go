@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// configStdin is the configuration path that reads JSON from standard input
+const configStdin = "-"
+
+// configFetchTimeout bounds fetching the configuration over HTTP, body included
+const configFetchTimeout = 10 * time.Second
+
+// isConfigURL reports whether a configuration path is fetched over HTTP
+func isConfigURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// readConfigSource returns the configuration at path: standard input for "-",
+// the body of a GET for an http:// or https:// URL, and otherwise the named
+// file. It also reports whether the data is YAML rather than JSON.
+func readConfigSource(path string) ([]byte, bool, error) {
+	switch {
+	case path == configStdin:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %w", ErrConfigRead, err)
+		}
+		return data, false, nil
+	case isConfigURL(path):
+		return fetchConfig(path, configFetchTimeout)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, fmt.Errorf("%w: %w", ErrConfigNotFound, err)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrConfigRead, err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return data, true, nil
+	}
+	return data, false, nil
+}
+
+// fetchConfig downloads the configuration from url, giving up after timeout. The
+// format is taken from the response's Content-Type, so a server answering with an
+// HTML error page or similar is refused rather than decoded.
+func fetchConfig(url string, timeout time.Duration) ([]byte, bool, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrConfigRead, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, fmt.Errorf("%w: %s returned %s", ErrConfigNotFound, url, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("%w: %s returned %s", ErrConfigRead, url, resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var isYAML bool
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+	case mediaType == "application/yaml" || mediaType == "application/x-yaml" || mediaType == "text/yaml":
+		isYAML = true
+	default:
+		return nil, false, fmt.Errorf("%w: %s returned content type %q, not JSON or YAML", ErrConfigDecode, url, resp.Header.Get("Content-Type"))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrConfigRead, err)
+	}
+	return data, isYAML, nil
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeNamedConfig writes contents to a file called name in a temporary directory
+// and returns its path
+func writeNamedConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadConfig loads the configuration at path over the defaults
+func loadConfig(t *testing.T, path string) (*Config, error) {
+	t.Helper()
+	config := DefaultConfig()
+	err := LoadConfig(path, config)
+	return config, err
+}
+
+const jsonConfig = `{
+	"server": {
+		"requestTimeout": 1234,
+		"http": {"host": "127.0.0.1", "port": 9999},
+		"routes": [{"host": "api.example.com", "pathPrefix": "/api", "stripPrefix": true, "clientTags": ["blue"]}]
+	},
+	"client": {
+		"proxy": {
+			"defaultTarget": "http://backend:8080",
+			"hostTargets": {"web.example.com": "http://web:8080"},
+			"rewriteRules": [{"pattern": "^/old/", "replacement": "/new/", "target": "path"}]
+		}
+	},
+	"logging": {"level": "warn", "redactHeaders": ["Authorization"]}
+}`
+
+const yamlConfig = `
+server:
+  requestTimeout: 1234
+  http:
+    host: 127.0.0.1
+    port: 9999
+  routes:
+    - host: api.example.com
+      pathPrefix: /api
+      stripPrefix: true
+      clientTags: [blue]
+client:
+  proxy:
+    defaultTarget: http://backend:8080
+    hostTargets:
+      web.example.com: http://web:8080
+    rewriteRules:
+      - pattern: ^/old/
+        replacement: /new/
+        target: path
+logging:
+  level: warn
+  redactHeaders:
+    - Authorization
+`
+
+func TestLoadConfigFormats(t *testing.T) {
+	want, err := loadConfig(t, writeNamedConfig(t, "config.json", jsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Server.RequestTimeout != 1234 || want.Client.Proxy.RewriteRules[0].Target != "path" {
+		t.Fatalf("JSON configuration not applied: %+v", want.Server)
+	}
+
+	for _, name := range []string{"config.yaml", "config.yml", "CONFIG.YAML"} {
+		t.Run(name, func(t *testing.T) {
+			got, err := loadConfig(t, writeNamedConfig(t, name, yamlConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("YAML loaded %+v, want the same as JSON %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDefaultsToJSON(t *testing.T) {
+	if _, err := loadConfig(t, writeNamedConfig(t, "proxy.conf", jsonConfig)); err != nil {
+		t.Errorf("JSON with an unknown extension: %v", err)
+	}
+	if _, err := loadConfig(t, writeNamedConfig(t, "proxy.conf", yamlConfig)); !errors.Is(err, ErrConfigDecode) {
+		t.Errorf("YAML with an unknown extension: err = %v, want ErrConfigDecode", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path func(t *testing.T) string
+		want error
+	}{
+		{"missing file", func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing.json") }, ErrConfigNotFound},
+		{"unreadable file", func(t *testing.T) string { return t.TempDir() }, ErrConfigRead},
+		{"invalid JSON", func(t *testing.T) string { return writeNamedConfig(t, "config.json", "{") }, ErrConfigDecode},
+		{"invalid YAML", func(t *testing.T) string { return writeNamedConfig(t, "config.yaml", "server: [") }, ErrConfigDecode},
+		{"wrong type in YAML", func(t *testing.T) string {
+			return writeNamedConfig(t, "config.yaml", "server:\n  requestTimeout: soon\n")
+		}, ErrConfigDecode},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := loadConfig(t, tc.path(t)); !errors.Is(err, tc.want) {
+				t.Errorf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrorsKeepCause(t *testing.T) {
+	if _, err := loadConfig(t, filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: err = %v, want it to wrap fs.ErrNotExist", err)
+	}
+	var syntaxErr *json.SyntaxError
+	if _, err := loadConfig(t, writeNamedConfig(t, "config.json", "{")); !errors.As(err, &syntaxErr) {
+		t.Errorf("invalid JSON: err = %v, want it to wrap a *json.SyntaxError", err)
+	}
+}
+
+func TestLoadConfigFromStdin(t *testing.T) {
+	stdin, err := os.Open(writeNamedConfig(t, "stdin", jsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = saved })
+
+	config, err := loadConfig(t, configStdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.RequestTimeout != 1234 || config.Client.Proxy.DefaultTarget != "http://backend:8080" {
+		t.Errorf("configuration from standard input not applied: %+v", config.Server)
+	}
+}
+
+// serveConfig starts an HTTP server answering every request with body as
+// contentType, and returns its URL
+func serveConfig(t *testing.T, contentType, body string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/config"
+}
+
+func TestLoadConfigFromURL(t *testing.T) {
+	want, err := loadConfig(t, writeNamedConfig(t, "config.json", jsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		body        string
+	}{
+		{"application/json", jsonConfig},
+		{"application/json; charset=utf-8", jsonConfig},
+		{"application/yaml", yamlConfig},
+		{"text/yaml", yamlConfig},
+	} {
+		t.Run(tc.contentType, func(t *testing.T) {
+			got, err := loadConfig(t, serveConfig(t, tc.contentType, tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("fetched %+v, want the same as the file %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromURLErrors(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(notFound.Close)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+
+	for _, tc := range []struct {
+		name string
+		url  string
+		want error
+	}{
+		{"not found", notFound.URL, ErrConfigNotFound},
+		{"server error", failing.URL, ErrConfigRead},
+		{"HTML page", serveConfig(t, "text/html", "<html>Sign in</html>"), ErrConfigDecode},
+		{"no content type", serveConfig(t, "", jsonConfig), ErrConfigDecode},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := loadConfig(t, tc.url); !errors.Is(err, tc.want) {
+				t.Errorf("err = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestFetchConfigTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	// The body never finishes, so the timeout covers reading it as well as the head
+	start := time.Now()
+	if _, _, err := fetchConfig(server.URL, 200*time.Millisecond); !errors.Is(err, ErrConfigRead) {
+		t.Errorf("err = %v, want ErrConfigRead", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %v, want soon after the 200ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// connectionIDKey is the context key under which each HTTP connection's ID is stored
+type connectionIDKey struct{}
+
+// connContext gives each accepted HTTP connection an ID, shared by every request
+// made over it and unique for the life of the server
+func (s *ProxyServer) connContext(ctx context.Context, conn net.Conn) context.Context {
+	id := strconv.FormatUint(s.connectionIDs.Add(1), 10)
+	return context.WithValue(ctx, connectionIDKey{}, id)
+}
+
+// connectionID returns the ID of the connection a request arrived on
+func connectionID(ctx context.Context) string {
+	id, _ := ctx.Value(connectionIDKey{}).(string)
+	return id
+}
+
+// setConnectionInfoHeaders sets X-Forwarded-Port to the caller's source port and
+// X-Connection-ID to its connection's ID, when the request message carries them.
+// Values sent by the caller are replaced, so upstreams can trust them.
+func setConnectionInfoHeaders(h http.Header, request map[string]interface{}) {
+	if remoteAddr, ok := request["remoteAddr"].(string); ok {
+		if _, port, err := net.SplitHostPort(remoteAddr); err == nil {
+			h.Set("X-Forwarded-Port", port)
+		}
+	}
+	if id, _ := request["connectionId"].(string); id != "" {
+		h.Set("X-Connection-ID", id)
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import "net/http"
+
+// Reasons a request could not be delivered to any client
+const (
+	deadLetterNoClients        = "no_clients"
+	deadLetterNoHealthyClients = "no_healthy_clients"
+	deadLetterNoCapacity       = "no_capacity"
+	deadLetterPinnedClient     = "pinned_client_unavailable"
+	deadLetterEncodeFailed     = "encode_failed"
+	deadLetterWriteTimeout     = "write_timeout"
+	deadLetterWriteFailed      = "write_failed"
+	deadLetterQueueFull        = "queue_full"
+)
+
+// deadLetter records a request that never reached a client, so undelivered
+// requests can be alerted on or replayed. Every one is counted by reason in
+// proxy_dead_letters_total; with logging.deadLetter set it is also logged with
+// what is needed to send it again, apart from the body. clientID and requestID
+// are empty if the request never got that far.
+func (s *ProxyServer) deadLetter(r *http.Request, reason string, clientID string, requestID string) {
+	s.metrics.add("proxy_dead_letters_total", 1, "reason", reason)
+	if !s.config.live().deadLetter {
+		return
+	}
+
+	s.logger.Warn("dead-letter", "Request not delivered", map[string]interface{}{
+		"reason":        reason,
+		"method":        r.Method,
+		"url":           r.URL.String(),
+		"host":          r.Host,
+		"headers":       r.Header,
+		"contentLength": r.ContentLength,
+		"remoteAddress": r.RemoteAddr,
+		"clientId":      clientID,
+		"requestId":     requestID,
+	})
+}
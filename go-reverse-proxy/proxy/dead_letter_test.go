@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDeadLetter(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		pin          string
+		wantReason   string
+		wantClientID string
+	}{
+		{"no clients", "", deadLetterNoClients, ""},
+		{"pinned client unavailable", "missing", deadLetterPinnedClient, "missing"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestServer(t, func(c *Config) {
+				c.Server.Metrics.Path = "/metrics"
+				c.Server.AllowClientPinning = true
+				c.Server.Admin.Token = "secret"
+				c.Logging.DeadLetter = true
+			})
+
+			req, err := http.NewRequest(http.MethodPost, p.url+"/orders?id=7", strings.NewReader("order"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Order", "7")
+			if tc.pin != "" {
+				req.Header.Set(clientPinHeader, tc.pin)
+				req.Header.Set("Authorization", "Bearer secret")
+			}
+			if resp, _ := p.do(t, req); resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503", resp.StatusCode)
+			}
+
+			p.waitForLog(t, "Request not delivered")
+			entries := p.logEntries(t, "dead-letter")
+			if len(entries) != 1 {
+				t.Fatalf("got %d dead letters, want 1", len(entries))
+			}
+			entry := entries[0]
+			if entry["reason"] != tc.wantReason || entry["clientId"] != tc.wantClientID {
+				t.Errorf("reason %v for client %q, want %s for %q", entry["reason"], entry["clientId"], tc.wantReason, tc.wantClientID)
+			}
+			if entry["method"] != http.MethodPost || entry["url"] != "/orders?id=7" || entry["contentLength"] != float64(5) {
+				t.Errorf("entry %v does not describe the request", entry)
+			}
+			if headers, _ := entry["headers"].(map[string]interface{}); headers == nil || headers["X-Order"] == nil {
+				t.Errorf("headers = %v, want the request's headers", entry["headers"])
+			}
+
+			_, metrics := p.get(t, "/metrics")
+			if !strings.Contains(metrics, `proxy_dead_letters_total{reason="`+tc.wantReason+`"} 1`) {
+				t.Errorf("metrics do not count the dead letter:\n%s", metrics)
+			}
+		})
+	}
+}
+
+func TestDeadLetterLogOff(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.Metrics.Path = "/metrics" })
+
+	p.get(t, "/")
+	_, metrics := p.get(t, "/metrics")
+	if !strings.Contains(metrics, `proxy_dead_letters_total{reason="no_clients"} 1`) {
+		t.Errorf("metrics do not count the dead letter:\n%s", metrics)
+	}
+	if entries := p.logEntries(t, "dead-letter"); len(entries) != 0 {
+		t.Errorf("got %d dead letters logged with logging.deadLetter off", len(entries))
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// frameClock tracks when the frame being received on a connection started to
+// arrive, so a peer trickling in a frame a byte at a time can be cut off
+type frameClock struct {
+	timeout time.Duration
+	started time.Time
+}
+
+// update records a read of n bytes, given how many bytes of incomplete frames the
+// message buffer held before and after consuming them. The clock restarts with each
+// complete frame and stops once no partial frame is left.
+func (f *frameClock) update(before, n, after int) {
+	switch {
+	case after == 0:
+		f.started = time.Time{}
+	case after < before+n || f.started.IsZero():
+		f.started = time.Now()
+	}
+}
+
+// deadline returns when the partial frame must be complete, or the zero time if
+// there is none or no timeout is configured
+func (f *frameClock) deadline() time.Time {
+	if f.timeout <= 0 || f.started.IsZero() {
+		return time.Time{}
+	}
+	return f.started.Add(f.timeout)
+}
+
+// expired reports whether the partial frame has taken longer than the timeout
+func (f *frameClock) expired() bool {
+	deadline := f.deadline()
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// earliest returns the earlier of two deadlines, where the zero time means none
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeFrame writes a frame to conn, giving up after timeout (0 means no limit).
+// A failed write may leave part of the frame on the wire, so the connection is
+// closed and its read loop cleans up.
+func writeFrame(conn net.Conn, frame []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if _, err := conn.Write(frame); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
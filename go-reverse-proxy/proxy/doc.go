@@ -0,0 +1,39 @@
+// Package proxy implements the reverse proxy's server and client. The server
+// accepts HTTP requests and forwards them over a socket to connected clients,
+// which send them on to their upstream and relay the responses back.
+//
+// The reverse-proxy command is a thin wrapper around this package. To embed the
+// proxy in another program, build a Config, create a Logger and run a server or
+// client until a context is cancelled:
+//
+//	config := proxy.DefaultConfig()
+//	config.Server.HTTP.Port = 8080
+//
+//	logger, err := proxy.NewLogger("info", "")
+//	if err != nil {
+//		return err
+//	}
+//	defer logger.Close()
+//
+//	server := proxy.NewProxyServer(config, logger)
+//	return server.Run(ctx)
+//
+// A client in the same or another process is created with NewProxyClient, which
+// fails if its upstream TLS settings can't be loaded, and run the same way. Start, Stop, Connect and Close are available for callers that
+// manage the lifecycle themselves.
+//
+// A server and clients can also be connected in memory, without binding any
+// ports, by giving them the same MemoryTransport. HTTP requests are then served
+// through the server's Handler:
+//
+//	transport := proxy.NewMemoryTransport()
+//	server.SetTransport(transport)
+//	client.SetTransport(transport)
+//	if err := server.Start(); err != nil {
+//		return err
+//	}
+//	if err := client.Connect(); err != nil {
+//		return err
+//	}
+//	server.Handler().ServeHTTP(w, r)
+package proxy
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Formats of the error responses the proxy writes itself
+const (
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// Codes identifying the errors the proxy writes itself, stable across messages
+const (
+	errorCodeMethodNotAllowed   = "method_not_allowed"
+	errorCodeForbidden          = "forbidden"
+	errorCodeWaitingForClients  = "waiting_for_clients"
+	errorCodeOverloaded         = "too_many_requests"
+	errorCodeHeadersTooLarge    = "headers_too_large"
+	errorCodeURLTooLong         = "url_too_long"
+	errorCodeHTTP2Required      = "http2_required"
+	errorCodeInvalidTimeout     = "invalid_timeout"
+	errorCodeNoRoute            = "no_route"
+	errorCodeNoClients          = "no_clients"
+	errorCodeNoCapacity         = "no_client_capacity"
+	errorCodePinnedClient       = "pinned_client_unavailable"
+	errorCodeGRPCUnsupported    = "grpc_unsupported"
+	errorCodeRateLimited        = "client_rate_limited"
+	errorCodeTooManyPending     = "too_many_pending_requests"
+	errorCodeBodyTooLarge       = "request_body_too_large"
+	errorCodeSlowBody           = "request_timeout"
+	errorCodeExpectationFailed  = "expectation_failed"
+	errorCodeInternal           = "internal_error"
+	errorCodeClientUnavailable  = "client_unavailable"
+	errorCodeClientBusy         = "client_busy"
+	errorCodeClientDisconnected = "client_disconnected"
+	errorCodeBadResponse        = "invalid_response"
+	errorCodeTunnelFailed       = "tunnel_failed"
+	errorCodeUpstream           = "upstream_error"
+	errorCodeTimeout            = "timeout"
+	errorCodeEvicted            = "evicted"
+)
+
+// errorEnvelope is the body of a JSON error response
+type errorEnvelope struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+
+	// Class is the kind of upstream failure, for upstream errors only
+	Class interface{} `json:"class,omitempty"`
+}
+
+// writeError answers a request with an error in server.errorFormat: plain text
+// with just the message, or a JSON envelope with the code and request ID as well.
+// The request ID is left out if the request never got one.
+func (s *ProxyServer) writeError(w http.ResponseWriter, status int, code, message, requestID string) {
+	if s.config.Server.ErrorFormat != errorFormatJSON {
+		http.Error(w, message, status)
+		return
+	}
+	writeErrorJSON(w, status, errorBody{Code: code, Message: message, RequestID: requestID})
+}
+
+// writeErrorJSON writes an error envelope with the given status
+func writeErrorJSON(w http.ResponseWriter, status int, body errorBody) {
+	data, _ := json.Marshal(errorEnvelope{Error: body})
+
+	// Like http.Error, drop headers meant for the response that was expected
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
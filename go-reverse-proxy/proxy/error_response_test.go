@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestErrorDetails(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		trusted     []string
+		token       string
+		wantDetails bool
+	}{
+		{"untrusted caller", nil, "", false},
+		{"wrong token", nil, "guess", false},
+		{"debug token", nil, "secret", true},
+		{"trusted network", []string{"127.0.0.0/8"}, "", true},
+		{"other network", []string{"10.0.0.0/8"}, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+				c.Client.Proxy.DefaultTarget = "http://127.0.0.1:1"
+				c.Server.ErrorDetails.TrustedCIDRs = tc.trusted
+				c.Server.ErrorDetails.Token = "secret"
+			})
+
+			req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.token != "" {
+				req.Header.Set("X-Proxy-Debug-Token", tc.token)
+			}
+			resp, body := p.do(t, req)
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("status = %d, want 502", resp.StatusCode)
+			}
+			if details := strings.Contains(body, "connection refused"); details != tc.wantDetails {
+				t.Errorf("body %s shows details = %v, want %v", body, details, tc.wantDetails)
+			}
+		})
+	}
+}
+
+func TestErrorDetailsTokenNotForwarded(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Proxy-Debug-Token")))
+	}), func(c *Config) { c.Server.ErrorDetails.Token = "secret" })
+
+	req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Proxy-Debug-Token", "secret")
+	if _, body := p.do(t, req); body != "" {
+		t.Errorf("upstream received the debug token %q", body)
+	}
+}
+
+func TestErrorFormatJSON(t *testing.T) {
+	// decode checks the body is an error envelope and returns what it holds
+	decode := func(t *testing.T, resp *http.Response, body string) errorBody {
+		t.Helper()
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", contentType)
+		}
+		var envelope errorEnvelope
+		if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+			t.Fatalf("invalid error envelope %q: %v", body, err)
+		}
+		return envelope.Error
+	}
+
+	t.Run("502", func(t *testing.T) {
+		p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+			c.Client.Proxy.DefaultTarget = "http://127.0.0.1:1"
+			c.Server.ErrorFormat = errorFormatJSON
+		})
+		resp, body := p.get(t, "/")
+		got := decode(t, resp, body)
+		if resp.StatusCode != http.StatusBadGateway || got.Code != errorCodeUpstream || got.Class != "connection_refused" || got.RequestID == "" {
+			t.Errorf("got %d %s, want 502 %s with the class and request ID", resp.StatusCode, body, errorCodeUpstream)
+		}
+	})
+
+	t.Run("503", func(t *testing.T) {
+		p := startTestServer(t, func(c *Config) { c.Server.ErrorFormat = errorFormatJSON })
+		resp, body := p.get(t, "/")
+		got := decode(t, resp, body)
+		if resp.StatusCode != http.StatusServiceUnavailable || got.Code != errorCodeNoClients || got.Message == "" {
+			t.Errorf("got %d %s, want 503 %s", resp.StatusCode, body, errorCodeNoClients)
+		}
+		if got.RequestID != "" {
+			t.Errorf("requestId = %q, want none before the request is sent to a client", got.RequestID)
+		}
+	})
+
+	t.Run("504", func(t *testing.T) {
+		p := startTestServer(t, func(c *Config) {
+			c.Server.ErrorFormat = errorFormatJSON
+			c.Server.RequestTimeout = 200
+		})
+		p.connectFakeClient(t)
+		resp, body := p.get(t, "/")
+		got := decode(t, resp, body)
+		if resp.StatusCode != http.StatusGatewayTimeout || got.Code != errorCodeTimeout || got.RequestID == "" {
+			t.Errorf("got %d %s, want 504 %s with the request ID", resp.StatusCode, body, errorCodeTimeout)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import "errors"
+
+// Errors returned when loading the configuration, creating the logger or connecting
+// to the server. They are wrapped with the underlying error, so check for them with
+// errors.Is; the underlying error is still available through errors.As.
+var (
+	// ErrConfigNotFound is returned when the configuration file does not exist, or
+	// its URL answers 404
+	ErrConfigNotFound = errors.New("config file not found")
+
+	// ErrConfigRead is returned when the configuration file exists but can't be read,
+	// or can't be fetched from its URL
+	ErrConfigRead = errors.New("failed to open config file")
+
+	// ErrConfigDecode is returned when the configuration file is not valid JSON or YAML
+	ErrConfigDecode = errors.New("failed to decode config file")
+
+	// ErrLogFile is returned when the log file can't be opened
+	ErrLogFile = errors.New("failed to open log file")
+
+	// ErrInvalidConfig is returned by LoadConfig when the file sets options that
+	// can't be used together, and by Start when a setting would leave the server
+	// running but unable to serve requests as configured
+	ErrInvalidConfig = errors.New("invalid configuration")
+
+	// ErrTLSLoad is returned when a certificate, key or CA can't be loaded, or the
+	// TLS settings are invalid
+	ErrTLSLoad = errors.New("failed to load TLS configuration")
+
+	// ErrDial is returned when the client can't connect to the server
+	ErrDial = errors.New("failed to connect to server")
+
+	// ErrNotConnected is returned when a client that never connected to the server
+	// is closed or asked to send
+	ErrNotConnected = errors.New("not connected to server")
+)
@@ -0,0 +1,121 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"reverse-proxy/proxy"
+)
+
+// freePort returns a local TCP port that was free a moment ago
+func freePort() int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Example embeds a server and a client in one program, connected over local
+// sockets as they would be in separate processes, and proxies a request
+func Example() {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	config := proxy.DefaultConfig()
+	config.Server.HTTP.Host = "127.0.0.1"
+	config.Server.HTTP.Port = freePort()
+	config.Server.Socket.Host = "127.0.0.1"
+	config.Server.Socket.Port = freePort()
+	config.Client.Server.Host = "127.0.0.1"
+	config.Client.Server.Port = config.Server.Socket.Port
+	config.Client.Proxy.DefaultTarget = backend.URL
+
+	// Hold requests until the client has registered
+	config.Server.WaitForClients.Count = 1
+
+	logger, err := proxy.NewLogger("error", "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer logger.Close()
+
+	server := proxy.NewProxyServer(config, logger)
+	if err := server.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer server.Stop(context.Background())
+
+	// The client serves until ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := proxy.NewProxyClient(config, logger)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	go client.Run(ctx)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/greeting", config.Server.HTTP.Port))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(resp.StatusCode, string(body))
+	// Output: 200 hello from /greeting
+}
+
+func ExampleMemoryTransport() {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello from %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	config := proxy.DefaultConfig()
+	config.Client.Proxy.DefaultTarget = backend.URL
+
+	// Hold requests until the client has registered
+	config.Server.WaitForClients.Count = 1
+
+	logger, err := proxy.NewLogger("error", "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer logger.Close()
+
+	transport := proxy.NewMemoryTransport()
+	server := proxy.NewProxyServer(config, logger)
+	server.SetTransport(transport)
+	if err := server.Start(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	client, err := proxy.NewProxyClient(config, logger)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	client.SetTransport(transport)
+	if err := client.Connect(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer client.Close()
+
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/greeting", nil))
+	fmt.Println(recorder.Code, recorder.Body.String())
+	// Output: 200 hello from /greeting
+}
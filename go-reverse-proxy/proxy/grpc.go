@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// isGRPCRequest reports whether r is a gRPC call. gRPC-Web, which works over
+// HTTP/1.1 with ordinary bodies, is proxied like any other request.
+func isGRPCRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	count func(n int)
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.count(n)
+	}
+	return n, err
+}
+
+// streamRequestBody relays the body of a gRPC request to its client as it arrives,
+// once the client has said it is ready for it, as tunnel-data messages ending in
+// tunnel-close. It returns when the body ends, the request finishes or the client
+// connection fails.
+func (s *ProxyServer) streamRequestBody(pending *PendingRequest, client *ClientInfo, requestID string, body io.Reader) {
+	select {
+	case <-pending.bodyReady:
+	case <-pending.done:
+		return
+	}
+
+	send := func(message map[string]interface{}) error {
+		message["clientId"] = pending.clientID
+		message["requestId"] = requestID
+		return s.sendToClient(client, message)
+	}
+	reader := countingReader{Reader: body, count: func(n int) {
+		s.countRequestBytes(pending, client, n)
+	}}
+	pumpTunnel(reader, send, func(chunk []byte) interface{} {
+		return s.encodeBody(client, chunk)
+	}, s.tunnelWindow(client, pending.bodyWindow))
+}
+
+// handleRequestBodyAck widens the window of a gRPC request's body as its client
+// writes the body upstream
+func (s *ProxyServer) handleRequestBodyAck(clientID string, requestID string, message map[string]interface{}) {
+	s.requestsMutex.RLock()
+	pending, exists := s.pendingRequests[requestID]
+	s.requestsMutex.RUnlock()
+	if !exists || pending.clientID != clientID || pending.bodyWindow == nil {
+		return
+	}
+	seq, _ := message["seq"].(float64)
+	pending.bodyWindow.ack(int(seq))
+}
+
+// handleRequestReady starts a gRPC request's body on its way to the client that
+// asked for it
+func (s *ProxyServer) handleRequestReady(clientID string, message map[string]interface{}) {
+	requestID, _ := message["requestId"].(string)
+	s.requestsMutex.RLock()
+	pending, exists := s.pendingRequests[requestID]
+	s.requestsMutex.RUnlock()
+	if !exists || pending.clientID != clientID || pending.bodyReady == nil {
+		return
+	}
+	pending.readyOnce.Do(func() { close(pending.bodyReady) })
+}
+
+// cancelRequest tells a client to abandon a gRPC request the caller has given up on
+func (s *ProxyServer) cancelRequest(client *ClientInfo, clientID string, requestID string) {
+	s.sendToClient(client, map[string]interface{}{
+		"type":      "request-cancel",
+		"clientId":  clientID,
+		"requestId": requestID,
+	})
+}
+
+// newGRPCClient returns a client for gRPC targets sharing httpClient's settings.
+// It only speaks HTTP/2: negotiated over TLS for https:// targets and without
+// TLS (h2c) for http:// ones.
+func newGRPCClient(httpClient *http.Client) *http.Client {
+	transport := httpClient.Transport.(*http.Transport).Clone()
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+// handleGRPCRequest forwards a gRPC request to the first target and streams the
+// response back, trailers included. The body follows from the server as the caller
+// sends it, so the request is never retried or failed over. The request timeout
+// only applies until the response headers arrive, so long-lived streams run
+// until either end closes them.
+func (c *ProxyClient) handleGRPCRequest(request map[string]interface{}) {
+	requestID, _ := request["requestId"].(string)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Track the server's deadline locally so clock skew between hosts doesn't matter
+	var timer *time.Timer
+	if timeoutMs, ok := request["timeoutMs"].(float64); ok {
+		timer = time.AfterFunc(time.Duration(timeoutMs)*time.Millisecond, cancel)
+	}
+
+	// Continue the server's trace around the upstream call
+	ctx = extractTraceContext(ctx, request)
+	ctx, span := tracer().Start(ctx, "proxy.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", fmt.Sprint(request["method"]))))
+	defer span.End()
+
+	targetURLs, err := c.upstreamURLs(request)
+	if err != nil {
+		c.sendUpstreamError(request, "invalid_url", err.Error())
+		return
+	}
+	targetURL := targetURLs[0]
+
+	body := c.openRequestBody(request, cancel)
+	defer c.closeRequestBody(requestID)
+
+	httpReq, err := c.newUpstreamRequest(ctx, request, targetURL, body)
+	if err != nil {
+		c.logger.Error("proxy", "Failed to create HTTP request", map[string]interface{}{
+			"error":     err.Error(),
+			"requestId": requestID,
+		})
+		c.sendUpstreamError(request, "malformed_request", err.Error())
+		return
+	}
+
+	// TE is hop-by-hop, but gRPC servers expect callers to declare they accept trailers
+	httpReq.Header.Set("Te", "trailers")
+
+	c.logger.Debug("proxy", "Forwarding gRPC request", map[string]interface{}{
+		"requestId": requestID,
+		"url":       targetURL,
+		"headers":   httpReq.Header,
+	})
+
+	upstreamStart := time.Now()
+	resp, err := c.grpcClient.Do(httpReq)
+	if timer != nil {
+		timer.Stop()
+	}
+	c.logUpstreamAccess(requestID, httpReq, resp, err, time.Since(upstreamStart))
+	c.recordUpstreamResult(err != nil)
+	span.SetAttributes(attribute.String("url.full", targetURL))
+	if err != nil {
+		errorClass := classifyUpstreamError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorClass)
+		c.logger.Error("proxy", "Failed to send gRPC request", map[string]interface{}{
+			"error": err.Error(),
+			"class": errorClass,
+			"url":   targetURL,
+		})
+		c.sendUpstreamError(request, errorClass, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	// An error with no messages comes back trailers-only, its status in the head.
+	// The head is relayed before the end of the stream is known, so the status
+	// goes in the trailers instead, where callers also look for it.
+	if resp.Header.Get("Grpc-Status") != "" {
+		if resp.Trailer == nil {
+			resp.Trailer = http.Header{}
+		}
+		for _, key := range []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"} {
+			if values := resp.Header.Values(key); len(values) > 0 {
+				resp.Trailer[key] = values
+				resp.Header.Del(key)
+			}
+		}
+	}
+
+	c.streamResponse(request, resp, nil, time.Since(upstreamStart))
+}
+
+// openRequestBody registers the pipe a gRPC request's body is written to as it
+// arrives from the server, along with the function that cancels the request, and
+// tells the server to start sending the body
+func (c *ProxyClient) openRequestBody(request map[string]interface{}, cancel context.CancelFunc) io.ReadCloser {
+	requestID, _ := request["requestId"].(string)
+	reader, writer := io.Pipe()
+
+	c.tunnelsMutex.Lock()
+	c.tunnels[requestID] = newTunnelStream(writer)
+	c.cancels[requestID] = cancel
+	c.tunnelsMutex.Unlock()
+
+	c.send(map[string]interface{}{
+		"type":      "request-ready",
+		"clientId":  request["clientId"],
+		"requestId": requestID,
+	})
+	return reader
+}
+
+// closeRequestBody forgets a gRPC request once it is over, discarding any body
+// still arriving for it
+func (c *ProxyClient) closeRequestBody(requestID string) {
+	c.tunnelsMutex.Lock()
+	stream := c.tunnels[requestID]
+	delete(c.tunnels, requestID)
+	delete(c.cancels, requestID)
+	c.tunnelsMutex.Unlock()
+	if stream != nil {
+		stream.close()
+	}
+}
+
+// handleRequestCancel abandons a gRPC request whose caller went away
+func (c *ProxyClient) handleRequestCancel(message map[string]interface{}) {
+	requestID, _ := message["requestId"].(string)
+	c.tunnelsMutex.Lock()
+	cancel := c.cancels[requestID]
+	c.tunnelsMutex.Unlock()
+	if cancel != nil {
+		c.logger.Debug("proxy", "Request cancelled by server", map[string]interface{}{
+			"requestId": requestID,
+		})
+		cancel()
+	}
+}
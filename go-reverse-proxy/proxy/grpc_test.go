@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcFrame wraps a message in gRPC's length-prefixed framing, uncompressed
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// readGRPCFrame reads one length-prefixed gRPC message from r
+func readGRPCFrame(r io.Reader) (string, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return "", err
+	}
+	message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+// grpcEcho is a gRPC service over h2c that answers each message with "echo:" and
+// the message as soon as it arrives, ending with grpc-status 0 in the trailers. A
+// first message of "fail" is refused trailers-only, with its status in the head.
+var grpcEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	message, err := readGRPCFrame(r.Body)
+	if message == "fail" {
+		w.Header().Set("Grpc-Status", "9")
+		w.Header().Set("Grpc-Message", "told to fail")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	for err == nil {
+		w.Write(grpcFrame("echo:" + message))
+		http.NewResponseController(w).Flush()
+		message, err = readGRPCFrame(r.Body)
+	}
+	w.Header().Set("Grpc-Status", "0")
+})
+
+// startGRPCProxy starts a server with an h2c listener and a client forwarding to
+// grpcEcho, and returns it with an HTTP client that only speaks h2c
+func startGRPCProxy(t *testing.T) (*testProxy, *http.Client) {
+	t.Helper()
+	backend := httptest.NewUnstartedServer(grpcEcho)
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	p := startSocketServer(t, func(c *Config) {
+		c.Server.HTTP.H2C = true
+		c.Client.Proxy.DefaultTarget = backend.URL
+	})
+	p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	return p, &http.Client{Transport: transport}
+}
+
+// newGRPCRequest returns a call to the echo service with body as its messages
+func newGRPCRequest(t *testing.T, p *testProxy, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, p.url+"/echo.Echo/Chat", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	return req
+}
+
+func TestGRPCUnary(t *testing.T) {
+	p, caller := startGRPCProxy(t)
+
+	resp, err := caller.Do(newGRPCRequest(t, p, bytes.NewReader(grpcFrame("ping"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s %d, want HTTP/2 200", resp.Proto, resp.StatusCode)
+	}
+	if message, err := readGRPCFrame(resp.Body); err != nil || message != "echo:ping" {
+		t.Errorf("got message %q (%v), want echo:ping", message, err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	// The status only arrives once the body has been read to the end
+	if status := resp.Header.Get("Grpc-Status"); status != "" {
+		t.Errorf("grpc-status %q arrived in the head, want it in the trailers", status)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("trailer grpc-status = %q, want 0", status)
+	}
+}
+
+func TestGRPCStreaming(t *testing.T) {
+	p, caller := startGRPCProxy(t)
+
+	// Each message is sent only after the echo of the one before it has come back,
+	// so the call can only finish if both directions stream
+	body, send := io.Pipe()
+	go send.Write(grpcFrame("a"))
+	resp, err := caller.Do(newGRPCRequest(t, p, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for _, word := range []string{"a", "b", "c"} {
+		if word != "a" {
+			if _, err := send.Write(grpcFrame(word)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if message, err := readGRPCFrame(resp.Body); err != nil || message != "echo:"+word {
+			t.Fatalf("got message %q (%v), want echo:%s", message, err, word)
+		}
+	}
+	send.Close()
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("trailer grpc-status = %q, want 0", status)
+	}
+}
+
+func TestGRPCTrailersOnlyError(t *testing.T) {
+	p, caller := startGRPCProxy(t)
+
+	resp, err := caller.Do(newGRPCRequest(t, p, bytes.NewReader(grpcFrame("fail"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream's status in the head is relayed in the trailers
+	if status := resp.Trailer.Get("Grpc-Status"); status != "9" {
+		t.Errorf("trailer grpc-status = %q, want 9", status)
+	}
+	if message := resp.Trailer.Get("Grpc-Message"); message != "told to fail" {
+		t.Errorf("trailer grpc-message = %q, want the upstream's message", message)
+	}
+}
+
+func TestGRPCRequiresHTTP2(t *testing.T) {
+	p, _ := startGRPCProxy(t)
+
+	resp, err := http.DefaultClient.Do(newGRPCRequest(t, p, bytes.NewReader(grpcFrame("ping"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("status = %d, want 505 for gRPC over HTTP/1", resp.StatusCode)
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Header rule actions
+const (
+	headerActionSet    = "set"
+	headerActionAdd    = "add"
+	headerActionRemove = "remove"
+)
+
+// headerRuleConfig is a header rule as it appears in the configuration
+type headerRuleConfig = struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+}
+
+// headerRule sets, adds or removes a header. Values may refer to request metadata
+// as ${clientIp}, ${host}, ${method}, ${path} and ${requestId}.
+type headerRule struct {
+	action string
+	name   string
+	value  string
+}
+
+// checkHeaderRule verifies a header rule's action and header name
+func checkHeaderRule(action, name string) error {
+	if action != headerActionSet && action != headerActionAdd && action != headerActionRemove {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	return nil
+}
+
+// compileHeaderRules validates the configured header rules, skipping invalid ones
+func compileHeaderRules(configured []headerRuleConfig, logger *Logger, category string) []headerRule {
+	var rules []headerRule
+	for _, rule := range configured {
+		if err := checkHeaderRule(rule.Action, rule.Name); err != nil {
+			logger.Error(category, "Invalid header rule", map[string]interface{}{
+				"name":  rule.Name,
+				"error": err.Error(),
+			})
+			continue
+		}
+		rules = append(rules, headerRule{
+			action: rule.Action,
+			name:   rule.Name,
+			value:  rule.Value,
+		})
+	}
+	return rules
+}
+
+// applyHeaderRules applies rules to h in order, filling in their values from vars.
+// Line breaks in filled-in values are replaced so they can't start a new header.
+func applyHeaderRules(h http.Header, rules []headerRule, vars map[string]string) {
+	if len(rules) == 0 {
+		return
+	}
+
+	pairs := make([]string, 0, len(vars)*2)
+	for name, value := range vars {
+		pairs = append(pairs, "${"+name+"}", strings.NewReplacer("\r", " ", "\n", " ").Replace(value))
+	}
+	expand := strings.NewReplacer(pairs...)
+
+	for _, rule := range rules {
+		switch rule.action {
+		case headerActionSet:
+			h.Set(rule.name, expand.Replace(rule.value))
+		case headerActionAdd:
+			h.Add(rule.name, expand.Replace(rule.value))
+		case headerActionRemove:
+			h.Del(rule.name)
+		}
+	}
+}
+
+// remoteIP returns the IP address of the caller that sent r
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestVars returns the metadata header rules can refer to for a caller's request
+func requestVars(r *http.Request, requestID string) map[string]string {
+	return map[string]string{
+		"clientIp":  remoteIP(r),
+		"host":      r.Host,
+		"method":    r.Method,
+		"path":      r.URL.Path,
+		"requestId": requestID,
+	}
+}
+
+// messageVars returns the metadata header rules can refer to for a request message
+func messageVars(request map[string]interface{}) map[string]string {
+	vars := make(map[string]string)
+	for _, field := range []string{"clientIp", "host", "method", "requestId"} {
+		vars[field], _ = request[field].(string)
+	}
+	if rawURL, ok := request["url"].(string); ok {
+		if parsed, err := url.Parse(rawURL); err == nil {
+			vars["path"] = parsed.Path
+		}
+	}
+	return vars
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Powered-By", "framework")
+	}), func(c *Config) {
+		c.Client.Proxy.HeaderRules = []headerRuleConfig{
+			{Action: "set", Name: "X-Real-IP", Value: "${clientIp}"},
+			{Action: "add", Name: "X-Multi", Value: "second ${method} ${path}"},
+			{Action: "remove", Name: "X-Secret"},
+		}
+		c.Server.ResponseHeaderRules = []headerRuleConfig{
+			{Action: "remove", Name: "X-Powered-By"},
+			{Action: "add", Name: "Server", Value: "proxy"},
+			{Action: "set", Name: "X-Served-For", Value: "${host}"},
+		}
+	})
+
+	req, err := http.NewRequest(http.MethodGet, p.url+"/a/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Multi", "first")
+	req.Header.Set("X-Secret", "hunter2")
+	resp, _ := p.do(t, req)
+
+	upstream := <-seen
+	if got := upstream.Get("X-Real-IP"); got != "127.0.0.1" {
+		t.Errorf("upstream X-Real-IP = %q, want the caller's IP", got)
+	}
+	if got := upstream.Values("X-Multi"); !slices.Equal(got, []string{"first", "second GET /a/b"}) {
+		t.Errorf("upstream X-Multi = %q, want the caller's value and the added one", got)
+	}
+	if got := upstream.Get("X-Secret"); got != "" {
+		t.Errorf("upstream X-Secret = %q, want it removed", got)
+	}
+
+	if got := resp.Header.Get("X-Powered-By"); got != "" {
+		t.Errorf("X-Powered-By = %q, want it removed", got)
+	}
+	if got := resp.Header.Values("Server"); !slices.Equal(got, []string{"backend", "proxy"}) {
+		t.Errorf("Server = %q, want the upstream's value and the added one", got)
+	}
+	if got := resp.Header.Get("X-Served-For"); got != strings.TrimPrefix(p.url, "http://") {
+		t.Errorf("X-Served-For = %q, want the request's host", got)
+	}
+}
+
+func TestInvalidHeaderRuleSkipped(t *testing.T) {
+	config := newTestConfig(t)
+	rules := compileHeaderRules([]headerRuleConfig{
+		{Action: "replace", Name: "X-One"},
+		{Action: "set", Name: "Bad Name"},
+		{Action: "set", Name: "X-Good", Value: "yes"},
+	}, newTestLogger(t, config), "test")
+
+	if len(rules) != 1 || rules[0].name != "X-Good" {
+		t.Errorf("compiled rules = %+v, want only the valid one", rules)
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are meaningful only for a single connection and must not be
+// forwarded by a proxy (RFC 7230 section 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"TE",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Proxy-Authorization",
+	"Proxy-Authenticate",
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, along with any
+// header named in its Connection header
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// headerSize returns the number of header values in h and their approximate
+// size on the wire, counting each value as a "Name: value\r\n" line
+func headerSize(h http.Header) (count int, size int) {
+	for name, values := range h {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value) + 4
+		}
+	}
+	return count, size
+}
+
+// headersWithinLimits reports whether h stays within maxCount values and maxBytes
+// bytes; a limit of zero is not enforced
+func headersWithinLimits(h http.Header, maxCount int, maxBytes int) bool {
+	count, size := headerSize(h)
+	return (maxCount <= 0 || count <= maxCount) && (maxBytes <= 0 || size <= maxBytes)
+}
+
+// loggedURLLength is how much of an overly long URL is logged
+const loggedURLLength = 256
+
+// truncateURL shortens a URL for logging, marking where it was cut
+func truncateURL(url string) string {
+	if len(url) <= loggedURLLength {
+		return url
+	}
+	return url[:loggedURLLength] + "..."
+}
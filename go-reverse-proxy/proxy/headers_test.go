@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withHeaders returns a handler that adds count X-Extra headers to its response
+func withHeaders(count int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < count; i++ {
+			w.Header().Add(fmt.Sprintf("X-Extra-%d", i), "value")
+		}
+	})
+}
+
+func TestRequestHeaderLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configure  func(*Config)
+		wantStatus int
+	}{
+		{"off by default", nil, http.StatusOK},
+		{"too many values", func(c *Config) { c.Server.MaxHeaderCount = 50 }, http.StatusRequestHeaderFieldsTooLarge},
+		{"too many bytes", func(c *Config) { c.Server.MaxHeaderBytes = 1024 }, http.StatusRequestHeaderFieldsTooLarge},
+		{"within the limits", func(c *Config) {
+			c.Server.MaxHeaderCount = 200
+			c.Server.MaxHeaderBytes = 64 * 1024
+		}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, withHeaders(0), tc.configure)
+			req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				req.Header.Add(fmt.Sprintf("X-Extra-%d", i), "value")
+			}
+			if resp, _ := p.do(t, req); resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestResponseHeaderLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configure  func(*Config)
+		wantStatus int
+	}{
+		{"off by default", nil, http.StatusOK},
+		{"too many values", func(c *Config) { c.Client.Proxy.MaxResponseHeaderCount = 50 }, http.StatusBadGateway},
+		{"too many bytes", func(c *Config) { c.Client.Proxy.MaxResponseHeaderBytes = 1024 }, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, withHeaders(100), tc.configure)
+			if resp, _ := p.get(t, "/"); resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHopByHopRequestHeadersNotForwarded(t *testing.T) {
+	received := make(chan http.Header, 1)
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}), nil)
+
+	req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "X-Custom-Hop, keep-alive")
+	req.Header.Set("X-Custom-Hop", "hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-End-To-End", "kept")
+	p.do(t, req)
+
+	headers := <-received
+	for _, name := range []string{"Connection", "X-Custom-Hop", "Keep-Alive", "Te", "Proxy-Authorization"} {
+		if values := headers.Values(name); len(values) > 0 {
+			t.Errorf("upstream received %s: %v", name, values)
+		}
+	}
+	if headers.Get("X-End-To-End") != "kept" {
+		t.Errorf("X-End-To-End = %q, want it forwarded", headers.Get("X-End-To-End"))
+	}
+}
+
+func TestHopByHopResponseHeadersNotReturned(t *testing.T) {
+	p := startTestServer(t, nil)
+	f := p.connectFakeClient(t)
+
+	resp, _, err := respondWith(t, p, f, map[string]interface{}{
+		"type":       "response",
+		"statusCode": 200,
+		"headers": map[string]interface{}{
+			"Connection":         "X-Custom-Hop",
+			"X-Custom-Hop":       "hop",
+			"Keep-Alive":         "timeout=5",
+			"Proxy-Authenticate": "Basic",
+			"Upgrade":            "websocket",
+			"X-End-To-End":       "kept",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"X-Custom-Hop", "Keep-Alive", "Proxy-Authenticate", "Upgrade"} {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			t.Errorf("caller received %s: %v", name, values)
+		}
+	}
+	if connection := resp.Header.Get("Connection"); strings.Contains(connection, "X-Custom-Hop") {
+		t.Errorf("caller received the upstream's Connection header %q", connection)
+	}
+	if resp.Header.Get("X-End-To-End") != "kept" {
+		t.Errorf("X-End-To-End = %q, want it returned", resp.Header.Get("X-End-To-End"))
+	}
+}
+
+func TestMaxURLLength(t *testing.T) {
+	long := "/" + strings.Repeat("a", 9*1024)
+	for _, tc := range []struct {
+		name       string
+		maxLength  int
+		wantStatus int
+	}{
+		{"off by default", 0, http.StatusOK},
+		{"too long", 8 * 1024, http.StatusRequestURITooLong},
+		{"within the limit", 16 * 1024, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, withHeaders(0), func(c *Config) { c.Server.MaxURLLength = tc.maxLength })
+			if resp, _ := p.get(t, long); resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+	p := startTestProxy(t, withHeaders(0), func(c *Config) { c.Server.MaxURLLength = 8 * 1024 })
+	p.get(t, long)
+	logs := p.logs(t)
+	if !strings.Contains(logs, long[:loggedURLLength]+"...") || strings.Contains(logs, long[:loggedURLLength+1]) {
+		t.Error("the URL was not logged cut short to its first 256 bytes")
+	}
+}
+
+// startConnectionInfoProxy starts a proxy on local ports, which unlike an
+// httptest front assign connection IDs, in front of a backend that echoes the
+// connection info headers
+func startConnectionInfoProxy(t *testing.T, forward bool) *testProxy {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Port") + " " + r.Header.Get("X-Connection-ID")))
+	}))
+	t.Cleanup(backend.Close)
+	p := startSocketServer(t, func(c *Config) {
+		c.Client.Proxy.DefaultTarget = backend.URL
+		c.Server.ForwardConnectionInfo = forward
+	})
+	p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+	return p
+}
+
+func TestConnectionInfoHeaders(t *testing.T) {
+	p := startConnectionInfoProxy(t, true)
+
+	// Record the source port of each connection the caller opens
+	var ports []string
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+				ports = append(ports, port)
+			}
+			return conn, err
+		},
+	}}
+	var seen []string
+	for range 3 {
+		req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Connection-ID", "spoofed")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		seen = append(seen, string(body))
+	}
+	client.CloseIdleConnections()
+
+	if len(ports) != 1 {
+		t.Fatalf("caller opened %d connections, want one kept alive", len(ports))
+	}
+	port, id, _ := strings.Cut(seen[0], " ")
+	if port != ports[0] || id == "" || id == "spoofed" {
+		t.Errorf("upstream saw port %q and connection ID %q, want port %s and an ID from the server", port, id, ports[0])
+	}
+	for _, got := range seen[1:] {
+		if got != seen[0] {
+			t.Errorf("upstream saw %q, want the same port and ID %q across the keep-alive connection", got, seen[0])
+		}
+	}
+
+	// A new connection gets a new ID
+	if _, body := p.get(t, "/"); strings.HasSuffix(body, " "+id) {
+		t.Errorf("a second connection reused connection ID %s", id)
+	}
+}
+
+func TestConnectionInfoHeadersOff(t *testing.T) {
+	p := startConnectionInfoProxy(t, false)
+
+	if _, body := p.get(t, "/"); body != " " {
+		t.Errorf("upstream saw %q, want no connection info headers", body)
+	}
+}
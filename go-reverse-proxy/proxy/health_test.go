@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthEndpointIsOptIn(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}), nil)
+
+	if resp, body := p.get(t, "/healthz"); resp.StatusCode != http.StatusOK || body != "upstream /healthz" {
+		t.Errorf("got %d %q, want the request forwarded upstream", resp.StatusCode, body)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.Health.Path = "/healthz" })
+
+	health := func(wantStatus, wantClients, wantHealthy int) {
+		t.Helper()
+		resp, body := p.get(t, "/healthz")
+		var report struct {
+			Clients        int `json:"clients"`
+			HealthyClients int `json:"healthyClients"`
+		}
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Fatalf("invalid health report %q: %v", body, err)
+		}
+		if resp.StatusCode != wantStatus || report.Clients != wantClients || report.HealthyClients != wantHealthy {
+			t.Errorf("got %d with %d clients, %d healthy; want %d with %d clients, %d healthy",
+				resp.StatusCode, report.Clients, report.HealthyClients, wantStatus, wantClients, wantHealthy)
+		}
+	}
+
+	health(http.StatusServiceUnavailable, 0, 0)
+
+	// A connection that hasn't registered can't serve requests
+	conn, err := p.transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, "connection to be accepted", func() bool {
+		p.server.clientsMutex.RLock()
+		defer p.server.clientsMutex.RUnlock()
+		return len(p.server.clients) == 1
+	})
+	health(http.StatusServiceUnavailable, 0, 0)
+
+	f := p.connectFakeClient(t)
+	health(http.StatusOK, 1, 1)
+
+	f.send(t, map[string]interface{}{"type": "health", "healthy": false})
+	p.waitForLog(t, "Client reported backend unhealthy")
+	health(http.StatusServiceUnavailable, 1, 0)
+}
+
+func TestHealthEndpointIsNotForwarded(t *testing.T) {
+	var forwarded atomic.Int32
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	}), func(c *Config) { c.Server.Health.Path = "/healthz" })
+
+	resp, body := p.get(t, "/healthz")
+	var report map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("invalid health report %q: %v", body, err)
+	}
+	if _, ok := report["uptimeSeconds"].(float64); !ok || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d %s, want 200 with the uptime", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", resp.Header.Get("Cache-Control"))
+	}
+	if forwarded.Load() != 0 {
+		t.Error("the health check was forwarded to the upstream")
+	}
+}
+
+func TestUnhealthyClientIsNotRouted(t *testing.T) {
+	// The backend drops connections without answering until it is told to recover
+	var failing atomic.Bool
+	failing.Store(true)
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("recovered"))
+	}), func(c *Config) {
+		c.Client.Health.FailureThreshold = 2
+		c.Client.Health.ProbeInterval = 20
+	})
+
+	for i := 0; i < 2; i++ {
+		if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status = %d, want 502 from the failing backend", resp.StatusCode)
+		}
+	}
+	p.waitForLog(t, "Client reported backend unhealthy")
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 with the only client unhealthy", resp.StatusCode)
+	}
+
+	failing.Store(false)
+	p.waitForLog(t, "Client reported backend healthy")
+	if resp, body := p.get(t, "/"); resp.StatusCode != http.StatusOK || body != "recovered" {
+		t.Errorf("got %d %q, want 200 recovered", resp.StatusCode, body)
+	}
+}
+
+func TestStaleHealthReportIsIgnored(t *testing.T) {
+	p := startTestServer(t, nil)
+	f := p.connectFakeClient(t)
+
+	f.send(t, map[string]interface{}{"type": "health", "healthy": false, "generation": 2})
+	p.waitForLog(t, "Client reported backend unhealthy")
+
+	// A report older than the one applied arrives late, and must not undo it
+	f.send(t, map[string]interface{}{"type": "health", "healthy": true, "generation": 1})
+	p.waitForLog(t, "Ignored stale health report")
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 with the only client unhealthy", resp.StatusCode)
+	}
+
+	f.send(t, map[string]interface{}{"type": "health", "healthy": true, "generation": 3})
+	p.waitForLog(t, "Client reported backend healthy")
+	resp, body, err := respondWith(t, p, f, map[string]interface{}{
+		"type": "response", "statusCode": 200, "body": jsonCodec{}.EncodeBody([]byte("ok")),
+	})
+	if err != nil || resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("got %d %q (%v), want 200 ok", resp.StatusCode, body, err)
+	}
+}
@@ -0,0 +1,391 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProxy is a server and a client connected over a MemoryTransport. The
+// server's handler is served over HTTP at url and the client forwards to a
+// test backend.
+type testProxy struct {
+	config    *Config
+	logger    *Logger
+	logPath   string
+	transport *MemoryTransport
+	server    *ProxyServer
+	client    *ProxyClient
+	url       string
+}
+
+// newTestConfig returns the default configuration with debug logging to a file
+// in a temporary directory
+func newTestConfig(t testing.TB) *Config {
+	t.Helper()
+	config := DefaultConfig()
+	config.Logging.Level = "debug"
+	config.Logging.File = filepath.Join(t.TempDir(), "proxy.log")
+	config.Reconnection.Delay = 50
+	return config
+}
+
+// newTestLogger creates the logger described by config. It is left open, since the
+// server and client goroutines may still log after the test ends.
+func newTestLogger(t testing.TB, config *Config) *Logger {
+	t.Helper()
+	logger, err := NewLogger(config.Logging.Level, config.Logging.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetRedactHeaders(config.Logging.RedactHeaders)
+	return logger
+}
+
+// startTestServer starts a server over a MemoryTransport with no clients, letting
+// configure adjust the configuration first
+func startTestServer(t testing.TB, configure func(*Config)) *testProxy {
+	t.Helper()
+	config := newTestConfig(t)
+	if configure != nil {
+		configure(config)
+	}
+	p := &testProxy{config: config, logger: newTestLogger(t, config), logPath: config.Logging.File}
+
+	p.transport = NewMemoryTransport()
+	p.server = NewProxyServer(config, p.logger)
+	p.server.SetTransport(p.transport)
+	if err := p.server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.server.Stop(ctx)
+	})
+
+	front := httptest.NewServer(p.server.Handler())
+	t.Cleanup(front.Close)
+	p.url = front.URL
+	return p
+}
+
+// freeTestPort returns a local TCP port that was free a moment ago
+func freeTestPort(t testing.TB) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startSocketServer starts a server on local TCP ports rather than a
+// MemoryTransport, for tests of the listeners themselves, letting configure adjust
+// the configuration first. The client configuration points at the socket listener.
+func startSocketServer(t testing.TB, configure func(*Config)) *testProxy {
+	t.Helper()
+	config := newTestConfig(t)
+	config.Server.HTTP.Host = "127.0.0.1"
+	config.Server.HTTP.Port = freeTestPort(t)
+	config.Server.Socket.Host = "127.0.0.1"
+	config.Server.Socket.Port = freeTestPort(t)
+	config.Client.Server.Host = "127.0.0.1"
+	config.Client.Server.Port = config.Server.Socket.Port
+	if configure != nil {
+		configure(config)
+	}
+	p := &testProxy{config: config, logger: newTestLogger(t, config), logPath: config.Logging.File}
+
+	p.server = NewProxyServer(config, p.logger)
+	if err := p.server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		p.server.Stop(ctx)
+	})
+	p.url = fmt.Sprintf("http://127.0.0.1:%d", config.Server.HTTP.Port)
+	return p
+}
+
+// startTestProxy starts a server and a client forwarding to backend, letting
+// configure adjust the configuration first, and waits for the client to register
+func startTestProxy(t testing.TB, backend http.Handler, configure func(*Config)) *testProxy {
+	t.Helper()
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+
+	p := startTestServer(t, func(c *Config) {
+		c.Client.Proxy.DefaultTarget = upstream.URL
+		if configure != nil {
+			configure(c)
+		}
+	})
+	p.client = p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+	return p
+}
+
+// connectClient connects another client with config, closed when the test ends
+func (p *testProxy) connectClient(t testing.TB, config *Config) *ProxyClient {
+	t.Helper()
+	client, err := NewProxyClient(config, p.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.transport != nil {
+		client.SetTransport(p.transport)
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// do sends a request to the server and returns the response with its body read
+func (p *testProxy) do(t testing.TB, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// get sends a GET request for path to the server
+func (p *testProxy) get(t testing.TB, path string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, p.url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.do(t, req)
+}
+
+// logs returns everything logged so far
+func (p *testProxy) logs(t testing.TB) string {
+	t.Helper()
+	data, err := os.ReadFile(p.logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// waitForLog waits until the log contains text
+func (p *testProxy) waitForLog(t testing.TB, text string) {
+	t.Helper()
+	waitFor(t, "log to contain "+text, func() bool {
+		data, _ := os.ReadFile(p.logPath)
+		return strings.Contains(string(data), text)
+	})
+}
+
+// fakeClient speaks the client side of the protocol by hand, so tests can send the
+// server messages a real client wouldn't
+type fakeClient struct {
+	conn     net.Conn
+	buffer   *MessageBuffer
+	messages chan map[string]interface{}
+}
+
+// connectFakeClient connects a fakeClient to the server and registers it
+func (p *testProxy) connectFakeClient(t *testing.T) *fakeClient {
+	t.Helper()
+	f := p.dialFakeClient(t)
+	f.send(t, map[string]interface{}{
+		"type":               "register",
+		"protocolVersion":    protocolVersion,
+		"minProtocolVersion": minProtocolVersion,
+	})
+	f.receive(t, "registered")
+	return f
+}
+
+// dialFakeClient connects a fakeClient to the server without registering it, so
+// the test can send a register message of its own
+func (p *testProxy) dialFakeClient(t *testing.T) *fakeClient {
+	t.Helper()
+	conn, err := p.transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	f := &fakeClient{conn: conn, buffer: NewMessageBuffer(), messages: make(chan map[string]interface{}, 64)}
+	f.buffer.SetOnDataCallback(func(data []byte) {
+		message, err := jsonCodec{}.Decode(data)
+		if err == nil {
+			f.messages <- message
+		}
+	})
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			f.buffer.Consume(buffer[:n])
+		}
+	}()
+	return f
+}
+
+// send writes a message to the server
+func (f *fakeClient) send(t *testing.T, message map[string]interface{}) {
+	t.Helper()
+	data, err := jsonCodec{}.Encode(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.conn.Write(f.buffer.Produce(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the next message from the server, which must be of the given type.
+// Messages are handled concurrently, so those of other types are skipped.
+func (f *fakeClient) receive(t *testing.T, messageType string) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-f.messages:
+			if message["type"] == messageType {
+				return message
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s message", messageType)
+			return nil
+		}
+	}
+}
+
+// waitFor polls condition until it holds, failing the test after five seconds
+func waitFor(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testCA is a certificate authority for tests, with its certificate in a PEM file
+type testCA struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	serial   int64
+}
+
+// newTestCA creates a certificate authority whose files live in a temporary directory
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, serial: 1}
+	ca.certFile = writePEM(t, "ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+// issue creates a certificate signed by the CA for the given DNS names or IP
+// addresses, usable by servers and clients alike
+func (ca *testCA) issue(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// issueFiles creates a certificate like issue and writes it and its key to PEM
+// files, returning their paths
+func (ca *testCA) issueFiles(t *testing.T, names ...string) (certFile, keyFile string) {
+	t.Helper()
+	cert := ca.issue(t, names...)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, names[0]+".crt", "CERTIFICATE", cert.Certificate[0]),
+		writePEM(t, names[0]+".key", "PRIVATE KEY", keyDER)
+}
+
+// writePEM writes a PEM block to a file in a temporary directory
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpListener is an address the server accepts HTTP requests on
+type httpListener struct {
+	addr string
+	tls  bool
+
+	// redirectToHTTPS answers every request with a redirect to the same URL on
+	// the first TLS listener instead of proxying it
+	redirectToHTTPS bool
+}
+
+// httpListeners returns the configured HTTP listeners. Without server.http.listeners
+// the server listens once, on server.http.host and port, with TLS if ssl.enabled.
+// LoadConfig refuses files that set both forms, see checkListenerForms.
+func httpListeners(config *Config) []httpListener {
+	httpConfig := config.Server.HTTP
+	if len(httpConfig.Listeners) == 0 {
+		return []httpListener{{
+			addr: net.JoinHostPort(httpConfig.Host, strconv.Itoa(httpConfig.Port)),
+			tls:  httpConfig.SSL.Enabled,
+		}}
+	}
+
+	listeners := make([]httpListener, 0, len(httpConfig.Listeners))
+	for _, l := range httpConfig.Listeners {
+		listeners = append(listeners, httpListener{
+			addr:            net.JoinHostPort(l.Host, strconv.Itoa(l.Port)),
+			tls:             l.TLS,
+			redirectToHTTPS: l.RedirectToHTTPS,
+		})
+	}
+	return listeners
+}
+
+// checkListenerForms fails if a configuration file sets server.http.listeners along
+// with the single listener's host, port or ssl.enabled, which the listeners would
+// otherwise silently override. data must already have decoded into a Config.
+func checkListenerForms(data []byte) error {
+	var probe struct {
+		Server struct {
+			HTTP struct {
+				Host *string `json:"host"`
+				Port *int    `json:"port"`
+				SSL  struct {
+					Enabled *bool `json:"enabled"`
+				} `json:"ssl"`
+				Listeners []json.RawMessage `json:"listeners"`
+			} `json:"http"`
+		} `json:"server"`
+	}
+	json.Unmarshal(data, &probe)
+
+	httpConfig := probe.Server.HTTP
+	if len(httpConfig.Listeners) == 0 {
+		return nil
+	}
+	var set []string
+	if httpConfig.Host != nil {
+		set = append(set, "host")
+	}
+	if httpConfig.Port != nil {
+		set = append(set, "port")
+	}
+	if httpConfig.SSL.Enabled != nil {
+		set = append(set, "ssl.enabled")
+	}
+	if len(set) > 0 {
+		return fmt.Errorf("%w: server.http.listeners can't be combined with server.http.%s; give each listener its own host, port and tls",
+			ErrInvalidConfig, strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// httpsPort returns the port of the first TLS listener, or "" if there is none
+func httpsPort(listeners []httpListener) string {
+	for _, l := range listeners {
+		if l.tls {
+			_, port, _ := net.SplitHostPort(l.addr)
+			return port
+		}
+	}
+	return ""
+}
+
+// checkHTTPListeners verifies that redirecting listeners have a TLS listener to
+// redirect to
+func checkHTTPListeners(listeners []httpListener) error {
+	for _, l := range listeners {
+		if !l.redirectToHTTPS {
+			continue
+		}
+		if l.tls {
+			return errors.New("listener " + l.addr + " redirects to HTTPS but is itself TLS")
+		}
+		if httpsPort(listeners) == "" {
+			return errors.New("listener " + l.addr + " redirects to HTTPS but no listener has TLS enabled")
+		}
+	}
+	return nil
+}
+
+// httpsRedirect redirects requests to the same host and URL over HTTPS on port.
+// GET and HEAD get a 301; other methods get a 308 so the method and body are kept.
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			hostname = h
+		}
+		host := strings.TrimSuffix(net.JoinHostPort(hostname, port), ":443")
+
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// boundHTTPListener is an HTTP listener that has been bound but not yet served
+type boundHTTPListener struct {
+	httpListener
+	server   *http.Server
+	listener net.Listener
+}
+
+// listenHTTP binds every configured HTTP listener. If any can't be bound, those
+// already bound are closed and the error is returned.
+func (s *ProxyServer) listenHTTP(handler http.Handler) ([]boundHTTPListener, error) {
+	listeners := httpListeners(s.config)
+
+	// The TLS listeners share one certificate
+	redirectPort := httpsPort(listeners)
+	var tlsConfig *tls.Config
+	if redirectPort != "" {
+		var err error
+		if tlsConfig, err = s.httpTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	timeouts := s.config.Server.HTTP.Timeouts
+	bound := make([]boundHTTPListener, 0, len(listeners))
+	for _, l := range listeners {
+		server := &http.Server{
+			Addr:              l.addr,
+			Handler:           handler,
+			ConnContext:       s.connContext,
+			ReadHeaderTimeout: time.Duration(timeouts.ReadHeader) * time.Millisecond,
+			ReadTimeout:       time.Duration(timeouts.Read) * time.Millisecond,
+			WriteTimeout:      time.Duration(timeouts.Write) * time.Millisecond,
+			IdleTimeout:       time.Duration(timeouts.Idle) * time.Millisecond,
+		}
+		if l.redirectToHTTPS {
+			server.Handler = httpsRedirect(redirectPort)
+		}
+		if l.tls {
+			server.TLSConfig = tlsConfig
+		}
+
+		// Listing the protocols replaces the defaults, so HTTP/2 over TLS is kept too
+		if s.config.Server.HTTP.H2C {
+			server.Protocols = new(http.Protocols)
+			server.Protocols.SetHTTP1(true)
+			server.Protocols.SetHTTP2(true)
+			server.Protocols.SetUnencryptedHTTP2(true)
+		}
+
+		listener, err := listen("tcp", l.addr, s.config.Server.Socket.ReusePort)
+		if err != nil {
+			for _, b := range bound {
+				b.listener.Close()
+			}
+			return nil, fmt.Errorf("HTTP listener: %w", err)
+		}
+		bound = append(bound, boundHTTPListener{httpListener: l, server: server, listener: listener})
+	}
+	return bound, nil
+}
+
+// serveHTTP serves a bound HTTP listener until the server stops
+func (s *ProxyServer) serveHTTP(l boundHTTPListener) {
+	s.logger.Info("server", "HTTP server listening", map[string]interface{}{
+		"address":         l.addr,
+		"tls":             l.tls,
+		"redirectToHttps": l.redirectToHTTPS,
+	})
+
+	var err error
+	if l.tls {
+		err = l.server.ServeTLS(l.listener, "", "")
+	} else {
+		err = l.server.Serve(l.listener)
+	}
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("server", "HTTP server error", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// httpTLSConfig loads the HTTP certificate and builds the TLS configuration
+// shared by the TLS listeners
+func (s *ProxyServer) httpTLSConfig() (*tls.Config, error) {
+	sslConfig := s.config.Server.HTTP.SSL
+	certs, err := newCertificateReloader(sslConfig.Cert, sslConfig.Key)
+	if err != nil {
+		return nil, err
+	}
+	s.addCertificates("http", certs)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.getCertificate,
+	}
+	if err := applyTLSPolicy(tlsConfig, sslConfig.MinVersion, sslConfig.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	// Ask callers for a certificate so its fingerprint can be forwarded; it is not verified
+	if sslConfig.RequestClientCert {
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	return tlsConfig, nil
+}
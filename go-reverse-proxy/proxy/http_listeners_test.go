@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addHTTPListener appends an HTTP listener on a free local port to the server
+// configuration and returns the port
+func addHTTPListener(t *testing.T, c *Config, tls, redirectToHTTPS bool) int {
+	t.Helper()
+	listeners := slices.Grow(c.Server.HTTP.Listeners, 1)[:len(c.Server.HTTP.Listeners)+1]
+	l := &listeners[len(listeners)-1]
+	l.Host = "127.0.0.1"
+	l.Port = freeTestPort(t)
+	l.TLS = tls
+	l.RedirectToHTTPS = redirectToHTTPS
+	c.Server.HTTP.Listeners = listeners
+	return l.Port
+}
+
+func TestPlainAndTLSListeners(t *testing.T) {
+	backend := httptest.NewServer(echoRequestURI)
+	t.Cleanup(backend.Close)
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueFiles(t, "127.0.0.1")
+
+	var plainPort, tlsPort int
+	p := startSocketServer(t, func(c *Config) {
+		c.Client.Proxy.DefaultTarget = backend.URL
+		c.Server.HTTP.SSL.Cert = certFile
+		c.Server.HTTP.SSL.Key = keyFile
+		plainPort = addHTTPListener(t, c, false, true)
+		tlsPort = addHTTPListener(t, c, true, false)
+	})
+	p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+
+	plainURL := "http://127.0.0.1:" + strconv.Itoa(plainPort)
+	tlsURL := "https://127.0.0.1:" + strconv.Itoa(tlsPort)
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for method, wantStatus := range map[string]int{
+		http.MethodGet:  http.StatusMovedPermanently,
+		http.MethodPost: http.StatusPermanentRedirect,
+	} {
+		req, err := http.NewRequest(method, plainURL+"/a/b?q=1", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := noRedirects.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != wantStatus || resp.Header.Get("Location") != tlsURL+"/a/b?q=1" {
+			t.Errorf("%s on the plain listener: got %d to %q, want %d to the TLS listener", method, resp.StatusCode, resp.Header.Get("Location"), wantStatus)
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	secure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	req, err := http.NewRequest(http.MethodGet, tlsURL+"/a/b?q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := secure.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil || string(body) != "/a/b?q=1" {
+		t.Errorf("TLS listener: got %d %q, want the request proxied over TLS", resp.StatusCode, body)
+	}
+}
+
+func TestCheckHTTPListeners(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		listeners []httpListener
+		wantErr   bool
+	}{
+		{"plain and TLS", []httpListener{{addr: ":80"}, {addr: ":443", tls: true}}, false},
+		{"redirect to TLS", []httpListener{{addr: ":80", redirectToHTTPS: true}, {addr: ":443", tls: true}}, false},
+		{"redirect without TLS", []httpListener{{addr: ":80", redirectToHTTPS: true}}, true},
+		{"TLS redirecting to itself", []httpListener{{addr: ":443", tls: true, redirectToHTTPS: true}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkHTTPListeners(tc.listeners); (err != nil) != tc.wantErr {
+				t.Errorf("checkHTTPListeners = %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestListenersCannotBeMixedWithSingleListener(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		http    string
+		wantErr bool
+	}{
+		{"listeners only", `{"listeners": [{"port": 443, "tls": true}], "ssl": {"cert": "server.crt", "key": "server.key"}}`, false},
+		{"single listener only", `{"host": "127.0.0.1", "port": 8443, "ssl": {"enabled": true}}`, false},
+		{"listeners with port", `{"port": 8080, "listeners": [{"port": 80}]}`, true},
+		{"listeners with host", `{"host": "127.0.0.1", "listeners": [{"port": 80}]}`, true},
+		{"listeners with ssl.enabled", `{"ssl": {"enabled": true}, "listeners": [{"port": 443, "tls": true}]}`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeNamedConfig(t, "config.json", `{"server": {"http": `+tc.http+`}}`)
+			_, err := loadConfig(t, path)
+			if tc.wantErr && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("err = %v, want ErrInvalidConfig", err)
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("err = %v, want none", err)
+			}
+		})
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	p := startSocketServer(t, func(c *Config) { c.Server.HTTP.Timeouts.ReadHeader = 200 })
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(p.config.Server.HTTP.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish its headers
+	start := time.Now()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); isTimeout(err) {
+		t.Fatal("the connection with unfinished headers was left open")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %v, want it cut off soon after the 200ms header timeout", elapsed)
+	}
+}
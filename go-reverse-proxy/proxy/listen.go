@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listen opens a listener with the server's socket options applied. Unix sockets
+// are listened on as they are; address reuse only applies to TCP.
+func listen(network, addr string, reusePort bool) (net.Listener, error) {
+	listenConfig := net.ListenConfig{}
+	if network != "unix" {
+		listenConfig.Control = func(network, address string, conn syscall.RawConn) error {
+			return setListenOptions(conn, reusePort)
+		}
+	}
+	return listenConfig.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListenRebindsPortInTimeWait(t *testing.T) {
+	listener, err := listen("tcp", "127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+
+	// Closing the accepted side first leaves the port's connection in TIME_WAIT
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+	conn.Close()
+	listener.Close()
+
+	listener, err = listen("tcp", addr, false)
+	if err != nil {
+		t.Fatalf("rebinding %s: %v", addr, err)
+	}
+	listener.Close()
+}
+
+func TestServerRestartsOnSamePorts(t *testing.T) {
+	p := startSocketServer(t, nil)
+	p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+	p.get(t, "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.server.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewProxyServer(p.config, p.logger)
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("restarting on the same ports: %v", err)
+	}
+	restarted.Stop(ctx)
+}
+
+// socketServerConfig returns a test configuration with the HTTP and socket
+// listeners on free local ports
+func socketServerConfig(t *testing.T) *Config {
+	t.Helper()
+	config := newTestConfig(t)
+	config.Server.HTTP.Host = "127.0.0.1"
+	config.Server.HTTP.Port = freeTestPort(t)
+	config.Server.Socket.Host = "127.0.0.1"
+	config.Server.Socket.Port = freeTestPort(t)
+	return config
+}
+
+func TestStartRejectsInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{"rate limit without a burst", func(c *Config) {
+			c.Server.PerClientRateLimit.RequestsPerSecond = 10
+			c.Server.PerClientRateLimit.Burst = 0
+		}},
+		{"negative route timeout", func(c *Config) {
+			addRoute(c, "", "/slow", false)
+			c.Server.Routes[0].Timeout = -1
+		}},
+		{"unknown load balancing strategy", func(c *Config) { c.Server.LoadBalancing.Strategy = "least_connections" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newTestConfig(t)
+			tc.configure(config)
+
+			server := NewProxyServer(config, newTestLogger(t, config))
+			server.SetTransport(NewMemoryTransport())
+			if err := server.Start(); !errors.Is(err, ErrInvalidConfig) {
+				server.Stop(context.Background())
+				t.Fatalf("Start = %v, want ErrInvalidConfig", err)
+			}
+		})
+	}
+}
+
+func TestStartFailsOnBadCertificate(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{"HTTP listener", func(c *Config) {
+			c.Server.HTTP.SSL.Enabled = true
+			c.Server.HTTP.SSL.Cert, c.Server.HTTP.SSL.Key = missing, missing
+		}},
+		{"socket listener", func(c *Config) {
+			c.Server.Socket.SSL.Enabled = true
+			c.Server.Socket.SSL.Cert, c.Server.Socket.SSL.Key = missing, missing
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := socketServerConfig(t)
+			tc.configure(config)
+
+			server := NewProxyServer(config, newTestLogger(t, config))
+			if err := server.Start(); !errors.Is(err, ErrTLSLoad) {
+				server.Stop(context.Background())
+				t.Fatalf("Start = %v, want ErrTLSLoad", err)
+			}
+
+			// Nothing is left listening
+			for _, port := range []int{config.Server.HTTP.Port, config.Server.Socket.Port} {
+				l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+				if err != nil {
+					t.Errorf("port %d still in use after Start failed: %v", port, err)
+					continue
+				}
+				l.Close()
+			}
+		})
+	}
+}
+
+func TestStartFailsWhenSocketPortIsTaken(t *testing.T) {
+	config := socketServerConfig(t)
+	busy, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(config.Server.Socket.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	if err := NewProxyServer(config, newTestLogger(t, config)).Start(); err == nil {
+		t.Fatal("Start succeeded with the socket port taken")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(config.Server.HTTP.Port))
+	if err != nil {
+		t.Fatalf("HTTP port still in use after Start failed: %v", err)
+	}
+	l.Close()
+}
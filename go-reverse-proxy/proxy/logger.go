@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel represents the severity level of a log message
+type LogLevel string
+
+const (
+	DebugLevel LogLevel = "debug"
+	InfoLevel  LogLevel = "info"
+	WarnLevel  LogLevel = "warn"
+	ErrorLevel LogLevel = "error"
+)
+
+// Logger handles logging functionality
+type Logger struct {
+	level    LogLevel
+	file     *os.File
+	mu       sync.Mutex
+	levelMap map[LogLevel]int
+
+	// maxEntryBytes caps the serialized size of a log entry (0 means unlimited)
+	maxEntryBytes int
+
+	// format is either FormatJSON or FormatText
+	format string
+
+	// redactHeaders holds the canonical names of headers whose values are never logged
+	redactHeaders map[string]bool
+
+	// syslog receives every entry as well as the file when set
+	syslog syslogWriter
+
+	// filePath is the configured log file. With rotation other than RotationNone,
+	// file is the dated file for the period starting at period instead.
+	filePath   string
+	rotation   string
+	maxAgeDays int
+	period     time.Time
+
+	// now is the clock entries are timestamped and rotated by
+	now func() time.Time
+}
+
+// syslogWriter sends log entries to syslog at the severity matching their level
+type syslogWriter interface {
+	write(level LogLevel, entry string) error
+	Close() error
+}
+
+// redactedValue replaces the values of redacted headers
+const redactedValue = "***"
+
+// Log output formats
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// truncatedMarker is appended to context values cut short by the entry size cap
+const truncatedMarker = "...[truncated]"
+
+// NewLogger creates a new Logger instance. An empty filePath writes no log file,
+// for when entries only go to syslog.
+func NewLogger(level string, filePath string) (*Logger, error) {
+	var file *os.File
+	if filePath != "" {
+		var err error
+		file, err = os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrLogFile, err)
+		}
+	}
+
+	levelMap := map[LogLevel]int{
+		DebugLevel: 0,
+		InfoLevel:  1,
+		WarnLevel:  2,
+		ErrorLevel: 3,
+	}
+
+	return &Logger{
+		level:    LogLevel(level),
+		file:     file,
+		levelMap: levelMap,
+		format:   FormatJSON,
+		filePath: filePath,
+		rotation: RotationNone,
+		now:      time.Now,
+	}, nil
+}
+
+// SetMaxEntryBytes sets the maximum serialized size of a log entry; oversized
+// context values are truncated to fit. Zero disables the limit.
+func (l *Logger) SetMaxEntryBytes(maxBytes int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxEntryBytes = maxBytes
+}
+
+// SetFormat selects the log output format, either FormatJSON or FormatText
+func (l *Logger) SetFormat(format string) error {
+	if format != FormatJSON && format != FormatText {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.format = format
+	return nil
+}
+
+// SetRedactHeaders sets the headers whose values are replaced with *** wherever
+// a header map appears in a log entry's context
+func (l *Logger) SetRedactHeaders(headers []string) {
+	redact := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		redact[http.CanonicalHeaderKey(header)] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.redactHeaders = redact
+}
+
+// SetSyslog sends entries to syslog as well as the log file. network is "udp" or
+// "tcp" for a remote daemon at addr, or empty for the local one. Entries keep
+// their format and are sent with the severity matching their level.
+func (l *Logger) SetSyslog(network, addr, facility, tag string) error {
+	writer, err := dialSyslog(network, addr, facility, tag)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
+	l.syslog = writer
+	return nil
+}
+
+// SetLevel changes the minimum level that is logged
+func (l *Logger) SetLevel(level string) error {
+	if _, ok := l.levelMap[LogLevel(level)]; !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = LogLevel(level)
+	return nil
+}
+
+// Level returns the minimum level that is logged
+func (l *Logger) Level() LogLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.level
+}
+
+// Close closes the logger's file and syslog connection
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// log writes a log message with the given level and context
+func (l *Logger) log(level LogLevel, category string, message string, context map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.levelMap[level] < l.levelMap[l.level] {
+		return
+	}
+
+	context = l.redact(context)
+
+	now := l.now()
+	if l.rotation != RotationNone && l.file != nil {
+		if err := l.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "Error rotating log file: %v\n", err)
+		}
+	}
+	if l.format == FormatText {
+		l.write(level, l.formatText(now, level, category, message, context))
+		return
+	}
+
+	logEntry := map[string]interface{}{
+		"timestamp": now.Format(time.RFC3339),
+		"level":     level,
+		"category":  category,
+		"message":   message,
+	}
+
+	if context != nil {
+		for k, v := range context {
+			logEntry[k] = v
+		}
+	}
+
+	jsonData, err := json.Marshal(logEntry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error marshaling log entry: %v\n", err)
+		return
+	}
+
+	if l.maxEntryBytes > 0 && len(jsonData) > l.maxEntryBytes && len(context) > 0 {
+		jsonData, err = l.truncateEntry(logEntry, context)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error marshaling log entry: %v\n", err)
+			return
+		}
+	}
+
+	l.write(level, string(jsonData))
+}
+
+// redact returns context with the values of redacted headers scrubbed from any
+// header maps it contains. The caller's maps are never modified.
+func (l *Logger) redact(context map[string]interface{}) map[string]interface{} {
+	if len(l.redactHeaders) == 0 {
+		return context
+	}
+
+	var redacted map[string]interface{}
+	for k, v := range context {
+		scrubbed, changed := l.redactHeaderMap(v)
+		if !changed {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]interface{}, len(context))
+			for key, value := range context {
+				redacted[key] = value
+			}
+		}
+		redacted[k] = scrubbed
+	}
+
+	if redacted == nil {
+		return context
+	}
+	return redacted
+}
+
+// redactHeaderMap scrubs redacted headers from v if it is a header map, reporting
+// whether anything was replaced
+func (l *Logger) redactHeaderMap(v interface{}) (interface{}, bool) {
+	switch headers := v.(type) {
+	case http.Header:
+		return redactHeaderValues(headers, l.redactHeaders, []string{redactedValue})
+	case map[string][]string:
+		return redactHeaderValues(headers, l.redactHeaders, []string{redactedValue})
+	case map[string]string:
+		return redactHeaderValues(headers, l.redactHeaders, redactedValue)
+	case map[string]interface{}:
+		return redactHeaderValues(headers, l.redactHeaders, interface{}(redactedValue))
+	default:
+		return v, false
+	}
+}
+
+// redactHeaderValues returns a copy of headers with the values of redacted headers
+// replaced, or headers itself if none of them are present
+func redactHeaderValues[M ~map[string]V, V any](headers M, redact map[string]bool, replacement V) (interface{}, bool) {
+	var scrubbed M
+	for name := range headers {
+		if !redact[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		if scrubbed == nil {
+			scrubbed = make(M, len(headers))
+			for key, value := range headers {
+				scrubbed[key] = value
+			}
+		}
+		scrubbed[name] = replacement
+	}
+
+	if scrubbed == nil {
+		return headers, false
+	}
+	return scrubbed, true
+}
+
+// write appends a single entry to the log file and sends it to syslog
+func (l *Logger) write(level LogLevel, entry string) {
+	if l.file != nil {
+		output := fmt.Sprintf("%s\n", entry)
+		if _, err := io.WriteString(l.file, output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to log file: %v\n", err)
+		}
+	}
+	if l.syslog != nil {
+		if err := l.syslog.write(level, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to syslog: %v\n", err)
+		}
+	}
+}
+
+// formatText renders an entry as a human-readable line:
+// 2006-01-02T15:04:05 [LEVEL] category: message key=value ...
+func (l *Logger) formatText(now time.Time, level LogLevel, category string, message string, context map[string]interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s [%s] %s: %s", now.Format("2006-01-02T15:04:05"), strings.ToUpper(string(level)), category, message)
+
+	keys := make([]string, 0, len(context))
+	for k := range context {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, formatTextValue(context[k]))
+	}
+
+	line := b.String()
+	if l.maxEntryBytes > 0 && len(line) > l.maxEntryBytes {
+		line = line[:max(l.maxEntryBytes-len(truncatedMarker), 0)] + truncatedMarker
+	}
+	return line
+}
+
+// formatTextValue renders a context value for the text format, quoting strings
+// that would otherwise be ambiguous
+func formatTextValue(v interface{}) string {
+	var str string
+	switch value := v.(type) {
+	case string:
+		str = value
+	case error:
+		str = value.Error()
+	case fmt.Stringer:
+		str = value.String()
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return fmt.Sprint(value)
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprintf("%q", fmt.Sprint(value))
+		}
+		return string(data)
+	}
+
+	if str == "" || strings.ContainsAny(str, " =\"\n\t") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// truncateEntry shrinks the context values of an oversized log entry so that
+// each gets an equal share of the size limit
+func (l *Logger) truncateEntry(logEntry map[string]interface{}, context map[string]interface{}) ([]byte, error) {
+	share := l.maxEntryBytes / (len(context) + 1)
+	for k, v := range context {
+		value, err := json.Marshal(v)
+		if err != nil || len(value) <= share {
+			continue
+		}
+		cut := max(share-len(truncatedMarker), 0)
+		if str, ok := v.(string); ok && cut < len(str) {
+			value = []byte(str)
+		}
+		logEntry[k] = string(value[:cut]) + truncatedMarker
+	}
+
+	jsonData, err := json.Marshal(logEntry)
+	if err != nil || len(jsonData) <= l.maxEntryBytes {
+		return jsonData, err
+	}
+
+	// Still too large (e.g. many keys or a huge message); drop the context entirely
+	for k := range context {
+		delete(logEntry, k)
+	}
+	logEntry["truncated"] = true
+	return json.Marshal(logEntry)
+}
+
+// Debug logs a debug message
+func (l *Logger) Debug(category string, message string, context map[string]interface{}) {
+	l.log(DebugLevel, category, message, context)
+}
+
+// Info logs an info message
+func (l *Logger) Info(category string, message string, context map[string]interface{}) {
+	l.log(InfoLevel, category, message, context)
+}
+
+// Warn logs a warning message
+func (l *Logger) Warn(category string, message string, context map[string]interface{}) {
+	l.log(WarnLevel, category, message, context)
+}
+
+// Error logs an error message
+func (l *Logger) Error(category string, message string, context map[string]interface{}) {
+	l.log(ErrorLevel, category, message, context)
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Intervals at which the log file is rotated
+const (
+	RotationNone   = "none"
+	RotationDaily  = "daily"
+	RotationHourly = "hourly"
+)
+
+// rotationLayouts are the timestamps in the names of rotated log files
+var rotationLayouts = map[string]string{
+	RotationDaily:  "2006-01-02",
+	RotationHourly: "2006-01-02-15",
+}
+
+// SetRotation starts a new log file every day or hour instead of writing to one
+// file forever. Each file is named after the configured one with the start of
+// its period added, so proxy.log becomes proxy-2024-01-15.log, or
+// proxy-2024-01-15-13.log when rotating hourly. Rotated files more than
+// maxAgeDays days old are deleted as new ones are started; 0 keeps them all.
+func (l *Logger) SetRotation(interval string, maxAgeDays int) error {
+	if _, ok := rotationLayouts[interval]; !ok && interval != RotationNone {
+		return fmt.Errorf("unknown rotation interval %q", interval)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotation = interval
+	l.maxAgeDays = maxAgeDays
+	if interval == RotationNone || l.file == nil {
+		return nil
+	}
+
+	// The undated file opened by NewLogger is replaced by the first dated one,
+	// and removed if nothing was written to it
+	l.period = time.Time{}
+	undated := l.file
+	if err := l.rotate(l.now()); err != nil {
+		return err
+	}
+	undated.Close()
+	if info, err := os.Stat(l.filePath); err == nil && info.Size() == 0 {
+		os.Remove(l.filePath)
+	}
+	return nil
+}
+
+// rotate switches to the file for the period containing now if the current
+// period has ended; the caller must hold mu
+func (l *Logger) rotate(now time.Time) error {
+	period := rotationPeriod(l.rotation, now)
+	if period.Equal(l.period) {
+		return nil
+	}
+
+	file, err := os.OpenFile(rotatedLogPath(l.filePath, l.rotation, period), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLogFile, err)
+	}
+	if !l.period.IsZero() {
+		l.file.Close()
+	}
+	l.file = file
+	l.period = period
+
+	if l.maxAgeDays > 0 {
+		l.removeOldLogs(now.AddDate(0, 0, -l.maxAgeDays))
+	}
+	return nil
+}
+
+// removeOldLogs deletes the rotated log files whose period started before cutoff;
+// the caller must hold mu
+func (l *Logger) removeOldLogs(cutoff time.Time) {
+	ext := filepath.Ext(l.filePath)
+	prefix := strings.TrimSuffix(l.filePath, ext) + "-"
+	matches, _ := filepath.Glob(prefix + "*" + ext)
+	for _, path := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext)
+		period, err := time.ParseInLocation(rotationLayouts[l.rotation], stamp, time.Local)
+		if err != nil || !period.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing old log file: %v\n", err)
+		}
+	}
+}
+
+// rotationPeriod returns the start of the day or hour containing now, in local time
+func rotationPeriod(interval string, now time.Time) time.Time {
+	now = now.Local()
+	if interval == RotationHourly {
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, time.Local)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// rotatedLogPath returns the name of the log file for the period starting at period
+func rotatedLogPath(path string, interval string, period time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + period.Format(rotationLayouts[interval]) + ext
+}
@@ -0,0 +1,69 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// syslogFacilities maps facility names to their log/syslog values
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogSender writes log entries to a syslog daemon
+type syslogSender struct {
+	writer *syslog.Writer
+}
+
+// dialSyslog connects to the syslog daemon at addr over network ("udp" or "tcp"),
+// or to the local daemon if network is empty
+func dialSyslog(network, addr, facility, tag string) (syslogWriter, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	writer, err := syslog.Dial(network, addr, priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSender{writer: writer}, nil
+}
+
+// write sends an entry with the syslog severity matching its level
+func (s *syslogSender) write(level LogLevel, entry string) error {
+	switch level {
+	case DebugLevel:
+		return s.writer.Debug(entry)
+	case WarnLevel:
+		return s.writer.Warning(entry)
+	case ErrorLevel:
+		return s.writer.Err(entry)
+	default:
+		return s.writer.Info(entry)
+	}
+}
+
+func (s *syslogSender) Close() error {
+	return s.writer.Close()
+}
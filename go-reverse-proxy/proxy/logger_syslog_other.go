@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package proxy
+
+import "errors"
+
+// dialSyslog is unavailable on platforms without log/syslog
+func dialSyslog(network, addr, facility, tag string) (syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
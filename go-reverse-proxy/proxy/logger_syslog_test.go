@@ -0,0 +1,61 @@
+//go:build !windows && !plan9
+
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSeverities(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	logger, err := NewLogger("debug", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	if err := logger.SetSyslog("udp", listener.LocalAddr().String(), "local3", "proxy"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("test", "debug entry", nil)
+	logger.Info("test", "info entry", nil)
+	logger.Warn("test", "warn entry", nil)
+	logger.Error("test", "error entry", nil)
+
+	// local3 is facility 19, so the priority is 19*8 plus the severity
+	for _, want := range []struct{ priority, message string }{
+		{"<159>", "debug entry"},
+		{"<158>", "info entry"},
+		{"<156>", "warn entry"},
+		{"<155>", "error entry"},
+	} {
+		buffer := make([]byte, 2048)
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := listener.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(buffer[:n])
+		if !strings.HasPrefix(got, want.priority) || !strings.Contains(got, "proxy[") || !strings.Contains(got, want.message) {
+			t.Errorf("syslog message = %q, want priority %s with tag proxy and %q", got, want.priority, want.message)
+		}
+	}
+}
+
+func TestSyslogUnknownFacility(t *testing.T) {
+	logger, err := NewLogger("info", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	if err := logger.SetSyslog("udp", "127.0.0.1:514", "bogus", "proxy"); err == nil {
+		t.Error("SetSyslog accepted an unknown facility")
+	}
+}
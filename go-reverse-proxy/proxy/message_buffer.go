@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// Frame layout: a version byte, a 4-byte big-endian payload length, a flags byte,
+// a 4-byte big-endian CRC32 (IEEE) of the payload, then the payload itself
+const (
+	frameVersion    byte = 1
+	frameHeaderSize      = 10
+
+	// flagCompressed marks a gzip-compressed payload
+	flagCompressed byte = 1 << 0
+)
+
+var (
+	// ErrFrameVersion is returned when a frame uses an unknown format; the rest of the buffered data is discarded
+	ErrFrameVersion = errors.New("unsupported frame version")
+
+	// ErrChecksumMismatch is returned when a frame's payload does not match its checksum; the frame is dropped
+	ErrChecksumMismatch = errors.New("frame checksum mismatch")
+
+	// ErrFrameTooLarge is returned when a frame's payload, as declared or once
+	// decompressed, exceeds the configured maximum; the frame is dropped
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// ErrCompressionNotNegotiated is returned for a compressed frame received while
+	// decompression is disabled; the frame is dropped
+	ErrCompressionNotNegotiated = errors.New("compressed frame without negotiated compression")
+)
+
+// MessageBuffer handles message framing and buffering
+type MessageBuffer struct {
+	// bufferMutex guards buffer, so its state can be inspected while another
+	// goroutine consumes data
+	bufferMutex sync.Mutex
+	buffer      bytes.Buffer
+
+	onData   func([]byte)
+	onError  func(error)
+	inFlight sync.WaitGroup
+
+	// maxFrameBytes is the largest payload a frame may declare (0 means no limit);
+	// discard counts the bytes of an oversized frame still to be skipped. Both are
+	// guarded by bufferMutex.
+	maxFrameBytes int
+	discard       int
+
+	// Compression settings, changed once the peers have negotiated: whether
+	// outgoing payloads are compressed, and whether incoming compressed payloads
+	// are accepted and how large they may inflate (0 means no limit)
+	compressionMutex  sync.RWMutex
+	compress          bool
+	compressThreshold int
+	decompress        bool
+	maxInflatedBytes  int
+}
+
+// NewMessageBuffer creates a new MessageBuffer instance
+func NewMessageBuffer() *MessageBuffer {
+	return &MessageBuffer{
+		buffer: bytes.Buffer{},
+	}
+}
+
+// SetOnDataCallback sets the callback function for when a complete message is
+// received. It is called on a new goroutine for every message, without limit, so
+// messages are handled concurrently and in no particular order.
+func (mb *MessageBuffer) SetOnDataCallback(callback func([]byte)) {
+	mb.onData = callback
+}
+
+// SetOnErrorCallback sets the callback function for each frame Consume drops. It is
+// called after Consume has released the buffer, so it may call Reset.
+func (mb *MessageBuffer) SetOnErrorCallback(callback func(error)) {
+	mb.onError = callback
+}
+
+// SetCompression controls whether Produce gzips payloads of at least threshold bytes.
+// It only affects sending; see SetDecompression for receiving.
+func (mb *MessageBuffer) SetCompression(enabled bool, threshold int) {
+	mb.compressionMutex.Lock()
+	defer mb.compressionMutex.Unlock()
+	mb.compress = enabled
+	mb.compressThreshold = threshold
+}
+
+// SetDecompression controls whether Consume accepts compressed frames, and how many
+// bytes their payloads may inflate to (0 means no limit). Compressed frames are
+// rejected until it is enabled, so it should be enabled only once the peer may
+// send them under the negotiated settings.
+func (mb *MessageBuffer) SetDecompression(enabled bool, maxInflatedBytes int) {
+	mb.compressionMutex.Lock()
+	defer mb.compressionMutex.Unlock()
+	mb.decompress = enabled
+	mb.maxInflatedBytes = maxInflatedBytes
+}
+
+// SetMaxFrameSize sets the largest payload an incoming frame may declare. Larger
+// frames are skipped as they arrive rather than buffered. Zero disables the limit.
+func (mb *MessageBuffer) SetMaxFrameSize(maxBytes int) {
+	mb.bufferMutex.Lock()
+	defer mb.bufferMutex.Unlock()
+	mb.maxFrameBytes = maxBytes
+}
+
+// Consume processes incoming data and extracts complete messages. Frames that fail
+// validation are dropped and reported in the returned error, and to the error
+// callback if one is set; the remaining frames are still processed.
+func (mb *MessageBuffer) Consume(data []byte) error {
+	errs := mb.consume(data)
+	if mb.onError != nil {
+		for _, err := range errs {
+			mb.onError(err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// consume buffers data and extracts its complete messages, returning the errors
+// of the frames it dropped
+func (mb *MessageBuffer) consume(data []byte) []error {
+	mb.bufferMutex.Lock()
+	defer mb.bufferMutex.Unlock()
+
+	mb.buffer.Write(data)
+
+	var errs []error
+	for {
+		// Skip what has arrived of an oversized frame
+		if mb.discard > 0 {
+			skipped := min(mb.discard, mb.buffer.Len())
+			mb.buffer.Next(skipped)
+			mb.discard -= skipped
+			if mb.discard > 0 {
+				return errs
+			}
+		}
+
+		// Check if we have enough data for the frame header
+		if mb.buffer.Len() < frameHeaderSize {
+			return errs
+		}
+
+		// Read the frame header
+		header := mb.buffer.Bytes()[:frameHeaderSize]
+		if header[0] != frameVersion {
+			// Without a known layout the frame boundaries can't be trusted
+			mb.buffer.Reset()
+			errs = append(errs, fmt.Errorf("%w: %d", ErrFrameVersion, header[0]))
+			return errs
+		}
+		length := binary.BigEndian.Uint32(header[1:5])
+		flags := header[5]
+		checksum := binary.BigEndian.Uint32(header[6:10])
+
+		if mb.maxFrameBytes > 0 && int64(length) > int64(mb.maxFrameBytes) {
+			mb.buffer.Next(frameHeaderSize)
+			mb.discard = int(length)
+			errs = append(errs, fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrFrameTooLarge, length, mb.maxFrameBytes))
+			continue
+		}
+
+		// Check if we have the complete message
+		if mb.buffer.Len() < int(length)+frameHeaderSize {
+			return errs
+		}
+
+		// Extract the message
+		message := make([]byte, length)
+		mb.buffer.Next(frameHeaderSize) // Skip the frame header
+		mb.buffer.Read(message)
+
+		if crc32.ChecksumIEEE(message) != checksum {
+			errs = append(errs, ErrChecksumMismatch)
+			continue
+		}
+
+		if flags&flagCompressed != 0 {
+			mb.compressionMutex.RLock()
+			decompress, maxInflatedBytes := mb.decompress, mb.maxInflatedBytes
+			mb.compressionMutex.RUnlock()
+			if !decompress {
+				errs = append(errs, ErrCompressionNotNegotiated)
+				continue
+			}
+
+			decompressed, err := decompressPayload(message, maxInflatedBytes)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to decompress frame: %w", err))
+				continue
+			}
+			message = decompressed
+		}
+
+		// Process the message
+		if mb.onData != nil {
+			// Call the callback asynchronously
+			mb.inFlight.Add(1)
+			go func() {
+				defer mb.inFlight.Done()
+				mb.onData(message)
+			}()
+		}
+	}
+}
+
+// BufferedBytes returns the number of bytes held for frames that have not fully arrived
+func (mb *MessageBuffer) BufferedBytes() int {
+	mb.bufferMutex.Lock()
+	defer mb.bufferMutex.Unlock()
+	return mb.buffer.Len()
+}
+
+// PendingFrameLength returns the payload length declared by the header of a frame
+// that has only partly arrived. It reports false if no frame header is buffered.
+// A header that arrived without its payload points at a stalled peer.
+func (mb *MessageBuffer) PendingFrameLength() (int, bool) {
+	mb.bufferMutex.Lock()
+	defer mb.bufferMutex.Unlock()
+	if mb.buffer.Len() < frameHeaderSize {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(mb.buffer.Bytes()[1:5])), true
+}
+
+// Reset discards everything buffered, including any partly received frame, and
+// stops skipping an oversized one. Call it when the buffered data can no longer be
+// trusted, for example after a protocol violation has been detected, so that the
+// next data consumed is read as the start of a new frame. Messages already handed
+// to the data callback are unaffected.
+func (mb *MessageBuffer) Reset() {
+	mb.bufferMutex.Lock()
+	defer mb.bufferMutex.Unlock()
+	mb.buffer.Reset()
+	mb.discard = 0
+}
+
+// Drain should be called once the underlying connection has closed. It waits up to
+// timeout for callbacks of already-received messages to finish, so complete messages
+// that arrived just before the close are still handled, then discards any partial
+// frame. It returns false if the timeout elapsed first.
+func (mb *MessageBuffer) Drain(timeout time.Duration) bool {
+	mb.Reset()
+
+	finished := make(chan struct{})
+	go func() {
+		mb.inFlight.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Produce creates a framed message with a header, compressing the payload
+// when compression is enabled and it makes the payload smaller
+func (mb *MessageBuffer) Produce(data []byte) []byte {
+	var flags byte
+
+	mb.compressionMutex.RLock()
+	compress := mb.compress && len(data) >= mb.compressThreshold
+	mb.compressionMutex.RUnlock()
+
+	if compress {
+		if compressed, err := compressPayload(data); err == nil && len(compressed) < len(data) {
+			data = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	header := make([]byte, frameHeaderSize)
+	header[0] = frameVersion
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(data)))
+	header[5] = flags
+	binary.BigEndian.PutUint32(header[6:10], crc32.ChecksumIEEE(data))
+
+	// Combine frame header and message
+	result := make([]byte, 0, len(header)+len(data))
+	result = append(result, header...)
+	result = append(result, data...)
+
+	return result
+}
+
+// compressPayload gzips a frame payload
+func compressPayload(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// decompressPayload inflates a gzip-compressed frame payload, failing if it would
+// exceed maxBytes (0 means no limit)
+func decompressPayload(data []byte, maxBytes int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if maxBytes <= 0 {
+		return io.ReadAll(reader)
+	}
+
+	// Read one byte past the limit to tell a payload that fits from one that doesn't
+	inflated, err := io.ReadAll(io.LimitReader(reader, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > maxBytes {
+		return nil, fmt.Errorf("%w: inflates beyond the limit of %d bytes", ErrFrameTooLarge, maxBytes)
+	}
+	return inflated, nil
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMessageBuffer returns a MessageBuffer that delivers its messages to the
+// returned channel
+func newTestMessageBuffer() (*MessageBuffer, chan []byte) {
+	messages := make(chan []byte, 16)
+	mb := NewMessageBuffer()
+	mb.SetOnDataCallback(func(data []byte) { messages <- data })
+	return mb, messages
+}
+
+// receive returns the next message delivered to messages
+func receive(t *testing.T, messages chan []byte) []byte {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+// compressedFrame returns a frame for payload that is compressed
+func compressedFrame(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	sender := NewMessageBuffer()
+	sender.SetCompression(true, 0)
+	frame := sender.Produce(payload)
+	if frame[5]&flagCompressed == 0 {
+		t.Fatal("payload was not compressed")
+	}
+	return frame
+}
+
+func TestMessageBufferCompressionRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible "), 1000)
+	frame := compressedFrame(t, payload)
+	if len(frame) >= len(payload) {
+		t.Errorf("frame of %d bytes is not smaller than the %d byte payload", len(frame), len(payload))
+	}
+
+	receiver, messages := newTestMessageBuffer()
+	receiver.SetDecompression(true, 0)
+	if err := receiver.Consume(frame); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(t, messages); !bytes.Equal(got, payload) {
+		t.Errorf("received %d bytes, want the %d byte payload", len(got), len(payload))
+	}
+}
+
+func TestMessageBufferCompressionThreshold(t *testing.T) {
+	sender := NewMessageBuffer()
+	sender.SetCompression(true, 1024)
+	if frame := sender.Produce(bytes.Repeat([]byte("a"), 1023)); frame[5]&flagCompressed != 0 {
+		t.Error("payload below the threshold was compressed")
+	}
+	if frame := sender.Produce(bytes.Repeat([]byte("a"), 1024)); frame[5]&flagCompressed == 0 {
+		t.Error("payload at the threshold was not compressed")
+	}
+}
+
+func TestMessageBufferRejectsUnnegotiatedCompression(t *testing.T) {
+	receiver, messages := newTestMessageBuffer()
+	frame := compressedFrame(t, bytes.Repeat([]byte("x"), 4096))
+	plain := NewMessageBuffer().Produce([]byte("plain"))
+
+	err := receiver.Consume(append(frame, plain...))
+	if !errors.Is(err, ErrCompressionNotNegotiated) {
+		t.Fatalf("Consume = %v, want ErrCompressionNotNegotiated", err)
+	}
+	if got := receive(t, messages); string(got) != "plain" {
+		t.Errorf("received %q, want the frame after the rejected one", got)
+	}
+}
+
+func TestMessageBufferInflateLimit(t *testing.T) {
+	receiver, messages := newTestMessageBuffer()
+	receiver.SetDecompression(true, 4096)
+
+	err := receiver.Consume(compressedFrame(t, bytes.Repeat([]byte("x"), 4097)))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Consume = %v, want ErrFrameTooLarge", err)
+	}
+
+	if err := receiver.Consume(compressedFrame(t, bytes.Repeat([]byte("x"), 4096))); err != nil {
+		t.Fatalf("Consume at the limit = %v", err)
+	}
+	if got := receive(t, messages); len(got) != 4096 {
+		t.Errorf("received %d bytes, want 4096", len(got))
+	}
+}
+
+func TestMessageBufferSkipsOversizedFrames(t *testing.T) {
+	receiver, messages := newTestMessageBuffer()
+	receiver.SetMaxFrameSize(100)
+
+	sender := NewMessageBuffer()
+	oversized := sender.Produce(bytes.Repeat([]byte("x"), 101))
+	next := sender.Produce([]byte("next"))
+
+	// The oversized frame arrives in pieces, and is skipped rather than buffered
+	if err := receiver.Consume(oversized[:50]); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Consume = %v, want ErrFrameTooLarge", err)
+	}
+	if buffered := receiver.BufferedBytes(); buffered != 0 {
+		t.Errorf("BufferedBytes = %d while skipping, want 0", buffered)
+	}
+	if err := receiver.Consume(append(oversized[50:], next...)); err != nil {
+		t.Fatalf("Consume after the oversized frame = %v", err)
+	}
+	if got := receive(t, messages); string(got) != "next" {
+		t.Errorf("received %q, want the frame after the oversized one", got)
+	}
+}
+
+func TestMessageBufferChecksum(t *testing.T) {
+	sender := NewMessageBuffer()
+	for _, tc := range []struct {
+		name    string
+		corrupt func(frame []byte)
+		wantErr error
+	}{
+		{"valid frame", func([]byte) {}, nil},
+		{"corrupted payload", func(frame []byte) { frame[frameHeaderSize] ^= 0x01 }, ErrChecksumMismatch},
+		{"corrupted checksum", func(frame []byte) { frame[frameHeaderSize-1] ^= 0x01 }, ErrChecksumMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver, messages := newTestMessageBuffer()
+			frame := sender.Produce([]byte(`{"type":"ping"}`))
+			tc.corrupt(frame)
+
+			if err := receiver.Consume(frame); !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Consume = %v, want %v", err, tc.wantErr)
+			}
+			select {
+			case got := <-messages:
+				if tc.wantErr != nil {
+					t.Errorf("delivered %q from a corrupt frame", got)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tc.wantErr == nil {
+					t.Error("the valid frame was not delivered")
+				}
+			}
+		})
+	}
+}
+
+func TestMessageBufferErrorCallback(t *testing.T) {
+	receiver, messages := newTestMessageBuffer()
+	var reported []error
+	receiver.SetOnErrorCallback(func(err error) { reported = append(reported, err) })
+
+	sender := NewMessageBuffer()
+	corrupt := sender.Produce([]byte("corrupt"))
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := receiver.Consume(append(corrupt, sender.Produce([]byte("intact"))...)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Consume = %v, want ErrChecksumMismatch", err)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrChecksumMismatch) {
+		t.Errorf("error callback got %v, want one ErrChecksumMismatch", reported)
+	}
+	if got := receive(t, messages); string(got) != "intact" {
+		t.Errorf("received %q, want the frame after the corrupt one", got)
+	}
+}
+
+func TestMessageBufferPendingFrame(t *testing.T) {
+	frame := NewMessageBuffer().Produce([]byte("hello world"))
+	receiver, messages := newTestMessageBuffer()
+
+	for _, step := range []struct {
+		name         string
+		data         []byte
+		wantBuffered int
+		wantLength   int
+		wantPending  bool
+	}{
+		{"nothing received", nil, 0, 0, false},
+		{"part of the header", frame[:4], 4, 0, false},
+		{"header and part of the payload", frame[4 : frameHeaderSize+2], frameHeaderSize + 2, 11, true},
+		{"rest of the frame and the start of the next", append(frame[frameHeaderSize+2:len(frame):len(frame)], frame[:frameHeaderSize]...), frameHeaderSize, 11, true},
+		{"rest of the second frame", frame[frameHeaderSize:], 0, 0, false},
+	} {
+		if err := receiver.Consume(step.data); err != nil {
+			t.Fatalf("%s: Consume = %v", step.name, err)
+		}
+		length, pending := receiver.PendingFrameLength()
+		if buffered := receiver.BufferedBytes(); buffered != step.wantBuffered || length != step.wantLength || pending != step.wantPending {
+			t.Errorf("%s: BufferedBytes = %d, PendingFrameLength = %d, %v; want %d, %d, %v",
+				step.name, buffered, length, pending, step.wantBuffered, step.wantLength, step.wantPending)
+		}
+	}
+	for range 2 {
+		if got := receive(t, messages); string(got) != "hello world" {
+			t.Errorf("received %q, want hello world", got)
+		}
+	}
+}
+
+func TestMessageBufferReset(t *testing.T) {
+	sender := NewMessageBuffer()
+	oversized := sender.Produce(bytes.Repeat([]byte("x"), 101))
+	for _, tc := range []struct {
+		name    string
+		partial []byte
+	}{
+		{"partial frame", sender.Produce([]byte("abandoned"))[:12]},
+		{"skipping an oversized frame", oversized[:50]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			receiver, messages := newTestMessageBuffer()
+			receiver.SetMaxFrameSize(100)
+			receiver.Consume(tc.partial)
+
+			receiver.Reset()
+			if buffered := receiver.BufferedBytes(); buffered != 0 {
+				t.Errorf("BufferedBytes = %d after Reset, want 0", buffered)
+			}
+			if err := receiver.Consume(sender.Produce([]byte("fresh"))); err != nil {
+				t.Fatalf("Consume after Reset = %v", err)
+			}
+			if got := receive(t, messages); string(got) != "fresh" {
+				t.Errorf("received %q, want the frame sent after Reset", got)
+			}
+		})
+	}
+}
+
+func TestMessageBufferResetFromErrorCallback(t *testing.T) {
+	receiver, messages := newTestMessageBuffer()
+	receiver.SetOnErrorCallback(func(error) { receiver.Reset() })
+
+	// A frame of an unknown version is followed by the start of another
+	sender := NewMessageBuffer()
+	unknown := sender.Produce([]byte("unknown"))
+	unknown[0] = frameVersion + 1
+	if err := receiver.Consume(unknown); !errors.Is(err, ErrFrameVersion) {
+		t.Fatalf("Consume = %v, want ErrFrameVersion", err)
+	}
+	if err := receiver.Consume(sender.Produce([]byte("recovered"))); err != nil {
+		t.Fatalf("Consume after Reset = %v", err)
+	}
+	if got := receive(t, messages); string(got) != "recovered" {
+		t.Errorf("received %q, want the frame sent after Reset", got)
+	}
+}
+
+func TestMessageBufferDrain(t *testing.T) {
+	mb := NewMessageBuffer()
+	release := make(chan struct{})
+	handled := make(chan []byte, 1)
+	mb.SetOnDataCallback(func(data []byte) {
+		<-release
+		handled <- data
+	})
+
+	// A complete message followed by the start of another, then the close
+	frame := mb.Produce([]byte("complete"))
+	if err := mb.Consume(append(frame, mb.Produce([]byte("partial"))[:4]...)); err != nil {
+		t.Fatal(err)
+	}
+	if mb.Drain(50 * time.Millisecond) {
+		t.Error("drain finished while a message was still being handled")
+	}
+
+	close(release)
+	if !mb.Drain(5 * time.Second) {
+		t.Fatal("drain timed out after the message was handled")
+	}
+	if got := <-handled; string(got) != "complete" {
+		t.Errorf("handled %q, want the complete message", got)
+	}
+	if n := mb.BufferedBytes(); n != 0 {
+		t.Errorf("%d bytes of the partial frame still buffered", n)
+	}
+}
+
+func TestTunnelCompressionNegotiation(t *testing.T) {
+	body := strings.Repeat("compressible ", 1000)
+	for _, tc := range []struct {
+		name           string
+		server, client bool
+	}{
+		{"both", true, true},
+		{"server only", true, false},
+		{"client only", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}), func(c *Config) {
+				c.Server.Compression.Enabled = tc.server
+				c.Client.Compression.Enabled = tc.client
+			})
+
+			resp, got := p.get(t, "/")
+			if resp.StatusCode != http.StatusOK || got != body {
+				t.Fatalf("status = %d, body of %d bytes; want 200 with %d bytes", resp.StatusCode, len(got), len(body))
+			}
+			want := fmt.Sprintf(`"compression":%t`, tc.server && tc.client)
+			if !strings.Contains(p.logs(t), want) {
+				t.Errorf("registration was not logged with %s", want)
+			}
+			if strings.Contains(p.logs(t), "Dropped invalid frames") {
+				t.Error("frames were dropped")
+			}
+		})
+	}
+}
+
+func BenchmarkMessageBufferProduce(b *testing.B) {
+	payload := bytes.Repeat([]byte(`{"type":"response","body":"aGVsbG8gd29ybGQ="}`), 200)
+	for _, compress := range []bool{false, true} {
+		name := "uncompressed"
+		if compress {
+			name = "compressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			mb := NewMessageBuffer()
+			mb.SetCompression(compress, 0)
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				mb.Produce(payload)
+			}
+		})
+	}
+}
+
+func BenchmarkMessageBufferConsume(b *testing.B) {
+	payload := bytes.Repeat([]byte(`{"type":"response","body":"aGVsbG8gd29ybGQ="}`), 200)
+	for _, compress := range []bool{false, true} {
+		name := "uncompressed"
+		if compress {
+			name = "compressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			sender := NewMessageBuffer()
+			sender.SetCompression(compress, 0)
+			frame := sender.Produce(payload)
+
+			receiver := NewMessageBuffer()
+			receiver.SetDecompression(compress, 0)
+			receiver.SetOnDataCallback(func([]byte) {})
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				if err := receiver.Consume(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metric kinds, as written in the exposition format
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+)
+
+// metricsRegistry holds counters and gauges and writes them in the Prometheus text format
+type metricsRegistry struct {
+	mu       sync.Mutex
+	kinds    map[string]string
+	help     map[string]string
+	counters map[string]float64
+	gauges   map[string]func() float64
+}
+
+// newMetricsRegistry creates an empty metricsRegistry
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		kinds:    make(map[string]string),
+		help:     make(map[string]string),
+		counters: make(map[string]float64),
+		gauges:   make(map[string]func() float64),
+	}
+}
+
+// counter declares a counter metric
+func (m *metricsRegistry) counter(name, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = metricCounter
+	m.help[name] = help
+}
+
+// gauge declares a gauge metric whose value is read when metrics are collected
+func (m *metricsRegistry) gauge(name, help string, value func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.kinds[name] = metricGauge
+	m.help[name] = help
+	m.gauges[name] = value
+}
+
+// add increments a counter; labels are given as alternating names and values
+func (m *metricsRegistry) add(name string, delta float64, labels ...string) {
+	key := seriesKey(name, labels)
+	m.mu.Lock()
+	m.counters[key] += delta
+	m.mu.Unlock()
+}
+
+// seriesKey formats a metric name and its labels as a series name
+func seriesKey(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write writes every metric in the Prometheus text format, sorted by name
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	series := make(map[string][]string)
+	values := make(map[string]float64)
+	for key, value := range m.counters {
+		name, _, _ := strings.Cut(key, "{")
+		series[name] = append(series[name], key)
+		values[key] = value
+	}
+	gauges := make(map[string]func() float64, len(m.gauges))
+	for name, value := range m.gauges {
+		gauges[name] = value
+	}
+	kinds := make(map[string]string, len(m.kinds))
+	names := make([]string, 0, len(m.kinds))
+	for name, kind := range m.kinds {
+		kinds[name] = kind
+		names = append(names, name)
+	}
+	help := make(map[string]string, len(m.help))
+	for name, description := range m.help {
+		help[name] = description
+	}
+	m.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help[name], name, kinds[name])
+		if value, ok := gauges[name]; ok {
+			fmt.Fprintf(w, "%s %g\n", name, value())
+			continue
+		}
+
+		keys := series[name]
+		if len(keys) == 0 {
+			fmt.Fprintf(w, "%s 0\n", name)
+			continue
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s %g\n", key, values[key])
+		}
+	}
+}
+
+// handleMetrics serves the server's metrics
+func (s *ProxyServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w)
+}
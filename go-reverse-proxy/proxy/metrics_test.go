@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpointIsOptIn(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}), nil)
+
+	if resp, body := p.get(t, "/metrics"); resp.StatusCode != http.StatusOK || body != "upstream /metrics" {
+		t.Errorf("got %d %q, want the request forwarded upstream", resp.StatusCode, body)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) { c.Server.Metrics.Path = "/metrics" })
+
+	resp, body := p.get(t, "/metrics")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", resp.Header.Get("Content-Type"))
+	}
+	for _, metric := range []string{"proxy_pending_requests 0", "# TYPE proxy_pending_requests gauge", "proxy_requests_in_flight"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("metrics do not include %q:\n%s", metric, body)
+		}
+	}
+}
+
+func TestPendingRequestWarning(t *testing.T) {
+	release := make(chan struct{})
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), func(c *Config) { c.Server.PendingRequestWarnThreshold = 2 })
+
+	done := make(chan struct{})
+	for range 2 {
+		go func() {
+			p.get(t, "/")
+			done <- struct{}{}
+		}()
+	}
+	p.waitForLog(t, "Pending requests reached warning threshold")
+	close(release)
+	<-done
+	<-done
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// loadNoClientsBody returns the configured maintenance page served when no client
+// can take a request, or nil to answer with a plain error. A body file that can't
+// be read is logged and the plain error is used instead.
+func loadNoClientsBody(config *Config, logger *Logger) []byte {
+	page := config.Server.NoClientsResponse
+	if page.BodyFile != "" {
+		body, err := os.ReadFile(page.BodyFile)
+		if err != nil {
+			logger.Error("server", "Failed to read no clients response body", map[string]interface{}{
+				"file":  page.BodyFile,
+				"error": err.Error(),
+			})
+			return nil
+		}
+		return body
+	}
+	if page.Body != "" {
+		return []byte(page.Body)
+	}
+	return nil
+}
+
+// noClientsStatus returns the status for requests no client can serve
+func (s *ProxyServer) noClientsStatus() int {
+	if status := s.config.Server.NoClientsResponse.Status; status != 0 {
+		return status
+	}
+	return s.config.Server.Routing.NoClientStatus
+}
+
+// writeNoClients answers a request that no client can serve, with the maintenance
+// page if one is configured and message otherwise
+func (s *ProxyServer) writeNoClients(w http.ResponseWriter, message string) {
+	if s.noClientsBody == nil {
+		s.writeError(w, s.noClientsStatus(), errorCodeNoClients, message, "")
+		return
+	}
+
+	contentType := s.config.Server.NoClientsResponse.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.noClientsBody)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(s.noClientsStatus())
+	w.Write(s.noClientsBody)
+}
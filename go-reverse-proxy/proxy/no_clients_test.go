@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNoClientsResponse(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(page, []byte("<h1>Down for maintenance</h1>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		configure       func(*Config)
+		wantStatus      int
+		wantBody        string
+		wantContentType string
+	}{
+		{"body from a file", func(c *Config) {
+			c.Server.NoClientsResponse.Status = http.StatusBadGateway
+			c.Server.NoClientsResponse.BodyFile = page
+		}, http.StatusBadGateway, "<h1>Down for maintenance</h1>", "text/html; charset=utf-8"},
+		{"inline body", func(c *Config) {
+			c.Server.NoClientsResponse.Body = `{"maintenance":true}`
+			c.Server.NoClientsResponse.ContentType = "application/json"
+		}, http.StatusServiceUnavailable, `{"maintenance":true}`, "application/json"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestServer(t, tc.configure)
+
+			resp, body := p.get(t, "/")
+			if resp.StatusCode != tc.wantStatus || body != tc.wantBody {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tc.wantStatus, tc.wantBody)
+			}
+			if contentType := resp.Header.Get("Content-Type"); contentType != tc.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, tc.wantContentType)
+			}
+			if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", cacheControl)
+			}
+		})
+	}
+}
+
+func TestNoClientsResponseUnreadableFile(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.NoClientsResponse.BodyFile = filepath.Join(t.TempDir(), "missing.html")
+	})
+
+	if resp, body := p.get(t, "/"); resp.StatusCode != http.StatusServiceUnavailable || body == "" {
+		t.Errorf("got %d %q, want the default 503 error", resp.StatusCode, body)
+	}
+	p.waitForLog(t, "Failed to read no clients response body")
+}
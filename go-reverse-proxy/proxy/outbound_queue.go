@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+)
+
+// Policies for new requests to a client whose outbound queue is full
+const (
+	outboundOverflowBlock  = "block"
+	outboundOverflowReject = "reject"
+)
+
+var (
+	// errOutboundQueueFull is returned for a request refused because its client
+	// already has server.socket.outboundQueueSize frames waiting to be written
+	errOutboundQueueFull = errors.New("client outbound queue is full")
+
+	// errClientClosed is returned for frames queued to a connection that has closed
+	errClientClosed = errors.New("client connection closed")
+)
+
+// outboundFrame is a frame waiting to be written
+type outboundFrame struct {
+	data []byte
+
+	// failed, if set, is called with the reason once it is certain the frame will
+	// not be written
+	failed func(error)
+
+	// closeAfter closes the connection once the frame has been written
+	closeAfter bool
+}
+
+// fail reports that the frame will not be written
+func (f outboundFrame) fail(err error) {
+	if f.failed != nil {
+		f.failed(err)
+	}
+}
+
+// outboundQueue holds the frames waiting to be written to a client connection.
+// A single writer goroutine writes them in the order they were queued, so a
+// client that falls behind holds up only the frames going to it. Senders don't
+// wait for the write: a frame that can't be written is reported to its failed
+// callback, and the connection is closed.
+type outboundQueue struct {
+	frames    chan outboundFrame
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Senders hold a read lock while queueing, so that once drain takes the lock
+	// and sets done no frame can slip in behind it unreported
+	mu   sync.RWMutex
+	done bool
+
+	// stopped is closed once the writer has returned; it always finishes the
+	// frame it is writing first
+	stopped chan struct{}
+}
+
+// newOutboundQueue creates a queue holding up to size frames
+func newOutboundQueue(size int) *outboundQueue {
+	return &outboundQueue{
+		frames:  make(chan outboundFrame, size),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// push queues a frame for writing and returns without waiting for the write. If
+// the queue is full, push waits for room, or with reject set returns
+// errOutboundQueueFull straight away. The frame's failed callback is not called
+// when push returns an error.
+func (q *outboundQueue) push(frame outboundFrame, reject bool) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.done {
+		return errClientClosed
+	}
+
+	if reject {
+		select {
+		case q.frames <- frame:
+			return nil
+		case <-q.closed:
+			return errClientClosed
+		default:
+			return errOutboundQueueFull
+		}
+	}
+	select {
+	case q.frames <- frame:
+		return nil
+	case <-q.closed:
+		return errClientClosed
+	}
+}
+
+// close stops the writer. Frames still queued are failed once it has stopped.
+func (q *outboundQueue) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// drain fails the frames left in the queue and refuses any more
+func (q *outboundQueue) drain() {
+	q.close()
+	q.mu.Lock()
+	q.done = true
+	q.mu.Unlock()
+
+	for {
+		select {
+		case frame := <-q.frames:
+			frame.fail(errClientClosed)
+		default:
+			return
+		}
+	}
+}
+
+// writeOutbound writes the frames queued for a client until its queue is closed
+// or a write fails. A failed write has already closed the connection, so the
+// client is torn down as for any disconnect.
+func (s *ProxyServer) writeOutbound(info *ClientInfo) {
+	defer close(info.outbound.stopped)
+	defer info.outbound.drain()
+	for {
+		select {
+		case frame := <-info.outbound.frames:
+			if err := s.writeToClient(info, frame.data); err != nil {
+				s.clientWriteFailed(info, err)
+				frame.fail(err)
+				return
+			}
+			if frame.closeAfter {
+				info.conn.Close()
+				return
+			}
+		case <-info.outbound.closed:
+			return
+		}
+	}
+}
+
+// clientWriteFailed logs a failed write to a client. A client whose socket stays
+// full is not keeping up, so a timeout also marks it unhealthy until its
+// connection has been torn down.
+func (s *ProxyServer) clientWriteFailed(info *ClientInfo, err error) {
+	if s.stopping.Load() {
+		return
+	}
+	if !isTimeout(err) {
+		s.logger.Error("socket", "Failed to write to client", map[string]interface{}{
+			"clientId": s.clientID(info),
+			"error":    err.Error(),
+		})
+		return
+	}
+
+	s.clientsMutex.Lock()
+	info.healthy = false
+	s.clientsMutex.Unlock()
+
+	s.logger.Error("socket", "Timed out writing to client", map[string]interface{}{
+		"clientId": s.clientID(info),
+		"timeout":  s.config.Server.Socket.WriteTimeout,
+	})
+}
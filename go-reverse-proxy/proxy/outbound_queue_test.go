@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundQueuePush(t *testing.T) {
+	q := newOutboundQueue(1)
+
+	// Nothing is writing, yet push returns once the frame is queued
+	var failures []error
+	frame := outboundFrame{data: []byte("first"), failed: func(err error) { failures = append(failures, err) }}
+	if err := q.push(frame, false); err != nil {
+		t.Fatalf("push = %v", err)
+	}
+	if err := q.push(outboundFrame{data: []byte("second")}, true); !errors.Is(err, errOutboundQueueFull) {
+		t.Errorf("push to a full queue with reject = %v, want errOutboundQueueFull", err)
+	}
+
+	// Frames left behind when the queue stops are failed, and no more are taken
+	q.drain()
+	if len(failures) != 1 || !errors.Is(failures[0], errClientClosed) {
+		t.Errorf("queued frame failed with %v, want errClientClosed", failures)
+	}
+	if err := q.push(outboundFrame{data: []byte("third")}, false); !errors.Is(err, errClientClosed) {
+		t.Errorf("push after drain = %v, want errClientClosed", err)
+	}
+}
+
+// connectStalledClient registers a client by hand that stops reading once the
+// server has acknowledged it, so that writes to it block
+func (p *testProxy) connectStalledClient(t *testing.T) net.Conn {
+	t.Helper()
+	conn, err := p.transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	buffer := NewMessageBuffer()
+	acknowledged := make(chan struct{}, 1)
+	buffer.SetOnDataCallback(func([]byte) { acknowledged <- struct{}{} })
+	data, err := jsonCodec{}.Encode(map[string]interface{}{
+		"type":               "register",
+		"protocolVersion":    protocolVersion,
+		"minProtocolVersion": minProtocolVersion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buffer.Produce(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	read := make([]byte, 4096)
+	for {
+		n, err := conn.Read(read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer.Consume(read[:n])
+		if buffer.BufferedBytes() == 0 {
+			break
+		}
+	}
+	select {
+	case <-acknowledged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+	return conn
+}
+
+func TestStalledClientIsTornDown(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.Socket.WriteTimeout = 100
+		c.Server.Metrics.Path = "/metrics"
+		c.Logging.DeadLetter = true
+	})
+	p.connectStalledClient(t)
+
+	resp, _ := p.get(t, "/")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	p.waitForLog(t, "Timed out writing to client")
+	p.waitForLog(t, "Client disconnected")
+
+	_, metrics := p.get(t, "/metrics")
+	if !strings.Contains(metrics, `proxy_dead_letters_total{reason="write_timeout"} 1`) {
+		t.Errorf("the request was not recorded as a write_timeout dead letter:\n%s", metrics)
+	}
+}
+
+func TestFinalMessagesAreWrittenBeforeClosing(t *testing.T) {
+	t.Run("shutdown", func(t *testing.T) {
+		p := startTestServer(t, nil)
+		f := p.connectFakeClient(t)
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			p.server.Stop(ctx)
+		}()
+		f.receive(t, "shutdown")
+	})
+
+	t.Run("rejected registration", func(t *testing.T) {
+		p := startTestServer(t, nil)
+		f := p.connectFakeClient(t)
+		f.send(t, map[string]interface{}{
+			"type":               "register",
+			"id":                 "edge",
+			"protocolVersion":    protocolVersion,
+			"minProtocolVersion": minProtocolVersion,
+		})
+		f.receive(t, "registered")
+
+		duplicate := p.connectFakeClient(t)
+		duplicate.send(t, map[string]interface{}{
+			"type":               "register",
+			"id":                 "edge",
+			"protocolVersion":    protocolVersion,
+			"minProtocolVersion": minProtocolVersion,
+		})
+		reply := duplicate.receive(t, "registered")
+		if errorText, _ := reply["error"].(string); !strings.Contains(errorText, "already in use") {
+			t.Errorf("reply = %v, want an error saying the ID is in use", reply)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Policies for new requests once server.maxPendingRequests are pending
+const (
+	pendingOverflowReject      = "reject"
+	pendingOverflowEvictOldest = "evict-oldest"
+)
+
+// Reasons addPendingRequest refuses a request
+var (
+	errTooManyPending     = errors.New("too many pending requests")
+	errDuplicateRequestID = errors.New("no unused request ID")
+)
+
+// maxRequestIDAttempts is how many IDs are generated for a request before giving
+// up on finding one that is not already pending
+const maxRequestIDAttempts = 3
+
+// addPendingRequest stores a request awaiting its client's response under a new
+// request ID, and returns the ID and how many requests are now pending. At
+// server.maxPendingRequests the new request is either refused with
+// errTooManyPending or admitted in place of the oldest pending request, which
+// fails with 504. An ID that is already pending is never reused, since the
+// request holding it would be orphaned; another is generated instead.
+func (s *ProxyServer) addPendingRequest(pending *PendingRequest) (string, int, error) {
+	limit := s.config.Server.MaxPendingRequests
+
+	s.requestsMutex.Lock()
+	s.tunnelsMutex.Lock()
+	requestID, collisions := s.unusedRequestID()
+	s.tunnelsMutex.Unlock()
+	if collisions > 0 {
+		// Reported on return, once requestsMutex is released
+		defer s.requestIDCollision(requestID, pending.clientID, collisions)
+	}
+	if collisions == maxRequestIDAttempts {
+		s.requestsMutex.Unlock()
+		return requestID, 0, errDuplicateRequestID
+	}
+
+	var evicted *PendingRequest
+	var evictedID string
+	if limit > 0 && len(s.pendingRequests) >= limit {
+		if s.config.Server.PendingOverflowPolicy != pendingOverflowEvictOldest {
+			s.requestsMutex.Unlock()
+			s.logger.Warn("request", "Too many pending requests, rejecting request", map[string]interface{}{
+				"limit": limit,
+			})
+			return requestID, limit, errTooManyPending
+		}
+		evictedID, evicted = s.oldestPendingRequest()
+		delete(s.pendingRequests, evictedID)
+	}
+	s.pendingRequests[requestID] = pending
+	count := len(s.pendingRequests)
+	s.requestsMutex.Unlock()
+
+	if evicted != nil {
+		s.logger.Warn("request", "Too many pending requests, evicting oldest request", map[string]interface{}{
+			"limit":     limit,
+			"requestId": evictedID,
+			"clientId":  evicted.clientID,
+			"ageMs":     time.Since(evicted.createdAt).Milliseconds(),
+		})
+
+		evicted.mu.Lock()
+		if !evicted.finished {
+			// A streamed response has already sent its status; it can only be cut short
+			if evicted.nextSeq == 0 {
+				s.httpError(evicted.res, evicted.req, http.StatusGatewayTimeout, errorCodeEvicted, "Gateway Timeout",
+					"evicted to make room for newer requests", evictedID)
+			}
+			evicted.finish()
+		}
+		evicted.mu.Unlock()
+	}
+	return requestID, count, nil
+}
+
+// unusedRequestID generates request IDs until it finds one that is neither pending
+// nor held by an open tunnel, up to maxRequestIDAttempts times, and returns the
+// last one along with how many were already in use; the caller must hold
+// requestsMutex and tunnelsMutex, in that order
+func (s *ProxyServer) unusedRequestID() (string, int) {
+	var requestID string
+	collisions := 0
+	for collisions < maxRequestIDAttempts {
+		requestID = s.newRequestID()
+		_, pending := s.pendingRequests[requestID]
+		_, tunnel := s.tunnels[requestID]
+		if !pending && !tunnel {
+			break
+		}
+		collisions++
+	}
+	return requestID, collisions
+}
+
+// requestIDCollision records that generated request IDs were already in use.
+// Only a broken or too coarse ID generator should ever cause this.
+func (s *ProxyServer) requestIDCollision(requestID string, clientID string, collisions int) {
+	s.metrics.add("proxy_request_id_collisions_total", float64(collisions))
+	s.logger.Error("request", "Generated request ID is already in use", map[string]interface{}{
+		"requestId":   requestID,
+		"collisions":  collisions,
+		"clientId":    clientID,
+		"regenerated": collisions < maxRequestIDAttempts,
+	})
+}
+
+// timestampRequestID returns the current time in nanoseconds as a request ID
+func timestampRequestID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// oldestPendingRequest returns the pending request that was created first; the
+// caller must hold requestsMutex
+func (s *ProxyServer) oldestPendingRequest() (string, *PendingRequest) {
+	var oldestID string
+	var oldest *PendingRequest
+	for requestID, pending := range s.pendingRequests {
+		if oldest == nil || pending.createdAt.Before(oldest.createdAt) {
+			oldestID, oldest = requestID, pending
+		}
+	}
+	return oldestID, oldest
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sequentialIDs returns a request ID generator handing out ids in turn and then
+// repeating the last one
+func sequentialIDs(ids ...string) func() string {
+	var mu sync.Mutex
+	next := 0
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		id := ids[min(next, len(ids)-1)]
+		next++
+		return id
+	}
+}
+
+// startIDTestServer starts a server with a fake client whose request IDs come from
+// ids, with CONNECT allowed
+func startIDTestServer(t *testing.T, ids ...string) (*testProxy, *fakeClient) {
+	t.Helper()
+	p := startTestServer(t, func(c *Config) {
+		c.Server.AllowConnect = true
+		c.Server.Metrics.Path = "/metrics"
+	})
+	p.server.newRequestID = sequentialIDs(ids...)
+	return p, p.connectFakeClient(t)
+}
+
+// getAsync sends a GET request for path in the background
+func (p *testProxy) getAsync(t *testing.T, path string) <-chan *http.Response {
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(p.url + path)
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+	return responses
+}
+
+// connectAsync sends a CONNECT request that is left open until the test ends
+func (p *testProxy) connectAsync(t *testing.T, destination string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(p.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte("CONNECT " + destination + " HTTP/1.1\r\nHost: " + destination + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestIDCollision(t *testing.T) {
+	p, f := startIDTestServer(t, "1", "1", "2")
+
+	first := p.getAsync(t, "/first")
+	if id := f.receive(t, "request")["requestId"]; id != "1" {
+		t.Fatalf("first request ID = %v, want 1", id)
+	}
+	second := p.getAsync(t, "/second")
+	if id := f.receive(t, "request")["requestId"]; id != "2" {
+		t.Fatalf("second request ID = %v, want 2 after the collision", id)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		f.send(t, map[string]interface{}{"type": "response", "requestId": id, "statusCode": 200})
+	}
+	for _, responses := range []<-chan *http.Response{first, second} {
+		if resp := <-responses; resp == nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("response = %v, want 200", resp)
+		}
+	}
+	p.waitForLog(t, "Generated request ID is already in use")
+	if _, metrics := p.get(t, "/metrics"); !strings.Contains(metrics, "proxy_request_id_collisions_total 1") {
+		t.Errorf("collision was not counted:\n%s", metrics)
+	}
+}
+
+func TestRequestIDCollisionGivesUp(t *testing.T) {
+	p, f := startIDTestServer(t, "1")
+
+	p.getAsync(t, "/first")
+	f.receive(t, "request")
+
+	resp, _ := p.get(t, "/second")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500 once every generated ID is taken", resp.StatusCode)
+	}
+}
+
+func TestTunnelIDCollision(t *testing.T) {
+	t.Run("tunnel after request", func(t *testing.T) {
+		p, f := startIDTestServer(t, "1", "1", "2")
+
+		p.getAsync(t, "/")
+		f.receive(t, "request")
+		p.connectAsync(t, "example.com:443")
+		if id := f.receive(t, "connect")["requestId"]; id != "2" {
+			t.Errorf("tunnel ID = %v, want 2 rather than the pending request's ID", id)
+		}
+	})
+
+	t.Run("request after tunnel", func(t *testing.T) {
+		p, f := startIDTestServer(t, "1", "1", "2")
+
+		p.connectAsync(t, "example.com:443")
+		f.receive(t, "connect")
+		p.getAsync(t, "/")
+		if id := f.receive(t, "request")["requestId"]; id != "2" {
+			t.Errorf("request ID = %v, want 2 rather than the open tunnel's ID", id)
+		}
+	})
+}
+
+func TestResponseFromAnotherClientIsDropped(t *testing.T) {
+	p := startTestServer(t, nil)
+	owner := p.connectFakeClient(t)
+	responses := p.getAsync(t, "/")
+	requestID := owner.receive(t, "request")["requestId"]
+
+	// A client the request was not sent to tries to answer it and to start a stream
+	other := p.connectFakeClient(t)
+	other.send(t, map[string]interface{}{"type": "response", "requestId": requestID, "statusCode": 200})
+	other.send(t, map[string]interface{}{"type": "response-start", "requestId": requestID, "seq": 0, "statusCode": 200})
+	waitFor(t, "both messages to be dropped", func() bool {
+		return strings.Count(p.logs(t), "Dropped response from a client the request was not sent to") == 2
+	})
+
+	owner.send(t, map[string]interface{}{"type": "response", "requestId": requestID, "statusCode": 201})
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("got %v, want the owner's 201", resp)
+	}
+}
+
+// fillPendingRequests starts a server allowing two pending requests with the given
+// overflow policy and sends it two requests its fake client holds, returning the
+// server, the client, the requests' IDs and their responses
+func fillPendingRequests(t *testing.T, policy string) (*testProxy, *fakeClient, []interface{}, []<-chan *http.Response) {
+	t.Helper()
+	p := startTestServer(t, func(c *Config) {
+		c.Server.MaxPendingRequests = 2
+		c.Server.PendingOverflowPolicy = policy
+	})
+	f := p.connectFakeClient(t)
+
+	var ids []interface{}
+	var responses []<-chan *http.Response
+	for _, path := range []string{"/first", "/second"} {
+		responses = append(responses, p.getAsync(t, path))
+		ids = append(ids, f.receive(t, "request")["requestId"])
+	}
+	return p, f, ids, responses
+}
+
+func TestPendingLimitRejectsNewRequests(t *testing.T) {
+	p, f, ids, responses := fillPendingRequests(t, "reject")
+
+	if resp, _ := p.get(t, "/third"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request over the limit: status = %d, want 503", resp.StatusCode)
+	}
+	p.waitForLog(t, "Too many pending requests, rejecting request")
+
+	// The held requests are unaffected
+	for i, id := range ids {
+		f.send(t, map[string]interface{}{"type": "response", "requestId": id, "statusCode": 200})
+		if resp := <-responses[i]; resp == nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("held request %d: got %v, want 200", i, resp)
+		}
+	}
+}
+
+func TestPendingLimitEvictsOldestRequest(t *testing.T) {
+	p, f, ids, responses := fillPendingRequests(t, "evict-oldest")
+
+	third := p.getAsync(t, "/third")
+	thirdID := f.receive(t, "request")["requestId"]
+	if resp := <-responses[0]; resp == nil || resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("oldest request: got %v, want 504", resp)
+	}
+	p.waitForLog(t, "Too many pending requests, evicting oldest request")
+
+	for id, response := range map[interface{}]<-chan *http.Response{ids[1]: responses[1], thirdID: third} {
+		f.send(t, map[string]interface{}{"type": "response", "requestId": id, "statusCode": 200})
+		if resp := <-response; resp == nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("request %v: got %v, want 200", id, resp)
+		}
+	}
+}
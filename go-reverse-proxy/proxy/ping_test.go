@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPingWithoutClients(t *testing.T) {
+	p := startTestServer(t, nil)
+
+	resp, body := p.get(t, "/__ping")
+	if resp.StatusCode != http.StatusOK || body != "pong" {
+		t.Errorf("got %d %q, want 200 pong", resp.StatusCode, body)
+	}
+	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cacheControl)
+	}
+}
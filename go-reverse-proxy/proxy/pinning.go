@@ -0,0 +1,32 @@
+package proxy
+
+import "net/http"
+
+// clientPinHeader names the client a request must go to, for debugging one backend
+const clientPinHeader = "X-Proxy-Client"
+
+// pinnedClientID returns the client a request is pinned to. The pin is honoured
+// only with server.allowClientPinning set and the admin token presented, so
+// ordinary callers can't steer their requests around the load balancer.
+func (s *ProxyServer) pinnedClientID(r *http.Request) (string, bool) {
+	clientID := r.Header.Get(clientPinHeader)
+	if clientID == "" || !s.config.Server.AllowClientPinning || !s.hasAdminToken(r) {
+		return "", false
+	}
+	return clientID, true
+}
+
+// acquirePinnedClient reserves a slot on the client a request is pinned to,
+// whatever its health or routes. It returns nil if the client isn't connected
+// and registered, or is at its concurrency limit.
+func (s *ProxyServer) acquirePinnedClient(clientID string) *ClientInfo {
+	s.clientsMutex.RLock()
+	info, connected := s.clients[clientID]
+	registered := connected && info.registered
+	s.clientsMutex.RUnlock()
+
+	if !registered || !info.reserve() {
+		return nil
+	}
+	return info
+}
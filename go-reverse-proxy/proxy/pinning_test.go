@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startPinningProxy starts a server with clients a and b, each forwarding to a
+// backend that answers with the client's name
+func startPinningProxy(t *testing.T, allowPinning bool) *testProxy {
+	t.Helper()
+	p := startTestServer(t, func(c *Config) {
+		c.Server.AllowClientPinning = allowPinning
+		c.Server.Admin.Token = "secret"
+	})
+	for _, id := range []string{"a", "b"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(id))
+		}))
+		t.Cleanup(backend.Close)
+		config := newTestConfig(t)
+		config.Client.ID = id
+		config.Client.Proxy.DefaultTarget = backend.URL
+		p.connectClient(t, config)
+	}
+	waitFor(t, "both clients to register", func() bool { return p.server.registeredClients() == 2 })
+	return p
+}
+
+// getPinned sends a request pinned to clientID, with the admin token if token is set
+func (p *testProxy) getPinned(t *testing.T, clientID, token string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(clientPinHeader, clientID)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return p.do(t, req)
+}
+
+func TestClientPinning(t *testing.T) {
+	p := startPinningProxy(t, true)
+
+	for range 4 {
+		if resp, body := p.getPinned(t, "b", "secret"); resp.StatusCode != http.StatusOK || body != "b" {
+			t.Fatalf("got %d %q, want every pinned request served by b", resp.StatusCode, body)
+		}
+	}
+	p.waitForLog(t, "Request pinned to client")
+
+	if resp, _ := p.getPinned(t, "missing", "secret"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503 for a client that isn't connected", resp.StatusCode)
+	}
+	p.waitForLog(t, "Pinned client not available")
+}
+
+func TestClientPinningIgnored(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		allowPinning bool
+		token        string
+	}{
+		{"without the admin token", true, ""},
+		{"with the wrong token", true, "guess"},
+		{"pinning not allowed", false, "secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startPinningProxy(t, tc.allowPinning)
+
+			// The pin is dropped, so the load balancer picks a connected client
+			resp, body := p.getPinned(t, "missing", tc.token)
+			if resp.StatusCode != http.StatusOK || (body != "a" && body != "b") {
+				t.Errorf("got %d %q, want the request load balanced as usual", resp.StatusCode, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// Versions of the protocol spoken over the socket connection. The client offers
+// the range it speaks when it registers and the server answers with the highest
+// version both ends support.
+//
+// Version 1 base64-encodes every body. Version 2 leaves body encoding to the
+// codec, so MessagePack carries bodies as raw binary. Version 3 adds gRPC
+// requests, whose bodies are streamed to the client while the response streams
+// back. Version 4 acknowledges tunnel data as it is written, so neither end sends
+// more than a window ahead of the other.
+const (
+	protocolVersion    = 4
+	minProtocolVersion = 1
+
+	// protocolRawBodies is the first version whose bodies are encoded by the codec
+	protocolRawBodies = 2
+
+	// protocolGRPC is the first version that can carry gRPC requests
+	protocolGRPC = 3
+
+	// protocolTunnelAcks is the first version that acknowledges tunnel data
+	protocolTunnelAcks = 4
+)
+
+// negotiateProtocol returns the highest version within both the local range and
+// the peer's, or an error if the ranges don't overlap. Peers from before
+// versioning don't advertise a range and speak version 1.
+func negotiateProtocol(message map[string]interface{}) (int, error) {
+	peerVersion, peerMin := 1, 1
+	if v, ok := message["protocolVersion"].(float64); ok {
+		peerVersion = int(v)
+		peerMin = peerVersion
+	}
+	if v, ok := message["minProtocolVersion"].(float64); ok {
+		peerMin = int(v)
+	}
+
+	version := min(protocolVersion, peerVersion)
+	if version < max(minProtocolVersion, peerMin) {
+		return 0, fmt.Errorf("protocol versions %d-%d are not compatible with %d-%d",
+			peerMin, peerVersion, minProtocolVersion, protocolVersion)
+	}
+	return version, nil
+}
+
+// encodeBody encodes a body for a message sent over a connection speaking version
+func encodeBody(codec Codec, version int, body []byte) interface{} {
+	if version < protocolRawBodies {
+		return base64.StdEncoding.EncodeToString(body)
+	}
+	return codec.EncodeBody(body)
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// reloadableSettings lists the settings, by JSON path prefix, that take effect
+// when the configuration is reloaded. Everything else, including listener
+// addresses, TLS files and the log file, needs a restart.
+var reloadableSettings = []string{
+	"logging.level",
+	"logging.format",
+	"logging.maxEntryBytes",
+	"logging.accessLog",
+	"logging.deadLetter",
+	"logging.redactHeaders",
+	"server.requestTimeout",
+	"server.maxRequestTimeout",
+	"server.perClientRateLimit.",
+	"client.proxy.rewriteRules",
+	"client.proxy.retry.",
+	"client.proxy.timeoutHeader",
+	"client.proxy.accessLog",
+}
+
+// retrySettings has the type of Config.Client.Proxy.Retry
+type retrySettings = struct {
+	MaxAttempts        int   `json:"maxAttempts"`
+	RetryOnStatuses    []int `json:"retryOnStatuses"`
+	BackoffMs          int   `json:"backoffMs"`
+	AllowNonIdempotent bool  `json:"allowNonIdempotent"`
+}
+
+// rateLimitSettings has the type of Config.Server.PerClientRateLimit
+type rateLimitSettings = struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+	MaxWait           int     `json:"maxWait"`
+}
+
+// liveSettings is a copy of the reloadable settings that requests read as they
+// are served. Logging settings are applied to the Logger, and rewrite rules are
+// compiled again by ReloadRewriteRules, so neither is included.
+type liveSettings struct {
+	accessLog         bool
+	deadLetter        bool
+	requestTimeout    int
+	maxRequestTimeout int
+	rateLimit         rateLimitSettings
+	retry             retrySettings
+	timeoutHeader     string
+	upstreamAccessLog bool
+}
+
+// live returns the current values of the reloadable settings
+func (config *Config) live() liveSettings {
+	config.reloadMutex.RLock()
+	defer config.reloadMutex.RUnlock()
+	return liveSettings{
+		accessLog:         config.Logging.AccessLog,
+		deadLetter:        config.Logging.DeadLetter,
+		requestTimeout:    config.Server.RequestTimeout,
+		maxRequestTimeout: config.Server.MaxRequestTimeout,
+		rateLimit:         config.Server.PerClientRateLimit,
+		retry:             config.Client.Proxy.Retry,
+		timeoutHeader:     config.Client.Proxy.TimeoutHeader,
+		upstreamAccessLog: config.Client.Proxy.AccessLog,
+	}
+}
+
+// ReloadConfig reads the configuration file again and applies the settings that
+// can change at runtime to config, leaving everything else as it is. The new file
+// is checked first; if it is invalid nothing changes.
+func ReloadConfig(path string, config *Config, logger *Logger) error {
+	// Standard input was used up when the configuration was first loaded
+	if path == configStdin {
+		return fmt.Errorf("configuration read from standard input can't be reloaded")
+	}
+
+	next := DefaultConfig()
+	if err := LoadConfig(path, next); err != nil {
+		return err
+	}
+	if err := checkReloadable(next, logger); err != nil {
+		return err
+	}
+
+	var applied, ignored []string
+	for _, setting := range configChanges(config, next) {
+		if isReloadable(setting) {
+			applied = append(applied, setting)
+		} else {
+			ignored = append(ignored, setting)
+		}
+	}
+
+	config.reloadMutex.Lock()
+	config.Logging.Level = next.Logging.Level
+	config.Logging.Format = next.Logging.Format
+	config.Logging.MaxEntryBytes = next.Logging.MaxEntryBytes
+	config.Logging.AccessLog = next.Logging.AccessLog
+	config.Logging.DeadLetter = next.Logging.DeadLetter
+	config.Logging.RedactHeaders = next.Logging.RedactHeaders
+	config.Server.RequestTimeout = next.Server.RequestTimeout
+	config.Server.MaxRequestTimeout = next.Server.MaxRequestTimeout
+	config.Server.PerClientRateLimit = next.Server.PerClientRateLimit
+	config.Client.Proxy.RewriteRules = next.Client.Proxy.RewriteRules
+	config.Client.Proxy.Retry = next.Client.Proxy.Retry
+	config.Client.Proxy.TimeoutHeader = next.Client.Proxy.TimeoutHeader
+	config.Client.Proxy.AccessLog = next.Client.Proxy.AccessLog
+	config.reloadMutex.Unlock()
+
+	logger.SetLevel(config.Logging.Level)
+	logger.SetFormat(config.Logging.Format)
+	logger.SetMaxEntryBytes(config.Logging.MaxEntryBytes)
+	logger.SetRedactHeaders(config.Logging.RedactHeaders)
+
+	logger.Info("config", "Configuration reloaded", map[string]interface{}{
+		"file":    path,
+		"changed": applied,
+	})
+	if len(ignored) > 0 {
+		logger.Warn("config", "Some changed settings need a restart to take effect", map[string]interface{}{
+			"settings": ignored,
+		})
+	}
+	return nil
+}
+
+// checkReloadable verifies the settings that ReloadConfig would apply
+func checkReloadable(config *Config, logger *Logger) error {
+	if _, ok := logger.levelMap[LogLevel(config.Logging.Level)]; !ok {
+		return fmt.Errorf("unknown log level %q", config.Logging.Level)
+	}
+	if format := config.Logging.Format; format != FormatJSON && format != FormatText {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	if err := checkRateLimit(config.Server.PerClientRateLimit); err != nil {
+		return fmt.Errorf("per-client rate limit: %w", err)
+	}
+	for _, rule := range config.Client.Proxy.RewriteRules {
+		if err := checkRewriteRule(rule.Pattern, rule.Target); err != nil {
+			return fmt.Errorf("rewrite rule %q: %v", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// isReloadable reports whether a setting, given by its JSON path, is applied on reload
+func isReloadable(setting string) bool {
+	for _, prefix := range reloadableSettings {
+		if setting == strings.TrimSuffix(prefix, ".") || strings.HasPrefix(setting, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// configChanges returns the JSON paths of the settings that differ between two
+// configurations, in sorted order. Lists are compared as a whole.
+func configChanges(old, next *Config) []string {
+	var changes []string
+	diffSettings("", toSettings(old), toSettings(next), &changes)
+	sort.Strings(changes)
+	return changes
+}
+
+// toSettings converts a configuration to generic JSON values for comparison
+func toSettings(config *Config) map[string]interface{} {
+	data, _ := json.Marshal(config)
+	var settings map[string]interface{}
+	json.Unmarshal(data, &settings)
+	return settings
+}
+
+// diffSettings appends the paths below prefix whose values differ between old and next
+func diffSettings(prefix string, old, next map[string]interface{}, changes *[]string) {
+	for key, value := range next {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		oldMap, oldIsMap := old[key].(map[string]interface{})
+		nextMap, nextIsMap := value.(map[string]interface{})
+		if oldIsMap && nextIsMap {
+			diffSettings(path, oldMap, nextMap, changes)
+		} else if !reflect.DeepEqual(old[key], value) {
+			*changes = append(*changes, path)
+		}
+	}
+}
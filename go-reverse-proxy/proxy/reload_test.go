@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeConfigFile writes a JSON configuration file to a temporary directory
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadConfigAppliesReloadableSettings(t *testing.T) {
+	config := newTestConfig(t)
+	logger := newTestLogger(t, config)
+	path := writeConfigFile(t, `{
+		"server": {"requestTimeout": 1234, "http": {"port": 9999}},
+		"client": {"proxy": {"retry": {"maxAttempts": 5}, "timeoutHeader": "X-Budget"}},
+		"logging": {"level": "warn", "deadLetter": true}
+	}`)
+
+	if err := ReloadConfig(path, config, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	live := config.live()
+	if live.requestTimeout != 1234 || live.retry.MaxAttempts != 5 || live.timeoutHeader != "X-Budget" || !live.deadLetter {
+		t.Errorf("reloadable settings not applied: %+v", live)
+	}
+	if logger.Level() != WarnLevel {
+		t.Errorf("log level = %s, want warn", logger.Level())
+	}
+	if config.Server.HTTP.Port != DefaultConfig().Server.HTTP.Port {
+		t.Errorf("HTTP port changed to %d without a restart", config.Server.HTTP.Port)
+	}
+
+	data, _ := os.ReadFile(config.Logging.File)
+	if !strings.Contains(string(data), "server.http.port") {
+		t.Error("the setting needing a restart was not reported")
+	}
+}
+
+func TestReloadConfigRejectsInvalidFile(t *testing.T) {
+	config := newTestConfig(t)
+	logger := newTestLogger(t, config)
+	path := writeConfigFile(t, `{"server": {"requestTimeout": 1234}, "logging": {"level": "loud"}}`)
+
+	if err := ReloadConfig(path, config, logger); err == nil {
+		t.Fatal("ReloadConfig accepted an unknown log level")
+	}
+	if config.Server.RequestTimeout != DefaultConfig().Server.RequestTimeout {
+		t.Error("settings from the rejected file were applied")
+	}
+
+	if err := ReloadConfig(configStdin, config, logger); err == nil {
+		t.Error("ReloadConfig accepted standard input")
+	}
+}
+
+// TestReloadConfigWhileServing reloads the configuration while requests read it;
+// run it with -race
+func TestReloadConfigWhileServing(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Budget")))
+	}), func(c *Config) { c.Logging.AccessLog = true })
+	path := writeConfigFile(t, `{"server": {"requestTimeout": 20000}, "client": {"proxy": {"timeoutHeader": "X-Budget", "accessLog": true}}}`)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusOK {
+					t.Errorf("status = %d, want 200", resp.StatusCode)
+				}
+			}
+		}()
+	}
+	for range 10 {
+		if err := ReloadConfig(path, p.config, p.logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if _, body := p.get(t, "/"); body == "" {
+		t.Error("the reloaded timeout header was not sent upstream")
+	}
+}
+
+func TestReloadRateLimits(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+	statuses := func() (got []int) {
+		for range 3 {
+			resp, _ := p.get(t, "/")
+			got = append(got, resp.StatusCode)
+		}
+		return got
+	}
+	reload := func(contents string) {
+		t.Helper()
+		if err := ReloadConfig(writeConfigFile(t, contents), p.config, p.logger); err != nil {
+			t.Fatal(err)
+		}
+		p.server.ReloadRateLimits()
+	}
+
+	// The connected client is limited to one request, waiting at most a millisecond for the next
+	reload(`{"server": {"perClientRateLimit": {"requestsPerSecond": 0.001, "burst": 1, "maxWait": 1}}}`)
+	if got := statuses(); !slices.Equal(got, []int{404, 503, 503}) {
+		t.Errorf("statuses = %v with the limit imposed, want [404 503 503]", got)
+	}
+
+	reload(`{"server": {"perClientRateLimit": {"requestsPerSecond": 0}}}`)
+	if got := statuses(); !slices.Equal(got, []int{404, 404, 404}) {
+		t.Errorf("statuses = %v with the limit lifted, want [404 404 404]", got)
+	}
+}
+
+func TestReloadConfigRejectsInvalidRateLimit(t *testing.T) {
+	config := newTestConfig(t)
+	path := writeConfigFile(t, `{"server": {"perClientRateLimit": {"requestsPerSecond": 5, "burst": 0}}}`)
+	if err := ReloadConfig(path, config, newTestLogger(t, config)); err == nil {
+		t.Error("ReloadConfig accepted a rate limit with no burst")
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressResponse gzips a buffered response body for callers that accept gzip,
+// updating the response headers to match. Bodies the upstream already encoded,
+// small bodies and responses without a body are returned unchanged.
+func (s *ProxyServer) compressResponse(r *http.Request, response map[string]interface{}, body []byte) []byte {
+	compression := s.config.Server.ResponseCompression
+	if !compression.Enabled || len(body) < compression.MinBytes || !acceptsGzip(r) {
+		return body
+	}
+
+	statusCode, ok := response["statusCode"].(float64)
+	if !ok {
+		return body
+	}
+
+	// The Content-Range of a partial response counts bytes of the unencoded body
+	if statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusPartialContent ||
+		statusCode == http.StatusNotModified {
+		return body
+	}
+
+	headers, _ := response["headers"].(map[string]interface{})
+	if headers == nil {
+		headers = make(map[string]interface{})
+		response["headers"] = headers
+	}
+	for key, value := range headers {
+		// Never compress twice
+		if strings.EqualFold(key, "Content-Encoding") && !isIdentityEncoding(value) {
+			return body
+		}
+	}
+
+	compressed, err := compressPayload(body)
+	if err != nil || len(compressed) >= len(body) {
+		return body
+	}
+
+	for key := range headers {
+		if strings.EqualFold(key, "Content-Encoding") || strings.EqualFold(key, "Content-Length") {
+			delete(headers, key)
+		}
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, "ETag") {
+			headers[key] = weakenETag(value)
+		}
+	}
+	headers["Content-Encoding"] = "gzip"
+	headers["Content-Length"] = strconv.Itoa(len(compressed))
+	headers["Vary"] = appendVary(headers["Vary"], "Accept-Encoding")
+	return compressed
+}
+
+// acceptsGzip reports whether the caller's Accept-Encoding allows a gzip response.
+// An explicit gzip entry decides, so "gzip;q=0" refuses gzip even alongside "*".
+func acceptsGzip(r *http.Request) bool {
+	gzipListed, gzipAllowed := false, false
+	wildcardAllowed := false
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			name = strings.TrimSpace(name)
+			allowed := codingWeight(params) > 0
+			switch {
+			case strings.EqualFold(name, "gzip"):
+				gzipListed = true
+				gzipAllowed = gzipAllowed || allowed
+			case name == "*":
+				wildcardAllowed = wildcardAllowed || allowed
+			}
+		}
+	}
+	if gzipListed {
+		return gzipAllowed
+	}
+	return wildcardAllowed
+}
+
+// codingWeight returns the q value from the parameters of an Accept-Encoding entry,
+// which is 1 when absent or malformed
+func codingWeight(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		if q, ok := strings.CutPrefix(strings.ReplaceAll(param, " ", ""), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil {
+				return weight
+			}
+		}
+	}
+	return 1
+}
+
+// weakenETag marks a strong ETag header value weak, since the re-encoded body is
+// no longer byte for byte the one the upstream tagged
+func weakenETag(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if v != "" && !strings.HasPrefix(v, "W/") {
+			return "W/" + v
+		}
+	case []interface{}:
+		weakened := make([]interface{}, len(v))
+		for i, val := range v {
+			weakened[i] = weakenETag(val)
+		}
+		return weakened
+	}
+	return value
+}
+
+// isIdentityEncoding reports whether a Content-Encoding header value means no encoding
+func isIdentityEncoding(value interface{}) bool {
+	var values []string
+	switch v := value.(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, val := range v {
+			if str, ok := val.(string); ok {
+				values = append(values, str)
+			}
+		}
+	}
+	for _, v := range values {
+		if v != "" && !strings.EqualFold(strings.TrimSpace(v), "identity") {
+			return false
+		}
+	}
+	return true
+}
+
+// appendVary adds field to an existing Vary header value from a response message
+func appendVary(existing interface{}, field string) []interface{} {
+	var values []interface{}
+	switch v := existing.(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	for _, value := range values {
+		for _, name := range strings.Split(fmt.Sprint(value), ",") {
+			if strings.EqualFold(strings.TrimSpace(name), field) {
+				return values
+			}
+		}
+	}
+	return append(values, field)
+}
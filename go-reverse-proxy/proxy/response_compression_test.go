@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// compressibleBody is a response body well above the default minimum size
+var compressibleBody = strings.Repeat("compress me please ", 200)
+
+// getEncoded requests path with the given Accept-Encoding and returns the response
+// with its body exactly as it was sent
+func (p *testProxy) getEncoded(t *testing.T, path, acceptEncoding string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, p.url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set explicitly so the transport does not decompress the response itself
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	resp, body := p.do(t, req)
+	return resp, []byte(body)
+}
+
+// gunzip decompresses a gzip body
+func gunzip(t *testing.T, body []byte) string {
+	t.Helper()
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestResponseCompression(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("small"))
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "gzip")
+			writer := gzip.NewWriter(w)
+			writer.Write([]byte(compressibleBody))
+			writer.Close()
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(compressibleBody))
+		}
+	}), func(c *Config) { c.Server.ResponseCompression.Enabled = true })
+
+	t.Run("gzip caller", func(t *testing.T) {
+		resp, body := p.getEncoded(t, "/", "br, gzip;q=0.8")
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", resp.Header.Get("Content-Encoding"))
+		}
+		if got := gunzip(t, body); got != compressibleBody {
+			t.Errorf("decompressed %d bytes, want the %d byte body", len(got), len(compressibleBody))
+		}
+		if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("Content-Length = %q, want the %d compressed bytes", resp.Header.Get("Content-Length"), len(body))
+		}
+		if !strings.Contains(resp.Header.Get("Vary"), "Accept-Encoding") {
+			t.Errorf("Vary = %q, want Accept-Encoding", resp.Header.Get("Vary"))
+		}
+		if etag := resp.Header.Get("ETag"); etag != `W/"v1"` {
+			t.Errorf("ETag = %q, want the upstream's tag weakened", etag)
+		}
+	})
+
+	t.Run("wildcard caller", func(t *testing.T) {
+		resp, _ := p.getEncoded(t, "/", "*")
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Content-Encoding = %q, want gzip", resp.Header.Get("Content-Encoding"))
+		}
+	})
+
+	for name, acceptEncoding := range map[string]string{
+		"identity caller":            "identity",
+		"gzip refused":               "gzip;q=0, br",
+		"gzip refused over wildcard": "gzip;q=0, *",
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, body := p.getEncoded(t, "/", acceptEncoding)
+			if resp.Header.Get("Content-Encoding") != "" || string(body) != compressibleBody {
+				t.Errorf("got %d bytes with Content-Encoding %q, want the plain body", len(body), resp.Header.Get("Content-Encoding"))
+			}
+			if etag := resp.Header.Get("ETag"); etag != `"v1"` {
+				t.Errorf("ETag = %q, want the upstream's strong tag kept", etag)
+			}
+		})
+	}
+
+	t.Run("small body", func(t *testing.T) {
+		resp, body := p.getEncoded(t, "/small", "gzip")
+		if resp.Header.Get("Content-Encoding") != "" || string(body) != "small" {
+			t.Errorf("got %q with Content-Encoding %q, want it uncompressed", body, resp.Header.Get("Content-Encoding"))
+		}
+	})
+
+	t.Run("already encoded", func(t *testing.T) {
+		resp, body := p.getEncoded(t, "/encoded", "gzip")
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Content-Encoding = %q, want gzip", resp.Header.Get("Content-Encoding"))
+		}
+		if got := gunzip(t, body); got != compressibleBody {
+			t.Errorf("body was compressed twice or altered: decompressed %d bytes", len(got))
+		}
+	})
+}
+
+func TestResponseCompressionDisabled(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(compressibleBody))
+	}), nil)
+
+	resp, body := p.getEncoded(t, "/", "gzip")
+	if resp.Header.Get("Content-Encoding") != "" || string(body) != compressibleBody {
+		t.Errorf("got %d bytes with Content-Encoding %q, want the plain body", len(body), resp.Header.Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+)
+
+// Parts of the URL a rewrite rule can apply to
+const (
+	rewriteTargetFull  = "full"
+	rewriteTargetPath  = "path"
+	rewriteTargetQuery = "query"
+)
+
+// rewriteRule is a compiled URL rewriting rule
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	target      string
+}
+
+// compileRewriteRules compiles the configured rewrite rules, skipping invalid ones
+func compileRewriteRules(config *Config, logger *Logger) []rewriteRule {
+	var rules []rewriteRule
+	for _, rule := range config.Client.Proxy.RewriteRules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			logger.Error("proxy", "Invalid rewrite rule pattern", map[string]interface{}{
+				"pattern": rule.Pattern,
+				"error":   err.Error(),
+			})
+			continue
+		}
+
+		target := rule.Target
+		if target == "" {
+			target = rewriteTargetFull
+		}
+		if target != rewriteTargetFull && target != rewriteTargetPath && target != rewriteTargetQuery {
+			logger.Error("proxy", "Invalid rewrite rule target", map[string]interface{}{
+				"pattern": rule.Pattern,
+				"target":  rule.Target,
+			})
+			continue
+		}
+
+		rules = append(rules, rewriteRule{
+			pattern:     pattern,
+			replacement: rule.Replacement,
+			target:      target,
+		})
+	}
+	return rules
+}
+
+// ReloadRewriteRules compiles the configured rewrite rules again, replacing the
+// rules used for subsequent requests
+func (c *ProxyClient) ReloadRewriteRules() {
+	c.config.reloadMutex.RLock()
+	rules := compileRewriteRules(c.config, c.logger)
+	c.config.reloadMutex.RUnlock()
+
+	c.rewriteMutex.Lock()
+	c.rewriteRules = rules
+	c.rewriteMutex.Unlock()
+}
+
+// applyRewriteRules applies URL rewriting rules. Path and query rules only see
+// their part of the URL, so the rest of it is preserved exactly.
+func (c *ProxyClient) applyRewriteRules(requestURL string) string {
+	parsed, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
+	}
+
+	c.rewriteMutex.RLock()
+	rules := c.rewriteRules
+	c.rewriteMutex.RUnlock()
+
+	for _, rule := range rules {
+		var original string
+		switch rule.target {
+		case rewriteTargetPath:
+			original = parsed.EscapedPath()
+		case rewriteTargetQuery:
+			original = parsed.RawQuery
+		default:
+			original = parsed.String()
+		}
+
+		if !rule.pattern.MatchString(original) {
+			continue
+		}
+		rewritten := rule.pattern.ReplaceAllString(original, rule.replacement)
+
+		switch rule.target {
+		case rewriteTargetPath:
+			path, err := url.PathUnescape(rewritten)
+			if err != nil {
+				return requestURL
+			}
+			parsed.Path = path
+			parsed.RawPath = rewritten
+		case rewriteTargetQuery:
+			parsed.RawQuery = rewritten
+		default:
+			if parsed, err = url.Parse(rewritten); err != nil {
+				return requestURL
+			}
+		}
+
+		c.logger.Debug("proxy", "URL rewritten", map[string]interface{}{
+			"original":  requestURL,
+			"rewritten": parsed.String(),
+			"rule":      rule.pattern.String(),
+			"target":    rule.target,
+		})
+		break
+	}
+
+	return parsed.String()
+}
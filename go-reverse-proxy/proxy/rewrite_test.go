@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// addRewriteRule appends a rewrite rule to the client configuration
+func addRewriteRule(c *Config, pattern, replacement, target string) {
+	rules := slices.Grow(c.Client.Proxy.RewriteRules, 1)[:len(c.Client.Proxy.RewriteRules)+1]
+	rule := &rules[len(rules)-1]
+	rule.Pattern = pattern
+	rule.Replacement = replacement
+	rule.Target = target
+	c.Client.Proxy.RewriteRules = rules
+}
+
+// echoRequestURI is a backend answering with the request URI it received
+var echoRequestURI = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.URL.RequestURI()))
+})
+
+func TestRewriteRules(t *testing.T) {
+	for _, tc := range []struct {
+		name                         string
+		pattern, replacement, target string
+		path                         string
+		want                         string
+	}{
+		{"path leaves the query intact", "^/api/(.*)", "/v1/$1", "path", "/api/users?api=/api/x&page=2", "/v1/users?api=/api/x&page=2"},
+		{"path keeps escaped characters", "^/api/", "/v1/", "path", "/api/a%2Fb?x=%20", "/v1/a%2Fb?x=%20"},
+		{"query leaves the path intact", "foo=", "bar=", "query", "/foo=/x?foo=1", "/foo=/x?bar=1"},
+		{"query that does not match", "missing=", "bar=", "query", "/x?foo=1", "/x?foo=1"},
+		{"full URL by default", "/old/", "/new/", "", "/old/x?y=/old/", "/new/x?y=/new/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, echoRequestURI, func(c *Config) {
+				addRewriteRule(c, tc.pattern, tc.replacement, tc.target)
+			})
+
+			if _, got := p.get(t, tc.path); got != tc.want {
+				t.Errorf("upstream received %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRewriteRulesKeepFragment(t *testing.T) {
+	p := startTestProxy(t, echoRequestURI, func(c *Config) {
+		addRewriteRule(c, "^/api/", "/v1/", "path")
+		addRewriteRule(c, "^a=", "b=", "query")
+	})
+
+	// Only the first matching rule applies
+	for requestURL, want := range map[string]string{
+		"http://backend/api/x?a=1#section": "http://backend/v1/x?a=1#section",
+		"http://backend/x?a=1#section":     "http://backend/x?b=1#section",
+	} {
+		if got := p.client.applyRewriteRules(requestURL); got != want {
+			t.Errorf("rewrote %s to %s, want %s", requestURL, got, want)
+		}
+	}
+}
+
+func TestInvalidRewriteRulesAreSkipped(t *testing.T) {
+	p := startTestProxy(t, echoRequestURI, func(c *Config) {
+		addRewriteRule(c, "(", "/broken/", "path")
+		addRewriteRule(c, "^/", "/other/", "fragment")
+		addRewriteRule(c, "^/api/", "/v1/", "path")
+	})
+
+	if _, got := p.get(t, "/api/x"); got != "/v1/x" {
+		t.Errorf("upstream received %q, want the valid rule applied", got)
+	}
+	p.waitForLog(t, "Invalid rewrite rule pattern")
+	p.waitForLog(t, "Invalid rewrite rule target")
+}
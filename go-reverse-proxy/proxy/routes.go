@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of host match a route can make, from most to least specific
+const (
+	hostExact = iota
+	hostWildcard
+	hostRegexp
+	hostAny
+)
+
+// route is a server routing rule matched against the request host and path
+type route struct {
+	pathPrefix  string
+	stripPrefix bool
+
+	// hostKind says how host is matched: exactly, as the suffix of a *. wildcard
+	// (including the dot), or by hostPattern
+	hostKind    int
+	host        string
+	hostPattern *regexp.Regexp
+
+	// clientTags restricts the route to clients that registered every one of these tags
+	clientTags []string
+
+	// timeout overrides server.requestTimeout for requests on the route when set
+	timeout time.Duration
+}
+
+// compileRoutes builds the configured routes, skipping those with an invalid host
+// pattern. They are ordered so the first match is the most specific: exact hosts,
+// then wildcards with the longest suffix, then patterns, then routes for any host,
+// and the longest path prefix among routes with equally specific hosts.
+func compileRoutes(config *Config, logger *Logger) []*route {
+	var routes []*route
+	for _, r := range config.Server.Routes {
+		rt := &route{
+			pathPrefix:  "/" + strings.Trim(r.PathPrefix, "/"),
+			stripPrefix: r.StripPrefix,
+			clientTags:  r.ClientTags,
+			timeout:     time.Duration(r.Timeout) * time.Millisecond,
+		}
+		if err := rt.setHost(r.Host); err != nil {
+			logger.Error("server", "Invalid route host pattern", map[string]interface{}{
+				"host":  r.Host,
+				"error": err.Error(),
+			})
+			continue
+		}
+		routes = append(routes, rt)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].hostKind != routes[j].hostKind {
+			return routes[i].hostKind < routes[j].hostKind
+		}
+		if routes[i].hostKind == hostWildcard && len(routes[i].host) != len(routes[j].host) {
+			return len(routes[i].host) > len(routes[j].host)
+		}
+		return len(routes[i].pathPrefix) > len(routes[j].pathPrefix)
+	})
+	return routes
+}
+
+// setHost parses a route's host: empty matches any host, *.example.com matches any
+// subdomain of example.com, a leading ~ makes the rest a regular expression matched
+// against the whole hostname, and anything else must match exactly. Hosts are
+// compared without their port and ignoring case.
+func (rt *route) setHost(host string) error {
+	switch {
+	case host == "":
+		rt.hostKind = hostAny
+	case strings.HasPrefix(host, "~"):
+		pattern, err := regexp.Compile("(?i)^(?:" + host[1:] + ")$")
+		if err != nil {
+			return err
+		}
+		rt.hostKind = hostRegexp
+		rt.hostPattern = pattern
+	case strings.HasPrefix(host, "*."):
+		rt.hostKind = hostWildcard
+		rt.host = strings.ToLower(host[1:])
+	default:
+		rt.hostKind = hostExact
+		rt.host = strings.ToLower(host)
+	}
+	return nil
+}
+
+// matchesHost reports whether hostname, without its port, is one the route serves
+func (rt *route) matchesHost(hostname string) bool {
+	switch rt.hostKind {
+	case hostExact:
+		return strings.EqualFold(hostname, rt.host)
+	case hostWildcard:
+		return len(hostname) > len(rt.host) && strings.HasSuffix(strings.ToLower(hostname), rt.host)
+	case hostRegexp:
+		return rt.hostPattern.MatchString(hostname)
+	}
+	return true
+}
+
+// matches reports whether path falls under the route's prefix. Prefixes match whole
+// path segments, so /service-a matches /service-a/users but not /service-ab.
+func (rt *route) matches(path string) bool {
+	if rt.pathPrefix == "/" {
+		return true
+	}
+	return path == rt.pathPrefix || strings.HasPrefix(path, rt.pathPrefix+"/")
+}
+
+// accepts reports whether a client may serve requests on the route. A nil route,
+// used for requests matching no route, accepts every client. The caller must hold
+// clientsMutex, which guards the client's tags.
+func (rt *route) accepts(info *ClientInfo) bool {
+	if rt == nil {
+		return true
+	}
+	for _, tag := range rt.clientTags {
+		if !slices.Contains(info.tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestTimeout returns how long to wait for a client response to a request on
+// the route, falling back to server.requestTimeout
+func (s *ProxyServer) requestTimeout(rt *route) time.Duration {
+	if rt != nil && rt.timeout > 0 {
+		return rt.timeout
+	}
+	return time.Duration(s.config.live().requestTimeout) * time.Millisecond
+}
+
+// matchRoute returns the route for a request, or nil if no route matches
+func (s *ProxyServer) matchRoute(r *http.Request) *route {
+	hostname := r.Host
+	if h, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = h
+	}
+	for _, rt := range s.routes {
+		if rt.matchesHost(hostname) && rt.matches(r.URL.Path) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// forwardURL returns the URL to send to the client for a request on this route,
+// with the prefix removed when the route strips it. The query is left untouched.
+func (rt *route) forwardURL(u *url.URL) string {
+	if !rt.stripPrefix || rt.pathPrefix == "/" {
+		return u.String()
+	}
+
+	stripped := *u
+	escapedPath := strings.TrimPrefix(u.EscapedPath(), rt.pathPrefix)
+	if escapedPath == "" {
+		escapedPath = "/"
+	}
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return u.String()
+	}
+	stripped.Path = path
+	stripped.RawPath = escapedPath
+	return stripped.String()
+}
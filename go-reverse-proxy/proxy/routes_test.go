@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// addRoute appends a route for host and pathPrefix to the server configuration
+func addRoute(c *Config, host, pathPrefix string, stripPrefix bool, clientTags ...string) {
+	routes := slices.Grow(c.Server.Routes, 1)[:len(c.Server.Routes)+1]
+	rt := &routes[len(routes)-1]
+	rt.Host = host
+	rt.PathPrefix = pathPrefix
+	rt.StripPrefix = stripPrefix
+	rt.ClientTags = clientTags
+	c.Server.Routes = routes
+}
+
+func TestRouteStripPrefix(t *testing.T) {
+	p := startTestProxy(t, echoRequestURI, func(c *Config) {
+		addRoute(c, "", "/service-a", true)
+		addRoute(c, "", "/service-b/", false)
+	})
+
+	for path, want := range map[string]string{
+		"/service-a/users?id=1":   "/users?id=1",
+		"/service-a":              "/",
+		"/service-a?id=1":         "/?id=1",
+		"/service-a/a%2Fb?q=%20":  "/a%2Fb?q=%20",
+		"/service-a/service-a/x":  "/service-a/x",
+		"/service-ab/users?id=1":  "/service-ab/users?id=1",
+		"/other/service-a?id=1":   "/other/service-a?id=1",
+		"/service-b/users?id=1":   "/service-b/users?id=1",
+		"/users?next=/service-a/": "/users?next=/service-a/",
+	} {
+		if _, got := p.get(t, path); got != want {
+			t.Errorf("%s reached the upstream as %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRoutingStatusCodes(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		noClients bool
+		configure func(*Config)
+		path      string
+		want      int
+	}{
+		{"route matched", false, nil, "/api/users", http.StatusOK},
+		{"no route matched", false, nil, "/other", http.StatusNotFound},
+		{"no client with the route's tags", false, nil, "/tagged", http.StatusServiceUnavailable},
+		{"no clients", true, nil, "/api", http.StatusServiceUnavailable},
+		{"configured no route status", false, func(c *Config) { c.Server.Routing.NoRouteStatus = http.StatusMisdirectedRequest }, "/other", http.StatusMisdirectedRequest},
+		{"configured no client status", true, func(c *Config) { c.Server.Routing.NoClientStatus = http.StatusBadGateway }, "/api", http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			configure := func(c *Config) {
+				c.Server.Routing.RequireRoute = true
+				addRoute(c, "", "/api", false)
+				addRoute(c, "", "/tagged", false, "blue")
+				if tc.configure != nil {
+					tc.configure(c)
+				}
+			}
+			var p *testProxy
+			if tc.noClients {
+				p = startTestServer(t, configure)
+			} else {
+				p = startTestProxy(t, echoRequestURI, configure)
+			}
+
+			if resp, body := p.get(t, tc.path); resp.StatusCode != tc.want {
+				t.Errorf("status = %d (%s), want %d", resp.StatusCode, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnroutedRequestsForwardedByDefault(t *testing.T) {
+	p := startTestProxy(t, echoRequestURI, func(c *Config) { addRoute(c, "", "/api", false) })
+
+	if resp, body := p.get(t, "/other"); resp.StatusCode != http.StatusOK || body != "/other" {
+		t.Errorf("got %d %q, want the request forwarded", resp.StatusCode, body)
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}), func(c *Config) {
+		c.Server.RequestTimeout = 100
+		addRoute(c, "", "/fast", false)
+		c.Server.Routes[0].Timeout = 50
+		addRoute(c, "", "/slow", false)
+		c.Server.Routes[1].Timeout = 2000
+	})
+
+	// Either the server's timeout or the client's canceled call answers a timed out request
+	for path, wantOK := range map[string]bool{"/fast": false, "/slow": true, "/other": false} {
+		resp, _ := p.get(t, path)
+		timedOut := resp.StatusCode == http.StatusGatewayTimeout || resp.StatusCode == http.StatusBadGateway
+		if wantOK && resp.StatusCode != http.StatusOK || !wantOK && !timedOut {
+			t.Errorf("%s: status = %d, want it to time out: %v", path, resp.StatusCode, !wantOK)
+		}
+	}
+}
+
+func TestRouteHostPrecedence(t *testing.T) {
+	config := newTestConfig(t)
+	addRoute(config, "", "/long/path", false, "any host")
+	addRoute(config, `~api-[0-9]+\.example\.com`, "/", false, "pattern")
+	addRoute(config, "*.example.com", "/", false, "wildcard")
+	addRoute(config, "*.eu.example.com", "/", false, "longer wildcard")
+	addRoute(config, "api.example.com", "/", false, "exact")
+	addRoute(config, "~(", "/", false, "invalid")
+	s := &ProxyServer{config: config, routes: compileRoutes(config, newTestLogger(t, config))}
+
+	for url, want := range map[string]string{
+		"http://api.example.com/x":           "exact",
+		"http://API.example.com:8080/x":      "exact",
+		"http://api.example.com/long/path":   "exact",
+		"http://www.example.com/x":           "wildcard",
+		"http://a.eu.example.com/x":          "longer wildcard",
+		"http://api-7.example.com/x":         "wildcard",
+		"http://api-7.example.org/x":         "",
+		"http://example.com/x":               "",
+		"http://example.com/long/path/users": "any host",
+	} {
+		got := ""
+		if rt := s.matchRoute(httptest.NewRequest(http.MethodGet, url, nil)); rt != nil {
+			got = rt.clientTags[0]
+		}
+		if got != want {
+			t.Errorf("%s matched route %q, want %q", url, got, want)
+		}
+	}
+	if len(s.routes) != 5 {
+		t.Errorf("compiled %d routes, want the invalid pattern skipped", len(s.routes))
+	}
+}
+
+func TestRouteHostPatternBeatsAnyHost(t *testing.T) {
+	config := newTestConfig(t)
+	addRoute(config, "", "/", false, "any host")
+	addRoute(config, `~api-[0-9]+\.example\.com`, "/", false, "pattern")
+	s := &ProxyServer{config: config, routes: compileRoutes(config, newTestLogger(t, config))}
+
+	if rt := s.matchRoute(httptest.NewRequest(http.MethodGet, "http://api-7.example.com/", nil)); rt == nil || rt.clientTags[0] != "pattern" {
+		t.Errorf("matched %+v, want the pattern route", rt)
+	}
+}
@@ -0,0 +1,2349 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// pendingSweepInterval is how often expired pending requests are swept, and how long
+// past its deadline a request must be before it is swept
+const pendingSweepInterval = 10 * time.Second
+
+// knownClientRetention is how long the ID of a disconnected client is remembered,
+// so that it is still recognized if it reconnects
+const knownClientRetention = time.Hour
+
+// Load balancing strategies for choosing a client
+const (
+	strategyFirst              = "first"
+	strategyLeastConnections   = "least-connections"
+	strategyWeightedRoundRobin = "weighted-round-robin"
+)
+
+// Policies for requests that expect a 100 Continue before sending their body
+const (
+	expectContinueSend   = "continue"
+	expectContinueReject = "reject"
+)
+
+// PendingRequest holds both the request and its response writer
+type PendingRequest struct {
+	req      *http.Request
+	res      http.ResponseWriter
+	clientID string
+	client   *ClientInfo
+	deadline time.Time
+	done     chan bool
+	started  chan bool
+
+	// progress is signalled each time a streamed message is written, so the
+	// handler can tell a stalled stream from a slow one
+	progress chan struct{}
+
+	// createdAt is when the request started waiting for its client
+	createdAt time.Time
+
+	// mu serializes writes to res; cond orders streamed messages by sequence number
+	mu       sync.Mutex
+	cond     *sync.Cond
+	nextSeq  int
+	finished bool
+
+	// aborted is set when a streamed response was cut short after its head was
+	// written, so the handler breaks the response instead of ending it cleanly
+	aborted bool
+
+	// upstreamMs is how long the client reported the upstream took, or -1 until it does
+	upstreamMs int64
+
+	// requestBytes and responseBytes count the request body forwarded and the
+	// response body received
+	requestBytes  int64
+	responseBytes int64
+
+	// bodyReady is closed when the client is ready for a gRPC request's body,
+	// which is streamed to it rather than sent with the request
+	bodyReady chan struct{}
+	readyOnce sync.Once
+
+	// bodyWindow paces a gRPC request's body by the client's acknowledgements
+	bodyWindow *tunnelWindow
+}
+
+// newPendingRequest creates a PendingRequest for a request forwarded to the given client
+func newPendingRequest(r *http.Request, w http.ResponseWriter, clientID string) *PendingRequest {
+	pending := &PendingRequest{
+		req:        r,
+		res:        w,
+		clientID:   clientID,
+		done:       make(chan bool),
+		started:    make(chan bool),
+		progress:   make(chan struct{}, 1),
+		createdAt:  time.Now(),
+		upstreamMs: -1,
+	}
+	pending.cond = sync.NewCond(&pending.mu)
+	return pending
+}
+
+// finish marks the request as complete and wakes any waiters; the caller must hold mu
+func (p *PendingRequest) finish() {
+	if p.finished {
+		return
+	}
+	p.finished = true
+	close(p.done)
+	p.cond.Broadcast()
+}
+
+// hasStarted reports whether the head of a streamed response has been written;
+// the caller must hold p.mu
+func (p *PendingRequest) hasStarted() bool {
+	select {
+	case <-p.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// abortIfCut aborts the handler if the response stream was cut short. The caller
+// then sees a broken response rather than a truncated body that looks complete.
+func (p *PendingRequest) abortIfCut() {
+	p.mu.Lock()
+	aborted := p.aborted
+	p.mu.Unlock()
+	if aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ClientInfo holds the state of a connected proxy client
+type ClientInfo struct {
+	conn          net.Conn
+	messageBuffer *MessageBuffer
+	healthy       bool
+
+	// healthGeneration is the generation of the last health report applied
+	healthGeneration int64
+
+	// outbound holds the frames waiting to be written to conn
+	outbound *outboundQueue
+
+	// id is the key the client is stored under. Connections start with an ID derived
+	// from their remote address and take the client's own ID if it registers with one.
+	id string
+
+	// registered is set once the client has completed registration; until then it
+	// receives no requests
+	registered bool
+
+	// draining clients finish their in-flight requests but receive no new ones
+	draining bool
+
+	// inFlight counts requests forwarded to this client that have not completed;
+	// maxConcurrency is the most the client said it can handle at once, 0 for no limit
+	inFlight       atomic.Int64
+	maxConcurrency atomic.Int64
+
+	// weight is the share of traffic the client asked for at registration;
+	// currentWeight is its running score under weighted-round-robin
+	weight        int
+	currentWeight int
+
+	// tags are the labels the client reported at registration
+	tags []string
+
+	// connectedAt is when the connection was accepted
+	connectedAt time.Time
+
+	// idleTimeout closes the connection after a period without traffic (0 disables);
+	// lastActivity is when traffic was last seen, in Unix nanoseconds
+	idleTimeout  time.Duration
+	lastActivity atomic.Int64
+
+	// limiter paces the requests dispatched to the client. Its rate is infinite
+	// while there is no limit, so a reload can impose one.
+	limiter *rate.Limiter
+
+	// bytes totals the traffic on the connection
+	bytes byteCounts
+
+	// protocol is the protocol version agreed at registration
+	protocol atomic.Int64
+}
+
+// available reports whether the client may be selected for new requests
+func (info *ClientInfo) available() bool {
+	return info.registered && info.healthy && !info.draining && info.hasCapacity()
+}
+
+// touch records traffic on the connection, pushing back its idle deadline
+func (info *ClientInfo) touch() {
+	info.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleDeadline returns when the connection counts as idle, or the zero time if
+// there is no idle timeout
+func (info *ClientInfo) idleDeadline() time.Time {
+	if info.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, info.lastActivity.Load()).Add(info.idleTimeout)
+}
+
+// ProxyServer handles the server-side of the reverse proxy
+type ProxyServer struct {
+	config  *Config
+	logger  *Logger
+	codec   Codec
+	clients map[string]*ClientInfo
+
+	// knownClients records the IDs clients have registered with, so a client
+	// reconnecting under the same ID is recognized. Each maps to when its client
+	// disconnected, or the zero time while it is connected; guarded by clientsMutex.
+	knownClients map[string]time.Time
+
+	// connectionCount numbers socket connections for their initial client IDs
+	connectionCount atomic.Uint64
+	clientsMutex    sync.RWMutex
+	pendingRequests map[string]*PendingRequest
+	requestsMutex   sync.RWMutex
+	trustedNets     []*net.IPNet
+	startTime       time.Time
+	startup         *startupGate
+	readBuffers     *bufferPool
+	sessions        map[string]*stickySession
+	sessionsMutex   sync.Mutex
+	metrics         *metricsRegistry
+	routes          []*route
+	requestSlots    chan struct{}
+	connsPerIP      map[string]int
+	cache           *responseCache
+	headerRules     []headerRule
+	allow           allowList
+	noClientsBody   []byte
+	connsMutex      sync.Mutex
+	inFlight        atomic.Int64
+	certs           map[string]*certificateReloader
+	certsMutex      sync.Mutex
+	tunnels         map[string]*serverTunnel
+	tunnelsMutex    sync.Mutex
+	capacityFreed   capacitySignal
+	warmup          *warmup
+
+	// httpServers and socketListener are set once listening, for Stop; guarded by
+	// listenersMutex. stopping is set when Stop begins.
+	httpServers    []*http.Server
+	socketListener net.Listener
+	listenersMutex sync.Mutex
+	stopping       atomic.Bool
+
+	// done is closed by Stop to end the background loops Start launches, which
+	// background tracks so Stop can wait for them to exit
+	done       chan struct{}
+	stopOnce   sync.Once
+	background sync.WaitGroup
+
+	// connectionIDs numbers accepted HTTP connections
+	connectionIDs atomic.Uint64
+
+	// newRequestID generates the IDs requests and tunnels are tracked by
+	newRequestID func() string
+
+	// handler serves HTTP requests once started; transport, if set, replaces the
+	// HTTP and socket listeners
+	handler   http.Handler
+	transport Transport
+}
+
+// NewProxyServer creates a new ProxyServer instance
+func NewProxyServer(config *Config, logger *Logger) *ProxyServer {
+	server := &ProxyServer{
+		config:          config,
+		certs:           make(map[string]*certificateReloader),
+		tunnels:         make(map[string]*serverTunnel),
+		logger:          logger,
+		clients:         make(map[string]*ClientInfo),
+		knownClients:    make(map[string]time.Time),
+		pendingRequests: make(map[string]*PendingRequest),
+		readBuffers:     newBufferPool(config.Server.Socket.ReadBufferSize),
+		sessions:        make(map[string]*stickySession),
+		metrics:         newMetricsRegistry(),
+		routes:          compileRoutes(config, logger),
+		headerRules:     compileHeaderRules(config.Server.ResponseHeaderRules, logger, "server"),
+		allow:           compileAllowList(config, logger),
+		noClientsBody:   loadNoClientsBody(config, logger),
+		connsPerIP:      make(map[string]int),
+		newRequestID:    timestampRequestID,
+		done:            make(chan struct{}),
+	}
+
+	server.metrics.gauge("proxy_pending_requests", "Requests waiting for a client response.", func() float64 {
+		server.requestsMutex.RLock()
+		defer server.requestsMutex.RUnlock()
+		return float64(len(server.pendingRequests))
+	})
+	server.metrics.gauge("proxy_requests_in_flight", "HTTP requests currently being proxied.", func() float64 {
+		return float64(server.inFlight.Load())
+	})
+	server.metrics.counter("proxy_pending_requests_swept_total", "Pending requests removed by the sweeper after their deadline.")
+	server.metrics.counter("proxy_client_rate_limited_total", "Requests rejected because their client's rate limit was exceeded.")
+	server.metrics.counter("proxy_upstream_duration_seconds_sum", "Total time clients spent waiting on upstreams, as they reported it.")
+	server.metrics.counter("proxy_upstream_duration_seconds_count", "Responses whose upstream time was reported by the client.")
+	server.metrics.counter("proxy_slow_request_bodies_total", "Requests rejected because their body arrived below the minimum rate.")
+	server.metrics.counter("proxy_dead_letters_total", "Requests that could not be delivered to any client, by reason.")
+	server.metrics.counter("proxy_tls_handshake_errors_total", "TLS handshakes on the socket listener that failed, by reason.")
+	server.metrics.counter("proxy_request_id_collisions_total", "Generated request IDs that were already in use by a pending request or tunnel.")
+	server.registerByteMetrics()
+
+	if config.Server.Cache.Enabled {
+		server.cache = newResponseCache(config.Server.Cache.MaxEntries, config.Server.Cache.MaxBodyBytes)
+		server.metrics.counter("proxy_cache_hits_total", "Requests served from the response cache.")
+		server.metrics.counter("proxy_cache_misses_total", "Cacheable requests with no fresh cached response.")
+		server.metrics.gauge("proxy_cache_entries", "Responses held in the response cache.", func() float64 {
+			return float64(server.cache.len())
+		})
+	}
+
+	// Each in-flight request holds a slot; none means no limit
+	if config.Server.MaxConcurrentRequests > 0 {
+		server.requestSlots = make(chan struct{}, config.Server.MaxConcurrentRequests)
+	}
+
+	// Parse the networks allowed to see detailed error messages
+	for _, cidr := range config.Server.ErrorDetails.TrustedCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Error("server", "Invalid trusted CIDR", map[string]interface{}{
+				"cidr":  cidr,
+				"error": err.Error(),
+			})
+			continue
+		}
+		server.trustedNets = append(server.trustedNets, network)
+	}
+
+	return server
+}
+
+// Start starts the HTTP and socket servers. It fails with ErrInvalidConfig if
+// the configuration would leave the server unable to serve as configured.
+func (s *ProxyServer) Start() error {
+	if err := checkServerConfig(s.config); err != nil {
+		return err
+	}
+
+	codec, err := newCodec(s.config.Transport.Codec)
+	if err != nil {
+		return err
+	}
+	s.codec = codec
+
+	s.startTime = time.Now()
+	s.startup = newStartupGate(s.startupChecks()...)
+	waitForClients := s.config.Server.WaitForClients
+	s.warmup = newWarmup(waitForClients.Count, time.Duration(waitForClients.Timeout)*time.Millisecond)
+
+	// Built-in endpoints are registered alongside the catch-all proxy handler
+	// so they are never forwarded to a client
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleHTTPRequest)
+	if s.config.Server.Health.Path != "" {
+		mux.HandleFunc(s.config.Server.Health.Path, s.handleHealth)
+	}
+	if s.config.Server.Ping.Path != "" {
+		mux.HandleFunc(s.config.Server.Ping.Path, s.handlePing)
+	}
+	if s.config.Server.Startup.ReadyPath != "" {
+		mux.HandleFunc(s.config.Server.Startup.ReadyPath, s.handleReady)
+	}
+	if s.config.Server.Metrics.Path != "" {
+		mux.HandleFunc(s.config.Server.Metrics.Path, s.handleMetrics)
+	}
+	s.registerAdminRoutes(mux)
+
+	// CONNECT requests name a host rather than a path, so the mux can't route them
+	s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			s.handleHTTPRequest(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+
+	// Bind every listener before starting anything else, so that a listener that
+	// can't start fails Start rather than leaving the server running without it.
+	// With a transport the caller serves HTTP through Handler instead.
+	var httpListeners []boundHTTPListener
+	if s.transport == nil {
+		httpListeners, err = s.listenHTTP(s.handler)
+		if err != nil {
+			s.startup.fail(checkHTTPListener)
+			return err
+		}
+	}
+	s.passStartupCheck(checkHTTPListener)
+
+	var socketListener net.Listener
+	if s.transport != nil {
+		socketListener, err = s.transport.Listen()
+	} else {
+		socketListener, err = s.listenSocket()
+	}
+	if err != nil {
+		for _, l := range httpListeners {
+			l.listener.Close()
+		}
+		s.startup.fail(checkSocketListener)
+		return err
+	}
+	s.passStartupCheck(checkSocketListener)
+
+	s.listenersMutex.Lock()
+	for _, l := range httpListeners {
+		s.httpServers = append(s.httpServers, l.server)
+	}
+	s.socketListener = socketListener
+	s.listenersMutex.Unlock()
+
+	s.background.Go(s.watchStartup)
+	s.background.Go(s.watchWarmup)
+	s.background.Go(s.sweepSessions)
+	s.background.Go(s.sweepPendingRequests)
+	if interval := s.config.Server.CertReloadInterval; interval > 0 {
+		s.background.Go(func() { s.watchCertificates(time.Duration(interval) * time.Millisecond) })
+	}
+
+	for _, l := range httpListeners {
+		go s.serveHTTP(l)
+	}
+	go s.acceptSocketConnections(socketListener)
+
+	return nil
+}
+
+// SetTransport makes the server accept clients through transport instead of its
+// socket listener. It must be called before Start. A server with a transport binds
+// no ports; HTTP requests are served by passing Handler to an http.Server or
+// calling it directly.
+func (s *ProxyServer) SetTransport(transport Transport) {
+	s.transport = transport
+}
+
+// Handler returns the handler for HTTP requests to the server, including its
+// built-in endpoints. It is nil until the server has started.
+func (s *ProxyServer) Handler() http.Handler {
+	return s.handler
+}
+
+// listenSocket binds the socket listener that proxy clients connect to
+func (s *ProxyServer) listenSocket() (net.Listener, error) {
+	network, addr := socketListenAddress(s.config)
+
+	// A socket file left behind by an earlier run would make the listen fail
+	if network == "unix" {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, fmt.Errorf("removing stale socket file %s: %w", addr, err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if s.config.Server.Socket.SSL.Enabled {
+		certs, err := newCertificateReloader(s.config.Server.Socket.SSL.Cert, s.config.Server.Socket.SSL.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = &tls.Config{
+			GetCertificate: certs.getCertificate,
+		}
+		sslConfig := s.config.Server.Socket.SSL
+		if err := applyTLSPolicy(tlsConfig, sslConfig.MinVersion, sslConfig.CipherSuites); err != nil {
+			return nil, err
+		}
+
+		// Require proxy clients to authenticate with a certificate signed by the client CA
+		if s.config.Server.Socket.SSL.RequireClientCert {
+			caCert, err := os.ReadFile(s.config.Server.Socket.SSL.ClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrTLSLoad, err)
+			}
+
+			clientCAs := x509.NewCertPool()
+			if !clientCAs.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("%w: no certificates found in client CA %s", ErrTLSLoad, s.config.Server.Socket.SSL.ClientCA)
+			}
+
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.ClientCAs = clientCAs
+		}
+		s.addCertificates("socket", certs)
+	}
+
+	listener, err := listen(network, addr, s.config.Server.Socket.ReusePort)
+	if err != nil {
+		return nil, fmt.Errorf("socket listener: %w", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s.logger.Info("server", "Socket server listening", map[string]interface{}{
+		"network": network,
+		"address": addr,
+	})
+	return listener, nil
+}
+
+// acceptSocketConnections accepts proxy client connections until the server stops.
+// Like net/http, it backs off after a failed accept, from 5ms doubling up to a
+// second, so running out of file descriptors doesn't turn into a busy loop.
+func (s *ProxyServer) acceptSocketConnections(listener net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			s.logger.Error("server", "Failed to accept connection", map[string]interface{}{
+				"error":   err.Error(),
+				"retryMs": delay.Milliseconds(),
+			})
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		go s.handleSocketConnection(conn)
+	}
+}
+
+// Stop shuts the server down. It stops accepting connections, waits for in-flight
+// requests until ctx is done, then tells each client how long to wait before
+// reconnecting and closes its connection. The server's background loops have
+// exited by the time it returns.
+func (s *ProxyServer) Stop(ctx context.Context) error {
+	s.stopping.Store(true)
+	s.stopOnce.Do(func() { close(s.done) })
+	s.logger.Info("server", "Shutting down", nil)
+
+	s.listenersMutex.Lock()
+	httpServers, socketListener := s.httpServers, s.socketListener
+	s.listenersMutex.Unlock()
+
+	if socketListener != nil {
+		socketListener.Close()
+	}
+	var err error
+	for _, httpServer := range httpServers {
+		if shutdownErr := httpServer.Shutdown(ctx); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+
+	// Well-behaved clients back off instead of reconnecting straight away
+	shutdown := map[string]interface{}{
+		"type":             "shutdown",
+		"reconnectAfterMs": s.config.Server.Shutdown.ReconnectAfter,
+	}
+	s.clientsMutex.RLock()
+	clients := make([]*ClientInfo, 0, len(s.clients))
+	for _, info := range s.clients {
+		clients = append(clients, info)
+	}
+	s.clientsMutex.RUnlock()
+	for _, info := range clients {
+		if sendErr := s.sendAndClose(info, shutdown); sendErr != nil {
+			s.logger.Warn("socket", "Failed to send shutdown to client", map[string]interface{}{
+				"clientId": s.clientID(info),
+				"error":    sendErr.Error(),
+			})
+		}
+	}
+
+	// Give the writers until the deadline to flush the shutdown message
+	for _, info := range clients {
+		select {
+		case <-info.outbound.stopped:
+		case <-ctx.Done():
+		}
+		info.conn.Close()
+	}
+
+	s.background.Wait()
+	return err
+}
+
+// Run starts the server and serves until ctx is done, then stops it, giving
+// in-flight requests up to server.shutdown.timeout to finish. It returns an error
+// only if the server fails to start.
+func (s *ProxyServer) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+
+	timeout := time.Duration(s.config.Server.Shutdown.Timeout) * time.Millisecond
+	stopCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Stop(stopCtx); err != nil {
+		s.logger.Warn("server", "In-flight requests did not finish before shutdown", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	return nil
+}
+
+// selectClient chooses a client allowed to serve the request's route, honoring
+// session affinity when the request carries a sticky session cookie
+func (s *ProxyServer) selectClient(r *http.Request, rt *route) (string, *ClientInfo) {
+	key := s.stickyKey(r)
+	if key != "" {
+		if clientID, info := s.stickyClient(key, rt); info != nil {
+			return clientID, info
+		}
+	}
+
+	if s.config.Server.LoadBalancing.Strategy == strategyWeightedRoundRobin {
+		clientID, client := s.nextWeightedClient(rt)
+		if client != nil && key != "" {
+			s.bindSession(key, clientID)
+		}
+		return clientID, client
+	}
+
+	// Get the healthy client that connected first, or the least busy one
+	leastConnections := s.config.Server.LoadBalancing.Strategy == strategyLeastConnections
+	s.clientsMutex.RLock()
+	var clientID string
+	var client *ClientInfo
+	for id, info := range s.clients {
+		if !info.available() || !rt.accepts(info) {
+			continue
+		}
+		var better bool
+		switch {
+		case client == nil:
+			better = true
+		case leastConnections:
+			better = info.inFlight.Load() < client.inFlight.Load()
+		default:
+			better = info.connectedAt.Before(client.connectedAt) ||
+				info.connectedAt.Equal(client.connectedAt) && id < clientID
+		}
+		if better {
+			clientID = id
+			client = info
+		}
+	}
+	s.clientsMutex.RUnlock()
+
+	if client != nil && key != "" {
+		s.bindSession(key, clientID)
+	}
+	return clientID, client
+}
+
+// nextWeightedClient picks a healthy client for the route using smooth weighted round
+// robin, so each client receives a share of requests proportional to its weight
+func (s *ProxyServer) nextWeightedClient(rt *route) (string, *ClientInfo) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	var clientID string
+	var client *ClientInfo
+	total := 0
+	for id, info := range s.clients {
+		if !info.available() || !rt.accepts(info) {
+			continue
+		}
+		info.currentWeight += info.weight
+		total += info.weight
+		if client == nil || info.currentWeight > client.currentWeight {
+			clientID = id
+			client = info
+		}
+	}
+	if client != nil {
+		client.currentWeight -= total
+	}
+	return clientID, client
+}
+
+// waitForClientRate waits until the client's rate limit lets another request through.
+// It gives up, returning false, if that would take longer than the configured maximum
+// wait or the caller goes away first.
+func (s *ProxyServer) waitForClientRate(r *http.Request, client *ClientInfo) bool {
+	if client.limiter.Limit() == rate.Inf {
+		return true
+	}
+	maxWait := time.Duration(s.config.live().rateLimit.MaxWait) * time.Millisecond
+	ctx, cancel := context.WithTimeout(r.Context(), maxWait)
+	defer cancel()
+	return client.limiter.Wait(ctx) == nil
+}
+
+// setRateLimit applies the per-client rate limit settings to a client's limiter. A
+// rate of 0 lifts the limit.
+func setRateLimit(limiter *rate.Limiter, rateLimit rateLimitSettings) {
+	if rateLimit.RequestsPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetBurst(rateLimit.Burst)
+	limiter.SetLimit(rate.Limit(rateLimit.RequestsPerSecond))
+}
+
+// ReloadRateLimits applies the configured per-client rate limit to the connected
+// clients, for use after ReloadConfig. Clients that connect later get it anyway.
+func (s *ProxyServer) ReloadRateLimits() {
+	rateLimit := s.config.live().rateLimit
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	for _, info := range s.clients {
+		setRateLimit(info.limiter, rateLimit)
+	}
+}
+
+// handleHealth reports whether any proxy client could serve a request. Clients
+// that are still registering or whose backend is unhealthy don't count.
+func (s *ProxyServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s.clientsMutex.RLock()
+	clients := 0
+	healthyClients := 0
+	for _, info := range s.clients {
+		if !info.registered {
+			continue
+		}
+		clients++
+		if info.healthy {
+			healthyClients++
+		}
+	}
+	s.clientsMutex.RUnlock()
+
+	status := "ok"
+	statusCode := http.StatusOK
+	if healthyClients == 0 {
+		status = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"status":         status,
+		"clients":        clients,
+		"healthyClients": healthyClients,
+		"uptimeSeconds":  int64(time.Since(s.startTime).Seconds()),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+// handlePing answers "pong" to show the HTTP listener is up. Unlike the health
+// endpoint it says nothing about clients, so it succeeds even with none connected.
+func (s *ProxyServer) handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("pong"))
+}
+
+// handleHTTPRequest handles incoming HTTP requests
+func (s *ProxyServer) handleHTTPRequest(w http.ResponseWriter, r *http.Request) {
+	var clientID, requestID string
+	var pending *PendingRequest
+
+	// Continue the caller's trace, if any, across the socket hop
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "proxy.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+
+	// Record the outcome of every request for the access log and the trace
+	recorder := newResponseRecorder(w)
+	w = recorder
+	start := time.Now()
+	defer func() {
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", status),
+			attribute.String("proxy.client_id", clientID),
+			attribute.String("proxy.request_id", requestID),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+
+		if s.config.live().accessLog {
+			s.logAccess(r, recorder, start, clientID, requestID, pending)
+		}
+	}()
+
+	// Turn away methods and paths outside the allowlist before anything else
+	if !s.checkAllowed(w, r) {
+		return
+	}
+
+	// A CONNECT that would be refused is refused whether or not any client could take it
+	if r.Method == http.MethodConnect {
+		if !s.config.Server.AllowConnect {
+			w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			s.writeError(w, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "CONNECT is not allowed", "")
+			return
+		}
+		if !connectAllowed(s.config.Server.ConnectAllowedHosts, r.Host) {
+			s.logger.Warn("request", "CONNECT destination not allowed", map[string]interface{}{
+				"host": r.Host,
+			})
+			s.writeError(w, http.StatusForbidden, errorCodeForbidden, "CONNECT destination is not allowed", "")
+			return
+		}
+	}
+
+	// Hold requests back until enough clients have registered after startup
+	if !s.awaitWarmup(w, r) {
+		return
+	}
+
+	// Shed load instead of queuing once the concurrency limit is reached
+	if s.requestSlots != nil {
+		select {
+		case s.requestSlots <- struct{}{}:
+			defer func() { <-s.requestSlots }()
+		default:
+			s.logger.Warn("request", "Too many concurrent requests", map[string]interface{}{
+				"limit": s.config.Server.MaxConcurrentRequests,
+			})
+			w.Header().Set("Retry-After", "1")
+			s.writeError(w, http.StatusServiceUnavailable, errorCodeOverloaded, "Too many concurrent requests", "")
+			return
+		}
+	}
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+
+	// Refuse requests whose headers would bloat the forwarded message
+	if !headersWithinLimits(r.Header, s.config.Server.MaxHeaderCount, s.config.Server.MaxHeaderBytes) {
+		count, size := headerSize(r.Header)
+		s.logger.Warn("request", "Request headers too large", map[string]interface{}{
+			"method":      r.Method,
+			"url":         r.URL.String(),
+			"headerCount": count,
+			"headerBytes": size,
+		})
+		s.writeError(w, http.StatusRequestHeaderFieldsTooLarge, errorCodeHeadersTooLarge, "Request Header Fields Too Large", "")
+		return
+	}
+
+	// Refuse overly long URLs before they are copied into the forwarded message
+	if uri := r.URL.RequestURI(); s.config.Server.MaxURLLength > 0 && len(uri) > s.config.Server.MaxURLLength {
+		s.logger.Warn("request", "Request URL too long", map[string]interface{}{
+			"method":    r.Method,
+			"url":       truncateURL(uri),
+			"urlLength": len(uri),
+			"limit":     s.config.Server.MaxURLLength,
+		})
+		s.writeError(w, http.StatusRequestURITooLong, errorCodeURLTooLong, "URI Too Long", "")
+		return
+	}
+
+	// gRPC streams its messages and ends with trailers, which only HTTP/2 carries
+	grpc := isGRPCRequest(r)
+	if grpc && r.ProtoMajor < 2 {
+		s.logger.Warn("request", "gRPC request over HTTP/1", map[string]interface{}{
+			"url":   r.URL.String(),
+			"proto": r.Proto,
+		})
+		s.writeError(w, http.StatusHTTPVersionNotSupported, errorCodeHTTP2Required, "gRPC requires HTTP/2", "")
+		return
+	}
+
+	// Callers may set their own timeout, up to the server's maximum
+	callerTimeout, ok := s.callerTimeout(w, r)
+	if !ok {
+		return
+	}
+
+	// Requests matching no route are forwarded unchanged unless a route is required
+	rt := s.matchRoute(r)
+	if rt == nil && s.config.Server.Routing.RequireRoute {
+		s.logger.Warn("request", "No route matches request", map[string]interface{}{
+			"method": r.Method,
+			"url":    r.URL.String(),
+		})
+		s.writeError(w, s.config.Server.Routing.NoRouteStatus, errorCodeNoRoute, "No route matches request", "")
+		return
+	}
+
+	// A request pinned to a client for debugging bypasses the cache and the load
+	// balancer, and fails rather than going to another client
+	pinnedID, pinned := s.pinnedClientID(r)
+
+	// Fresh cached responses are served without involving a client
+	if !pinned && s.serveFromCache(w, r) {
+		return
+	}
+
+	var client *ClientInfo
+	if pinned {
+		if client = s.acquirePinnedClient(pinnedID); client == nil {
+			s.logger.Warn("request", "Pinned client not available", map[string]interface{}{
+				"clientId": pinnedID,
+				"url":      r.URL.String(),
+			})
+			s.deadLetter(r, deadLetterPinnedClient, pinnedID, "")
+			s.writeError(w, http.StatusServiceUnavailable, errorCodePinnedClient, "Pinned client not available", "")
+			return
+		}
+		clientID = pinnedID
+		s.logger.Info("request", "Request pinned to client", map[string]interface{}{
+			"clientId": clientID,
+			"url":      r.URL.String(),
+		})
+	} else if clientID, client = s.balanceRequest(w, r, rt); client == nil {
+		return
+	}
+	defer s.releaseClient(client)
+
+	// Pace requests to the client so a weak backend isn't overwhelmed
+	if !s.waitForClientRate(r, client) {
+		s.metrics.add("proxy_client_rate_limited_total", 1)
+		s.logger.Warn("request", "Client rate limit exceeded", map[string]interface{}{
+			"clientId": clientID,
+			"limit":    float64(client.limiter.Limit()),
+		})
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, errorCodeRateLimited, "Client rate limit exceeded", "")
+		return
+	}
+
+	// Clients that predate gRPC support can't stream the request body
+	if grpc && client.protocol.Load() < protocolGRPC {
+		s.logger.Warn("request", "Client does not support gRPC", map[string]interface{}{
+			"clientId": clientID,
+			"protocol": client.protocol.Load(),
+		})
+		s.writeError(w, http.StatusBadGateway, errorCodeGRPCUnsupported, "Client does not support gRPC", "")
+		return
+	}
+
+	// CONNECT opens a raw tunnel through the client instead of forwarding a request
+	if r.Method == http.MethodConnect {
+		tunnel := newServerTunnel(clientID)
+		var err error
+		if requestID, err = s.addTunnel(tunnel); err != nil {
+			s.writeError(w, http.StatusInternalServerError, errorCodeInternal, "Internal Server Error", requestID)
+			return
+		}
+		s.handleConnect(w, r, clientID, client, tunnel, requestID)
+		return
+	}
+
+	// gRPC bodies are streamed to the client as they arrive; others are read in full
+	var body []byte
+	if !grpc {
+		if body, ok = s.readRequestBody(w, r); !ok {
+			return
+		}
+	}
+
+	// Store the request and response writer
+	timeout := s.requestTimeout(rt)
+	if callerTimeout > 0 {
+		timeout = callerTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	pending = newPendingRequest(r, w, clientID)
+	pending.deadline = deadline
+	pending.client = client
+	if grpc {
+		pending.bodyReady = make(chan struct{})
+		pending.bodyWindow = newTunnelWindow()
+	}
+	var pendingCount int
+	var err error
+	requestID, pendingCount, err = s.addPendingRequest(pending)
+	switch err {
+	case errTooManyPending:
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, errorCodeTooManyPending, "Too many pending requests", requestID)
+		return
+	case errDuplicateRequestID:
+		s.writeError(w, http.StatusInternalServerError, errorCodeInternal, "Internal Server Error", requestID)
+		return
+	}
+
+	// Warn once each time the backlog grows past the high-water mark
+	if threshold := s.config.Server.PendingRequestWarnThreshold; threshold > 0 && pendingCount == threshold {
+		s.logger.Warn("request", "Pending requests reached warning threshold", map[string]interface{}{
+			"pendingRequests": pendingCount,
+			"threshold":       threshold,
+		})
+	}
+
+	// Never pass the error details token on to the backend
+	headers := r.Header
+	if s.config.Server.ErrorDetails.Token != "" {
+		headers = r.Header.Clone()
+		headers.Del(s.config.Server.ErrorDetails.Header)
+	}
+
+	// The expectation was answered here, not by the upstream
+	if headers.Get("Expect") != "" {
+		headers = headers.Clone()
+		headers.Del("Expect")
+	}
+
+	// Callers can't supply their own TLS details when the server forwards them
+	if s.config.Server.HTTP.SSL.ForwardInfo {
+		headers = headers.Clone()
+		removeTLSInfoHeaders(headers)
+	}
+
+	// The client passes on the remaining budget in its own header
+	if headers.Get(callerTimeoutHeader) != "" {
+		headers = headers.Clone()
+		headers.Del(callerTimeoutHeader)
+	}
+
+	// The pin and the admin token that allowed it are meant for the proxy alone
+	if pinned {
+		headers = headers.Clone()
+		headers.Del(clientPinHeader)
+		headers.Del("Authorization")
+	}
+
+	// Routes may strip their prefix before the request reaches the upstream
+	forwardURL := r.URL.String()
+	if rt != nil {
+		forwardURL = rt.forwardURL(r.URL)
+	}
+
+	// Forward the request to the client
+	requestData := map[string]interface{}{
+		"type":               "request",
+		"clientId":           clientID,
+		"requestId":          requestID,
+		"method":             r.Method,
+		"host":               r.Host,
+		"clientIp":           remoteIP(r),
+		"url":                forwardURL,
+		"headers":            headers,
+		"body":               s.encodeBody(client, body),
+		"streamingThreshold": s.config.Server.StreamingThresholdBytes,
+	}
+
+	// Tell the client which responses to stream whatever their size
+	if len(s.config.Server.StreamContentTypes) > 0 {
+		requestData["streamContentTypes"] = s.config.Server.StreamContentTypes
+	}
+
+	// The client asks for a gRPC request's body once it has somewhere to put it
+	if grpc {
+		requestData["grpc"] = true
+	}
+
+	// Tell the client how much of the timeout budget remains
+	requestData["timeoutMs"] = time.Until(deadline).Milliseconds()
+
+	// Let the client continue this request's trace
+	requestData["traceContext"] = injectTraceContext(ctx)
+
+	// Pass on the caller's source port and connection for the client to set as headers
+	if s.config.Server.ForwardConnectionInfo {
+		requestData["remoteAddr"] = r.RemoteAddr
+		requestData["connectionId"] = connectionID(r.Context())
+	}
+
+	// Pass on the caller's TLS connection details for the client to set as headers
+	if s.config.Server.HTTP.SSL.ForwardInfo && r.TLS != nil {
+		requestData["tls"] = tlsInfo(r.TLS)
+	}
+
+	s.logger.Debug("request", "Forwarding request to client", map[string]interface{}{
+		"clientId":  clientID,
+		"requestId": requestID,
+		"method":    r.Method,
+		"url":       forwardURL,
+		"headers":   headers,
+	})
+
+	// Send request to client
+	data, err := s.codec.Encode(requestData)
+	if err != nil {
+		s.logger.Error("request", "Failed to encode request data", map[string]interface{}{
+			"error": err.Error(),
+		})
+		s.deadLetter(r, deadLetterEncodeFailed, clientID, requestID)
+		s.httpError(w, r, http.StatusInternalServerError, errorCodeInternal, "Internal Server Error", err.Error(), requestID)
+		return
+	}
+
+	// The client drops messages over the frame limit, so a request too large for
+	// one is refused here rather than left to time out
+	if maxFrame := s.config.Transport.MaxFrameBytes; maxFrame > 0 && len(data) > maxFrame {
+		s.removePendingRequest(requestID)
+		s.logger.Warn("request", "Request too large for one message", map[string]interface{}{
+			"clientId":     clientID,
+			"requestId":    requestID,
+			"messageBytes": len(data),
+			"limit":        maxFrame,
+		})
+
+		pending.mu.Lock()
+		defer pending.mu.Unlock()
+		pending.finish()
+		s.writeError(w, http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "Request Entity Too Large", requestID)
+		return
+	}
+
+	// Shed the request rather than wait behind a client that is not keeping up.
+	// The frame is written after push returns; if that fails, the request is
+	// answered from the client's writer.
+	reject := s.config.Server.Socket.OutboundOverflowPolicy == outboundOverflowReject
+	err = client.outbound.push(outboundFrame{
+		data:   client.messageBuffer.Produce(data),
+		failed: func(err error) { s.requestNotSent(pending, clientID, requestID, err) },
+	}, reject)
+	if err == errOutboundQueueFull {
+		s.removePendingRequest(requestID)
+		s.deadLetter(r, deadLetterQueueFull, clientID, requestID)
+		s.logger.Warn("request", "Client outbound queue full, rejecting request", map[string]interface{}{
+			"clientId":  clientID,
+			"requestId": requestID,
+			"queueSize": s.config.Server.Socket.OutboundQueueSize,
+		})
+
+		pending.mu.Lock()
+		defer pending.mu.Unlock()
+		if pending.finished {
+			return
+		}
+		pending.finish()
+		w.Header().Set("Retry-After", "1")
+		s.httpError(w, r, http.StatusServiceUnavailable, errorCodeClientBusy, "Service Unavailable",
+			"client "+clientID+" has too many messages waiting to be sent", requestID)
+		return
+	}
+	if err != nil {
+		s.requestNotSent(pending, clientID, requestID, err)
+		return
+	}
+	client.touch()
+	s.countRequestBytes(pending, client, len(body))
+
+	// Relay the gRPC request body while the response streams back
+	if grpc {
+		pumped := make(chan struct{})
+		go func() {
+			defer close(pumped)
+			s.streamRequestBody(pending, client, requestID, r.Body)
+		}()
+		defer func() {
+			r.Body.Close()
+			pending.bodyWindow.close()
+			<-pumped
+		}()
+	}
+
+	// Wait for response from client
+	select {
+	case <-pending.done:
+		// Response received and processed
+		pending.abortIfCut()
+		return
+	case <-pending.started:
+		// Streamed response in progress; wait for it to end or the caller to go away.
+		// gRPC streams may idle for as long as either end likes, but any other stream
+		// that goes quiet for the request timeout is cut short.
+		var idle *time.Timer
+		var idleC <-chan time.Time
+		if !grpc {
+			idle = time.NewTimer(timeout)
+			defer idle.Stop()
+			idleC = idle.C
+		}
+		for {
+			select {
+			case <-pending.done:
+				pending.abortIfCut()
+				return
+			case <-pending.progress:
+				if idle != nil {
+					idle.Reset(timeout)
+				}
+			case <-idleC:
+				s.removePendingRequest(requestID)
+				pending.mu.Lock()
+				if !pending.finished {
+					pending.aborted = true
+					pending.finish()
+					s.logger.Error("request", "Streamed response stalled, cutting it short", map[string]interface{}{
+						"clientId":  clientID,
+						"requestId": requestID,
+						"idle":      timeout.String(),
+					})
+				}
+				pending.mu.Unlock()
+				pending.abortIfCut()
+				return
+			case <-r.Context().Done():
+				s.removePendingRequest(requestID)
+				pending.mu.Lock()
+				pending.finish()
+				pending.mu.Unlock()
+				if grpc {
+					s.cancelRequest(client, clientID, requestID)
+				}
+				return
+			}
+		}
+	case <-time.After(time.Until(deadline)):
+		// Timeout once the request deadline passes
+		s.removePendingRequest(requestID)
+
+		pending.mu.Lock()
+		defer pending.mu.Unlock()
+		if pending.finished || pending.nextSeq > 0 {
+			// The response raced the timeout and has already been written
+			return
+		}
+		pending.finish()
+		if grpc {
+			s.cancelRequest(client, clientID, requestID)
+		}
+
+		s.logger.Error("request", "Timeout waiting for client response", map[string]interface{}{
+			"requestId": requestID,
+		})
+		s.httpError(w, r, http.StatusGatewayTimeout, errorCodeTimeout, "Timeout waiting for client response",
+			fmt.Sprintf("no response from client %s within %v", clientID, timeout), requestID)
+		return
+	}
+}
+
+// balanceRequest picks a client for a request through the load balancer and
+// reserves a slot on it. If none can take the request, it answers the request
+// itself and returns a nil client.
+func (s *ProxyServer) balanceRequest(w http.ResponseWriter, r *http.Request, rt *route) (string, *ClientInfo) {
+	s.clientsMutex.RLock()
+	if len(s.clients) == 0 {
+		s.clientsMutex.RUnlock()
+		s.logger.Warn("request", "No clients available", nil)
+		s.deadLetter(r, deadLetterNoClients, "", "")
+		s.writeNoClients(w, "No clients available")
+		return "", nil
+	}
+	s.clientsMutex.RUnlock()
+
+	clientID, client, err := s.acquireClient(r, rt)
+	if errors.Is(err, errNoCapacity) {
+		s.logger.Warn("request", "Timed out waiting for client capacity", map[string]interface{}{
+			"url": r.URL.String(),
+		})
+		s.deadLetter(r, deadLetterNoCapacity, "", "")
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusServiceUnavailable, errorCodeNoCapacity, "No client capacity available", "")
+		return "", nil
+	}
+	if err != nil {
+		// The caller went away while waiting
+		return "", nil
+	}
+	if client == nil {
+		s.logger.Warn("request", "No healthy clients available", map[string]interface{}{
+			"url": r.URL.String(),
+		})
+		s.deadLetter(r, deadLetterNoHealthyClients, "", "")
+		s.writeNoClients(w, "No healthy clients available")
+		return "", nil
+	}
+	return clientID, client
+}
+
+// readRequestBody reads the body of a request to be forwarded, holding it to the
+// size and upload rate limits. If it can't, it answers the request itself and
+// returns false.
+func (s *ProxyServer) readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	// Reject oversized bodies before buffering them
+	maxBodyBytes := s.config.Server.MaxRequestBodyBytes
+	if maxBodyBytes > 0 {
+		if r.ContentLength > maxBodyBytes {
+			s.rejectOversizedBody(w, r, r.ContentLength)
+			return nil, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	}
+
+	// Callers waiting for a 100 Continue only send the body once told to
+	if !s.answerExpectContinue(w, r) {
+		return nil, false
+	}
+
+	// Hold the caller to a minimum upload rate so a dribbled body can't pin the request
+	var slowBody *slowBodyReader
+	if minRate := s.config.Server.MinBodyReadRate; minRate > 0 {
+		slowBody = newSlowBodyReader(w, r.Body, minRate)
+		r.Body = slowBody
+	}
+
+	// Read request body
+	body, err := io.ReadAll(r.Body)
+	if slowBody != nil {
+		slowBody.stop()
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.rejectOversizedBody(w, r, -1)
+			return nil, false
+		}
+		if errors.Is(err, errSlowBody) {
+			s.rejectSlowBody(w, r, slowBody)
+			return nil, false
+		}
+		s.logger.Error("request", "Failed to read request body", map[string]interface{}{
+			"error": err.Error(),
+		})
+		s.httpError(w, r, http.StatusInternalServerError, errorCodeInternal, "Internal Server Error", err.Error(), "")
+		return nil, false
+	}
+	return body, true
+}
+
+// httpError replies with a generic error message, appending detail only for trusted callers
+func (s *ProxyServer) httpError(w http.ResponseWriter, r *http.Request, status int, code, message, detail, requestID string) {
+	if detail != "" && s.showErrorDetails(r) {
+		message = message + ": " + detail
+	}
+	s.writeError(w, status, code, message, requestID)
+}
+
+// showErrorDetails reports whether the caller may see detailed error messages, either
+// because it connects from a trusted network or because it presents the debug token
+func (s *ProxyServer) showErrorDetails(r *http.Request) bool {
+	errorDetails := s.config.Server.ErrorDetails
+	if errorDetails.Token != "" {
+		token := r.Header.Get(errorDetails.Header)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(errorDetails.Token)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectOversizedBody responds with 413 to a request whose body exceeds the configured limit
+func (s *ProxyServer) rejectOversizedBody(w http.ResponseWriter, r *http.Request, contentLength int64) {
+	s.logger.Warn("request", "Request body too large", map[string]interface{}{
+		"method":        r.Method,
+		"url":           r.URL.String(),
+		"contentLength": contentLength,
+		"limit":         s.config.Server.MaxRequestBodyBytes,
+	})
+	s.writeError(w, http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "Request Entity Too Large", "")
+}
+
+// answerExpectContinue sends a 100 Continue to a request that expects one, or
+// rejects it with 417 if the policy says so. It returns false if the request was
+// rejected.
+func (s *ProxyServer) answerExpectContinue(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return true
+	}
+	if s.config.Server.ExpectContinue == expectContinueReject {
+		s.logger.Warn("request", "Rejected request expecting 100 Continue", map[string]interface{}{
+			"method":        r.Method,
+			"url":           r.URL.String(),
+			"contentLength": r.ContentLength,
+		})
+		s.writeError(w, http.StatusExpectationFailed, errorCodeExpectationFailed, "Expectation Failed", "")
+		return false
+	}
+
+	// Only requests that passed every check get here, so the body is wanted
+	w.WriteHeader(http.StatusContinue)
+	return true
+}
+
+// requestNotSent fails a request whose frame could not be written to its client
+func (s *ProxyServer) requestNotSent(pending *PendingRequest, clientID string, requestID string, err error) {
+	s.removePendingRequest(requestID)
+	if isTimeout(err) {
+		s.deadLetter(pending.req, deadLetterWriteTimeout, clientID, requestID)
+	} else {
+		s.deadLetter(pending.req, deadLetterWriteFailed, clientID, requestID)
+	}
+
+	// Tearing down the connection may already have failed the request. The
+	// handler returns once the request is finished, so the error goes out first.
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if pending.finished {
+		return
+	}
+	defer pending.finish()
+
+	switch {
+	case isTimeout(err):
+		s.httpError(pending.res, pending.req, http.StatusBadGateway, errorCodeClientUnavailable, "Bad Gateway",
+			"client "+clientID+" is not accepting requests: "+err.Error(), requestID)
+	case err == errClientClosed:
+		s.httpError(pending.res, pending.req, http.StatusBadGateway, errorCodeClientDisconnected, "Bad Gateway",
+			"client "+clientID+" disconnected", requestID)
+	default:
+		s.httpError(pending.res, pending.req, http.StatusInternalServerError, errorCodeInternal, "Internal Server Error",
+			"failed to send request to client "+clientID+": "+err.Error(), requestID)
+	}
+}
+
+// removePendingRequest removes a request from the pending requests map
+func (s *ProxyServer) removePendingRequest(requestID string) {
+	s.requestsMutex.Lock()
+	delete(s.pendingRequests, requestID)
+	s.requestsMutex.Unlock()
+}
+
+// sweepPendingRequests periodically removes pending requests that are long past their
+// deadline, until the server stops. Requests are normally removed by their handler;
+// this is a safety net.
+func (s *ProxyServer) sweepPendingRequests() {
+	ticker := time.NewTicker(pendingSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		expired := make(map[string]*PendingRequest)
+		cutoff := time.Now().Add(-pendingSweepInterval)
+		s.requestsMutex.RLock()
+		for requestID, pending := range s.pendingRequests {
+			if pending.deadline.Before(cutoff) {
+				expired[requestID] = pending
+			}
+		}
+		s.requestsMutex.RUnlock()
+
+		swept := 0
+		for requestID, pending := range expired {
+			pending.mu.Lock()
+			// Streamed responses may legitimately outlive the deadline
+			if pending.nextSeq == 0 {
+				s.removePendingRequest(requestID)
+				pending.finish()
+				swept++
+			}
+			pending.mu.Unlock()
+		}
+
+		if swept > 0 {
+			s.metrics.add("proxy_pending_requests_swept_total", float64(swept))
+			s.logger.Warn("request", "Swept expired pending requests", map[string]interface{}{
+				"requests": swept,
+			})
+		}
+	}
+}
+
+// failClientRequests fails every request still waiting on a disconnected client,
+// so callers get an immediate 502 instead of waiting for the request timeout
+func (s *ProxyServer) failClientRequests(clientID string) {
+	orphaned := make(map[string]*PendingRequest)
+	s.requestsMutex.Lock()
+	for requestID, pending := range s.pendingRequests {
+		if pending.clientID == clientID {
+			orphaned[requestID] = pending
+			delete(s.pendingRequests, requestID)
+		}
+	}
+	s.requestsMutex.Unlock()
+
+	for requestID, pending := range orphaned {
+		pending.mu.Lock()
+		if !pending.finished {
+			// A streamed response has already sent its status; it can only be cut short
+			if pending.nextSeq == 0 {
+				s.httpError(pending.res, pending.req, http.StatusBadGateway, errorCodeClientDisconnected, "Bad Gateway",
+					"client "+clientID+" disconnected", requestID)
+			}
+			pending.finish()
+		}
+		pending.mu.Unlock()
+	}
+
+	if len(orphaned) > 0 {
+		s.logger.Warn("socket", "Failed pending requests of disconnected client", map[string]interface{}{
+			"clientId": clientID,
+			"requests": len(orphaned),
+		})
+	}
+}
+
+// acquireConnSlot counts a new socket connection from ip, reporting false if
+// ip is already at the per-IP connection limit
+func (s *ProxyServer) acquireConnSlot(ip string) bool {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	limit := s.config.Server.Socket.MaxConnsPerIP
+	if limit > 0 && s.connsPerIP[ip] >= limit {
+		return false
+	}
+	s.connsPerIP[ip]++
+	return true
+}
+
+// releaseConnSlot stops counting a closed socket connection from ip
+func (s *ProxyServer) releaseConnSlot(ip string) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// socketListenAddress returns the network and address the socket server listens on
+func socketListenAddress(config *Config) (string, string) {
+	if config.Server.Socket.Network == "unix" {
+		return "unix", config.Server.Socket.Path
+	}
+	return "tcp", fmt.Sprintf("%s:%d", config.Server.Socket.Host, config.Server.Socket.Port)
+}
+
+// removeStaleSocket deletes a unix socket file that no server is listening on.
+// A socket that still accepts connections is left alone so the listen fails.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// handleSocketConnection handles new socket connections
+func (s *ProxyServer) handleSocketConnection(conn net.Conn) {
+	// Refuse hosts that already hold too many connections
+	remoteIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+	if !s.acquireConnSlot(remoteIP) {
+		s.logger.Warn("socket", "Too many connections from remote address", map[string]interface{}{
+			"remoteAddress": conn.RemoteAddr().String(),
+			"limit":         s.config.Server.Socket.MaxConnsPerIP,
+		})
+		conn.Close()
+		return
+	}
+	defer s.releaseConnSlot(remoteIP)
+
+	// Complete the TLS handshake before registering the client so that
+	// unauthenticated connections are never selected for requests
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			s.handshakeFailed(conn, err)
+			conn.Close()
+			return
+		}
+	}
+
+	// Until the client registers it is known by where it connected from
+	remoteAddr := conn.RemoteAddr().String()
+	if remoteAddr == "" || remoteAddr == "@" {
+		remoteAddr = "local"
+	}
+	clientID := fmt.Sprintf("%s-%d", remoteAddr, s.connectionCount.Add(1))
+
+	info := &ClientInfo{
+		id:            clientID,
+		conn:          conn,
+		messageBuffer: NewMessageBuffer(),
+		outbound:      newOutboundQueue(s.config.Server.Socket.OutboundQueueSize),
+		healthy:       true,
+		weight:        1,
+		tags:          []string{},
+		connectedAt:   time.Now(),
+		idleTimeout:   time.Duration(s.config.Server.Socket.IdleTimeout) * time.Millisecond,
+	}
+	info.limiter = rate.NewLimiter(rate.Inf, 0)
+	setRateLimit(info.limiter, s.config.live().rateLimit)
+	info.messageBuffer.SetMaxFrameSize(s.config.Transport.MaxFrameBytes)
+	info.messageBuffer.SetOnDataCallback(func(data []byte) {
+		s.handleMessage(info, s.clientID(info), data)
+	})
+	info.touch()
+
+	go s.writeOutbound(info)
+
+	s.clientsMutex.Lock()
+	s.clients[clientID] = info
+	s.clientsMutex.Unlock()
+
+	s.logger.Info("socket", "Client connected", map[string]interface{}{
+		"clientId": clientID,
+	})
+
+	defer func() {
+		conn.Close()
+		info.outbound.close()
+		s.clientsMutex.Lock()
+		clientID := info.id
+		delete(s.clients, clientID)
+		if _, known := s.knownClients[clientID]; known {
+			s.knownClients[clientID] = time.Now()
+		}
+		s.forgetDepartedClients()
+		s.clientsMutex.Unlock()
+		s.unbindClientSessions(clientID)
+
+		// Let responses that arrived just before the close reach their callers
+		drainTimeout := time.Duration(s.config.Server.Socket.DrainTimeout) * time.Millisecond
+		if !info.messageBuffer.Drain(drainTimeout) {
+			s.logger.Warn("socket", "Timed out draining client messages", map[string]interface{}{
+				"clientId": clientID,
+			})
+		}
+		s.failClientRequests(clientID)
+		s.closeClientTunnels(clientID)
+
+		s.logger.Info("socket", "Client disconnected", map[string]interface{}{
+			"clientId": clientID,
+		})
+	}()
+
+	bufferPtr := s.readBuffers.Get()
+	defer s.readBuffers.Put(bufferPtr)
+	buffer := *bufferPtr
+
+	// Deadlines are checked again on timeout, as traffic elsewhere may have moved them
+	frames := &frameClock{timeout: time.Duration(s.config.Server.Socket.ReadTimeout) * time.Millisecond}
+	for {
+		conn.SetReadDeadline(earliest(info.idleDeadline(), frames.deadline()))
+		n, err := conn.Read(buffer)
+		if n > 0 {
+			s.countFrameBytes(info, directionReceived, n)
+		}
+		if err != nil {
+			if isTimeout(err) && frames.expired() {
+				s.logger.Warn("socket", "Timed out reading frame from client", map[string]interface{}{
+					"clientId":    s.clientID(info),
+					"readTimeout": s.config.Server.Socket.ReadTimeout,
+				})
+				return
+			}
+			if isTimeout(err) {
+				// A request still waiting on its upstream is not idleness
+				if info.inFlight.Load() > 0 {
+					info.touch()
+					continue
+				}
+				if deadline := info.idleDeadline(); deadline.IsZero() || time.Now().Before(deadline) {
+					continue
+				}
+				s.logger.Info("socket", "Closing idle client connection", map[string]interface{}{
+					"clientId":    s.clientID(info),
+					"idleTimeout": s.config.Server.Socket.IdleTimeout,
+				})
+				return
+			}
+			if err != io.EOF && !s.stopping.Load() {
+				s.logger.Error("socket", "Error reading from client", map[string]interface{}{
+					"error":    err.Error(),
+					"clientId": s.clientID(info),
+				})
+			}
+			return
+		}
+
+		buffered := info.messageBuffer.BufferedBytes()
+		if err := info.messageBuffer.Consume(buffer[:n]); err != nil {
+			s.logger.Error("socket", "Dropped invalid frames from client", map[string]interface{}{
+				"error":    err.Error(),
+				"clientId": s.clientID(info),
+			})
+		}
+		frames.update(buffered, n, info.messageBuffer.BufferedBytes())
+	}
+}
+
+// handleMessage processes messages from clients. The message buffer calls it on a
+// goroutine of its own for every message, so a slow caller or a long stream never
+// holds up responses to other requests on the same client connection.
+//
+// The number of these goroutines is deliberately not capped. Stream messages wait
+// for their predecessors, so with a fixed number of them every slot could be taken
+// by chunks waiting on one that can't be dispatched until a slot frees up. Each
+// goroutine holds at most one frame of transport.maxFrameBytes, and one waiting
+// on a predecessor gives up once its request finishes or times out.
+func (s *ProxyServer) handleMessage(info *ClientInfo, clientID string, data []byte) {
+	response, err := s.codec.Decode(data)
+	if err != nil {
+		s.logger.Error("message", "Failed to decode message", map[string]interface{}{
+			"error": err.Error(),
+			"codec": s.config.Transport.Codec,
+		})
+		return
+	}
+
+	// Health reports are heartbeats and don't keep an idle connection open
+	if response["type"] != "health" {
+		info.touch()
+	}
+
+	switch response["type"] {
+	case "register":
+		s.handleRegister(clientID, response)
+	case "health":
+		healthy, _ := response["healthy"].(bool)
+		generation, _ := response["generation"].(float64)
+		s.setClientHealth(clientID, healthy, int64(generation))
+	case "response-start", "response-chunk", "response-end":
+		s.handleStreamMessage(clientID, response)
+	case "connect-result", "tunnel-data", "tunnel-close", "tunnel-ack":
+		s.handleTunnelMessage(info, clientID, response)
+	case "request-ready":
+		s.handleRequestReady(clientID, response)
+	default:
+		s.handleResponse(clientID, response)
+	}
+}
+
+// handleRegister negotiates connection settings with a newly connected client
+func (s *ProxyServer) handleRegister(clientID string, message map[string]interface{}) {
+	s.clientsMutex.RLock()
+	info, exists := s.clients[clientID]
+	s.clientsMutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	// Refuse clients whose protocol range doesn't overlap this server's
+	version, err := negotiateProtocol(message)
+	if err != nil {
+		s.logger.Warn("socket", "Client protocol version is not supported", map[string]interface{}{
+			"clientId":      clientID,
+			"remoteAddress": info.conn.RemoteAddr().String(),
+			"error":         err.Error(),
+		})
+		s.sendAndClose(info, map[string]interface{}{
+			"type":  "registered",
+			"error": err.Error(),
+		})
+		return
+	}
+	info.protocol.Store(int64(version))
+
+	// Compress only if both ends have it enabled
+	offered, _ := message["compression"].(bool)
+	compression := offered && s.config.Server.Compression.Enabled
+
+	// Older clients do not advertise a weight or concurrency limit
+	weight := 1
+	if w, ok := message["weight"].(float64); ok && w >= 1 {
+		weight = int(w)
+	}
+	maxConcurrency := 0
+	if m, ok := message["maxConcurrency"].(float64); ok && m >= 1 {
+		maxConcurrency = int(m)
+	}
+	tags := []string{}
+	if values, ok := message["tags"].([]interface{}); ok {
+		for _, value := range values {
+			if tag, ok := value.(string); ok {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	// A client with an ID of its own is known by it from now on, provided no
+	// connected client already uses it
+	s.clientsMutex.Lock()
+	requestedID, _ := message["id"].(string)
+	if requestedID != "" && requestedID != clientID {
+		if _, taken := s.clients[requestedID]; taken {
+			s.clientsMutex.Unlock()
+			s.logger.Warn("socket", "Client ID already in use", map[string]interface{}{
+				"clientId":      requestedID,
+				"remoteAddress": info.conn.RemoteAddr().String(),
+			})
+			s.sendAndClose(info, map[string]interface{}{
+				"type":  "registered",
+				"error": "client ID " + requestedID + " is already in use",
+			})
+			return
+		}
+		delete(s.clients, clientID)
+		s.clients[requestedID] = info
+		info.id = requestedID
+		clientID = requestedID
+	}
+	_, reconnected := s.knownClients[requestedID]
+	if requestedID != "" {
+		s.knownClients[requestedID] = time.Time{}
+	}
+	info.weight = weight
+	info.tags = tags
+	info.maxConcurrency.Store(int64(maxConcurrency))
+	s.clientsMutex.Unlock()
+
+	// The client may compress as soon as it reads the reply
+	info.messageBuffer.SetDecompression(compression, s.config.Transport.MaxInflatedBytes)
+
+	err = s.sendToClient(info, map[string]interface{}{
+		"type":            "registered",
+		"protocolVersion": version,
+		"compression":     compression,
+	})
+	if err != nil {
+		s.logger.Error("socket", "Failed to acknowledge client registration", map[string]interface{}{
+			"error":    err.Error(),
+			"clientId": clientID,
+		})
+		return
+	}
+	info.messageBuffer.SetCompression(compression, s.config.Server.Compression.Threshold)
+
+	s.clientsMutex.Lock()
+	info.registered = true
+	s.clientsMutex.Unlock()
+
+	// Requests waiting for a slot may be able to use the new client
+	s.capacityFreed.notify()
+	s.checkWarmup()
+	s.passStartupCheck(checkClient)
+
+	s.logger.Info("socket", "Client registered", map[string]interface{}{
+		"clientId":        clientID,
+		"compression":     compression,
+		"protocolVersion": version,
+		"weight":          weight,
+		"maxConcurrency":  maxConcurrency,
+		"tags":            tags,
+		"reconnected":     reconnected,
+	})
+}
+
+// forgetDepartedClients drops the IDs of clients that have been gone for longer than
+// knownClientRetention, so the record doesn't grow with every ID ever seen; the
+// caller must hold clientsMutex
+func (s *ProxyServer) forgetDepartedClients() {
+	cutoff := time.Now().Add(-knownClientRetention)
+	for id, disconnectedAt := range s.knownClients {
+		if !disconnectedAt.IsZero() && disconnectedAt.Before(cutoff) {
+			delete(s.knownClients, id)
+		}
+	}
+}
+
+// clientID returns the ID a client is currently stored under
+func (s *ProxyServer) clientID(info *ClientInfo) string {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	return info.id
+}
+
+// sendToClient encodes a message and writes it to a client connection
+func (s *ProxyServer) sendToClient(info *ClientInfo, message map[string]interface{}) error {
+	data, err := s.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+	return info.outbound.push(outboundFrame{data: info.messageBuffer.Produce(data)}, false)
+}
+
+// sendAndClose queues a last message to a client, closing the connection once it
+// has been written or straight away if it can't be queued
+func (s *ProxyServer) sendAndClose(info *ClientInfo, message map[string]interface{}) error {
+	data, err := s.codec.Encode(message)
+	if err == nil {
+		err = info.outbound.push(outboundFrame{data: info.messageBuffer.Produce(data), closeAfter: true}, false)
+	}
+	if err != nil {
+		info.conn.Close()
+	}
+	return err
+}
+
+// encodeBody encodes a body for a message to a client
+func (s *ProxyServer) encodeBody(info *ClientInfo, body []byte) interface{} {
+	return encodeBody(s.codec, int(info.protocol.Load()), body)
+}
+
+// writeToClient writes a frame to a client connection within the write timeout,
+// closing the connection if it fails. Only the client's outbound writer calls it;
+// everything else queues frames.
+func (s *ProxyServer) writeToClient(info *ClientInfo, frame []byte) error {
+	if err := writeFrame(info.conn, frame, time.Duration(s.config.Server.Socket.WriteTimeout)*time.Millisecond); err != nil {
+		return err
+	}
+	s.countFrameBytes(info, directionSent, len(frame))
+	return nil
+}
+
+// setClientHealth updates whether a client is eligible to receive requests. Health
+// reports are handled concurrently, so one whose generation is no newer than the
+// last one applied is stale and ignored. Reports without a generation always apply.
+func (s *ProxyServer) setClientHealth(clientID string, healthy bool, generation int64) {
+	stale := false
+	s.clientsMutex.Lock()
+	info, exists := s.clients[clientID]
+	if exists {
+		if generation > 0 && generation <= info.healthGeneration {
+			stale = true
+		} else {
+			info.healthy = healthy
+			info.healthGeneration = max(info.healthGeneration, generation)
+		}
+	}
+	s.clientsMutex.Unlock()
+
+	if !exists {
+		return
+	}
+	if stale {
+		s.logger.Debug("socket", "Ignored stale health report", map[string]interface{}{
+			"clientId":   clientID,
+			"healthy":    healthy,
+			"generation": generation,
+		})
+		return
+	}
+
+	if healthy {
+		s.logger.Info("socket", "Client reported backend healthy", map[string]interface{}{
+			"clientId": clientID,
+		})
+	} else {
+		s.logger.Warn("socket", "Client reported backend unhealthy", map[string]interface{}{
+			"clientId": clientID,
+		})
+	}
+}
+
+// handleResponse writes a fully buffered response back to the original caller
+func (s *ProxyServer) handleResponse(clientID string, response map[string]interface{}) {
+	requestID, ok := response["requestId"].(string)
+	if !ok {
+		s.logger.Warn("message", "Message from client has no request ID", map[string]interface{}{
+			"clientId": clientID,
+			"type":     response["type"],
+		})
+		return
+	}
+	s.requestsMutex.Lock()
+	pendingReq, exists := s.pendingRequests[requestID]
+	owned := exists && pendingReq.clientID == clientID
+	if owned {
+		// Remove the request from pending requests
+		delete(s.pendingRequests, requestID)
+	}
+	s.requestsMutex.Unlock()
+
+	if !exists {
+		s.logger.Warn("message", "No matching request found", map[string]interface{}{
+			"requestId": requestID,
+		})
+		return
+	}
+	if !owned {
+		s.dropForeignResponse(clientID, pendingReq, requestID, response)
+		return
+	}
+
+	pendingReq.mu.Lock()
+	defer pendingReq.mu.Unlock()
+	if pendingReq.finished {
+		return
+	}
+
+	// The client could not reach its target; describe the failure to the caller
+	if upstreamError, ok := response["upstreamError"].(map[string]interface{}); ok {
+		s.writeUpstreamError(pendingReq.res, pendingReq.req, requestID, upstreamError)
+		pendingReq.finish()
+		return
+	}
+
+	if err := checkResponseHead(response); err != nil {
+		s.rejectResponse(pendingReq, requestID, err)
+		return
+	}
+
+	// Decode the body before writing anything so it can still be compressed
+	var bodyBytes []byte
+	if body, ok := response["body"]; ok {
+		var err error
+		bodyBytes, err = s.codec.DecodeBody(body)
+		if err != nil {
+			s.logger.Error("message", "Failed to decode response body", map[string]interface{}{
+				"error": err.Error(),
+			})
+			s.httpError(pendingReq.res, pendingReq.req, http.StatusBadGateway, errorCodeBadResponse, "Bad Gateway",
+				"invalid response body: "+err.Error(), requestID)
+			pendingReq.finish()
+			return
+		}
+		s.countResponseBytes(pendingReq, len(bodyBytes))
+		s.storeResponse(pendingReq.req, response, bodyBytes)
+		bodyBytes = s.compressResponse(pendingReq.req, response, bodyBytes)
+	}
+
+	s.recordUpstreamDuration(pendingReq, response)
+
+	// Set headers first, then status code
+	statusCode := s.writeResponseHead(pendingReq.res, pendingReq.req, response)
+	s.bindSessionFromResponse(clientID, pendingReq.res.Header())
+
+	// Write body
+	pendingReq.res.Write(bodyBytes)
+	writeTrailers(pendingReq.res, response)
+
+	// Signal that response is complete
+	pendingReq.finish()
+
+	s.logger.Info("message", "Response sent to client", map[string]interface{}{
+		"requestId":          requestID,
+		"statusCode":         statusCode,
+		"upstreamDurationMs": pendingReq.upstreamMs,
+	})
+}
+
+// dropForeignResponse logs a response message from a client other than the one its
+// request was sent to. Only that client may answer the request or add to its
+// response, so the message is dropped.
+func (s *ProxyServer) dropForeignResponse(clientID string, pendingReq *PendingRequest, requestID string, message map[string]interface{}) {
+	s.logger.Warn("message", "Dropped response from a client the request was not sent to", map[string]interface{}{
+		"clientId":  clientID,
+		"ownerId":   pendingReq.clientID,
+		"requestId": requestID,
+		"type":      message["type"],
+	})
+}
+
+// recordUpstreamDuration notes the upstream time a client reported with a response;
+// the caller must hold pendingReq.mu
+func (s *ProxyServer) recordUpstreamDuration(pendingReq *PendingRequest, message map[string]interface{}) {
+	upstreamMs, ok := message["upstreamDurationMs"].(float64)
+	if !ok {
+		return
+	}
+	pendingReq.upstreamMs = int64(upstreamMs)
+	s.metrics.add("proxy_upstream_duration_seconds_sum", upstreamMs/1000)
+	s.metrics.add("proxy_upstream_duration_seconds_count", 1)
+}
+
+// handleStreamMessage writes one part of a streamed response back to the original caller.
+// Messages are dispatched concurrently, so each one waits for its sequence number to come up.
+func (s *ProxyServer) handleStreamMessage(clientID string, message map[string]interface{}) {
+	requestID, ok := message["requestId"].(string)
+	if !ok {
+		s.logger.Warn("message", "Message from client has no request ID", map[string]interface{}{
+			"clientId": clientID,
+			"type":     message["type"],
+		})
+		return
+	}
+
+	s.requestsMutex.RLock()
+	pendingReq, exists := s.pendingRequests[requestID]
+	s.requestsMutex.RUnlock()
+
+	if !exists {
+		s.logger.Warn("message", "No matching request found", map[string]interface{}{
+			"requestId": requestID,
+		})
+		return
+	}
+	if pendingReq.clientID != clientID {
+		s.dropForeignResponse(clientID, pendingReq, requestID, message)
+		return
+	}
+
+	pendingReq.mu.Lock()
+	defer pendingReq.mu.Unlock()
+
+	// Without a sequence number the message can't be put in order
+	seqValue, ok := message["seq"].(float64)
+	if !ok {
+		if !pendingReq.finished {
+			s.rejectResponse(pendingReq, requestID, fmt.Errorf("%v message has no sequence number", message["type"]))
+		}
+		return
+	}
+	seq := int(seqValue)
+
+	for pendingReq.nextSeq != seq && !pendingReq.finished {
+		pendingReq.cond.Wait()
+	}
+	if pendingReq.finished {
+		return
+	}
+
+	switch message["type"] {
+	case "response-start":
+		if pendingReq.nextSeq != 0 || pendingReq.hasStarted() {
+			s.rejectResponse(pendingReq, requestID, fmt.Errorf("response-start at seq %d after the response started", seq))
+			return
+		}
+		if err := checkResponseHead(message); err != nil {
+			s.rejectResponse(pendingReq, requestID, err)
+			return
+		}
+		s.recordUpstreamDuration(pendingReq, message)
+		statusCode := s.writeResponseHead(pendingReq.res, pendingReq.req, message)
+		s.bindSessionFromResponse(clientID, pendingReq.res.Header())
+		close(pendingReq.started)
+
+		// Send the head now; gRPC callers may wait for it before their first message
+		if flusher, ok := pendingReq.res.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		s.logger.Info("message", "Streaming response to client", map[string]interface{}{
+			"requestId":          requestID,
+			"statusCode":         statusCode,
+			"upstreamDurationMs": pendingReq.upstreamMs,
+		})
+	case "response-chunk":
+		if !pendingReq.hasStarted() {
+			s.rejectResponse(pendingReq, requestID, errors.New("response-chunk before response-start"))
+			return
+		}
+		bodyBytes, err := s.codec.DecodeBody(message["body"])
+		if err != nil {
+			s.logger.Error("message", "Failed to decode response chunk", map[string]interface{}{
+				"error":     err.Error(),
+				"requestId": requestID,
+			})
+			s.removePendingRequest(requestID)
+			pendingReq.aborted = true
+			pendingReq.finish()
+			return
+		}
+		s.countResponseBytes(pendingReq, len(bodyBytes))
+		pendingReq.res.Write(bodyBytes)
+		if flusher, ok := pendingReq.res.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	case "response-end":
+		if !pendingReq.hasStarted() {
+			s.rejectResponse(pendingReq, requestID, errors.New("response-end before response-start"))
+			return
+		}
+		s.removePendingRequest(requestID)
+
+		// The client could not read the rest of the upstream body
+		if upstreamError, ok := message["upstreamError"].(map[string]interface{}); ok {
+			s.logger.Error("message", "Upstream response cut short", map[string]interface{}{
+				"clientId":  clientID,
+				"requestId": requestID,
+				"class":     upstreamError["class"],
+				"error":     upstreamError["message"],
+			})
+			pendingReq.aborted = true
+			pendingReq.finish()
+			return
+		}
+		writeTrailers(pendingReq.res, message)
+		pendingReq.finish()
+		return
+	}
+
+	pendingReq.nextSeq++
+	pendingReq.cond.Broadcast()
+	select {
+	case pendingReq.progress <- struct{}{}:
+	default:
+	}
+}
+
+// writeUpstreamError writes a 502 response with a JSON body describing an upstream
+// failure. With server.errorFormat "json" it uses the same envelope as other errors.
+func (s *ProxyServer) writeUpstreamError(w http.ResponseWriter, r *http.Request, requestID string, upstreamError map[string]interface{}) {
+	message := upstreamError["message"]
+	if !s.showErrorDetails(r) {
+		message = "Bad Gateway"
+	}
+
+	if s.config.Server.ErrorFormat == errorFormatJSON {
+		text, _ := message.(string)
+		writeErrorJSON(w, http.StatusBadGateway, errorBody{
+			Code:      errorCodeUpstream,
+			Message:   text,
+			RequestID: requestID,
+			Class:     upstreamError["class"],
+		})
+	} else {
+		body, err := json.Marshal(map[string]interface{}{
+			"error":     errorCodeUpstream,
+			"class":     upstreamError["class"],
+			"message":   message,
+			"requestId": requestID,
+		})
+		if err != nil {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(body)
+	}
+
+	s.logger.Warn("message", "Upstream error relayed to caller", map[string]interface{}{
+		"requestId": requestID,
+		"class":     upstreamError["class"],
+	})
+}
+
+// checkResponseHead reports what is wrong with the status code and headers of a
+// response or response-start message, if anything. A client that sends an unusable
+// head is broken, so the request gets a 502 rather than a guess.
+func checkResponseHead(message map[string]interface{}) error {
+	statusCode, ok := message["statusCode"].(float64)
+	if !ok {
+		return fmt.Errorf("response has no status code")
+	}
+	if statusCode < 100 || statusCode > 999 {
+		return fmt.Errorf("invalid status code %v", statusCode)
+	}
+	if headers := message["headers"]; headers != nil {
+		if _, ok := headers.(map[string]interface{}); !ok {
+			return fmt.Errorf("response headers are not a map")
+		}
+	}
+	return nil
+}
+
+// rejectResponse fails a request whose client sent an unusable response, answering
+// 502 unless part of the response was already written, in which case the response
+// is broken off; the caller must hold pendingReq.mu
+func (s *ProxyServer) rejectResponse(pendingReq *PendingRequest, requestID string, err error) {
+	s.logger.Error("message", "Invalid response from client", map[string]interface{}{
+		"clientId":  pendingReq.clientID,
+		"requestId": requestID,
+		"error":     err.Error(),
+	})
+	s.removePendingRequest(requestID)
+	if pendingReq.nextSeq == 0 {
+		s.httpError(pendingReq.res, pendingReq.req, http.StatusBadGateway, errorCodeBadResponse, "Bad Gateway",
+			"invalid response from client: "+err.Error(), requestID)
+	} else {
+		// The head has been written, so the response can only be broken off
+		pendingReq.aborted = true
+	}
+	pendingReq.finish()
+}
+
+// writeResponseHead copies the headers and status code from a response message to w,
+// applying the response header rules for the caller's request r. The message must
+// have passed checkResponseHead.
+func (s *ProxyServer) writeResponseHead(w http.ResponseWriter, r *http.Request, response map[string]interface{}) int {
+	headers, _ := response["headers"].(map[string]interface{})
+	for key, value := range headers {
+		switch v := value.(type) {
+		case string:
+			w.Header().Set(key, v)
+		case []interface{}:
+			// If it's a slice, set each value
+			for _, val := range v {
+				w.Header().Add(key, fmt.Sprint(val))
+			}
+		default:
+			// For any other type, convert to string
+			w.Header().Set(key, fmt.Sprint(v))
+		}
+	}
+
+	// Hop-by-hop headers belong to the upstream connection, not the caller's
+	removeHopByHopHeaders(w.Header())
+
+	requestID, _ := response["requestId"].(string)
+	applyHeaderRules(w.Header(), s.headerRules, requestVars(r, requestID))
+
+	// Declare trailers up front so the response is sent chunked with room for them
+	if trailers, ok := response["trailers"].(map[string]interface{}); ok {
+		for key := range trailers {
+			w.Header().Add("Trailer", key)
+		}
+	}
+
+	statusCode, _ := response["statusCode"].(float64)
+	w.WriteHeader(int(statusCode))
+	return int(statusCode)
+}
+
+// writeTrailers sets the trailers carried by a response or response-end message;
+// they are sent once the handler returns
+func writeTrailers(w http.ResponseWriter, message map[string]interface{}) {
+	trailers, ok := message["trailers"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key, value := range trailers {
+		values, _ := value.([]interface{})
+		for _, val := range values {
+			w.Header().Add(http.TrailerPrefix+key, fmt.Sprint(val))
+		}
+	}
+}
@@ -0,0 +1,1306 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamingThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		threshold    int64
+		bodyBytes    int
+		wantStreamed bool
+	}{
+		{"below threshold", 1024, 1024, false},
+		{"above threshold", 1024, 1025, true},
+		{"streaming disabled", 0, 64 * 1024, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := strings.Repeat("x", tc.bodyBytes)
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}), func(c *Config) { c.Server.StreamingThresholdBytes = tc.threshold })
+
+			resp, got := p.get(t, "/")
+			if resp.StatusCode != http.StatusOK || got != body {
+				t.Fatalf("status = %d, body of %d bytes; want 200 with %d bytes", resp.StatusCode, len(got), len(body))
+			}
+			if streamed := strings.Contains(p.logs(t), "Streaming response to client"); streamed != tc.wantStreamed {
+				t.Errorf("streamed = %v, want %v", streamed, tc.wantStreamed)
+			}
+		})
+	}
+}
+
+func TestStreamContentTypes(t *testing.T) {
+	for _, tc := range []struct {
+		contentType  string
+		wantStreamed bool
+	}{
+		{"video/mp4", true},
+		{"application/json", false},
+	} {
+		t.Run(tc.contentType, func(t *testing.T) {
+			// The upstream sends a small first chunk and holds the rest back
+			release := make(chan struct{})
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				w.Write([]byte("first"))
+				w.(http.Flusher).Flush()
+				<-release
+				w.Write([]byte(" rest"))
+			}), func(c *Config) { c.Server.StreamContentTypes = []string{"video/*"} })
+			var releaseOnce sync.Once
+			releaseUpstream := func() { releaseOnce.Do(func() { close(release) }) }
+			t.Cleanup(releaseUpstream)
+
+			responses := make(chan *http.Response, 1)
+			go func() {
+				resp, err := http.Get(p.url + "/media")
+				if err != nil {
+					t.Error(err)
+					close(responses)
+					return
+				}
+				responses <- resp
+			}()
+
+			var resp *http.Response
+			select {
+			case resp = <-responses:
+				if !tc.wantStreamed {
+					t.Fatal("a buffered response arrived before the upstream finished")
+				}
+				first := make([]byte, len("first"))
+				if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first" {
+					t.Fatalf("read %q (%v), want the first chunk while the upstream is still sending", first, err)
+				}
+				releaseUpstream()
+			case <-time.After(300 * time.Millisecond):
+				if tc.wantStreamed {
+					t.Fatal("the response was not streamed")
+				}
+				releaseUpstream()
+				resp = <-responses
+			}
+			if resp == nil {
+				return
+			}
+			defer resp.Body.Close()
+			if rest, err := io.ReadAll(resp.Body); err != nil || !strings.HasSuffix(string(rest), " rest") {
+				t.Errorf("body ends %q (%v), want the rest of the response", rest, err)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		threshold int64
+	}{
+		{"buffered", 0},
+		{"streamed", 16},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				for range 4 {
+					w.Write([]byte("chunk of the body "))
+					w.(http.Flusher).Flush()
+				}
+				w.Header().Set("X-Checksum", "abc123")
+			}), func(c *Config) { c.Server.StreamingThresholdBytes = tc.threshold })
+
+			resp, err := http.Get(p.url + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Repeat("chunk of the body ", 4); string(body) != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+			if !slices.Contains(resp.TransferEncoding, "chunked") {
+				t.Errorf("Transfer-Encoding = %v, want chunked to carry the trailer", resp.TransferEncoding)
+			}
+			if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+				t.Errorf("trailer X-Checksum = %q, want abc123", got)
+			}
+			if streamed := strings.Contains(p.logs(t), "Streaming response to client"); streamed != (tc.threshold > 0) {
+				t.Errorf("streamed = %v, want %v", streamed, tc.threshold > 0)
+			}
+		})
+	}
+}
+
+// respondWith sends a request through the server to a fake client, which answers
+// it with the given messages, and returns the caller's response along with any
+// error reading its body
+func respondWith(t *testing.T, p *testProxy, f *fakeClient, messages ...map[string]interface{}) (*http.Response, string, error) {
+	t.Helper()
+	type result struct {
+		resp *http.Response
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(p.url + "/")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{resp, string(body), err}
+	}()
+
+	request := f.receive(t, "request")
+	for _, message := range messages {
+		message["requestId"] = request["requestId"]
+		f.send(t, message)
+	}
+	r := <-results
+	if r.resp == nil {
+		t.Fatal(r.err)
+	}
+	return r.resp, r.body, r.err
+}
+
+func TestInvalidResponseFromClient(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		messages []map[string]interface{}
+
+		// started is set when the head is written before the response turns out
+		// to be invalid, so it can only be broken off
+		started bool
+	}{
+		{"missing status code", []map[string]interface{}{
+			{"type": "response", "headers": map[string]interface{}{}},
+		}, false},
+		{"status code of the wrong type", []map[string]interface{}{
+			{"type": "response", "statusCode": "200", "headers": map[string]interface{}{}},
+		}, false},
+		{"status code out of range", []map[string]interface{}{
+			{"type": "response", "statusCode": 42, "headers": map[string]interface{}{}},
+		}, false},
+		{"headers of the wrong type", []map[string]interface{}{
+			{"type": "response", "statusCode": 200, "headers": "Content-Type: text/plain"},
+		}, false},
+		{"stream start without sequence number", []map[string]interface{}{
+			{"type": "response-start", "statusCode": 200, "headers": map[string]interface{}{}},
+		}, false},
+		{"stream start without status code", []map[string]interface{}{
+			{"type": "response-start", "seq": 0, "headers": map[string]interface{}{}},
+		}, false},
+		{"stream chunk before start", []map[string]interface{}{
+			{"type": "response-chunk", "seq": 0, "body": jsonCodec{}.EncodeBody([]byte("early"))},
+		}, false},
+		{"stream end before start", []map[string]interface{}{
+			{"type": "response-end", "seq": 0},
+		}, false},
+		{"second stream start", []map[string]interface{}{
+			{"type": "response-start", "seq": 0, "statusCode": 200, "headers": map[string]interface{}{}},
+			{"type": "response-start", "seq": 1, "statusCode": 200, "headers": map[string]interface{}{}},
+		}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestServer(t, nil)
+			f := p.connectFakeClient(t)
+
+			resp, _, err := respondWith(t, p, f, tc.messages...)
+			if tc.started {
+				if err == nil {
+					t.Errorf("response with status %d ended cleanly, want it broken off", resp.StatusCode)
+				}
+			} else if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode)
+			}
+			p.waitForLog(t, "Invalid response from client")
+
+			// The connection is still usable for the next request
+			resp, body, err := respondWith(t, p, f, map[string]interface{}{
+				"type": "response", "statusCode": 200, "body": jsonCodec{}.EncodeBody([]byte("ok")),
+			})
+			if err != nil || resp.StatusCode != http.StatusOK || body != "ok" {
+				t.Errorf("next request got %d %q (%v), want 200 ok", resp.StatusCode, body, err)
+			}
+		})
+	}
+}
+
+func TestTruncatedStreamIsBrokenOff(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+		wantLog   string
+	}{
+		{"upstream connection lost", nil, "read_error"},
+		{"body size limit", func(c *Config) { c.Client.Proxy.MaxResponseBodyBytes = 4096 }, "response_too_large"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Stream more than the limit without a Content-Length, then drop the connection
+				w.Write([]byte(strings.Repeat("x", 8192)))
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}), func(c *Config) {
+				c.Server.StreamingThresholdBytes = 1024
+				if tc.configure != nil {
+					tc.configure(c)
+				}
+			})
+
+			resp, err := http.Get(p.url + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if body, err := io.ReadAll(resp.Body); err == nil {
+				t.Errorf("response of %d bytes ended cleanly, want it broken off", len(body))
+			}
+			p.waitForLog(t, "Upstream response cut short")
+			if !strings.Contains(p.logs(t), tc.wantLog) {
+				t.Errorf("the cut was not logged as %s", tc.wantLog)
+			}
+		})
+	}
+}
+
+func TestStalledStreamIsCutShort(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.RequestTimeout = 300 })
+	f := p.connectFakeClient(t)
+
+	// Chunks keep arriving for longer than the timeout, then stop without an end
+	stream := []map[string]interface{}{
+		{"type": "response-start", "seq": 0, "statusCode": 200, "headers": map[string]interface{}{}},
+	}
+	for seq := 1; seq <= 4; seq++ {
+		stream = append(stream, map[string]interface{}{
+			"type": "response-chunk", "seq": seq, "body": jsonCodec{}.EncodeBody([]byte("x")),
+		})
+	}
+	go func() {
+		request := f.receive(t, "request")
+		for _, message := range stream {
+			message["requestId"] = request["requestId"]
+			f.send(t, message)
+			time.Sleep(150 * time.Millisecond)
+		}
+	}()
+
+	resp, err := http.Get(p.url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("stalled response of %q ended cleanly, want it broken off", body)
+	}
+	if string(body) != "xxxx" {
+		t.Errorf("body = %q, want every chunk sent before the stall", body)
+	}
+	p.waitForLog(t, "Streamed response stalled, cutting it short")
+}
+
+func TestCorruptFrameFromClientIsDropped(t *testing.T) {
+	p := startTestServer(t, nil)
+	f := p.connectFakeClient(t)
+	responses := p.getAsync(t, "/")
+	requestID := f.receive(t, "request")["requestId"]
+
+	data, err := jsonCodec{}.Encode(map[string]interface{}{"type": "response", "requestId": requestID, "statusCode": 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := f.buffer.Produce(data)
+	corrupt[len(corrupt)-2] ^= 0x01
+	if _, err := f.conn.Write(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	p.waitForLog(t, "Dropped invalid frames from client")
+
+	// The connection is still usable
+	f.send(t, map[string]interface{}{"type": "response", "requestId": requestID, "statusCode": 201})
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("got %v, want the 201 from the intact frame", resp)
+	}
+}
+
+func TestResponseWithoutRequestIDIsIgnored(t *testing.T) {
+	p := startTestServer(t, nil)
+	f := p.connectFakeClient(t)
+
+	f.send(t, map[string]interface{}{"type": "response", "statusCode": 200})
+	f.send(t, map[string]interface{}{"type": "response-chunk", "seq": 1})
+	p.waitForLog(t, "Message from client has no request ID")
+}
+
+func TestSlowResponseDoesNotDelayOthers(t *testing.T) {
+	slowStarted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	large := strings.Repeat("x", 16<<20)
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			slowStarted <- struct{}{}
+			<-release
+		case "/large":
+			w.Write([]byte(large))
+		default:
+			w.Write([]byte("fast"))
+		}
+	}), func(c *Config) { c.Server.StreamingThresholdBytes = 1024 })
+	t.Cleanup(func() { close(release) })
+
+	fast := func(t *testing.T) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"/fast", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, body := p.do(t, req); resp.StatusCode != http.StatusOK || body != "fast" {
+			t.Errorf("got %d %q, want 200 fast", resp.StatusCode, body)
+		}
+	}
+
+	t.Run("slow upstream", func(t *testing.T) {
+		go http.Get(p.url + "/slow")
+		<-slowStarted
+		fast(t)
+	})
+
+	t.Run("caller not reading a stream", func(t *testing.T) {
+		resp, err := http.Get(p.url + "/large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		p.waitForLog(t, "Streaming response to client")
+		fast(t)
+	})
+}
+
+func TestClientDisconnectFailsPendingRequests(t *testing.T) {
+	p := startTestServer(t, nil)
+	f := p.connectFakeClient(t)
+
+	results := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := p.get(t, "/")
+		results <- resp
+	}()
+	f.receive(t, "request")
+
+	start := time.Now()
+	f.conn.Close()
+	select {
+	case resp := <-results:
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("status = %d, want 502", resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("caller waited %v after the disconnect", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request was not failed when its client disconnected")
+	}
+	p.waitForLog(t, "Failed pending requests of disconnected client")
+}
+
+func TestResponseBeforeDisconnectIsDelivered(t *testing.T) {
+	p := startTestServer(t, nil)
+	f := p.connectFakeClient(t)
+	responses := p.getAsync(t, "/")
+	requestID := f.receive(t, "request")["requestId"]
+
+	// The connection closes straight after the last complete message, whose large
+	// body is still being decoded when the server reads the close
+	body := bytes.Repeat([]byte("x"), 8<<20)
+	f.send(t, map[string]interface{}{"type": "response", "requestId": requestID, "statusCode": 201, "body": jsonCodec{}.EncodeBody(body)})
+	f.conn.Close()
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusCreated {
+		t.Errorf("got %v, want the 201 sent before the disconnect", resp)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	var started atomic.Int32
+	release := make(chan struct{})
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Add(1)
+		<-release
+	}), func(c *Config) {
+		c.Server.MaxConcurrentRequests = 2
+		c.Server.Metrics.Path = "/metrics"
+	})
+
+	statuses := make(chan int, 2)
+	for range 2 {
+		go func() {
+			resp, _ := p.get(t, "/slow")
+			statuses <- resp.StatusCode
+		}()
+	}
+	waitFor(t, "both requests to reach the upstream", func() bool { return started.Load() == 2 })
+
+	resp, _ := p.get(t, "/excess")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("excess request got %d with Retry-After %q, want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if _, metrics := p.get(t, "/metrics"); !strings.Contains(metrics, "proxy_requests_in_flight 2") {
+		t.Errorf("metrics do not report the 2 requests in flight:\n%s", metrics)
+	}
+
+	close(release)
+	for range 2 {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("in-flight request got %d, want 200", status)
+		}
+	}
+	if resp, _ := p.get(t, "/after"); resp.StatusCode != http.StatusOK {
+		t.Errorf("request after the others finished got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestClientMaxConcurrency(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}), func(c *Config) { c.Client.MaxConcurrency = 1 })
+
+	// The client can only take one request at a time, so the rest wait their turn
+	statuses := make(chan int, 4)
+	for range 4 {
+		go func() {
+			resp, _ := p.get(t, "/serial")
+			statuses <- resp.StatusCode
+		}()
+	}
+	for range 4 {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("status = %d, want 200", status)
+		}
+	}
+	if n := peak.Load(); n != 1 {
+		t.Errorf("%d requests reached the upstream at once, want 1", n)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.Socket.MaxConnsPerIP = 2 })
+	first := p.connectFakeClient(t)
+	p.connectFakeClient(t)
+
+	// The server closes the excess connection without reading from it
+	excess, err := p.transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer excess.Close()
+	excess.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := excess.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the excess connection = %v, want EOF", err)
+	}
+	p.waitForLog(t, "Too many connections from remote address")
+	if clients := p.server.registeredClients(); clients != 2 {
+		t.Errorf("%d clients registered, want 2", clients)
+	}
+
+	// A closed connection frees its slot
+	first.conn.Close()
+	waitFor(t, "the first connection's slot to be released", func() bool {
+		p.server.connsMutex.Lock()
+		defer p.server.connsMutex.Unlock()
+		return p.server.connsPerIP["memory"] == 1
+	})
+	p.connectFakeClient(t)
+}
+
+func TestIdleClientIsDropped(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.Socket.IdleTimeout = 200 })
+	f := p.connectFakeClient(t)
+
+	// Heartbeats alone do not keep the connection open
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for generation := 1; ; generation++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				f.conn.Write(f.buffer.Produce([]byte(`{"type":"health","healthy":true,"generation":` + strconv.Itoa(generation) + `}`)))
+			}
+		}
+	}()
+
+	p.waitForLog(t, "Closing idle client connection")
+	waitFor(t, "the idle client to be removed", func() bool { return p.server.registeredClients() == 0 })
+}
+
+func TestActiveClientIsKept(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) { c.Server.Socket.IdleTimeout = 300 })
+
+	for range 10 {
+		p.get(t, "/")
+		time.Sleep(100 * time.Millisecond)
+	}
+	if strings.Contains(p.logs(t), "Closing idle client connection") {
+		t.Error("a client with steady traffic was closed as idle")
+	}
+	if clients := p.server.registeredClients(); clients != 1 {
+		t.Errorf("%d clients registered, want the active one", clients)
+	}
+}
+
+func TestTricklingClientIsDropped(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.Socket.ReadTimeout = 200
+		c.Server.Socket.IdleTimeout = 0
+	})
+	conn, err := p.transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send all but the last byte of a frame, one byte every 50ms
+	frame := NewMessageBuffer().Produce([]byte(`{"type":"register","protocolVersion":1}`))
+	start := time.Now()
+	for _, b := range frame[:len(frame)-1] {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); isTimeout(err) {
+		t.Fatal("the trickling connection was left open")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %v, want it cut off soon after the 200ms read timeout", elapsed)
+	}
+	p.waitForLog(t, "Timed out reading frame from client")
+}
+
+func TestReadTimeoutSparesCompleteFrames(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) { c.Server.Socket.ReadTimeout = 100 })
+
+	// A registered client with nothing to send stays connected
+	time.Sleep(300 * time.Millisecond)
+	if resp, _ := p.get(t, "/"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want the request forwarded", resp.StatusCode)
+	}
+	if strings.Contains(p.logs(t), "Timed out reading frame") {
+		t.Error("a client between frames was timed out")
+	}
+}
+
+func TestStalledClientFailsFast(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.Socket.WriteTimeout = 200
+		c.Server.RequestTimeout = 30000
+	})
+	p.connectStalledClient(t)
+
+	start := time.Now()
+	resp, _ := p.get(t, "/")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request failed after %v, want soon after the 200ms write timeout rather than the request timeout", elapsed)
+	}
+	p.waitForLog(t, "Timed out writing to client")
+	waitFor(t, "the stalled client to be removed", func() bool { return p.server.registeredClients() == 0 })
+}
+
+// unixSocketConfig points the server's socket listener and the client at a unix socket at path
+func unixSocketConfig(path string) func(*Config) {
+	return func(c *Config) {
+		c.Server.Socket.Network = "unix"
+		c.Server.Socket.Path = path
+		c.Client.Server.Network = "unix"
+		c.Client.Server.Path = path
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("over unix " + r.URL.Path))
+	}))
+	t.Cleanup(backend.Close)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	p := startSocketServer(t, func(c *Config) {
+		unixSocketConfig(path)(c)
+		c.Client.Proxy.DefaultTarget = backend.URL
+	})
+	p.connectClient(t, p.config)
+	waitFor(t, "the client to register over the unix socket", func() bool { return p.server.registeredClients() == 1 })
+
+	if resp, body := p.get(t, "/path"); resp.StatusCode != http.StatusOK || body != "over unix /path" {
+		t.Errorf("got %d %q, want 200 over unix /path", resp.StatusCode, body)
+	}
+}
+
+func TestUnixSocketStaleFile(t *testing.T) {
+	// A socket file left behind by a server that did not shut down cleanly
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	p := startSocketServer(t, unixSocketConfig(path))
+	p.connectClient(t, p.config)
+	waitFor(t, "the client to register over the unix socket", func() bool { return p.server.registeredClients() == 1 })
+}
+
+func TestUnixSocketPathInUse(t *testing.T) {
+	for name, create := range map[string]func(t *testing.T, path string){
+		"live socket": func(t *testing.T, path string) {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { listener.Close() })
+		},
+		"regular file": func(t *testing.T, path string) {
+			if err := os.WriteFile(path, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.sock")
+			create(t, path)
+
+			config := newTestConfig(t)
+			config.Server.HTTP.Host = "127.0.0.1"
+			config.Server.HTTP.Port = freeTestPort(t)
+			unixSocketConfig(path)(config)
+			server := NewProxyServer(config, newTestLogger(t, config))
+			if err := server.Start(); err == nil {
+				server.Stop(t.Context())
+				t.Fatal("Start succeeded with the socket path in use")
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("the existing %s was removed: %v", name, err)
+			}
+		})
+	}
+}
+
+func TestRangeRequest(t *testing.T) {
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	for _, tc := range []struct {
+		name             string
+		rangeHeader      string
+		wantStatus       int
+		wantContentRange string
+		wantBody         []byte
+	}{
+		{"slice", "bytes=10-19", http.StatusPartialContent, "bytes 10-19/65536", content[10:20]},
+		{"streamed slice", "bytes=1024-", http.StatusPartialContent, "bytes 1024-65535/65536", content[1024:]},
+		{"suffix", "bytes=-5", http.StatusPartialContent, "bytes 65531-65535/65536", content[65531:]},
+		{"unsatisfiable", "bytes=70000-", http.StatusRequestedRangeNotSatisfiable, "bytes */65536", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "download.bin", time.Time{}, bytes.NewReader(content))
+			}), func(c *Config) { c.Server.StreamingThresholdBytes = 1024 })
+
+			req, err := http.NewRequest(http.MethodGet, p.url+"/download.bin", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Range", tc.rangeHeader)
+			resp, body := p.do(t, req)
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tc.wantContentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tc.wantContentRange)
+			}
+			if tc.wantBody != nil && body != string(tc.wantBody) {
+				t.Errorf("body of %d bytes does not match the %d byte range", len(body), len(tc.wantBody))
+			}
+		})
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configure  func(*Config)
+		bodyBytes  int
+		chunked    bool
+		wantStatus int
+		wantLog    string
+	}{
+		{"under the limit", func(c *Config) { c.Server.MaxRequestBodyBytes = 100 }, 100, false, http.StatusOK, ""},
+		{"over the limit", func(c *Config) { c.Server.MaxRequestBodyBytes = 100 }, 101, false, http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"over the limit without a length", func(c *Config) { c.Server.MaxRequestBodyBytes = 100 }, 101, true, http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"too large for one message", func(c *Config) { c.Transport.MaxFrameBytes = 64 * 1024 }, 64 * 1024, false, http.StatusRequestEntityTooLarge, "Request too large for one message"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, r.Body)
+			}), tc.configure)
+
+			body := strings.Repeat("x", tc.bodyBytes)
+			var reader io.Reader = strings.NewReader(body)
+			if tc.chunked {
+				reader = io.MultiReader(reader)
+			}
+			req, err := http.NewRequest(http.MethodPost, p.url+"/", reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, got := p.do(t, req)
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if tc.wantStatus == http.StatusOK && got != body {
+				t.Errorf("upstream echoed %d bytes, want %d", len(got), len(body))
+			}
+			if tc.wantLog != "" {
+				p.waitForLog(t, tc.wantLog)
+			}
+		})
+	}
+}
+
+// failingListener fails every Accept until it is closed, counting the attempts
+type failingListener struct {
+	net.Listener
+	accepts atomic.Int32
+	closed  atomic.Bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts.Add(1)
+	if l.closed.Load() {
+		return nil, net.ErrClosed
+	}
+	return nil, errors.New("too many open files")
+}
+
+func TestAcceptErrorBackoff(t *testing.T) {
+	config := newTestConfig(t)
+	server := NewProxyServer(config, newTestLogger(t, config))
+	listener := &failingListener{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.acceptSocketConnections(listener)
+	}()
+
+	// Backing off 5, 10, 20, 40 and 80ms allows at most six attempts in 150ms
+	time.Sleep(150 * time.Millisecond)
+	if n := listener.accepts.Load(); n > 6 {
+		t.Errorf("accepted %d times in 150ms, want the loop to back off", n)
+	}
+
+	listener.closed.Store(true)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the accept loop kept going after the listener closed")
+	}
+}
+
+// startBalancedProxy starts a server using the given load balancing strategy with a
+// client of each weight, named after its position. Each upstream reports its name
+// on arrivals and answers with it once handle returns.
+func startBalancedProxy(t *testing.T, strategy string, handle func(), weights ...int) (*testProxy, <-chan string) {
+	t.Helper()
+	p := startTestServer(t, func(c *Config) { c.Server.LoadBalancing.Strategy = strategy })
+	arrivals := make(chan string, 1024)
+	for i, weight := range weights {
+		name := strconv.Itoa(i)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrivals <- name
+			handle()
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(upstream.Close)
+
+		config := newTestConfig(t)
+		config.Client.Proxy.DefaultTarget = upstream.URL
+		config.Client.Weight = weight
+		p.connectClient(t, config)
+	}
+	waitFor(t, "every client to register", func() bool { return p.server.registeredClients() == len(weights) })
+	return p, arrivals
+}
+
+func TestFirstStrategy(t *testing.T) {
+	p, _ := startBalancedProxy(t, strategyFirst, func() {}, 1, 1, 1)
+
+	// Every request goes to the client that connected first
+	for range 20 {
+		if _, name := p.get(t, "/"); name != "0" {
+			t.Fatalf("request served by client %s, want client 0", name)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	release := make(chan struct{})
+	p, arrivals := startBalancedProxy(t, strategyLeastConnections, func() { <-release }, 1, 1)
+
+	// Each request goes to the client with fewer requests in flight, so held
+	// requests alternate between the two
+	counts := make(map[string]int)
+	statuses := make(chan int, 6)
+	for range 6 {
+		go func() {
+			resp, _ := p.get(t, "/")
+			statuses <- resp.StatusCode
+		}()
+		counts[<-arrivals]++
+	}
+	if counts["0"] != 3 || counts["1"] != 3 {
+		t.Errorf("held requests went %v, want 3 to each client", counts)
+	}
+
+	close(release)
+	for range 6 {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("status = %d, want 200", status)
+		}
+	}
+	waitFor(t, "in-flight counts to return to zero", func() bool {
+		p.server.clientsMutex.RLock()
+		defer p.server.clientsMutex.RUnlock()
+		for _, info := range p.server.clients {
+			if info.inFlight.Load() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	p, _ := startBalancedProxy(t, strategyWeightedRoundRobin, func() {}, 1, 2, 3)
+
+	counts := make(map[string]int)
+	for range 600 {
+		_, name := p.get(t, "/")
+		counts[name]++
+	}
+	for name, want := range map[string]int{"0": 100, "1": 200, "2": 300} {
+		if got := counts[name]; got < want*9/10 || got > want*11/10 {
+			t.Errorf("client of weight %s served %d of 600 requests, want about %d", name, got, want)
+		}
+	}
+}
+
+func TestClientWeightDefaultsToOne(t *testing.T) {
+	// The fake client registers without advertising a weight
+	p := startTestServer(t, nil)
+	p.connectFakeClient(t)
+
+	p.server.clientsMutex.RLock()
+	defer p.server.clientsMutex.RUnlock()
+	for _, info := range p.server.clients {
+		if info.weight != 1 {
+			t.Errorf("weight = %d, want 1", info.weight)
+		}
+	}
+}
+
+func TestUpstreamDurationReported(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}), func(c *Config) { c.Server.Metrics.Path = "/metrics" })
+
+	start := time.Now()
+	p.get(t, "/slow")
+	elapsed := time.Since(start)
+
+	var reported float64
+	waitFor(t, "the response to be logged", func() bool {
+		for _, entry := range p.logEntries(t, "message") {
+			if entry["message"] == "Response sent to client" {
+				reported, _ = entry["upstreamDurationMs"].(float64)
+				return true
+			}
+		}
+		return false
+	})
+	if reported < 50 || reported > float64(elapsed.Milliseconds()) {
+		t.Errorf("upstreamDurationMs = %v, want between the upstream's 50ms and the %v the request took", reported, elapsed)
+	}
+
+	_, metrics := p.get(t, "/metrics")
+	if !strings.Contains(metrics, "proxy_upstream_duration_seconds_count 1\n") {
+		t.Errorf("metrics do not count the reported duration:\n%s", metrics)
+	}
+}
+
+// registrations returns the "reconnected" field of each client registration logged
+// for id, in order
+func (p *testProxy) registrations(t *testing.T, id string) []bool {
+	t.Helper()
+	var reconnected []bool
+	for _, entry := range p.logEntries(t, "socket") {
+		if entry["message"] == "Client registered" && entry["clientId"] == id {
+			reconnected = append(reconnected, entry["reconnected"] == true)
+		}
+	}
+	return reconnected
+}
+
+func TestAnonymousClientID(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+
+	ids := p.clientIDs()
+	if len(ids) != 1 || !strings.HasPrefix(ids[0], "memory-") {
+		t.Errorf("client IDs = %v, want one derived from the remote address", ids)
+	}
+}
+
+func TestClientIDFromHandshake(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) { c.Client.ID = "worker-1" })
+
+	if ids := p.clientIDs(); !slices.Equal(ids, []string{"worker-1"}) {
+		t.Fatalf("client IDs = %v, want [worker-1]", ids)
+	}
+
+	// Dropping the connection makes the client reconnect with the same ID
+	p.server.clientsMutex.RLock()
+	p.server.clients["worker-1"].conn.Close()
+	p.server.clientsMutex.RUnlock()
+	waitFor(t, "the client to register again", func() bool { return len(p.registrations(t, "worker-1")) == 2 })
+
+	if got := p.registrations(t, "worker-1"); !slices.Equal(got, []bool{false, true}) {
+		t.Errorf("reconnected = %v, want the second registration recognized as the same client", got)
+	}
+	if ids := p.clientIDs(); !slices.Equal(ids, []string{"worker-1"}) {
+		t.Errorf("client IDs = %v, want [worker-1]", ids)
+	}
+}
+
+func TestDepartedClientIDsAreForgotten(t *testing.T) {
+	p := startTestServer(t, nil)
+	s := p.server
+
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	s.knownClients["connected"] = time.Time{}
+	s.knownClients["recently-gone"] = time.Now().Add(-time.Minute)
+	s.knownClients["long-gone"] = time.Now().Add(-knownClientRetention - time.Minute)
+	s.forgetDepartedClients()
+
+	var ids []string
+	for id := range s.knownClients {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"connected", "recently-gone"}) {
+		t.Errorf("known client IDs = %v, want [connected recently-gone]", ids)
+	}
+}
+
+func TestPerClientRateLimit(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Server.PerClientRateLimit.RequestsPerSecond = 0.001
+		c.Server.PerClientRateLimit.Burst = 2
+		c.Server.PerClientRateLimit.MaxWait = 1
+		c.Client.Tags = []string{"a"}
+		addRoute(c, "", "/a", false, "a")
+		addRoute(c, "", "/b", false, "b")
+	})
+	config := newTestConfig(t)
+	config.Client.Proxy.DefaultTarget = p.config.Client.Proxy.DefaultTarget
+	config.Client.Tags = []string{"b"}
+	p.connectClient(t, config)
+	waitFor(t, "second client to register", func() bool { return p.server.registeredClients() == 2 })
+
+	statuses := func(path string, n int) (got []int) {
+		for range n {
+			resp, _ := p.get(t, path)
+			got = append(got, resp.StatusCode)
+		}
+		return got
+	}
+
+	// Client a's burst is used up, so its next request is turned away
+	if got := statuses("/a", 3); !slices.Equal(got, []int{404, 404, 503}) {
+		t.Errorf("statuses for the saturated client = %v, want [404 404 503]", got)
+	}
+	// while client b has its own allowance
+	if got := statuses("/b", 2); !slices.Equal(got, []int{404, 404}) {
+		t.Errorf("statuses for the other client = %v, want [404 404]", got)
+	}
+}
+
+// sendExpectContinue sends the head of a POST request expecting 100 Continue over
+// a raw connection, and returns the connection and the first response to it
+func (p *testProxy) sendExpectContinue(t *testing.T, body string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(p.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /upload HTTP/1.1\r\nHost: proxy\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", len(body))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func TestExpectContinue(t *testing.T) {
+	expect := make(chan string, 1)
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect <- r.Header.Get("Expect")
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("got " + string(body)))
+	}), nil)
+
+	conn, reader, interim := p.sendExpectContinue(t, "hello")
+	if interim.StatusCode != http.StatusContinue {
+		t.Fatalf("first response = %d, want 100 Continue before the body is sent", interim.StatusCode)
+	}
+
+	conn.Write([]byte("hello"))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "got hello" {
+		t.Errorf("got %d %q, want the body forwarded", resp.StatusCode, body)
+	}
+	if got := <-expect; got != "" {
+		t.Errorf("upstream saw Expect %q, want it answered by the proxy", got)
+	}
+}
+
+func TestExpectContinueRejected(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) { c.Server.ExpectContinue = "reject" })
+
+	_, _, resp := p.sendExpectContinue(t, "hello")
+	if resp.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("status = %d, want 417", resp.StatusCode)
+	}
+	p.waitForLog(t, "Rejected request expecting 100 Continue")
+}
+
+func TestShutdownMessage(t *testing.T) {
+	p := startTestServer(t, func(c *Config) { c.Server.Shutdown.ReconnectAfter = 1500 })
+	f := p.connectFakeClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.server.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.receive(t, "shutdown")["reconnectAfterMs"]; got != float64(1500) {
+		t.Errorf("reconnectAfterMs = %v, want 1500", got)
+	}
+}
+
+func TestRunLeavesNoGoroutines(t *testing.T) {
+	config := newTestConfig(t)
+	config.Server.Startup.Timeout = 60000
+	config.Server.WaitForClients.Count = 1
+	config.Server.StickySession.CookieName = "proxy_session"
+	config.Server.CertReloadInterval = 60000
+	config.Server.Shutdown.Timeout = 1000
+	logger := newTestLogger(t, config)
+
+	// Every background loop is running while the server is, and gone once Run returns
+	before := runtime.NumGoroutine()
+	for range 3 {
+		server := NewProxyServer(config, logger)
+		transport := NewMemoryTransport()
+		server.SetTransport(transport)
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan error, 1)
+		go func() { stopped <- server.Run(ctx) }()
+
+		// Connections are accepted once Start has launched everything else
+		conn, err := transport.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(io.Discard, conn)
+
+		cancel()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after its context was canceled")
+		}
+		conn.Close()
+	}
+	waitFor(t, "the server's goroutines to exit", func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestShutdownDelaysReconnect(t *testing.T) {
+	p := startSocketServer(t, func(c *Config) { c.Server.Shutdown.ReconnectAfter = 300 })
+	p.connectClient(t, p.config)
+	waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stopped := time.Now()
+	if err := p.server.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewProxyServer(p.config, p.logger)
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { restarted.Stop(context.Background()) })
+	waitFor(t, "client to reconnect", func() bool { return restarted.registeredClients() == 1 })
+
+	// The configured reconnection delay is only 50ms
+	if waited := time.Since(stopped); waited < 300*time.Millisecond {
+		t.Errorf("client reconnected after %v, want it to wait the 300ms the server asked for", waited)
+	}
+}
+
+// tricklingBody is a request body that yields one byte every interval, size times
+type tricklingBody struct {
+	size     int
+	interval time.Duration
+}
+
+func (b *tricklingBody) Read(p []byte) (int, error) {
+	if b.size == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(b.interval)
+	b.size--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestSlowRequestBody(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(strconv.Itoa(len(body))))
+	}), func(c *Config) { c.Server.MinBodyReadRate = 100 })
+
+	// Ten bytes a second, against a floor of a hundred
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodPost, p.url+"/upload", &tricklingBody{size: 50, interval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := p.do(t, req)
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status = %d, want 408", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("slow body rejected after %v, want soon after the grace period", elapsed)
+	}
+	p.waitForLog(t, `"event":"slow_body"`)
+
+	// A body sent at full speed is forwarded
+	req, err = http.NewRequest(http.MethodPost, p.url+"/upload", strings.NewReader(strings.Repeat("y", 5000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := p.do(t, req); resp.StatusCode != http.StatusOK || body != "5000" {
+		t.Errorf("fast body: got %d %q, want all 5000 bytes forwarded", resp.StatusCode, body)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	p := startTestServer(t, nil)
+
+	t.Run("matched", func(t *testing.T) {
+		f := p.dialFakeClient(t)
+		f.send(t, map[string]interface{}{
+			"type":               "register",
+			"protocolVersion":    protocolVersion,
+			"minProtocolVersion": minProtocolVersion,
+		})
+		if reply := f.receive(t, "registered"); reply["protocolVersion"] != float64(protocolVersion) {
+			t.Errorf("protocolVersion = %v, want %d", reply["protocolVersion"], protocolVersion)
+		}
+	})
+
+	t.Run("older client", func(t *testing.T) {
+		f := p.dialFakeClient(t)
+		f.send(t, map[string]interface{}{"type": "register", "protocolVersion": protocolRawBodies})
+		reply := f.receive(t, "registered")
+		if reply["protocolVersion"] != float64(protocolRawBodies) || reply["error"] != nil {
+			t.Errorf("reply = %v, want version %d negotiated", reply, protocolRawBodies)
+		}
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		f := p.dialFakeClient(t)
+		f.send(t, map[string]interface{}{
+			"type":               "register",
+			"protocolVersion":    protocolVersion + 2,
+			"minProtocolVersion": protocolVersion + 1,
+		})
+		if reply := f.receive(t, "registered"); reply["error"] == nil {
+			t.Errorf("reply = %v, want the registration refused", reply)
+		}
+		f.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := f.conn.Read(make([]byte, 1)); isTimeout(err) {
+			t.Error("the incompatible client was left connected")
+		}
+		p.waitForLog(t, "Client protocol version is not supported")
+	})
+}
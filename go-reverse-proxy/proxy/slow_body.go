@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// slowBodyGracePeriod is how long a request body may take before its read rate is
+// held to server.minBodyReadRate, so a slow start or a small body isn't rejected
+const slowBodyGracePeriod = time.Second
+
+// errSlowBody is returned when a request body arrives slower than the minimum rate
+var errSlowBody = errors.New("request body read rate below minimum")
+
+// slowBodyReader fails a request body whose average read rate drops below
+// minRate bytes per second once the grace period has passed. A read deadline on
+// the connection catches callers that stop sending altogether.
+type slowBodyReader struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	minRate    int64
+	start      time.Time
+	read       int64
+}
+
+// newSlowBodyReader wraps a request body to enforce minRate bytes per second
+func newSlowBodyReader(w http.ResponseWriter, body io.ReadCloser, minRate int64) *slowBodyReader {
+	return &slowBodyReader{
+		ReadCloser: body,
+		controller: http.NewResponseController(w),
+		minRate:    minRate,
+		start:      time.Now(),
+	}
+}
+
+// Read reads from the body, failing with errSlowBody if the caller has fallen
+// behind the minimum rate
+func (b *slowBodyReader) Read(p []byte) (int, error) {
+	// The bytes read so far cover the rate until this deadline
+	allowed := time.Duration(float64(b.read) / float64(b.minRate) * float64(time.Second))
+	b.controller.SetReadDeadline(b.start.Add(max(allowed, slowBodyGracePeriod)))
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && isTimeout(err) {
+		return n, errSlowBody
+	}
+
+	if elapsed := time.Since(b.start); err == nil && elapsed > slowBodyGracePeriod &&
+		float64(b.read)/elapsed.Seconds() < float64(b.minRate) {
+		return n, errSlowBody
+	}
+	return n, err
+}
+
+// stop clears the read deadline once reading the body is over, so it doesn't
+// cut off the rest of the connection
+func (b *slowBodyReader) stop() {
+	b.controller.SetReadDeadline(time.Time{})
+}
+
+// rate returns the average rate the body was read at, in bytes per second
+func (b *slowBodyReader) rate() int64 {
+	elapsed := time.Since(b.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(b.read) / elapsed)
+}
+
+// rejectSlowBody answers a request whose body arrived too slowly with 408
+func (s *ProxyServer) rejectSlowBody(w http.ResponseWriter, r *http.Request, body *slowBodyReader) {
+	s.metrics.add("proxy_slow_request_bodies_total", 1)
+	s.logger.Warn("request", "Request body too slow", map[string]interface{}{
+		"event":      "slow_body",
+		"method":     r.Method,
+		"url":        r.URL.String(),
+		"bytesRead":  body.read,
+		"durationMs": time.Since(body.start).Milliseconds(),
+		"rate":       body.rate(),
+		"minRate":    body.minRate,
+	})
+
+	// The rest of the body was never read, so the connection can't be reused
+	w.Header().Set("Connection", "close")
+	s.writeError(w, http.StatusRequestTimeout, errorCodeSlowBody, "Request Timeout", "")
+}
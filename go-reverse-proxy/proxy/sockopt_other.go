@@ -0,0 +1,17 @@
+//go:build !unix
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setListenOptions keeps the platform's default address reuse behaviour; SO_REUSEPORT
+// is not available outside unix systems
+func setListenOptions(conn syscall.RawConn, reusePort bool) error {
+	if reusePort {
+		return errors.New("server.socket.reusePort is not supported on this platform")
+	}
+	return nil
+}
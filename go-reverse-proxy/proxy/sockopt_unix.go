@@ -0,0 +1,25 @@
+//go:build unix
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setListenOptions sets SO_REUSEADDR so a restarted server can bind a port still in
+// TIME_WAIT, and SO_REUSEPORT when several processes should share the port
+func setListenOptions(conn syscall.RawConn, reusePort bool) error {
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil && reusePort {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package proxy
+
+import "testing"
+
+func TestListenReusePort(t *testing.T) {
+	first, err := listen("tcp", "127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+
+	if listener, err := listen("tcp", addr, false); err == nil {
+		listener.Close()
+		t.Fatal("a second listener without reusePort bound a port in use")
+	}
+	second, err := listen("tcp", addr, true)
+	if err != nil {
+		t.Fatalf("second listener with reusePort: %v", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Startup check names
+const (
+	checkHTTPListener   = "httpListener"
+	checkSocketListener = "socketListener"
+	checkClient         = "client"
+)
+
+// Startup check states
+const (
+	checkPending = "pending"
+	checkPassed  = "passed"
+	checkFailed  = "failed"
+)
+
+// startupGate tracks the checks that must pass before the server reports ready.
+// A failed check stays failed so that a broken startup is never reported ready.
+type startupGate struct {
+	mu     sync.Mutex
+	checks map[string]string
+}
+
+// newStartupGate creates a startupGate with the given checks pending
+func newStartupGate(names ...string) *startupGate {
+	checks := make(map[string]string)
+	for _, name := range names {
+		checks[name] = checkPending
+	}
+	return &startupGate{checks: checks}
+}
+
+// pass marks a pending check as passed; it reports whether the state changed
+func (g *startupGate) pass(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.checks[name] != checkPending {
+		return false
+	}
+	g.checks[name] = checkPassed
+	return true
+}
+
+// fail marks a pending check as failed
+func (g *startupGate) fail(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.checks[name] == checkPending {
+		g.checks[name] = checkFailed
+	}
+}
+
+// expire fails every check that is still pending and returns their names
+func (g *startupGate) expire() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var expired []string
+	for name, state := range g.checks {
+		if state == checkPending {
+			g.checks[name] = checkFailed
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// status reports whether all checks passed along with a copy of each check's state
+func (g *startupGate) status() (bool, map[string]string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ready := true
+	checks := make(map[string]string, len(g.checks))
+	for name, state := range g.checks {
+		checks[name] = state
+		if state != checkPassed {
+			ready = false
+		}
+	}
+	return ready, checks
+}
+
+// startupChecks returns the names of the startup checks enabled by the configuration
+func (s *ProxyServer) startupChecks() []string {
+	checks := []string{checkHTTPListener, checkSocketListener}
+	if s.config.Server.Startup.RequireClient {
+		checks = append(checks, checkClient)
+	}
+	return checks
+}
+
+// watchStartup fails any startup checks still pending once the startup timeout elapses
+func (s *ProxyServer) watchStartup() {
+	if s.config.Server.Startup.Timeout <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(time.Duration(s.config.Server.Startup.Timeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.done:
+		return
+	}
+	for _, name := range s.startup.expire() {
+		s.logger.Error("server", "Startup check timed out", map[string]interface{}{
+			"check": name,
+		})
+	}
+}
+
+// passStartupCheck marks a startup check as passed and logs when the server becomes ready
+func (s *ProxyServer) passStartupCheck(name string) {
+	if !s.startup.pass(name) {
+		return
+	}
+	if ready, _ := s.startup.status(); ready {
+		s.logger.Info("server", "Startup checks passed, server is ready", nil)
+	}
+}
+
+// handleReady reports whether all startup checks have passed
+func (s *ProxyServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready, checks := s.startup.status()
+
+	statusCode := http.StatusOK
+	if !ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"ready":  ready,
+		"checks": checks,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
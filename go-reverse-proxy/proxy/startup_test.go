@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestReadyEndpointIsOptIn(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	}), nil)
+
+	if resp, body := p.get(t, "/readyz"); resp.StatusCode != http.StatusOK || body != "upstream /readyz" {
+		t.Errorf("got %d %q, want the request forwarded upstream", resp.StatusCode, body)
+	}
+}
+
+func TestReadyRequiresRegisteredClient(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.Startup.ReadyPath = "/readyz"
+		c.Server.Startup.RequireClient = true
+	})
+
+	ready := func(wantStatus int, wantClientCheck string) {
+		t.Helper()
+		resp, body := p.get(t, "/readyz")
+		var report struct {
+			Checks map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Fatalf("invalid readiness report %q: %v", body, err)
+		}
+		if resp.StatusCode != wantStatus || report.Checks[checkClient] != wantClientCheck {
+			t.Errorf("got %d with client check %q, want %d with %q",
+				resp.StatusCode, report.Checks[checkClient], wantStatus, wantClientCheck)
+		}
+	}
+
+	ready(http.StatusServiceUnavailable, checkPending)
+
+	// Connecting isn't enough, the client must register
+	conn, err := p.transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p.waitForLog(t, "Client connected")
+	ready(http.StatusServiceUnavailable, checkPending)
+
+	p.connectFakeClient(t)
+	ready(http.StatusOK, checkPassed)
+}
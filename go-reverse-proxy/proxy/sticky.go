@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// stickySession records which client serves a session
+type stickySession struct {
+	clientID string
+	lastSeen time.Time
+}
+
+// stickyKey returns the session key carried by a request, if sticky sessions are enabled
+func (s *ProxyServer) stickyKey(r *http.Request) string {
+	cookieName := s.config.Server.StickySession.CookieName
+	if cookieName == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// stickyClient returns the client bound to a session if it is still connected, healthy
+// and allowed to serve the request's route
+func (s *ProxyServer) stickyClient(key string, rt *route) (string, *ClientInfo) {
+	s.sessionsMutex.Lock()
+	session, exists := s.sessions[key]
+	if exists {
+		session.lastSeen = time.Now()
+	}
+	s.sessionsMutex.Unlock()
+	if !exists {
+		return "", nil
+	}
+
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	info, connected := s.clients[session.clientID]
+	if !connected || !info.available() || !rt.accepts(info) {
+		return "", nil
+	}
+	return session.clientID, info
+}
+
+// bindSession routes future requests for a session to the given client
+func (s *ProxyServer) bindSession(key string, clientID string) {
+	s.sessionsMutex.Lock()
+	s.sessions[key] = &stickySession{
+		clientID: clientID,
+		lastSeen: time.Now(),
+	}
+	s.sessionsMutex.Unlock()
+}
+
+// bindSessionFromResponse binds a session cookie set by a response to the client that served it
+func (s *ProxyServer) bindSessionFromResponse(clientID string, header http.Header) {
+	cookieName := s.config.Server.StickySession.CookieName
+	if cookieName == "" {
+		return
+	}
+
+	for _, cookie := range (&http.Response{Header: header}).Cookies() {
+		if cookie.Name == cookieName && cookie.Value != "" {
+			s.bindSession(cookie.Value, clientID)
+		}
+	}
+}
+
+// unbindClientSessions forgets every session bound to a client that disconnected
+func (s *ProxyServer) unbindClientSessions(clientID string) {
+	s.sessionsMutex.Lock()
+	defer s.sessionsMutex.Unlock()
+	for key, session := range s.sessions {
+		if session.clientID == clientID {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// sweepSessions periodically forgets sessions that have been idle longer than the
+// session TTL, until the server stops
+func (s *ProxyServer) sweepSessions() {
+	ttl := time.Duration(s.config.Server.StickySession.TTL) * time.Millisecond
+	if s.config.Server.StickySession.CookieName == "" || ttl <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		cutoff := time.Now().Add(-ttl)
+		s.sessionsMutex.Lock()
+		for key, session := range s.sessions {
+			if session.lastSeen.Before(cutoff) {
+				delete(s.sessions, key)
+			}
+		}
+		s.sessionsMutex.Unlock()
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startStickyProxy starts a server with sticky sessions on cookieName and two clients,
+// "a" and "b", whose backends answer with their name. Requests without a session
+// alternate between the clients. A request for /login sets a "sid" cookie named
+// after the backend that served it.
+func startStickyProxy(t *testing.T, cookieName string) (*testProxy, map[string]*ProxyClient) {
+	t.Helper()
+	p := startTestServer(t, func(c *Config) {
+		c.Server.StickySession.CookieName = cookieName
+		c.Server.LoadBalancing.Strategy = strategyWeightedRoundRobin
+	})
+
+	clients := make(map[string]*ProxyClient)
+	for _, name := range []string{"a", "b"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/login" {
+				http.SetCookie(w, &http.Cookie{Name: "sid", Value: "session-" + name})
+			}
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(backend.Close)
+
+		config := newTestConfig(t)
+		config.Client.Proxy.DefaultTarget = backend.URL
+		clients[name] = p.connectClient(t, config)
+	}
+	waitFor(t, "both clients to register", func() bool { return p.server.registeredClients() == 2 })
+	return p, clients
+}
+
+// getWithSession requests path carrying the session cookie and returns the backend that served it
+func (p *testProxy) getWithSession(t *testing.T, path, session string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, p.url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "sid", Value: session})
+	resp, body := p.do(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	return body
+}
+
+func TestStickySessionFromResponseCookie(t *testing.T) {
+	p, _ := startStickyProxy(t, "sid")
+
+	resp, first := p.get(t, "/login")
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Value != "session-"+first {
+		t.Fatalf("login set cookies %v, want session-%s", cookies, first)
+	}
+	for i := 0; i < 20; i++ {
+		if got := p.getWithSession(t, "/", cookies[0].Value); got != first {
+			t.Fatalf("request %d served by %q, want %q which set the session", i, got, first)
+		}
+	}
+}
+
+func TestStickySessionFromRequestCookie(t *testing.T) {
+	p, _ := startStickyProxy(t, "sid")
+
+	// A session the proxy has not seen is bound to whichever client serves it first
+	first := p.getWithSession(t, "/", "new-session")
+	for i := 0; i < 20; i++ {
+		if got := p.getWithSession(t, "/", "new-session"); got != first {
+			t.Fatalf("request %d served by %q, want %q which served the first", i, got, first)
+		}
+	}
+}
+
+func TestStickySessionFallback(t *testing.T) {
+	p, clients := startStickyProxy(t, "sid")
+	first := p.getWithSession(t, "/", "session")
+
+	clients[first].Close()
+	waitFor(t, "the sticky client to disconnect", func() bool { return p.server.registeredClients() == 1 })
+
+	other := p.getWithSession(t, "/", "session")
+	if other == first {
+		t.Fatalf("request served by %q after it disconnected", first)
+	}
+	// The session stays with the client it fell back to
+	for i := 0; i < 10; i++ {
+		if got := p.getWithSession(t, "/", "session"); got != other {
+			t.Fatalf("request %d served by %q, want %q", i, got, other)
+		}
+	}
+}
+
+func TestWithoutStickySessionsRequestsAreSpread(t *testing.T) {
+	p, _ := startStickyProxy(t, "")
+
+	first := p.getWithSession(t, "/", "session")
+	if second := p.getWithSession(t, "/", "session"); second == first {
+		t.Errorf("both requests served by %q without sticky sessions", first)
+	}
+}
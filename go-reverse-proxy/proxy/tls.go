@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// tlsVersions maps configured TLS versions to their crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// applyTLSPolicy sets the minimum protocol version and, if any are listed, the
+// allowed cipher suites on tlsConfig. Cipher suites are given by their standard
+// names and only restrict TLS 1.2 and earlier; TLS 1.3 suites are not configurable.
+func applyTLSPolicy(tlsConfig *tls.Config, minVersion string, cipherSuites []string) error {
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %q", minVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(cipherSuites) == 0 {
+		return nil
+	}
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+	tlsConfig.CipherSuites = make([]uint16, 0, len(cipherSuites))
+	for _, name := range cipherSuites {
+		id, ok := ids[name]
+		if !ok {
+			return fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return nil
+}
+
+// tlsInfoHeaders maps the fields of a request message's tls object to the headers
+// the client sets on the upstream request
+var tlsInfoHeaders = map[string]string{
+	"sni":               "X-SSL-SNI",
+	"protocol":          "X-SSL-Protocol",
+	"version":           "X-SSL-Version",
+	"cipher":            "X-SSL-Cipher",
+	"clientFingerprint": "X-SSL-Client-Fingerprint",
+}
+
+// tlsInfo describes the caller's TLS connection for forwarding to the upstream. The
+// client certificate fingerprint is the hex SHA-256 of the leaf certificate.
+func tlsInfo(state *tls.ConnectionState) map[string]string {
+	info := map[string]string{
+		"sni":     state.ServerName,
+		"version": tls.VersionName(state.Version),
+		"cipher":  tls.CipherSuiteName(state.CipherSuite),
+	}
+	if state.NegotiatedProtocol != "" {
+		info["protocol"] = state.NegotiatedProtocol
+	}
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		info["clientFingerprint"] = hex.EncodeToString(sum[:])
+	}
+	return info
+}
+
+// removeTLSInfoHeaders deletes any X-SSL-* headers, so callers can't pass off their
+// own values as the server's description of the connection
+func removeTLSInfoHeaders(h http.Header) {
+	for key := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), "X-Ssl-") {
+			h.Del(key)
+		}
+	}
+}
+
+// setTLSInfoHeaders sets the X-SSL-* headers described by a request message's tls object
+func setTLSInfoHeaders(h http.Header, info map[string]interface{}) {
+	for field, header := range tlsInfoHeaders {
+		if value, _ := info[field].(string); value != "" {
+			h.Set(header, value)
+		}
+	}
+}
+
+// Reasons a TLS handshake on the socket listener failed
+const (
+	handshakeProtocolVersion = "protocol_version"
+	handshakeCertificate     = "certificate"
+	handshakeOther           = "other"
+)
+
+// classifyHandshakeError reports why a TLS handshake failed, or "" if the peer
+// just went away before finishing it, as port scanners and TCP health checks do
+func classifyHandshakeError(err error) string {
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return ""
+	}
+
+	// Alerts sent by the peer, numbered as in RFC 8446
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		switch alert {
+		case 70: // protocol_version
+			return handshakeProtocolVersion
+		case 42, 43, 44, 45, 46, 48: // bad, unsupported, revoked, expired, unknown certificate, unknown CA
+			return handshakeCertificate
+		}
+		return handshakeOther
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &unknownAuthority) || errors.As(err, &invalid) {
+		return handshakeCertificate
+	}
+
+	// Failures detected locally are only described by their message
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "unsupported versions"), strings.Contains(message, "protocol version"):
+		return handshakeProtocolVersion
+	case strings.Contains(message, "certificate"):
+		return handshakeCertificate
+	}
+	return handshakeOther
+}
+
+// handshakeFailed records a TLS handshake on the socket listener that didn't
+// complete. Real failures are logged as warnings and counted by reason in
+// proxy_tls_handshake_errors_total; peers that just disconnected are only
+// logged at debug level.
+func (s *ProxyServer) handshakeFailed(conn net.Conn, err error) {
+	reason := classifyHandshakeError(err)
+	if reason == "" {
+		s.logger.Debug("socket", "Connection closed during TLS handshake", map[string]interface{}{
+			"error":         err.Error(),
+			"remoteAddress": conn.RemoteAddr().String(),
+		})
+		return
+	}
+
+	s.metrics.add("proxy_tls_handshake_errors_total", 1, "reason", reason)
+	s.logger.Warn("socket", "TLS handshake failed", map[string]interface{}{
+		"event":         "tls_handshake_failed",
+		"reason":        reason,
+		"error":         err.Error(),
+		"remoteAddress": conn.RemoteAddr().String(),
+	})
+}
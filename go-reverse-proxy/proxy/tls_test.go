@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// socketTLS returns a configuration function enabling TLS on the socket listener
+// with a certificate from ca, and on the client trusting ca
+func socketTLS(t *testing.T, ca *testCA) func(*Config) {
+	t.Helper()
+	certFile, keyFile := ca.issueFiles(t, "127.0.0.1")
+	return func(c *Config) {
+		c.Server.Socket.SSL.Enabled = true
+		c.Server.Socket.SSL.Cert = certFile
+		c.Server.Socket.SSL.Key = keyFile
+		c.Client.Server.SSL.Enabled = true
+		c.Client.Server.SSL.CA = ca.certFile
+	}
+}
+
+func TestSocketClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	trustedCert, trustedKey := ca.issueFiles(t, "trusted-client")
+	untrustedCert, untrustedKey := newTestCA(t).issueFiles(t, "untrusted-client")
+
+	for _, tc := range []struct {
+		name           string
+		cert, key      string
+		wantRegistered bool
+	}{
+		{"trusted certificate", trustedCert, trustedKey, true},
+		{"untrusted certificate", untrustedCert, untrustedKey, false},
+		{"no certificate", "", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startSocketServer(t, func(c *Config) {
+				socketTLS(t, ca)(c)
+				c.Server.Socket.SSL.ClientCA = ca.certFile
+				c.Server.Socket.SSL.RequireClientCert = true
+				c.Client.Server.SSL.Cert = tc.cert
+				c.Client.Server.SSL.Key = tc.key
+			})
+			p.connectClient(t, p.config)
+
+			if tc.wantRegistered {
+				waitFor(t, "client to register", func() bool { return p.server.registeredClients() == 1 })
+				return
+			}
+			p.waitForLog(t, `"reason":"certificate"`)
+			if p.server.registeredClients() != 0 {
+				t.Error("a client without a trusted certificate registered")
+			}
+		})
+	}
+}
+
+// dialSocketTLS performs a TLS handshake with the server's socket listener as
+// configured by clientConfig, trusting ca, and returns the negotiated state
+func dialSocketTLS(p *testProxy, ca *testCA, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig.RootCAs = roots
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.config.Server.Socket.Port), clientConfig)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), nil
+}
+
+func TestSocketTLSMinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	tls11 := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+
+	p := startSocketServer(t, socketTLS(t, ca))
+	if _, err := dialSocketTLS(p, ca, tls11.Clone()); err == nil {
+		t.Fatal("TLS 1.1 handshake succeeded with the default minimum of 1.2")
+	}
+	p.waitForLog(t, `"reason":"protocol_version"`)
+	if state, err := dialSocketTLS(p, ca, &tls.Config{MaxVersion: tls.VersionTLS12}); err != nil || state.Version != tls.VersionTLS12 {
+		t.Errorf("TLS 1.2 handshake: version %x, err %v", state.Version, err)
+	}
+
+	p = startSocketServer(t, func(c *Config) {
+		socketTLS(t, ca)(c)
+		c.Server.Socket.SSL.MinVersion = "1.0"
+	})
+	if state, err := dialSocketTLS(p, ca, tls11.Clone()); err != nil || state.Version != tls.VersionTLS11 {
+		t.Errorf("TLS 1.1 handshake with a minimum of 1.0: version %x, err %v", state.Version, err)
+	}
+}
+
+func TestTLSHandshakeFailureMetric(t *testing.T) {
+	ca := newTestCA(t)
+	p := startSocketServer(t, func(c *Config) {
+		socketTLS(t, ca)(c)
+		c.Server.Metrics.Path = "/metrics"
+	})
+
+	// A peer that connects and leaves without a handshake is not a failure
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.config.Server.Socket.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	p.waitForLog(t, "Connection closed during TLS handshake")
+
+	// A client that doesn't trust the server's certificate aborts the handshake
+	if _, err := dialSocketTLS(p, newTestCA(t), &tls.Config{}); err == nil {
+		t.Fatal("handshake succeeded with a certificate from an unknown CA")
+	}
+	p.waitForLog(t, `"event":"tls_handshake_failed"`)
+
+	_, metrics := p.get(t, "/metrics")
+	if !strings.Contains(metrics, `proxy_tls_handshake_errors_total{reason="certificate"} 1`) {
+		t.Errorf("metrics do not count the one certificate failure:\n%s", metrics)
+	}
+	if strings.Count(metrics, "proxy_tls_handshake_errors_total{") != 1 {
+		t.Errorf("metrics count handshake failures for other reasons:\n%s", metrics)
+	}
+}
+
+func TestSocketTLSCipherSuites(t *testing.T) {
+	ca := newTestCA(t)
+	p := startSocketServer(t, func(c *Config) {
+		socketTLS(t, ca)(c)
+		c.Server.Socket.SSL.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	})
+
+	state, err := dialSocketTLS(p, ca, &tls.Config{MaxVersion: tls.VersionTLS12})
+	if err != nil || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("negotiated %s, err %v; want the only allowed suite", tls.CipherSuiteName(state.CipherSuite), err)
+	}
+	if _, err := dialSocketTLS(p, ca, &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}); err == nil {
+		t.Error("handshake succeeded with a cipher suite that is not allowed")
+	}
+}
+
+func TestTLSPolicyRejectsUnknownNames(t *testing.T) {
+	for _, tc := range []struct {
+		minVersion   string
+		cipherSuites []string
+	}{
+		{"1.4", nil},
+		{"1.2", []string{"TLS_NOT_A_SUITE"}},
+	} {
+		if err := applyTLSPolicy(&tls.Config{}, tc.minVersion, tc.cipherSuites); err == nil {
+			t.Errorf("minVersion %q, cipherSuites %v: no error", tc.minVersion, tc.cipherSuites)
+		}
+	}
+}
+
+// getOverTLS serves the proxy's handler over TLS with a certificate from ca for
+// proxy.example.com and requests it with header set, presenting clientCerts
+func getOverTLS(t *testing.T, p *testProxy, ca *testCA, header http.Header, clientCerts ...tls.Certificate) {
+	t.Helper()
+	front := httptest.NewUnstartedServer(p.server.Handler())
+	front.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "proxy.example.com")},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	front.StartTLS()
+	t.Cleanup(front.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "proxy.example.com",
+		Certificates: clientCerts,
+	}}}
+	req, err := http.NewRequest(http.MethodGet, front.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestForwardTLSInfo(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert := ca.issue(t, "caller")
+	sum := sha256.Sum256(clientCert.Certificate[0])
+
+	for _, forward := range []bool{true, false} {
+		t.Run(fmt.Sprintf("forwardInfo %v", forward), func(t *testing.T) {
+			received := make(chan http.Header, 1)
+			p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+			}), func(c *Config) { c.Server.HTTP.SSL.ForwardInfo = forward })
+
+			getOverTLS(t, p, ca, http.Header{"X-Ssl-Client-Fingerprint": {"forged"}}, clientCert)
+			header := <-received
+
+			if !forward {
+				if sni := header.Get("X-SSL-SNI"); sni != "" {
+					t.Errorf("X-SSL-SNI = %q with forwarding disabled, want none", sni)
+				}
+				return
+			}
+			for name, want := range map[string]string{
+				"X-SSL-SNI":                "proxy.example.com",
+				"X-SSL-Version":            "TLS 1.3",
+				"X-SSL-Client-Fingerprint": hex.EncodeToString(sum[:]),
+			} {
+				if got := header.Values(name); len(got) != 1 || got[0] != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if header.Get("X-SSL-Cipher") == "" {
+				t.Error("X-SSL-Cipher not set")
+			}
+
+			// Without a certificate the caller's own fingerprint is still removed
+			getOverTLS(t, p, ca, http.Header{"X-Ssl-Client-Fingerprint": {"forged"}})
+			if got := (<-received).Get("X-SSL-Client-Fingerprint"); got != "" {
+				t.Errorf("X-SSL-Client-Fingerprint = %q without a client certificate, want none", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by the proxy
+const tracerName = "reverse-proxy"
+
+// SetupTracing installs the W3C trace context propagator and, when tracing is
+// enabled, a tracer provider that exports spans over OTLP/HTTP. With tracing
+// disabled spans are not recorded, but trace context is still passed through.
+func SetupTracing(config *Config) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !config.Tracing.Enabled {
+		return nil
+	}
+
+	var options []otlptracehttp.Option
+	if config.Tracing.Endpoint != "" {
+		options = append(options, otlptracehttp.WithEndpointURL(config.Tracing.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.Tracing.ServiceName),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// tracer returns the proxy's tracer from the global provider
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// injectTraceContext returns the trace context of ctx in a form that can be sent in a message
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// extractTraceContext returns ctx carrying the trace context sent in a message, if any
+func extractTraceContext(ctx context.Context, message map[string]interface{}) context.Context {
+	fields, ok := message["traceContext"].(map[string]interface{})
+	if !ok {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{}
+	for key, value := range fields {
+		if str, ok := value.(string); ok {
+			carrier[key] = str
+		}
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider recording spans in memory until the test ends
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		provider.Shutdown(t.Context())
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return exporter
+}
+
+// spanNamed returns the recorded span with the given name
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span among %d recorded", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+func TestTracingSpansAcrossBothHops(t *testing.T) {
+	exporter := recordSpans(t)
+	var traceparent string
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}), nil)
+
+	p.get(t, "/traced")
+	waitFor(t, "both spans to end", func() bool { return len(exporter.GetSpans()) == 2 })
+
+	spans := exporter.GetSpans()
+	request := spanNamed(t, spans, "proxy.request")
+	upstream := spanNamed(t, spans, "proxy.upstream")
+	if request.SpanKind != trace.SpanKindServer || upstream.SpanKind != trace.SpanKindClient {
+		t.Errorf("span kinds = %v and %v, want server and client", request.SpanKind, upstream.SpanKind)
+	}
+	if upstream.Parent.SpanID() != request.SpanContext.SpanID() || upstream.SpanContext.TraceID() != request.SpanContext.TraceID() {
+		t.Errorf("upstream span %v is not a child of request span %v", upstream.Parent, request.SpanContext)
+	}
+	if request.Parent.IsValid() {
+		t.Errorf("request span has parent %v, want a new trace", request.Parent)
+	}
+
+	// The upstream continues the trace from the client's span
+	want := "00-" + upstream.SpanContext.TraceID().String() + "-" + upstream.SpanContext.SpanID().String() + "-"
+	if !strings.HasPrefix(traceparent, want) {
+		t.Errorf("upstream received traceparent %q, want it to start with %q", traceparent, want)
+	}
+}
+
+func TestTracingContinuesCallerTrace(t *testing.T) {
+	exporter := recordSpans(t)
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodGet, p.url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	p.do(t, req)
+	waitFor(t, "both spans to end", func() bool { return len(exporter.GetSpans()) == 2 })
+
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("%s span in trace %s, want the caller's %s", span.Name, span.SpanContext.TraceID(), traceID)
+		}
+	}
+	if parent := spanNamed(t, exporter.GetSpans(), "proxy.request").Parent.SpanID().String(); parent != "00f067aa0ba902b7" {
+		t.Errorf("request span parent = %s, want the caller's span", parent)
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// Transport carries the connections between a server and its clients in place of
+// the configured socket. Listen is used by the server and Dial by clients.
+type Transport interface {
+	Listen() (net.Listener, error)
+	Dial() (net.Conn, error)
+}
+
+// MemoryTransport connects clients to a server in the same process over net.Pipe,
+// without binding any ports. Connections go through the same handshake, framing
+// and message handling as socket connections.
+type MemoryTransport struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryTransport creates a MemoryTransport
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Listen returns a listener that accepts the connections made with Dial. Closing
+// it closes the transport, after which Dial fails.
+func (t *MemoryTransport) Listen() (net.Listener, error) {
+	return memoryListener{t}, nil
+}
+
+// Dial connects to the server listening on the transport, waiting for it to
+// accept the connection
+func (t *MemoryTransport) Dial() (net.Conn, error) {
+	serverEnd, clientEnd := net.Pipe()
+	select {
+	case t.conns <- memoryConn{serverEnd}:
+		return memoryConn{clientEnd}, nil
+	case <-t.closed:
+		serverEnd.Close()
+		clientEnd.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// memoryListener is the server end of a MemoryTransport
+type memoryListener struct {
+	transport *MemoryTransport
+}
+
+func (l memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.transport.conns:
+		return conn, nil
+	case <-l.transport.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l memoryListener) Close() error {
+	l.transport.closeOnce.Do(func() { close(l.transport.closed) })
+	return nil
+}
+
+func (l memoryListener) Addr() net.Addr {
+	return memoryAddr{}
+}
+
+// memoryConn is one end of a MemoryTransport connection. It reports the transport's
+// address, so connected clients are identified as memory-N until they register.
+type memoryConn struct {
+	net.Conn
+}
+
+func (c memoryConn) LocalAddr() net.Addr  { return memoryAddr{} }
+func (c memoryConn) RemoteAddr() net.Addr { return memoryAddr{} }
+
+// memoryAddr is the address of a MemoryTransport
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "memory" }
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestMemoryTransportProxiesRequests(t *testing.T) {
+	p := startTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.Write([]byte("hello from " + r.URL.Path))
+	}), nil)
+
+	resp, body := p.get(t, "/greeting")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if body != "hello from /greeting" {
+		t.Errorf("body = %q", body)
+	}
+	if resp.Header.Get("X-Backend") != "yes" {
+		t.Errorf("X-Backend = %q, want yes", resp.Header.Get("X-Backend"))
+	}
+}
+
+func TestMemoryTransportConnectsSeveralClients(t *testing.T) {
+	p := startTestProxy(t, http.NotFoundHandler(), nil)
+
+	p.connectClient(t, p.config)
+	waitFor(t, "second client to register", func() bool { return p.server.registeredClients() == 2 })
+}
+
+func TestMemoryTransportDialAfterClose(t *testing.T) {
+	transport := NewMemoryTransport()
+	listener, err := transport.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transport.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Dial after Close = %v, want net.ErrClosed", err)
+	}
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestMemoryTransportAddresses(t *testing.T) {
+	transport := NewMemoryTransport()
+	listener, _ := transport.Listen()
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	clientEnd, err := transport.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientEnd.Close()
+	serverEnd := <-accepted
+	defer serverEnd.Close()
+
+	for _, addr := range []net.Addr{listener.Addr(), clientEnd.RemoteAddr(), serverEnd.LocalAddr()} {
+		if addr.Network() != "memory" || addr.String() != "memory" {
+			t.Errorf("address = %s/%s, want memory/memory", addr.Network(), addr)
+		}
+	}
+
+	go clientEnd.Write([]byte("ping"))
+	buffer := make([]byte, 4)
+	if _, err := serverEnd.Read(buffer); err != nil || string(buffer) != "ping" {
+		t.Errorf("read %q, %v; want ping", buffer, err)
+	}
+}
@@ -0,0 +1,554 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelChunkSize is the largest amount of tunnel data carried by one message
+const tunnelChunkSize = 32 * 1024
+
+// tunnelWindowSize is how many tunnel-data messages may be sent ahead of those the
+// other end has acknowledged writing, bounding the data buffered for a tunnel
+// whose reader is slower than its writer
+const tunnelWindowSize = 16
+
+// errTunnelOverrun is returned when a peer sends further ahead of the data written
+// than the window allows
+var errTunnelOverrun = errors.New("tunnel data arrived beyond the window")
+
+// tunnelStream writes the data arriving for one end of a CONNECT tunnel, or for a
+// streamed request body, to its connection. Messages are dispatched concurrently,
+// so each one waits for its sequence number to come up; the connection may be
+// attached after data arrives.
+type tunnelStream struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    io.WriteCloser
+	nextSeq int
+	closed  bool
+
+	// window paces the data sent the other way, and is closed along with the stream
+	window *tunnelWindow
+}
+
+// newTunnelStream creates a tunnelStream writing to conn, which may be nil until attached
+func newTunnelStream(conn io.WriteCloser) *tunnelStream {
+	stream := &tunnelStream{conn: conn, window: newTunnelWindow()}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+// attach sets the connection data is written to
+func (t *tunnelStream) attach(conn io.WriteCloser) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		conn.Close()
+		return
+	}
+	t.conn = conn
+	t.cond.Broadcast()
+}
+
+// deliver writes the message with sequence number seq once every earlier one has
+// been written, reporting whether it was. A closing message closes the connection
+// instead. If the sender is windowed, data further ahead than the window allows
+// closes the stream with errTunnelOverrun rather than waiting in memory for a
+// reader that can't keep up. Peers older than protocolTunnelAcks send without a
+// window, so their data is always waited for.
+func (t *tunnelStream) deliver(seq int, data []byte, closing, windowed bool) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if windowed && !closing && !t.closed && seq >= t.nextSeq+tunnelWindowSize {
+		t.closeLocked()
+		return false, errTunnelOverrun
+	}
+	for !t.closed && (t.conn == nil || seq != t.nextSeq) {
+		t.cond.Wait()
+	}
+	if t.closed {
+		return false, nil
+	}
+
+	t.nextSeq++
+	t.cond.Broadcast()
+	if closing {
+		t.closeLocked()
+		return false, nil
+	}
+	if _, err := t.conn.Write(data); err != nil {
+		t.closeLocked()
+		return false, nil
+	}
+	return true, nil
+}
+
+// close closes the connection and discards any data still waiting to be written
+func (t *tunnelStream) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeLocked()
+}
+
+// closeLocked is close for callers that hold mu
+func (t *tunnelStream) closeLocked() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.window.close()
+	t.cond.Broadcast()
+}
+
+// tunnelWindow limits how far a tunnel's sender runs ahead of the other end, which
+// acknowledges each tunnel-data message once it has written it
+type tunnelWindow struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	sent   int
+	acked  int
+	closed bool
+}
+
+// newTunnelWindow creates an open tunnelWindow with nothing sent
+func newTunnelWindow() *tunnelWindow {
+	window := &tunnelWindow{}
+	window.cond = sync.NewCond(&window.mu)
+	return window
+}
+
+// wait blocks until another message fits in the window and counts it as sent. It
+// returns false once the window is closed.
+func (w *tunnelWindow) wait() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.closed && w.sent-w.acked >= tunnelWindowSize {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.sent++
+	return true
+}
+
+// ack records that the other end has written every message up to seq
+func (w *tunnelWindow) ack(seq int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq+1 > w.acked {
+		w.acked = min(seq+1, w.sent)
+		w.cond.Broadcast()
+	}
+}
+
+// close releases a sender waiting on the window for good
+func (w *tunnelWindow) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// deliverTunnelMessage hands a tunnel-data or tunnel-close message to its stream,
+// calling ack, if set, once the data has been written. A peer is only held to the
+// window if it speaks a version that acknowledges tunnel data, which is when ack
+// is set; it returns errTunnelOverrun if such a sender ignored the window.
+func deliverTunnelMessage(stream *tunnelStream, message map[string]interface{}, codec Codec, ack func(seq int)) error {
+	seq, _ := message["seq"].(float64)
+	if message["type"] == "tunnel-close" {
+		_, err := stream.deliver(int(seq), nil, true, ack != nil)
+		return err
+	}
+
+	data, err := codec.DecodeBody(message["body"])
+	if err != nil {
+		stream.close()
+		return nil
+	}
+	written, err := stream.deliver(int(seq), data, false, ack != nil)
+	if written && ack != nil {
+		ack(int(seq))
+	}
+	return err
+}
+
+// tunnelAck returns a tunnel-ack message acknowledging the data numbered seq
+func tunnelAck(seq int) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "tunnel-ack",
+		"seq":  seq,
+	}
+}
+
+// pumpTunnel reads from one end of a tunnel until it is closed, sending what it reads
+// as numbered tunnel-data messages followed by a tunnel-close message. With a
+// window, it stops reading while the other end is a window behind, and gives up
+// once the window is closed.
+func pumpTunnel(reader io.Reader, send func(map[string]interface{}) error, encodeBody func([]byte) interface{}, window *tunnelWindow) {
+	buffer := make([]byte, tunnelChunkSize)
+	seq := 0
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			if window != nil && !window.wait() {
+				return
+			}
+			sendErr := send(map[string]interface{}{
+				"type": "tunnel-data",
+				"seq":  seq,
+				"body": encodeBody(buffer[:n]),
+			})
+			seq++
+			if sendErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			send(map[string]interface{}{
+				"type": "tunnel-close",
+				"seq":  seq,
+			})
+			return
+		}
+	}
+}
+
+// connectAllowed reports whether a CONNECT to hostport matches one of patterns.
+// Each pattern is a host and port; the host may be "*" for any host or
+// "*.example.com" for any subdomain, and the port may be "*" for any port.
+func connectAllowed(patterns []string, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil || (patternPort != "*" && patternPort != port) {
+			continue
+		}
+		if patternHost == "*" || strings.EqualFold(patternHost, host) {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(patternHost, "*"); ok && strings.HasPrefix(suffix, ".") &&
+			len(host) > len(suffix) && strings.EqualFold(host[len(host)-len(suffix):], suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverTunnel is a CONNECT tunnel the server has asked a client to open
+type serverTunnel struct {
+	clientID string
+	stream   *tunnelStream
+
+	// result receives the client's answer to the connect message; empty means success
+	result chan string
+}
+
+// newServerTunnel creates a tunnel through clientID that has not been opened yet
+func newServerTunnel(clientID string) *serverTunnel {
+	return &serverTunnel{
+		clientID: clientID,
+		stream:   newTunnelStream(nil),
+		result:   make(chan string, 1),
+	}
+}
+
+// addTunnel stores a tunnel under a new ID and returns it. Clients track tunnels
+// and gRPC request streams by the same IDs, so an ID already used by a pending
+// request or another tunnel is never handed out; another is generated instead,
+// as for requests.
+func (s *ProxyServer) addTunnel(tunnel *serverTunnel) (string, error) {
+	s.requestsMutex.Lock()
+	s.tunnelsMutex.Lock()
+	requestID, collisions := s.unusedRequestID()
+	if collisions < maxRequestIDAttempts {
+		s.tunnels[requestID] = tunnel
+	}
+	s.tunnelsMutex.Unlock()
+	s.requestsMutex.Unlock()
+
+	if collisions > 0 {
+		s.requestIDCollision(requestID, tunnel.clientID, collisions)
+	}
+	if collisions == maxRequestIDAttempts {
+		return requestID, errDuplicateRequestID
+	}
+	return requestID, nil
+}
+
+// handleConnect serves a CONNECT request by asking the client to open a connection
+// to the requested host, then relaying bytes both ways until either side closes.
+// The tunnel has already been stored under requestID by addTunnel.
+func (s *ProxyServer) handleConnect(w http.ResponseWriter, r *http.Request, clientID string, client *ClientInfo, tunnel *serverTunnel, requestID string) {
+	defer func() {
+		s.tunnelsMutex.Lock()
+		delete(s.tunnels, requestID)
+		s.tunnelsMutex.Unlock()
+		tunnel.stream.close()
+	}()
+
+	send := func(message map[string]interface{}) error {
+		message["clientId"] = clientID
+		message["requestId"] = requestID
+		return s.sendToClient(client, message)
+	}
+	if err := send(map[string]interface{}{"type": "connect", "host": r.Host}); err != nil {
+		s.logger.Error("request", "Failed to send request to client", map[string]interface{}{
+			"error": err.Error(),
+		})
+		s.httpError(w, r, http.StatusInternalServerError, errorCodeInternal, "Internal Server Error",
+			"failed to send request to client "+clientID+": "+err.Error(), requestID)
+		return
+	}
+
+	timeout := time.Duration(s.config.live().requestTimeout) * time.Millisecond
+	select {
+	case errMessage := <-tunnel.result:
+		if errMessage != "" {
+			s.logger.Warn("request", "Client could not open tunnel", map[string]interface{}{
+				"clientId":  clientID,
+				"requestId": requestID,
+				"host":      r.Host,
+				"error":     errMessage,
+			})
+			s.httpError(w, r, http.StatusBadGateway, errorCodeTunnelFailed, "Bad Gateway", errMessage, requestID)
+			return
+		}
+	case <-time.After(timeout):
+		s.httpError(w, r, http.StatusGatewayTimeout, errorCodeTimeout, "Timeout waiting for client response",
+			"client "+clientID+" did not open the tunnel within "+timeout.String(), requestID)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// Take over the caller's connection. Anything it sent after the CONNECT request
+	// without waiting for the 200, such as a TLS ClientHello, is already buffered
+	// and is relayed from the buffer before reading more from the connection.
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.logger.Error("request", "Failed to take over connection for tunnel", map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// A tunnel lives as long as its peers want; the HTTP timeouts no longer apply
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	tunnel.stream.attach(conn)
+
+	s.logger.Info("request", "Tunnel opened", map[string]interface{}{
+		"clientId":   clientID,
+		"requestId":  requestID,
+		"host":       r.Host,
+		"earlyBytes": buffered.Reader.Buffered(),
+	})
+	pumpTunnel(buffered.Reader, send, func(body []byte) interface{} {
+		return s.encodeBody(client, body)
+	}, s.tunnelWindow(client, tunnel.stream.window))
+	s.logger.Info("request", "Tunnel closed", map[string]interface{}{
+		"clientId":  clientID,
+		"requestId": requestID,
+	})
+}
+
+// tunnelWindow returns window if the client acknowledges tunnel data, or nil for
+// clients that predate acknowledgements and would leave the sender waiting forever
+func (s *ProxyServer) tunnelWindow(client *ClientInfo, window *tunnelWindow) *tunnelWindow {
+	if client.protocol.Load() < protocolTunnelAcks {
+		return nil
+	}
+	return window
+}
+
+// handleTunnelMessage routes a client's connect-result, tunnel-data, tunnel-close or
+// tunnel-ack message to its tunnel. Messages for tunnels that already closed are
+// dropped.
+func (s *ProxyServer) handleTunnelMessage(info *ClientInfo, clientID string, message map[string]interface{}) {
+	requestID, _ := message["requestId"].(string)
+	s.tunnelsMutex.Lock()
+	tunnel, exists := s.tunnels[requestID]
+	s.tunnelsMutex.Unlock()
+	if message["type"] == "tunnel-ack" && !exists {
+		s.handleRequestBodyAck(clientID, requestID, message)
+		return
+	}
+	if !exists || tunnel.clientID != clientID {
+		return
+	}
+
+	switch message["type"] {
+	case "connect-result":
+		errMessage, _ := message["error"].(string)
+		select {
+		case tunnel.result <- errMessage:
+		default:
+		}
+		return
+	case "tunnel-ack":
+		seq, _ := message["seq"].(float64)
+		tunnel.stream.window.ack(int(seq))
+		return
+	}
+
+	var ack func(seq int)
+	if info.protocol.Load() >= protocolTunnelAcks {
+		ack = func(seq int) {
+			reply := tunnelAck(seq)
+			reply["clientId"] = clientID
+			reply["requestId"] = requestID
+			s.sendToClient(info, reply)
+		}
+	}
+	if err := deliverTunnelMessage(tunnel.stream, message, s.codec, ack); err != nil {
+		s.logger.Warn("request", "Tunnel closed", map[string]interface{}{
+			"clientId":  clientID,
+			"requestId": requestID,
+			"error":     err.Error(),
+		})
+	}
+}
+
+// closeClientTunnels closes every tunnel running through a client that disconnected
+func (s *ProxyServer) closeClientTunnels(clientID string) {
+	s.tunnelsMutex.Lock()
+	defer s.tunnelsMutex.Unlock()
+	for _, tunnel := range s.tunnels {
+		if tunnel.clientID == clientID {
+			select {
+			case tunnel.result <- "client disconnected":
+			default:
+			}
+			tunnel.stream.close()
+		}
+	}
+}
+
+// handleConnect opens the connection a CONNECT request asked for and relays bytes
+// between it and the server until either side closes
+func (c *ProxyClient) handleConnect(message map[string]interface{}) {
+	requestID, _ := message["requestId"].(string)
+	host, _ := message["host"].(string)
+	send := func(reply map[string]interface{}) error {
+		reply["clientId"] = message["clientId"]
+		reply["requestId"] = requestID
+		return c.send(reply)
+	}
+
+	// The client enforces its own allowlist, whatever the server allowed
+	if !connectAllowed(c.config.Client.Proxy.ConnectAllowedHosts, host) {
+		c.logger.Warn("proxy", "CONNECT destination not allowed", map[string]interface{}{
+			"requestId": requestID,
+			"host":      host,
+		})
+		send(map[string]interface{}{"type": "connect-result", "error": "destination " + host + " is not allowed"})
+		return
+	}
+
+	dialTimeout := time.Duration(c.config.Client.Proxy.Transport.DialTimeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		c.logger.Warn("proxy", "Failed to open tunnel", map[string]interface{}{
+			"requestId": requestID,
+			"host":      host,
+			"error":     err.Error(),
+		})
+		send(map[string]interface{}{"type": "connect-result", "error": err.Error()})
+		return
+	}
+
+	stream := newTunnelStream(conn)
+	c.tunnelsMutex.Lock()
+	c.tunnels[requestID] = stream
+	c.tunnelsMutex.Unlock()
+	defer func() {
+		c.tunnelsMutex.Lock()
+		delete(c.tunnels, requestID)
+		c.tunnelsMutex.Unlock()
+		stream.close()
+	}()
+
+	if err := send(map[string]interface{}{"type": "connect-result"}); err != nil {
+		return
+	}
+
+	c.logger.Info("proxy", "Tunnel opened", map[string]interface{}{
+		"requestId": requestID,
+		"host":      host,
+	})
+	pumpTunnel(conn, send, c.encodeBody, c.tunnelWindow(stream.window))
+	c.logger.Info("proxy", "Tunnel closed", map[string]interface{}{
+		"requestId": requestID,
+	})
+}
+
+// tunnelWindow returns window if the server acknowledges tunnel data, or nil for
+// servers that predate acknowledgements
+func (c *ProxyClient) tunnelWindow(window *tunnelWindow) *tunnelWindow {
+	if c.protocol.Load() < protocolTunnelAcks {
+		return nil
+	}
+	return window
+}
+
+// handleTunnelMessage writes tunnel data from the server to its upstream connection,
+// or widens a tunnel's window when the server acknowledges data
+func (c *ProxyClient) handleTunnelMessage(message map[string]interface{}) {
+	requestID, _ := message["requestId"].(string)
+	c.tunnelsMutex.Lock()
+	stream, exists := c.tunnels[requestID]
+	c.tunnelsMutex.Unlock()
+	if !exists {
+		return
+	}
+	if message["type"] == "tunnel-ack" {
+		seq, _ := message["seq"].(float64)
+		stream.window.ack(int(seq))
+		return
+	}
+
+	var ack func(seq int)
+	if c.protocol.Load() >= protocolTunnelAcks {
+		ack = func(seq int) {
+			reply := tunnelAck(seq)
+			reply["clientId"] = message["clientId"]
+			reply["requestId"] = requestID
+			c.send(reply)
+		}
+	}
+	if err := deliverTunnelMessage(stream, message, c.codec, ack); err != nil {
+		c.logger.Warn("proxy", "Tunnel closed", map[string]interface{}{
+			"requestId": requestID,
+			"error":     err.Error(),
+		})
+	}
+}
+
+// closeTunnels closes every open tunnel and cancels every gRPC request, for when
+// the server connection is lost
+func (c *ProxyClient) closeTunnels() {
+	c.tunnelsMutex.Lock()
+	defer c.tunnelsMutex.Unlock()
+	for _, stream := range c.tunnels {
+		stream.close()
+	}
+	for _, cancel := range c.cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		hostport string
+		want     bool
+	}{
+		{[]string{"*:443"}, "example.com:443", true},
+		{[]string{"*:443"}, "example.com:22", false},
+		{[]string{"*:443"}, "example.com", false},
+		{[]string{"example.com:*"}, "EXAMPLE.com:8443", true},
+		{[]string{"example.com:*"}, "other.com:443", false},
+		{[]string{"*.example.com:443"}, "api.example.com:443", true},
+		{[]string{"*.example.com:443"}, "example.com:443", false},
+		{[]string{"*.example.com:443"}, "badexample.com:443", false},
+		{[]string{"[::1]:443"}, "[::1]:443", true},
+		{nil, "example.com:443", false},
+	} {
+		if got := connectAllowed(tc.patterns, tc.hostport); got != tc.want {
+			t.Errorf("connectAllowed(%q, %q) = %v, want %v", tc.patterns, tc.hostport, got, tc.want)
+		}
+	}
+}
+
+func TestCheckConnectPattern(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"*:443":           true,
+		"example.com:*":   true,
+		"*.example.com:1": true,
+		"example.com":     false,
+		":443":            false,
+		"example.com:0":   false,
+		"example.com:ssh": false,
+	} {
+		if err := checkConnectPattern(pattern); (err == nil) != valid {
+			t.Errorf("checkConnectPattern(%q) = %v, want valid %v", pattern, err, valid)
+		}
+	}
+}
+
+// startEchoServer starts a TCP server that writes back everything it reads, and
+// returns its address
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// openTunnel sends a CONNECT request for destination to the server, followed at
+// once by early, and returns the connection and the response to the CONNECT
+func openTunnel(t *testing.T, p *testProxy, destination string, early string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(p.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "CONNECT " + destination + " HTTP/1.1\r\nHost: " + destination + "\r\n\r\n" + early
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+// readN reads exactly n bytes from reader
+func readN(t *testing.T, reader io.Reader, n int) string {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestConnectTunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Server.AllowConnect = true
+		c.Server.ConnectAllowedHosts = []string{"127.0.0.1:*"}
+		c.Client.Proxy.ConnectAllowedHosts = []string{"127.0.0.1:*"}
+	})
+
+	conn, reader, resp := openTunnel(t, p, echo, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	for _, message := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readN(t, reader, len(message)); got != message {
+			t.Errorf("echoed %q, want %q", got, message)
+		}
+	}
+}
+
+func TestConnectDestinationNotAllowed(t *testing.T) {
+	echo := startEchoServer(t)
+	for _, tc := range []struct {
+		name       string
+		configure  func(*Config)
+		wantStatus int
+		wantLog    string
+	}{
+		{"CONNECT disabled", func(c *Config) {}, http.StatusMethodNotAllowed, ""},
+		{"refused by the server", func(c *Config) {
+			c.Server.AllowConnect = true
+		}, http.StatusForbidden, "CONNECT destination not allowed"},
+		{"refused by the client", func(c *Config) {
+			c.Server.AllowConnect = true
+			c.Server.ConnectAllowedHosts = []string{"*:*"}
+		}, http.StatusBadGateway, "CONNECT destination not allowed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestProxy(t, http.NotFoundHandler(), tc.configure)
+			_, _, resp := openTunnel(t, p, echo, "")
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if tc.wantLog != "" {
+				p.waitForLog(t, tc.wantLog)
+			}
+		})
+	}
+}
+
+func TestConnectEarlyBytes(t *testing.T) {
+	echo := startEchoServer(t)
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Server.AllowConnect = true
+		c.Server.ConnectAllowedHosts = []string{"127.0.0.1:*"}
+		c.Client.Proxy.ConnectAllowedHosts = []string{"127.0.0.1:*"}
+	})
+
+	// The early bytes go out in the same write, and so the same segment, as the
+	// CONNECT request, before the tunnel is open
+	early := "sent before the 200"
+	conn, reader, resp := openTunnel(t, p, echo, early)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if _, err := conn.Write([]byte(" and after")); err != nil {
+		t.Fatal(err)
+	}
+	want := early + " and after"
+	if got := readN(t, reader, len(want)); got != want {
+		t.Errorf("echoed %q, want %q", got, want)
+	}
+	p.waitForLog(t, `"earlyBytes":19`)
+}
+
+func TestConnectRefusedWithoutClients(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configure  func(*Config)
+		wantStatus int
+	}{
+		{"CONNECT disabled", func(c *Config) {}, http.StatusMethodNotAllowed},
+		{"destination not allowed", func(c *Config) {
+			c.Server.AllowConnect = true
+		}, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := startTestServer(t, tc.configure)
+			_, _, resp := openTunnel(t, p, "127.0.0.1:22", "")
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTunnelWindow(t *testing.T) {
+	window := newTunnelWindow()
+	for i := 0; i < tunnelWindowSize; i++ {
+		if !window.wait() {
+			t.Fatal("wait failed on an open window")
+		}
+	}
+
+	sent := make(chan bool)
+	go func() { sent <- window.wait() }()
+	select {
+	case <-sent:
+		t.Fatal("sent more than the window allows without an ack")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	window.ack(0)
+	if ok := <-sent; !ok {
+		t.Fatal("wait failed after an ack")
+	}
+
+	go func() { sent <- window.wait() }()
+	window.close()
+	if ok := <-sent; ok {
+		t.Error("wait succeeded on a closed window")
+	}
+}
+
+func TestTunnelStreamOverrun(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := newTunnelStream(client)
+
+	written, err := stream.deliver(tunnelWindowSize, []byte("too far ahead"), false, true)
+	if written || err != errTunnelOverrun {
+		t.Fatalf("deliver = %v, %v; want false, errTunnelOverrun", written, err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after overrun = %v, want EOF from the closed connection", err)
+	}
+	if stream.window.wait() {
+		t.Error("the stream's window stayed open after it closed")
+	}
+}
+
+func TestTunnelStreamWithoutWindow(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stream := newTunnelStream(client)
+	defer stream.close()
+
+	// A peer that predates acknowledgements may run any distance ahead
+	delivered := make(chan error, 1)
+	go func() {
+		_, err := stream.deliver(tunnelWindowSize, []byte("late"), false, false)
+		delivered <- err
+	}()
+	go func() {
+		for seq := range tunnelWindowSize {
+			stream.deliver(seq, []byte("x"), false, false)
+		}
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(server, int64(tunnelWindowSize+len("late"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("x", tunnelWindowSize) + "late"; string(data) != want {
+		t.Errorf("read %q, want %q", data, want)
+	}
+	if err := <-delivered; err != nil {
+		t.Errorf("deliver = %v, want the data held until its turn", err)
+	}
+}
+
+// countingConn counts the bytes written to a connection
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestConnectSlowReader(t *testing.T) {
+	const size = 64 << 20
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var written atomic.Int64
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(countingConn{conn, &written}, io.LimitReader(zeroReader{}, size))
+	}()
+
+	p := startTestProxy(t, http.NotFoundHandler(), func(c *Config) {
+		c.Server.AllowConnect = true
+		c.Server.ConnectAllowedHosts = []string{"127.0.0.1:*"}
+		c.Client.Proxy.ConnectAllowedHosts = []string{"127.0.0.1:*"}
+	})
+	conn, reader, resp := openTunnel(t, p, listener.Addr().String(), "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// With the caller not reading, the upstream is held back once the window and
+	// the socket buffers along the way are full
+	time.Sleep(time.Second)
+	if n := written.Load(); n >= size/2 {
+		t.Fatalf("upstream wrote %d bytes to a caller that read nothing", n)
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	n, err := io.Copy(io.Discard, reader)
+	if err != nil || n != size {
+		t.Errorf("read %d bytes (%v), want %d", n, err, size)
+	}
+}
+
+// zeroReader reads endless zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationCheck is the outcome of a single check made by ValidateRuntime. Err
+// is nil if the check passed.
+type ValidationCheck struct {
+	Name string
+	Err  error
+}
+
+// ValidateRuntime checks that the configuration can actually be used in the
+// given mode, without serving traffic, and returns the outcome of each check
+// for the caller to report
+func ValidateRuntime(config *Config, mode string) []ValidationCheck {
+	var checks []ValidationCheck
+	check := func(name string, err error) {
+		checks = append(checks, ValidationCheck{Name: name, Err: err})
+	}
+
+	if format := config.Logging.Format; format != FormatJSON && format != FormatText {
+		check("log format", fmt.Errorf("unknown log format %q", format))
+	}
+	if interval := config.Logging.RotationInterval; interval != RotationNone {
+		if _, ok := rotationLayouts[interval]; !ok {
+			check("log rotation", fmt.Errorf("unknown rotation interval %q", interval))
+		} else if config.Logging.File == "" {
+			check("log rotation", fmt.Errorf("rotation needs a log file"))
+		}
+	}
+	if config.Logging.MaxAgeDays < 0 {
+		check("log max age", fmt.Errorf("max age %d must not be negative", config.Logging.MaxAgeDays))
+	}
+	if _, err := newCodec(config.Transport.Codec); err != nil {
+		check("transport codec", err)
+	}
+	if config.Transport.MaxFrameBytes < 0 {
+		check("transport max frame size", fmt.Errorf("max frame bytes %d must not be negative", config.Transport.MaxFrameBytes))
+	}
+	if config.Transport.MaxInflatedBytes < 0 {
+		check("transport max inflated size", fmt.Errorf("max inflated bytes %d must not be negative", config.Transport.MaxInflatedBytes))
+	}
+	if syslogConfig := config.Logging.Syslog; syslogConfig.Enabled {
+		check("connect to syslog", checkSyslog(syslogConfig.Network, syslogConfig.Address, syslogConfig.Facility, syslogConfig.Tag))
+	}
+
+	if mode == "server" {
+		listeners := httpListeners(config)
+		for _, l := range listeners {
+			check("bind HTTP "+l.addr, checkBind("tcp", l.addr))
+		}
+		check("HTTP listeners", checkHTTPListeners(listeners))
+		if httpsPort(listeners) != "" {
+			check("load HTTP certificate", checkKeyPair(config.Server.HTTP.SSL.Cert, config.Server.HTTP.SSL.Key))
+			check("HTTP TLS settings", checkTLSPolicy(config.Server.HTTP.SSL.MinVersion, config.Server.HTTP.SSL.CipherSuites))
+		}
+
+		socketNetwork, socketAddr := socketListenAddress(config)
+		check("bind socket "+socketAddr, checkBind(socketNetwork, socketAddr))
+		if config.Server.Socket.SSL.Enabled {
+			check("load socket certificate", checkKeyPair(config.Server.Socket.SSL.Cert, config.Server.Socket.SSL.Key))
+			check("socket TLS settings", checkTLSPolicy(config.Server.Socket.SSL.MinVersion, config.Server.Socket.SSL.CipherSuites))
+			if config.Server.Socket.SSL.RequireClientCert {
+				check("load client CA", checkCertPool(config.Server.Socket.SSL.ClientCA))
+			}
+		}
+
+		timeouts := config.Server.HTTP.Timeouts
+		for _, timeout := range []struct {
+			name  string
+			value int
+		}{
+			{"read header", timeouts.ReadHeader},
+			{"read", timeouts.Read},
+			{"write", timeouts.Write},
+			{"idle", timeouts.Idle},
+		} {
+			if timeout.value < 0 {
+				check("HTTP "+timeout.name+" timeout", fmt.Errorf("timeout %d must not be negative", timeout.value))
+			}
+		}
+
+		if err := checkStrategy(config.Server.LoadBalancing.Strategy); err != nil {
+			check("load balancing strategy", err)
+		}
+		for _, rt := range config.Server.Routes {
+			if rt.Host != "" {
+				check("route host "+rt.Host, checkRouteHost(rt.Host))
+			}
+			if err := checkRouteTimeout(rt.Timeout); err != nil {
+				check("route timeout "+rt.PathPrefix, err)
+			}
+		}
+		if err := checkRateLimit(config.Server.PerClientRateLimit); err != nil {
+			check("per-client rate limit", err)
+		}
+		for _, rule := range config.Server.ResponseHeaderRules {
+			check("response header rule "+rule.Name, checkHeaderRule(rule.Action, rule.Name))
+		}
+		for _, path := range config.Server.Allow.Paths {
+			_, err := regexp.Compile(path)
+			check("compile allowed path "+path, err)
+		}
+		check("no route status", checkErrorStatus(config.Server.Routing.NoRouteStatus))
+		check("no client status", checkErrorStatus(config.Server.Routing.NoClientStatus))
+		if status := config.Server.NoClientsResponse.Status; status != 0 {
+			check("no clients response status", checkErrorStatus(status))
+		}
+		if file := config.Server.NoClientsResponse.BodyFile; file != "" {
+			_, err := os.ReadFile(file)
+			check("read no clients response body", err)
+		}
+		if policy := config.Server.PendingOverflowPolicy; policy != pendingOverflowReject && policy != pendingOverflowEvictOldest {
+			check("pending overflow policy", fmt.Errorf("unknown policy %q", policy))
+		}
+		if format := config.Server.ErrorFormat; format != errorFormatText && format != errorFormatJSON {
+			check("error format", fmt.Errorf("unknown format %q", format))
+		}
+		if mode := config.Server.WaitForClients.Mode; mode != warmupHold && mode != warmupReject {
+			check("wait for clients mode", fmt.Errorf("unknown mode %q", mode))
+		}
+		for _, pattern := range config.Server.StreamContentTypes {
+			check("stream content type "+pattern, checkStreamContentType(pattern))
+		}
+		if config.Server.Socket.OutboundQueueSize < 1 {
+			check("outbound queue size", fmt.Errorf("size %d must be at least 1", config.Server.Socket.OutboundQueueSize))
+		}
+		if policy := config.Server.Socket.OutboundOverflowPolicy; policy != outboundOverflowBlock && policy != outboundOverflowReject {
+			check("outbound overflow policy", fmt.Errorf("unknown policy %q", policy))
+		}
+		for _, pattern := range config.Server.ConnectAllowedHosts {
+			check("CONNECT allowed host "+pattern, checkConnectPattern(pattern))
+		}
+		if config.Server.MaxURLLength < 0 {
+			check("max URL length", fmt.Errorf("length %d must not be negative", config.Server.MaxURLLength))
+		}
+		if config.Server.MaxRequestTimeout < 0 {
+			check("max request timeout", fmt.Errorf("timeout %d must not be negative", config.Server.MaxRequestTimeout))
+		}
+		if config.Server.WaitForClients.Count > 0 && config.Server.WaitForClients.Timeout <= 0 {
+			check("wait for clients timeout", fmt.Errorf("timeout %d must be positive", config.Server.WaitForClients.Timeout))
+		}
+		if policy := config.Server.ExpectContinue; policy != expectContinueSend && policy != expectContinueReject {
+			check("expect continue policy", fmt.Errorf("unknown policy %q", policy))
+		}
+
+		for _, cidr := range config.Server.ErrorDetails.TrustedCIDRs {
+			_, _, err := net.ParseCIDR(cidr)
+			check("parse trusted CIDR "+cidr, err)
+		}
+	} else {
+		if config.Client.Server.SSL.Enabled {
+			check("load server CA", checkCertPool(config.Client.Server.SSL.CA))
+			check("server TLS settings", checkTLSPolicy(config.Client.Server.SSL.MinVersion, config.Client.Server.SSL.CipherSuites))
+			if config.Client.Server.SSL.Cert != "" && config.Client.Server.SSL.Key != "" {
+				check("load client certificate", checkKeyPair(config.Client.Server.SSL.Cert, config.Client.Server.SSL.Key))
+			}
+		}
+
+		if config.Client.Proxy.SSL.CA != "" {
+			check("load upstream CA", checkCertPool(config.Client.Proxy.SSL.CA))
+		}
+		check("upstream TLS settings", checkTLSPolicy(config.Client.Proxy.SSL.MinVersion, config.Client.Proxy.SSL.CipherSuites))
+
+		serverNetwork, serverAddr := serverAddress(config)
+		check("dial server "+serverAddr, checkDial(serverNetwork, serverAddr))
+
+		_, err := url.Parse(config.Client.Proxy.DefaultTarget)
+		check("parse default target", err)
+		for _, target := range config.Client.Proxy.Targets {
+			_, err := url.Parse(target)
+			check("parse target "+target, err)
+		}
+		for host, target := range config.Client.Proxy.HostTargets {
+			_, err := url.Parse(target)
+			check("parse target for host "+host, err)
+		}
+
+		for _, rule := range config.Client.Proxy.RewriteRules {
+			check("compile rewrite rule "+rule.Pattern, checkRewriteRule(rule.Pattern, rule.Target))
+		}
+		for _, rule := range config.Client.Proxy.HeaderRules {
+			check("header rule "+rule.Name, checkHeaderRule(rule.Action, rule.Name))
+		}
+		for _, pattern := range config.Client.Proxy.ConnectAllowedHosts {
+			check("CONNECT allowed host "+pattern, checkConnectPattern(pattern))
+		}
+		if config.Client.Health.FailureThreshold > 0 && config.Client.Health.ProbeInterval <= 0 {
+			check("health probe interval", fmt.Errorf("interval %d must be positive", config.Client.Health.ProbeInterval))
+		}
+	}
+
+	return checks
+}
+
+// ValidationPassed reports whether every check passed
+func ValidationPassed(checks []ValidationCheck) bool {
+	for _, c := range checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// checkServerConfig verifies the settings Start refuses to run with, because the
+// server would come up but fail every request they apply to
+func checkServerConfig(config *Config) error {
+	if err := checkRateLimit(config.Server.PerClientRateLimit); err != nil {
+		return fmt.Errorf("%w: per-client rate limit: %w", ErrInvalidConfig, err)
+	}
+	for _, rt := range config.Server.Routes {
+		if err := checkRouteTimeout(rt.Timeout); err != nil {
+			return fmt.Errorf("%w: route timeout %s: %w", ErrInvalidConfig, rt.PathPrefix, err)
+		}
+	}
+	if err := checkStrategy(config.Server.LoadBalancing.Strategy); err != nil {
+		return fmt.Errorf("%w: load balancing strategy: %w", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// checkStrategy verifies that a load balancing strategy is one the server knows
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case strategyFirst, strategyLeastConnections, strategyWeightedRoundRobin:
+		return nil
+	}
+	return fmt.Errorf("unknown strategy %q", strategy)
+}
+
+// checkRouteTimeout verifies a route's timeout, where 0 means server.requestTimeout
+func checkRouteTimeout(timeout int) error {
+	if timeout < 0 {
+		return fmt.Errorf("timeout %d must be positive", timeout)
+	}
+	return nil
+}
+
+// checkRateLimit verifies that a per-client rate limit lets requests through. With
+// a rate set, a burst below 1 makes every wait for the limiter fail.
+func checkRateLimit(rateLimit rateLimitSettings) error {
+	if rateLimit.RequestsPerSecond > 0 && rateLimit.Burst < 1 {
+		return fmt.Errorf("burst %d must be at least 1", rateLimit.Burst)
+	}
+	return nil
+}
+
+// checkBind verifies that an address can be listened on
+func checkBind(network, addr string) error {
+	listener, err := listen(network, addr, false)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// checkErrorStatus verifies that a configured status code is a client or server error
+func checkErrorStatus(code int) error {
+	if code < 400 || code > 599 {
+		return fmt.Errorf("status %d is not an error status", code)
+	}
+	return nil
+}
+
+// checkSyslog verifies that the syslog daemon accepts connections
+func checkSyslog(network, addr, facility, tag string) error {
+	writer, err := dialSyslog(network, addr, facility, tag)
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// checkDial verifies that an address accepts connections
+func checkDial(network, addr string) error {
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkKeyPair verifies that a certificate and key can be loaded
+func checkKeyPair(certFile, keyFile string) error {
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return err
+}
+
+// checkTLSPolicy verifies that a TLS version and cipher suite list are recognized
+func checkTLSPolicy(minVersion string, cipherSuites []string) error {
+	return applyTLSPolicy(&tls.Config{}, minVersion, cipherSuites)
+}
+
+// checkCertPool verifies that a CA file contains at least one certificate
+func checkCertPool(caFile string) error {
+	caCert, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return nil
+}
+
+// checkStreamContentType verifies that a streamContentTypes pattern is a type and
+// subtype, or a type and "*"
+func checkStreamContentType(pattern string) error {
+	mediaType, subtype, ok := strings.Cut(pattern, "/")
+	if !ok || mediaType == "" || subtype == "" || strings.ContainsAny(pattern, " ;") {
+		return fmt.Errorf("%q is not a media type such as \"video/mp4\" or \"video/*\"", pattern)
+	}
+	return nil
+}
+
+// checkConnectPattern verifies that a CONNECT allowlist entry is a host and a
+// port number or "*"
+func checkConnectPattern(pattern string) error {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if port != "*" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+	}
+	return nil
+}
+
+// checkRouteHost verifies that a route's host pattern compiles
+func checkRouteHost(host string) error {
+	return (&route{}).setHost(host)
+}
+
+// checkRewriteRule verifies that a rewrite rule would be accepted by the client
+func checkRewriteRule(pattern, target string) error {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return err
+	}
+	switch target {
+	case "", rewriteTargetFull, rewriteTargetPath, rewriteTargetQuery:
+		return nil
+	}
+	return fmt.Errorf("unknown target %q", target)
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// findCheck returns the first check whose name starts with prefix
+func findCheck(checks []ValidationCheck, prefix string) (ValidationCheck, bool) {
+	for _, c := range checks {
+		if strings.HasPrefix(c.Name, prefix) {
+			return c, true
+		}
+	}
+	return ValidationCheck{}, false
+}
+
+// describeChecks lists the checks one per line for failure messages
+func describeChecks(checks []ValidationCheck) string {
+	var b strings.Builder
+	for _, c := range checks {
+		fmt.Fprintf(&b, "%s: %v\n", c.Name, c.Err)
+	}
+	return b.String()
+}
+
+// newValidateConfig returns a configuration whose server ports are free and whose
+// client points at a listening socket
+func newValidateConfig(t *testing.T) *Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	config := newTestConfig(t)
+	config.Server.HTTP.Host = "127.0.0.1"
+	config.Server.HTTP.Port = freeTestPort(t)
+	config.Server.Socket.Host = "127.0.0.1"
+	config.Server.Socket.Port = freeTestPort(t)
+	config.Client.Server.Host = "127.0.0.1"
+	config.Client.Server.Port = listener.Addr().(*net.TCPAddr).Port
+	return config
+}
+
+func TestValidateRuntime(t *testing.T) {
+	for _, mode := range []string{"server", "client"} {
+		t.Run(mode, func(t *testing.T) {
+			checks := ValidateRuntime(newValidateConfig(t), mode)
+			if len(checks) == 0 || !ValidationPassed(checks) {
+				t.Errorf("valid configuration failed:\n%s", describeChecks(checks))
+			}
+		})
+	}
+}
+
+func TestValidateRuntimeUnbindablePort(t *testing.T) {
+	config := newValidateConfig(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	config.Server.HTTP.Port = listener.Addr().(*net.TCPAddr).Port
+
+	checks := ValidateRuntime(config, "server")
+	if ValidationPassed(checks) {
+		t.Fatalf("validation passed with the HTTP port in use:\n%s", describeChecks(checks))
+	}
+	if c, ok := findCheck(checks, "bind HTTP "+listener.Addr().String()); !ok || c.Err == nil {
+		t.Errorf("the bind failure was not reported:\n%s", describeChecks(checks))
+	}
+	if c, ok := findCheck(checks, "bind socket"); !ok || c.Err != nil {
+		t.Errorf("the socket bind was not reported as passing:\n%s", describeChecks(checks))
+	}
+}
+
+func TestValidateRuntimeFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		mode      string
+		configure func(*Config)
+		wantFail  string
+	}{
+		{"server unreachable", "client", func(c *Config) { c.Client.Server.Port = freeTestPort(t) }, "dial server"},
+		{"missing certificate", "server", func(c *Config) {
+			c.Server.Socket.SSL.Enabled = true
+			c.Server.Socket.SSL.Cert = "missing.crt"
+			c.Server.Socket.SSL.Key = "missing.key"
+		}, "load socket certificate"},
+		{"invalid rewrite pattern", "client", func(c *Config) { addRewriteRule(c, "(", "", "path") }, "compile rewrite rule ("},
+		{"negative route timeout", "server", func(c *Config) {
+			addRoute(c, "", "/api", false)
+			c.Server.Routes[0].Timeout = -1
+		}, "route timeout /api"},
+		{"invalid rewrite target", "client", func(c *Config) { addRewriteRule(c, "^/", "/", "fragment") }, "compile rewrite rule ^/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newValidateConfig(t)
+			tc.configure(config)
+
+			checks := ValidateRuntime(config, tc.mode)
+			if c, ok := findCheck(checks, tc.wantFail); ValidationPassed(checks) || !ok || c.Err == nil {
+				t.Errorf("want a %q failure, got:\n%s", tc.wantFail, describeChecks(checks))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ways of handling requests while the server waits for clients after starting
+const (
+	warmupHold   = "hold"
+	warmupReject = "reject"
+)
+
+// warmup holds back proxied requests after startup until enough clients have
+// registered or the wait times out, whichever comes first
+type warmup struct {
+	done     chan struct{}
+	once     sync.Once
+	deadline time.Time
+}
+
+// newWarmup creates a warmup ending after timeout, or one that has already
+// ended if no clients are required
+func newWarmup(count int, timeout time.Duration) *warmup {
+	w := &warmup{done: make(chan struct{}), deadline: time.Now().Add(timeout)}
+	if count <= 0 {
+		w.end()
+	}
+	return w
+}
+
+// end ends the warmup, reporting whether this call ended it
+func (w *warmup) end() bool {
+	ended := false
+	w.once.Do(func() {
+		close(w.done)
+		ended = true
+	})
+	return ended
+}
+
+// ended reports whether requests are no longer held back
+func (w *warmup) ended() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchWarmup stops waiting for clients once server.waitForClients.timeout elapses
+func (s *ProxyServer) watchWarmup() {
+	timer := time.NewTimer(time.Until(s.warmup.deadline))
+	defer timer.Stop()
+
+	select {
+	case <-s.warmup.done:
+	case <-s.done:
+	case <-timer.C:
+		if s.warmup.end() {
+			s.logger.Warn("server", "Timed out waiting for clients, serving requests", map[string]interface{}{
+				"required":   s.config.Server.WaitForClients.Count,
+				"registered": s.registeredClients(),
+			})
+		}
+	}
+}
+
+// checkWarmup ends the warmup once server.waitForClients.count clients have registered
+func (s *ProxyServer) checkWarmup() {
+	if s.warmup.ended() {
+		return
+	}
+	registered := s.registeredClients()
+	if registered >= s.config.Server.WaitForClients.Count && s.warmup.end() {
+		s.logger.Info("server", "Clients registered, serving requests", map[string]interface{}{
+			"registered": registered,
+		})
+	}
+}
+
+// registeredClients counts the clients that have completed registration
+func (s *ProxyServer) registeredClients() int {
+	s.clientsMutex.RLock()
+	defer s.clientsMutex.RUnlock()
+	count := 0
+	for _, info := range s.clients {
+		if info.registered {
+			count++
+		}
+	}
+	return count
+}
+
+// awaitWarmup holds a request until the server stops waiting for clients, or
+// answers it with 503 if server.waitForClients.mode is "reject". It reports
+// whether the request may go on.
+func (s *ProxyServer) awaitWarmup(w http.ResponseWriter, r *http.Request) bool {
+	if s.warmup.ended() {
+		return true
+	}
+
+	if s.config.Server.WaitForClients.Mode == warmupReject {
+		retryAfter := math.Ceil(time.Until(s.warmup.deadline).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(retryAfter), 1)))
+		s.writeError(w, http.StatusServiceUnavailable, errorCodeWaitingForClients, "Waiting for clients to connect", "")
+		return false
+	}
+
+	select {
+	case <-s.warmup.done:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
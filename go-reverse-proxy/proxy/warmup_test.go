@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForClientsHold(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served"))
+	}))
+	t.Cleanup(upstream.Close)
+	p := startTestServer(t, func(c *Config) {
+		c.Client.Proxy.DefaultTarget = upstream.URL
+		c.Server.WaitForClients.Count = 1
+		c.Server.WaitForClients.Timeout = 5000
+	})
+
+	type result struct {
+		status int
+		body   string
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, body := p.get(t, "/held")
+		results <- result{resp.StatusCode, body}
+	}()
+
+	select {
+	case r := <-results:
+		t.Fatalf("request answered with %d before any client registered", r.status)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	p.connectClient(t, p.config)
+	select {
+	case r := <-results:
+		if r.status != http.StatusOK || r.body != "served" {
+			t.Errorf("got %d %q, want the held request forwarded to the new client", r.status, r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held request was not released when the client registered")
+	}
+	p.waitForLog(t, "Clients registered, serving requests")
+}
+
+func TestWaitForClientsTimeout(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.WaitForClients.Count = 1
+		c.Server.WaitForClients.Timeout = 200
+	})
+
+	// Once the wait runs out the request is served, and there is still no client
+	start := time.Now()
+	resp, _ := p.get(t, "/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("request answered after %v, want it held for the 200ms timeout", elapsed)
+	}
+	p.waitForLog(t, "Timed out waiting for clients, serving requests")
+}
+
+func TestWaitForClientsReject(t *testing.T) {
+	p := startTestServer(t, func(c *Config) {
+		c.Server.WaitForClients.Count = 1
+		c.Server.WaitForClients.Timeout = 5000
+		c.Server.WaitForClients.Mode = warmupReject
+	})
+
+	start := time.Now()
+	resp, _ := p.get(t, "/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", resp.StatusCode)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Retry-After = %q, want the seconds left to wait", retryAfter)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request answered after %v, want it rejected straight away", elapsed)
+	}
+}